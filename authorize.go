@@ -2,15 +2,54 @@ package main
 
 import (
 	"context"
-	"fmt"
 	"log/slog"
 	"net/http"
 	"net/url"
-	"slices"
-	"strings"
 	"time"
+
+	"github.com/golang-jwt/jwt/v5"
 )
 
+// authorizeRequest は /authorize（GET の クエリ、または同意画面からの POST フォーム）の入力パラメータ。
+type authorizeRequest struct {
+	ClientID            string
+	RedirectURI         string
+	ResponseType        string
+	Scope               string
+	State               string
+	CodeChallenge       string
+	CodeChallengeMethod string
+	Nonce               string
+
+	// Scopes は検証済みの要求スコープ（scope 省略時はクライアントの既定スコープ）。validateAuthorizeRequest が設定する
+	Scopes []string
+
+	// RequestURI は PAR（RFC 9126）で登録済みの request_uri。使った場合、パラメータは保存済みのものだけを使う
+	RequestURI string
+
+	// requestObject は検証済みのリクエストオブジェクト（RFC 9101）のクレーム。jti は認可コードの発行時に記録する
+	requestObject jwt.MapClaims
+
+	// params は受け取った生のパラメータ。同意画面の hidden フィールドにそのまま載せて POST で戻す
+	// （PAR の場合は client_id と request_uri だけで、POST でも保存済みのパラメータを読み直す）
+	params url.Values
+}
+
+// parseAuthorizeRequest は url.Values から authorizeRequest を組み立てる。
+func parseAuthorizeRequest(params url.Values) *authorizeRequest {
+	return &authorizeRequest{
+		ClientID:            params.Get("client_id"),
+		RedirectURI:         params.Get("redirect_uri"),
+		ResponseType:        params.Get("response_type"),
+		Scope:               params.Get("scope"),
+		State:               params.Get("state"),
+		CodeChallenge:       params.Get("code_challenge"),
+		CodeChallengeMethod: params.Get("code_challenge_method"),
+		Nonce:               params.Get("nonce"),
+		params:              params,
+	}
+}
+
 // OAuth2認可エンドポイント
 func authorizeHandler(w http.ResponseWriter, r *http.Request) {
 	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
@@ -18,108 +57,288 @@ func authorizeHandler(w http.ResponseWriter, r *http.Request) {
 
 	logger := slog.Default()
 
-	// デバッグ用: リクエストURLをログ出力
+	req, err := loadAuthorizeRequest(ctx, r.URL.Query())
+	if err != nil {
+		logger.Warn("request / request_uri が無効です", "client_id", r.URL.Query().Get("client_id"), "error", err.Error())
+		http.Error(w, "Invalid request or request_uri", http.StatusBadRequest)
+		return
+	}
+
+	// state・code_challenge 等はログに残さない
 	logger.Info("認可リクエストを受信しました",
-		"url", r.URL.String(),
-		"raw_query", r.URL.RawQuery)
-
-	// クエリパラメータを取得
-	clientID := r.URL.Query().Get("client_id")
-	redirectURI := r.URL.Query().Get("redirect_uri")
-	responseType := r.URL.Query().Get("response_type")
-	scope := r.URL.Query().Get("scope")
-	state := r.URL.Query().Get("state")
-	codeChallenge := r.URL.Query().Get("code_challenge")
-	codeChallengeMethod := r.URL.Query().Get("code_challenge_method")
-	nonce := r.URL.Query().Get("nonce")
-
-	logger.Info("パラメータ解析結果",
-		"client_id", clientID,
-		"redirect_uri", redirectURI,
-		"response_type", responseType,
-		"scope", scope,
-		"state", state)
-
-	// 基本的なバリデーション
-	if clientID == "" {
-		http.Error(w, "client_id is required", http.StatusBadRequest)
+		"client_id", req.ClientID,
+		"redirect_uri", req.RedirectURI,
+		"response_type", req.ResponseType,
+		"scope", req.Scope,
+		"pushed", req.RequestURI != "")
+
+	client := validateAuthorizeRequest(ctx, w, r, logger, req)
+	if client == nil {
 		return
 	}
-	if redirectURI == "" {
-		http.Error(w, "redirect_uri is required", http.StatusBadRequest)
+
+	session := requireBrowserSession(w, r)
+	if session == nil {
 		return
 	}
-	if responseType != "code" {
-		http.Error(w, "Unsupported response_type", http.StatusBadRequest)
+
+	// 既に同意済みのスコープだけが要求されていれば同意画面を省略する
+	grant, err := repository.GetUserGrant(ctx, session.UserID, client.ClientID)
+	if err != nil || !grant.Covers(req.Scopes) {
+		renderConsentPage(w, client, req, req.Scopes, consentCSRFToken(session))
 		return
 	}
 
-	// データベースからクライアント情報を取得
-	client, err := repository.GetClientByID(ctx, clientID)
+	issueAuthorizationCode(ctx, w, r, logger, client, req, session)
+}
+
+// 同意画面からの送信（POST /authorize）。
+// 元の認可リクエストは hidden フィールドで戻ってくるため、GET と同じ検証をやり直してから許可・拒否を処理する。
+// SameSite=Lax のセッションクッキーに加えて、フォームの CSRF トークン（consentCSRFToken）を照合してから同意を保存する。
+func authorizeConsentHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	logger := slog.Default()
+
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Invalid form data", http.StatusBadRequest)
+		return
+	}
+
+	action := r.PostForm.Get("consent_action")
+	params := url.Values{}
+	for k, v := range r.PostForm {
+		if k != "consent_action" && k != consentCSRFField {
+			params[k] = v
+		}
+	}
+	req, err := loadAuthorizeRequest(ctx, params)
 	if err != nil {
-		logger.Warn("無効なクライアントID", "client_id", clientID, "error", err.Error())
-		http.Error(w, "Invalid client_id", http.StatusBadRequest)
+		logger.Warn("request / request_uri が無効です", "client_id", params.Get("client_id"), "error", err.Error())
+		http.Error(w, "Invalid request or request_uri", http.StatusBadRequest)
 		return
 	}
 
-	// リダイレクトURIの検証
-	validRedirectURI := slices.Contains(client.RedirectURIs, redirectURI)
-	if !validRedirectURI {
-		logger.Warn("無効なリダイレクトURI",
-			"client_id", clientID,
-			"redirect_uri", redirectURI,
-			"allowed_uris", client.RedirectURIs)
-		http.Error(w, "Invalid redirect_uri", http.StatusBadRequest)
+	client := validateAuthorizeRequest(ctx, w, r, logger, req)
+	if client == nil {
 		return
 	}
 
-	session := requireBrowserSession(w, r)
+	session := currentSession(r)
 	if session == nil {
+		// セッション切れ: 元の認可リクエストに戻れるよう GET /authorize 経由でログインへ
+		loginURL := "/login?redirect=" + url.QueryEscape("/authorize?"+params.Encode())
+		http.Redirect(w, r, loginURL, http.StatusFound)
+		return
+	}
+
+	if !validConsentCSRFToken(session, r.PostForm.Get(consentCSRFField)) {
+		logger.Warn("同意画面の CSRF トークンが無いか一致しません",
+			"client_id", client.ClientID,
+			"user_id", session.UserID,
+			"remoteAddr", r.RemoteAddr)
+		http.Error(w, "Invalid consent form", http.StatusForbidden)
 		return
 	}
 
-	// スコープの処理
-	requestedScopes := []string{}
-	if scope != "" {
-		requestedScopes = strings.Fields(scope)
+	if action != "allow" {
+		logger.Info("ユーザーが認可を拒否しました",
+			"client_id", client.ClientID,
+			"user_id", session.UserID)
+		discardPushedAuthorizationRequest(ctx, logger, req)
+		redirectAuthorizeError(w, r, req, errAuthorize("access_denied", "the resource owner denied the request"))
+		return
+	}
+
+	if err := repository.SaveUserGrant(ctx, session.UserID, client.ClientID, req.Scopes); err != nil {
+		logger.Error("同意情報の保存に失敗しました", "error", err.Error())
+		redirectAuthorizeError(w, r, req, errAuthorize("server_error", "failed to save the consent"))
+		return
+	}
+
+	logger.Info("ユーザーが認可に同意しました",
+		"client_id", client.ClientID,
+		"user_id", session.UserID,
+		"scopes", req.Scopes)
+
+	issueAuthorizationCode(ctx, w, r, logger, client, req, session)
+}
+
+// validateAuthorizeRequest は client_id / redirect_uri / response_type / scope を検証し、問題なければクライアントを返す。
+// 検証に失敗した場合はレスポンスを書き込んで nil を返す。redirect_uri の検証後のエラーはクライアントへリダイレクトで通知する。
+func validateAuthorizeRequest(ctx context.Context, w http.ResponseWriter, r *http.Request, logger *slog.Logger, req *authorizeRequest) *OAuthClient {
+	// 基本的なバリデーション。redirect_uri を確認できるまではリダイレクトせずエラーページを返す（RFC 6749 4.1.2.1）
+	if req.ClientID == "" {
+		http.Error(w, "client_id is required", http.StatusBadRequest)
+		return nil
+	}
+	if req.RedirectURI == "" {
+		http.Error(w, "redirect_uri is required", http.StatusBadRequest)
+		return nil
+	}
+
+	// データベースからクライアント情報を取得
+	client, err := repository.GetClientByID(ctx, req.ClientID)
+	if err != nil {
+		logger.Warn("無効なクライアントID", "client_id", req.ClientID, "error", err.Error())
+		http.Error(w, "Invalid client_id", http.StatusBadRequest)
+		return nil
+	}
+
+	// リダイレクトURIの検証（ループバック IP はポートを問わない。RFC 8252）
+	if err := client.checkRedirectURI(req.RedirectURI); err != nil {
+		logger.Warn("無効なリダイレクトURI",
+			"client_id", req.ClientID,
+			"redirect_uri", req.RedirectURI,
+			"allowed_uris", client.RedirectURIs,
+			"error", err.Error())
+		http.Error(w, "Invalid redirect_uri: "+err.Error(), http.StatusBadRequest)
+		return nil
+	}
+
+	// ここから先のエラーは検証済みの redirect_uri へ state 付きで返す
+	if client.RequirePAR && req.RequestURI == "" {
+		redirectAuthorizeError(w, r, req, errAuthorize("invalid_request", "this client must use pushed authorization requests"))
+		return nil
+	}
+	if e := checkAuthorizeParameters(logger, client, req); e != nil {
+		redirectAuthorizeError(w, r, req, e)
+		return nil
+	}
+
+	return client
+}
+
+// checkAuthorizeParameters は redirect_uri 以外の認可パラメータ（response_type / PKCE / scope）を検証し、req.Scopes を設定する。
+// /authorize と /par（RFC 9126）で共通。エラーは認可エンドポイントのエラーコードで返す。
+func checkAuthorizeParameters(logger *slog.Logger, client *OAuthClient, req *authorizeRequest) *oauthError {
+	if req.ResponseType == "" {
+		return errAuthorize("invalid_request", "response_type is required")
+	}
+	if req.ResponseType != "code" {
+		return errAuthorize("unsupported_response_type", "only response_type=code is supported")
+	}
+	if !client.AllowsGrantType("authorization_code") {
+		return errAuthorize("unauthorized_client", "the client is not registered for the authorization_code grant")
+	}
+
+	// PKCE: 公開クライアントと require_pkce のクライアントは必須。送られた challenge は方式ごとの形式を検証する
+	if req.CodeChallenge == "" {
+		if req.CodeChallengeMethod != "" {
+			return errAuthorize("invalid_request", "code_challenge_method was sent without code_challenge")
+		}
+		if client.PKCERequired() {
+			return errAuthorize("invalid_request", "code_challenge is required for this client")
+		}
+	} else {
+		method, err := normalizeCodeChallenge(req.CodeChallenge, req.CodeChallengeMethod)
+		if err != nil {
+			logger.Warn("code_challenge が不正です",
+				"client_id", req.ClientID,
+				"code_challenge_method", req.CodeChallengeMethod,
+				"error", err.Error())
+			return errAuthorize("invalid_request", err.Error())
+		}
+		req.CodeChallengeMethod = method
+	}
+
+	// スコープの検証: クライアントに登録されたスコープだけを許可する
+	req.Scopes = client.RequestedScopes(req.Scope)
+	if s := findUnregisteredScope(client, req.Scopes); s != "" {
+		logger.Warn("登録されていないスコープが要求されました",
+			"client_id", req.ClientID,
+			"scope", s,
+			"allowed_scopes", client.Scopes)
+		return errAuthorize("invalid_scope", "the requested scope is not allowed for this client")
+	}
+	return nil
+}
+
+// issueAuthorizationCode は認可コードを生成・保存し、redirect_uri へ code と state を付けてリダイレクトする。
+func issueAuthorizationCode(ctx context.Context, w http.ResponseWriter, r *http.Request, logger *slog.Logger, client *OAuthClient, req *authorizeRequest, session *Session) {
+	// リクエストオブジェクトは認可コードを発行する時点で使用済みにする（同意画面の POST で検証し直すため、読み込み時には記録しない）
+	if req.requestObject != nil {
+		if err := recordRequestObjectJTI(ctx, req.ClientID, req.requestObject); err != nil {
+			logger.Warn("リクエストオブジェクトを使用済みにできません", "client_id", req.ClientID, "error", err.Error())
+			redirectAuthorizeError(w, r, req, errAuthorize("invalid_request_object", "the request object has already been used"))
+			return
+		}
+	}
+
+	// request_uri はここで削除して使用済みにする。同じ request_uri で先にコードが発行されていれば、このリクエストは無効
+	if err := consumePushedAuthorizationRequest(ctx, req); err != nil {
+		logger.Warn("request_uri を使用済みにできません", "client_id", req.ClientID, "error", err.Error())
+		redirectAuthorizeError(w, r, req, errAuthorize("invalid_request", "the request_uri is invalid or has already been used"))
+		return
 	}
 
 	// 認可コードを生成してデータベースに保存
 	authCode := generateRandomString(32)
 
 	var codeChallengePt, codeChallengeMethodPtr, noncePt, statePt *string
-	if codeChallenge != "" {
-		codeChallengePt = &codeChallenge
+	if req.CodeChallenge != "" {
+		codeChallengePt = &req.CodeChallenge
 	}
-	if codeChallengeMethod != "" {
-		codeChallengeMethodPtr = &codeChallengeMethod
+	if req.CodeChallengeMethod != "" {
+		codeChallengeMethodPtr = &req.CodeChallengeMethod
 	}
-	if nonce != "" {
-		noncePt = &nonce
+	if req.Nonce != "" {
+		noncePt = &req.Nonce
 	}
-	if state != "" {
-		statePt = &state
+	if req.State != "" {
+		statePt = &req.State
 	}
 
-	expiresAt := time.Now().Add(10 * time.Minute)
-	err = repository.CreateAuthorizationCode(ctx, authCode, clientID, session.UserID, redirectURI, requestedScopes, codeChallengePt, codeChallengeMethodPtr, noncePt, statePt, expiresAt)
+	expiresAt := time.Now().Add(client.AuthorizationCodeTTL())
+	err := repository.CreateAuthorizationCode(ctx, authCode, req.ClientID, session.UserID, req.RedirectURI, req.Scopes, codeChallengePt, codeChallengeMethodPtr, noncePt, statePt, session.CreatedAt, oidcSessionID(session.ID), expiresAt)
 	if err != nil {
 		logger.Error("認可コードの作成に失敗しました", "error", err.Error())
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		redirectAuthorizeError(w, r, req, errAuthorize("server_error", "failed to issue an authorization code"))
 		return
 	}
 
 	logger.Info("認可コードが生成されました",
-		"code", authCode,
-		"client_id", clientID,
+		"code_hash", tokenLogID(authCode),
+		"client_id", req.ClientID,
 		"user_id", session.UserID,
-		"scopes", requestedScopes)
+		"scopes", req.Scopes)
 
 	// 認可コードをクライアントにリダイレクト
-	redirectURL := fmt.Sprintf("%s?code=%s", redirectURI, authCode)
-	if state != "" {
-		redirectURL += "&state=" + url.QueryEscape(state)
+	params := url.Values{"code": {authCode}}
+	if req.State != "" {
+		params.Set("state", req.State)
 	}
 
-	http.Redirect(w, r, redirectURL, http.StatusFound)
+	http.Redirect(w, r, buildRedirectURL(req.RedirectURI, params), http.StatusFound)
+}
+
+// redirectAuthorizeError は検証済みの redirect_uri へ error / error_description / error_uri / state を付けてリダイレクトする（RFC 6749 4.1.2.1）。
+func redirectAuthorizeError(w http.ResponseWriter, r *http.Request, req *authorizeRequest, e *oauthError) {
+	params := url.Values{"error": {e.Code}}
+	if e.Description != "" {
+		params.Set("error_description", e.Description)
+	}
+	if e.URI != "" {
+		params.Set("error_uri", e.URI)
+	}
+	if req.State != "" {
+		params.Set("state", req.State)
+	}
+	http.Redirect(w, r, buildRedirectURL(req.RedirectURI, params), http.StatusFound)
+}
+
+// buildRedirectURL は redirect_uri に既存のクエリを保ったまま params を追加する。
+func buildRedirectURL(redirectURI string, params url.Values) string {
+	u, err := url.Parse(redirectURI)
+	if err != nil {
+		// 登録済み URI との一致を確認済みのため通常は起きない
+		return redirectURI + "?" + params.Encode()
+	}
+	q := u.Query()
+	for k, v := range params {
+		q[k] = v
+	}
+	u.RawQuery = q.Encode()
+	return u.String()
 }
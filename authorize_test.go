@@ -0,0 +1,113 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"testing"
+)
+
+func TestCheckAuthorizeParameters(t *testing.T) {
+	confidential := &OAuthClient{
+		ClientID:                "demo",
+		TokenEndpointAuthMethod: authMethodClientSecretBasic,
+		Scopes:                  []string{"openid", "profile", "read"},
+		DefaultScopes:           []string{"openid"},
+	}
+	public := &OAuthClient{ClientID: "spa", TokenEndpointAuthMethod: authMethodNone, Scopes: []string{"openid"}}
+	requirePKCE := &OAuthClient{ClientID: "web", TokenEndpointAuthMethod: authMethodClientSecretBasic, RequirePKCE: true, Scopes: []string{"openid"}}
+	withPKCE := func(challenge, method string) func(r *authorizeRequest) {
+		return func(r *authorizeRequest) { r.CodeChallenge, r.CodeChallengeMethod = challenge, method }
+	}
+	tests := []struct {
+		name       string
+		client     *OAuthClient
+		req        func(r *authorizeRequest)
+		wantCode   string
+		wantScopes []string
+	}{
+		{"response_type が無い", confidential, func(r *authorizeRequest) { r.ResponseType = "" }, "invalid_request", nil},
+		{"response_type=token", confidential, func(r *authorizeRequest) { r.ResponseType = "token" }, "unsupported_response_type", nil},
+		{"authorization_code を登録していない", &OAuthClient{
+			ClientID:                "svc",
+			TokenEndpointAuthMethod: authMethodClientSecretBasic,
+			GrantTypes:              []string{"client_credentials"},
+		}, nil, "unauthorized_client", nil},
+		{"公開クライアントは PKCE 必須", public, nil, "invalid_request", nil},
+		{"公開クライアントで S256", public, withPKCE(rfc7636Challenge, "S256"), "", []string{}},
+		{"require_pkce のクライアントは PKCE 必須", requirePKCE, nil, "invalid_request", nil},
+		{"機密クライアントは PKCE を省略できる", confidential, nil, "", []string{"openid"}},
+		{"機密クライアントでも送った challenge は検証する", confidential, withPKCE("short", "S256"), "invalid_request", nil},
+		{"plain は拒否", public, withPKCE(rfc7636Verifier, "plain"), "invalid_request", nil},
+		{"方式の省略は plain とみなして拒否", public, withPKCE(rfc7636Verifier, ""), "invalid_request", nil},
+		{"code_challenge なしの code_challenge_method", confidential, withPKCE("", "S256"), "invalid_request", nil},
+		{"登録済みのスコープ", confidential, func(r *authorizeRequest) { r.Scope = "openid read" }, "", []string{"openid", "read"}},
+		{"scope 省略時は既定スコープ", confidential, nil, "", []string{"openid"}},
+		{"登録されていないスコープ", confidential, func(r *authorizeRequest) { r.Scope = "openid admin" }, "invalid_scope", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &authorizeRequest{ClientID: tt.client.ClientID, RedirectURI: "https://app.example.com/callback", ResponseType: "code"}
+			if tt.req != nil {
+				tt.req(req)
+			}
+			e := checkAuthorizeParameters(slog.Default(), tt.client, req)
+			if tt.wantCode == "" {
+				if e != nil {
+					t.Fatalf("checkAuthorizeParameters() = %v", e)
+				}
+				if !slices.Equal(req.Scopes, tt.wantScopes) {
+					t.Errorf("Scopes = %v, want %v", req.Scopes, tt.wantScopes)
+				}
+				return
+			}
+			if e == nil || e.Code != tt.wantCode {
+				t.Errorf("checkAuthorizeParameters() = %v, want %s", e, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestRedirectAuthorizeError(t *testing.T) {
+	tests := []struct {
+		name        string
+		redirectURI string
+		state       string
+		err         *oauthError
+		want        url.Values
+	}{
+		{"state と error_uri を付ける", "https://app.example.com/callback", "xyz", errAuthorize("invalid_scope", "the requested scope is not allowed for this client"), url.Values{
+			"error":             {"invalid_scope"},
+			"error_description": {"the requested scope is not allowed for this client"},
+			"error_uri":         {rfc6749AuthorizeErrorURI},
+			"state":             {"xyz"},
+		}},
+		{"redirect_uri の既存のクエリを保つ", "https://app.example.com/callback?tenant=a", "", errAuthorize("access_denied", ""), url.Values{
+			"error":     {"access_denied"},
+			"error_uri": {rfc6749AuthorizeErrorURI},
+			"tenant":    {"a"},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			req := &authorizeRequest{RedirectURI: tt.redirectURI, State: tt.state}
+			redirectAuthorizeError(rec, httptest.NewRequest(http.MethodGet, "/authorize", nil), req, tt.err)
+			if rec.Code != http.StatusFound {
+				t.Fatalf("status = %d, want 302", rec.Code)
+			}
+			loc, err := url.Parse(rec.Header().Get("Location"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := loc.Scheme + "://" + loc.Host + loc.Path; got != "https://app.example.com/callback" {
+				t.Errorf("リダイレクト先 = %s", got)
+			}
+			if got := loc.Query(); got.Encode() != tt.want.Encode() {
+				t.Errorf("query = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
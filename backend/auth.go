@@ -16,34 +16,50 @@ import (
 // リソースサーバーは秘密鍵を持たず、JWKS の公開鍵だけで署名検証する。
 type accessClaims struct {
 	jwt.RegisteredClaims
-	Scope    string `json:"scope,omitempty"`
-	ClientID string `json:"client_id,omitempty"`
-	Username string `json:"username,omitempty"`
+	Scope        string        `json:"scope,omitempty"`
+	ClientID     string        `json:"client_id,omitempty"`
+	Username     string        `json:"username,omitempty"`
+	Confirmation *confirmation `json:"cnf,omitempty"`
 }
 
-// bearerToken は Authorization ヘッダから Bearer トークン文字列を取り出す。
-func bearerToken(r *http.Request) (string, bool) {
+// confirmation は送信者制約付きトークンの cnf クレーム。
+// jkt があれば DPoP の証明（dpop.go）、x5t#S256 があれば同じクライアント証明書の mTLS 接続（mtls.go）が必要。
+type confirmation struct {
+	JKT     string `json:"jkt,omitempty"`
+	X5TS256 string `json:"x5t#S256,omitempty"`
+}
+
+// accessToken は Authorization ヘッダから Bearer / DPoP のトークン文字列とスキームを取り出す。
+func accessToken(r *http.Request) (token, scheme string, ok bool) {
 	h := r.Header.Get("Authorization")
 	if h == "" {
-		return "", false
+		return "", "", false
+	}
+	s, t, found := strings.Cut(h, " ")
+	if !found {
+		return "", "", false
 	}
-	const p = "Bearer "
-	if len(h) < len(p) || !strings.EqualFold(h[:len(p)], p) {
-		return "", false
+	switch {
+	case strings.EqualFold(s, "Bearer"):
+		scheme = "Bearer"
+	case strings.EqualFold(s, "DPoP"):
+		scheme = "DPoP"
+	default:
+		return "", "", false
 	}
-	t := strings.TrimSpace(h[len(p):])
+	t = strings.TrimSpace(t)
 	if t == "" {
-		return "", false
+		return "", "", false
 	}
-	return t, true
+	return t, scheme, true
 }
 
-// expectedIssuer は jwt.WithIssuer に渡す値。認可サーバーが付与している iss と一致させる。
+// expectedIssuer は jwt.WithIssuer に渡す値。認可サーバーの issuer（Discovery の issuer、SERVER_BASE_URL）と一致させる。
 func expectedIssuer() string {
 	if v := os.Getenv("RESOURCE_EXPECTED_ISS"); v != "" {
 		return v
 	}
-	return "oauth2-server"
+	return "http://localhost:8080"
 }
 
 // allowedAudiences は jwt.WithAudience に渡す許可リスト。
@@ -62,12 +78,17 @@ func allowedAudiences() []string {
 	return out
 }
 
-// parseAndValidateAccessToken は JWT をパースし、署名（RS256）・iss・aud（任意）・exp を確認する。
+// parseAndValidateAccessToken は JWT をパースし、署名（RS256 / ES256 / ES384 / EdDSA）・iss・aud（任意）・exp を確認する。
 // 署名検証用の鍵は JWT ヘッダの kid に対応する公開鍵を cache から取得する。
 func parseAndValidateAccessToken(ctx context.Context, cache *jwksCache, tokenString string) (*accessClaims, error) {
 	issuer := expectedIssuer()
 	opts := []jwt.ParserOption{
-		jwt.WithValidMethods([]string{jwt.SigningMethodRS256.Alg()}),
+		jwt.WithValidMethods([]string{
+			jwt.SigningMethodRS256.Alg(),
+			jwt.SigningMethodES256.Alg(),
+			jwt.SigningMethodES384.Alg(),
+			jwt.SigningMethodEdDSA.Alg(),
+		}),
 		jwt.WithIssuer(issuer),
 	}
 	if aud := allowedAudiences(); len(aud) > 0 {
@@ -83,7 +104,8 @@ func parseAndValidateAccessToken(ctx context.Context, cache *jwksCache, tokenStr
 		if kid == "" {
 			return nil, fmt.Errorf("JWT ヘッダに kid がありません")
 		}
-		return cache.getKey(ctx, kid)
+		// alg は kid の鍵と一致するものだけ受け付ける（JWKS の alg で鍵ごとに固定）
+		return cache.getKey(ctx, kid, t.Method.Alg())
 	})
 	if err != nil {
 		return nil, err
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Yuki-TU/oauth2/internal/jose"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// DPoP（RFC 9449）で送信者に結びついたアクセストークンの検証。
+// トークンの cnf.jkt と、リクエストごとの証明（DPoP ヘッダの JWT）の公開鍵のサムプリントが一致することを確認する。
+const (
+	dpopProofMaxAge = time.Minute
+	dpopProofLeeway = 30 * time.Second
+)
+
+var dpopSigningAlgs = []string{"RS256", "ES256", "ES384", "EdDSA"}
+
+// dpopProofClaims は DPoP 証明のクレーム（RFC 9449 4.2）
+type dpopProofClaims struct {
+	jwt.RegisteredClaims
+	HTM string `json:"htm"`
+	HTU string `json:"htu"`
+	ATH string `json:"ath"`
+}
+
+// dpopReplayCache は使用済みの証明（jkt + jti）を期限まで覚えておく。
+// プロセス内のメモリだけに持つため、再起動で消え、複数台で動かす場合は台ごとに別になる
+// （別の台へ同じ証明を送るリプレイは防げない。iat の許容範囲の 1 分半だけが残る窓になる）。
+type dpopReplayCache struct {
+	mu   sync.Mutex
+	seen map[string]time.Time
+}
+
+var dpopReplays = &dpopReplayCache{seen: make(map[string]time.Time)}
+
+// record は初めて見た証明なら true を返す。ついでに期限切れのエントリを捨てる。
+func (c *dpopReplayCache) record(key string, expiresAt time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	for k, exp := range c.seen {
+		if exp.Before(now) {
+			delete(c.seen, k)
+		}
+	}
+	if _, ok := c.seen[key]; ok {
+		return false
+	}
+	c.seen[key] = expiresAt
+	return true
+}
+
+// checkTokenBinding はアクセストークンの使い方が cnf.jkt と合っているかを確認する。
+// cnf.jkt のあるトークンは Authorization: DPoP と一致する証明が必須で、Bearer としては受け付けない（RFC 9449 7）。
+func checkTokenBinding(r *http.Request, scheme, token string, claims *accessClaims) error {
+	bound := claims.Confirmation != nil && claims.Confirmation.JKT != ""
+	if scheme != "DPoP" {
+		if bound {
+			return fmt.Errorf("DPoP に結びついたトークンが Bearer として使われました")
+		}
+		return nil
+	}
+	if !bound {
+		return fmt.Errorf("DPoP に結びついていないトークンが DPoP スキームで使われました")
+	}
+
+	jkt, err := verifyDPoPProof(r, token)
+	if err != nil {
+		return err
+	}
+	if jkt != claims.Confirmation.JKT {
+		return fmt.Errorf("DPoP 証明の鍵がトークンの cnf.jkt と一致しません")
+	}
+	return nil
+}
+
+// verifyDPoPProof は DPoP ヘッダの証明を検証し、公開鍵の JWK サムプリント（RFC 7638）を返す。
+func verifyDPoPProof(r *http.Request, token string) (string, error) {
+	values := r.Header.Values("DPoP")
+	if len(values) != 1 {
+		return "", fmt.Errorf("DPoP ヘッダがちょうど 1 つ必要です")
+	}
+
+	var jwk jwkKey
+	claims := &dpopProofClaims{}
+	_, err := jwt.NewParser(jwt.WithValidMethods(dpopSigningAlgs)).ParseWithClaims(values[0], claims, func(t *jwt.Token) (interface{}, error) {
+		if typ, _ := t.Header["typ"].(string); typ != "dpop+jwt" {
+			return nil, fmt.Errorf("typ が dpop+jwt ではありません")
+		}
+		raw, ok := t.Header["jwk"].(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("ヘッダに jwk がありません")
+		}
+		if _, ok := raw["d"]; ok {
+			return nil, fmt.Errorf("jwk に秘密鍵が含まれています")
+		}
+		b, _ := json.Marshal(raw)
+		if err := json.Unmarshal(b, &jwk); err != nil {
+			return nil, fmt.Errorf("jwk が不正です: %w", err)
+		}
+		vk, err := verificationKeyFromJWK(jwk)
+		if err != nil {
+			return nil, err
+		}
+		if vk == nil {
+			return nil, fmt.Errorf("未対応の kty です: %s", jwk.Kty)
+		}
+		return vk.key, nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("DPoP 証明の検証エラー: %w", err)
+	}
+
+	if claims.HTM != r.Method {
+		return "", fmt.Errorf("DPoP 証明の htm が一致しません: %s", claims.HTM)
+	}
+	expectedHTU, err := requestURL(r)
+	if err != nil {
+		return "", err
+	}
+	if !htuMatches(claims.HTU, expectedHTU) {
+		return "", fmt.Errorf("DPoP 証明の htu が一致しません: %s", claims.HTU)
+	}
+	if claims.IssuedAt == nil {
+		return "", fmt.Errorf("DPoP 証明に iat がありません")
+	}
+	if age := time.Since(claims.IssuedAt.Time); age > dpopProofMaxAge || age < -dpopProofLeeway {
+		return "", fmt.Errorf("DPoP 証明の iat が許容範囲外です")
+	}
+	sum := sha256.Sum256([]byte(token))
+	if subtle.ConstantTimeCompare([]byte(claims.ATH), []byte(base64.RawURLEncoding.EncodeToString(sum[:]))) != 1 {
+		return "", fmt.Errorf("DPoP 証明の ath がアクセストークンと一致しません")
+	}
+
+	jkt, err := jwkThumbprint(jwk)
+	if err != nil {
+		return "", err
+	}
+	if claims.ID == "" || !dpopReplays.record(jkt+" "+claims.ID, claims.IssuedAt.Add(dpopProofMaxAge+dpopProofLeeway)) {
+		return "", fmt.Errorf("DPoP 証明の jti が無いか再利用されています")
+	}
+	return jkt, nil
+}
+
+// requestURL は htu と比べるリクエストの URL（RESOURCE_PUBLIC_URL + パス）。
+// Host ヘッダはクライアントが自由に決められるため、htu の比較には使わない。未設定なら DPoP トークンは受け付けない。
+func requestURL(r *http.Request) (string, error) {
+	base := resourcePublicURL()
+	if base == "" {
+		return "", fmt.Errorf("RESOURCE_PUBLIC_URL が設定されていないため DPoP 証明の htu を検証できません")
+	}
+	return base + r.URL.Path, nil
+}
+
+// resourcePublicURL は外から見えるこのサーバーのベース URL（末尾の / なし）。
+func resourcePublicURL() string {
+	return strings.TrimSuffix(os.Getenv("RESOURCE_PUBLIC_URL"), "/")
+}
+
+// htuMatches はクエリとフラグメントを除いて URL を比べる（RFC 9449 4.3）。
+func htuMatches(htu, expected string) bool {
+	u, err := url.Parse(htu)
+	if err != nil {
+		return false
+	}
+	e, err := url.Parse(expected)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Scheme, e.Scheme) && strings.EqualFold(u.Host, e.Host) && u.EscapedPath() == e.EscapedPath()
+}
+
+// jwkThumbprint は JWK の SHA-256 サムプリント（RFC 7638）を BASE64URL で返す。
+// 認可サーバーが cnf.jkt に入れる値と同じになるよう、計算は認可サーバーの internal/jose を使う。
+func jwkThumbprint(k jwkKey) (string, error) {
+	return jose.JWKThumbprint(jose.JWKMembers{Kty: k.Kty, Crv: k.Crv, X: k.X, Y: k.Y, N: k.N, E: k.E})
+}
+
+// dpopChallenge は DPoP トークンの検証に失敗したときの WWW-Authenticate（RFC 9449 7.1）。
+func dpopChallenge() string {
+	return fmt.Sprintf(`DPoP algs="%s", error="invalid_token"`, strings.Join(dpopSigningAlgs, " "))
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// testProofKey はクライアント役の DPoP 鍵。
+type testProofKey struct {
+	key *ecdsa.PrivateKey
+	jwk jwkKey
+}
+
+func newTestProofKey(t *testing.T) *testProofKey {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testProofKey{key: key, jwk: jwkKey{
+		Kty: "EC",
+		Crv: "P-256",
+		X:   base64.RawURLEncoding.EncodeToString(key.PublicKey.X.FillBytes(make([]byte, 32))),
+		Y:   base64.RawURLEncoding.EncodeToString(key.PublicKey.Y.FillBytes(make([]byte, 32))),
+	}}
+}
+
+func (k *testProofKey) thumbprint(t *testing.T) string {
+	t.Helper()
+	jkt, err := jwkThumbprint(k.jwk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return jkt
+}
+
+// proof は htm / htu 宛てで ath にアクセストークンのハッシュを入れた証明を作る。jti は毎回変える。
+func (k *testProofKey) proof(t *testing.T, htm, htu, token string) string {
+	t.Helper()
+	jti := make([]byte, 16)
+	if _, err := rand.Read(jti); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256([]byte(token))
+	claims := dpopProofClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:       base64.RawURLEncoding.EncodeToString(jti),
+			IssuedAt: jwt.NewNumericDate(time.Now()),
+		},
+		HTM: htm,
+		HTU: htu,
+		ATH: base64.RawURLEncoding.EncodeToString(sum[:]),
+	}
+	proof := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
+	proof.Header["typ"] = "dpop+jwt"
+	proof.Header["jwk"] = map[string]string{"kty": k.jwk.Kty, "crv": k.jwk.Crv, "x": k.jwk.X, "y": k.jwk.Y}
+	s, err := proof.SignedString(k.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestCheckTokenBinding(t *testing.T) {
+	t.Setenv("RESOURCE_PUBLIC_URL", "https://api.example.com/")
+	key := newTestProofKey(t)
+	other := newTestProofKey(t)
+	const token = "access-token"
+	bound := &accessClaims{Confirmation: &confirmation{JKT: key.thumbprint(t)}}
+	unbound := &accessClaims{}
+
+	tests := []struct {
+		name    string
+		scheme  string
+		claims  *accessClaims
+		host    string
+		proof   func(t *testing.T) string
+		wantErr bool
+	}{
+		{"結びついていない Bearer トークン", "Bearer", unbound, "", nil, false},
+		{"DPoP トークンと正しい証明", "DPoP", bound, "", func(t *testing.T) string {
+			return key.proof(t, http.MethodGet, "https://api.example.com/api/me", token)
+		}, false},
+		{"htu のクエリは比べない", "DPoP", bound, "", func(t *testing.T) string {
+			return key.proof(t, http.MethodGet, "https://api.example.com/api/me?x=1", token)
+		}, false},
+		{"DPoP トークンを Bearer で使う", "Bearer", bound, "", nil, true},
+		{"結びついていないトークンを DPoP で使う", "DPoP", unbound, "", func(t *testing.T) string {
+			return key.proof(t, http.MethodGet, "https://api.example.com/api/me", token)
+		}, true},
+		{"証明が無い", "DPoP", bound, "", nil, true},
+		{"別の鍵の証明", "DPoP", bound, "", func(t *testing.T) string {
+			return other.proof(t, http.MethodGet, "https://api.example.com/api/me", token)
+		}, true},
+		{"htm が違う", "DPoP", bound, "", func(t *testing.T) string {
+			return key.proof(t, http.MethodPost, "https://api.example.com/api/me", token)
+		}, true},
+		{"ath が別のトークン", "DPoP", bound, "", func(t *testing.T) string {
+			return key.proof(t, http.MethodGet, "https://api.example.com/api/me", "other-token")
+		}, true},
+		{"Host ヘッダに合わせた htu は受け付けない", "DPoP", bound, "evil.example.com", func(t *testing.T) string {
+			return key.proof(t, http.MethodGet, "http://evil.example.com/api/me", token)
+		}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/api/me", nil)
+			if tt.host != "" {
+				r.Host = tt.host
+			}
+			if tt.proof != nil {
+				r.Header.Set("DPoP", tt.proof(t))
+			}
+			err := checkTokenBinding(r, tt.scheme, token, tt.claims)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("checkTokenBinding() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCheckTokenBindingRejectsReplay(t *testing.T) {
+	t.Setenv("RESOURCE_PUBLIC_URL", "https://api.example.com")
+	key := newTestProofKey(t)
+	claims := &accessClaims{Confirmation: &confirmation{JKT: key.thumbprint(t)}}
+	proof := key.proof(t, http.MethodGet, "https://api.example.com/api/me", "access-token")
+
+	for i, wantErr := range []bool{false, true} {
+		r := httptest.NewRequest(http.MethodGet, "/api/me", nil)
+		r.Header.Set("DPoP", proof)
+		if err := checkTokenBinding(r, "DPoP", "access-token", claims); (err != nil) != wantErr {
+			t.Errorf("%d 回目: checkTokenBinding() error = %v, wantErr %v", i+1, err, wantErr)
+		}
+	}
+}
+
+func TestCheckTokenBindingRequiresPublicURL(t *testing.T) {
+	t.Setenv("RESOURCE_PUBLIC_URL", "")
+	key := newTestProofKey(t)
+	claims := &accessClaims{Confirmation: &confirmation{JKT: key.thumbprint(t)}}
+
+	// Host ヘッダから組み立てた URL と一致する証明でも、RESOURCE_PUBLIC_URL が無ければ受け付けない
+	r := httptest.NewRequest(http.MethodGet, "http://api.example.com/api/me", nil)
+	r.Header.Set("DPoP", key.proof(t, http.MethodGet, "http://api.example.com/api/me", "access-token"))
+	err := checkTokenBinding(r, "DPoP", "access-token", claims)
+	if err == nil || !strings.Contains(err.Error(), "RESOURCE_PUBLIC_URL") {
+		t.Errorf("checkTokenBinding() error = %v", err)
+	}
+}
@@ -2,4 +2,10 @@ module github.com/Yuki-TU/oauth2/backend
 
 go 1.24.1
 
-require github.com/golang-jwt/jwt/v5 v5.3.0
+require (
+	github.com/Yuki-TU/oauth2 v0.0.0-00010101000000-000000000000
+	github.com/golang-jwt/jwt/v5 v5.3.0
+)
+
+// 認可サーバーと共通の処理（internal/jose）は同じリポジトリのものを使う
+replace github.com/Yuki-TU/oauth2 => ../
@@ -2,6 +2,10 @@ package main
 
 import (
 	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
 	"crypto/rsa"
 	"encoding/base64"
 	"encoding/json"
@@ -13,25 +17,34 @@ import (
 	"time"
 )
 
-// jwkKey は RFC 7517 JWK のうち、RSA 署名検証に必要なフィールドだけを受け取る。
+// jwkKey は RFC 7517 JWK のうち、署名検証に必要なフィールドだけを受け取る。
 type jwkKey struct {
 	Kty string `json:"kty"`
 	Kid string `json:"kid"`
 	Alg string `json:"alg"`
 	Use string `json:"use"`
-	N   string `json:"n"` // RSA modulus（Base64URL）
-	E   string `json:"e"` // RSA exponent（Base64URL、通常は AQAB = 65537）
+	N   string `json:"n"`   // RSA modulus（Base64URL）
+	E   string `json:"e"`   // RSA exponent（Base64URL、通常は AQAB = 65537）
+	Crv string `json:"crv"` // EC: P-256 / P-384、OKP: Ed25519
+	X   string `json:"x"`   // EC: X 座標、OKP: 公開鍵（Base64URL）
+	Y   string `json:"y"`   // EC: Y 座標（Base64URL）
 }
 
 type jwksDoc struct {
 	Keys []jwkKey `json:"keys"`
 }
 
-// jwksCache は認可サーバー GET した JWKS を kid → *rsa.PublicKey に変換して保持する。
+// verificationKey は kid に対応する公開鍵と、その鍵で許可する alg。
+type verificationKey struct {
+	alg string
+	key crypto.PublicKey
+}
+
+// jwksCache は認可サーバー GET した JWKS を kid → 公開鍵（RSA / EC / Ed25519）に変換して保持する。
 // 毎リクエストで JWKS を取りに行かないよう TTL 経過後だけ refresh する（getKey 内で判定）。
 type jwksCache struct {
 	mu      sync.RWMutex
-	keys    map[string]*rsa.PublicKey
+	keys    map[string]verificationKey
 	fetched time.Time
 	ttl     time.Duration
 	uri     string
@@ -39,7 +52,7 @@ type jwksCache struct {
 
 func newJWKSCache(uri string, ttl time.Duration) *jwksCache {
 	return &jwksCache{
-		keys: make(map[string]*rsa.PublicKey),
+		keys: make(map[string]verificationKey),
 		ttl:  ttl,
 		uri:  uri,
 	}
@@ -63,6 +76,84 @@ func rsaPublicKeyFromJWK(nB64, eB64 string) (*rsa.PublicKey, error) {
 	return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
 }
 
+// ecPublicKeyFromJWK は JWK の crv, x, y から *ecdsa.PublicKey を復元する（曲線上の点かも確認する）。
+func ecPublicKeyFromJWK(crv, xB64, yB64 string) (*ecdsa.PublicKey, error) {
+	var curve elliptic.Curve
+	switch crv {
+	case "P-256":
+		curve = elliptic.P256()
+	case "P-384":
+		curve = elliptic.P384()
+	default:
+		return nil, fmt.Errorf("未対応の曲線です: %s", crv)
+	}
+	xb, err := base64.RawURLEncoding.DecodeString(xB64)
+	if err != nil {
+		return nil, fmt.Errorf("JWK x のデコード: %w", err)
+	}
+	yb, err := base64.RawURLEncoding.DecodeString(yB64)
+	if err != nil {
+		return nil, fmt.Errorf("JWK y のデコード: %w", err)
+	}
+	pub := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(xb), Y: new(big.Int).SetBytes(yb)}
+	if !curve.IsOnCurve(pub.X, pub.Y) {
+		return nil, fmt.Errorf("JWK の点が曲線 %s 上にありません", crv)
+	}
+	return pub, nil
+}
+
+// ed25519PublicKeyFromJWK は OKP JWK（crv=Ed25519）の x から ed25519.PublicKey を復元する（RFC 8037）。
+func ed25519PublicKeyFromJWK(crv, xB64 string) (ed25519.PublicKey, error) {
+	if crv != "Ed25519" {
+		return nil, fmt.Errorf("未対応の曲線です: %s", crv)
+	}
+	xb, err := base64.RawURLEncoding.DecodeString(xB64)
+	if err != nil {
+		return nil, fmt.Errorf("JWK x のデコード: %w", err)
+	}
+	if len(xb) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("Ed25519 公開鍵の長さが不正です")
+	}
+	return ed25519.PublicKey(xb), nil
+}
+
+// verificationKeyFromJWK は kty に応じて公開鍵を復元する。alg が無い JWK は鍵の種類の既定値（RS256 など）とみなす。
+// 対応していない kty の場合は nil を返す（スキップ）。
+func verificationKeyFromJWK(k jwkKey) (*verificationKey, error) {
+	switch k.Kty {
+	case "RSA":
+		pub, err := rsaPublicKeyFromJWK(k.N, k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &verificationKey{alg: defaultString(k.Alg, "RS256"), key: pub}, nil
+	case "EC":
+		pub, err := ecPublicKeyFromJWK(k.Crv, k.X, k.Y)
+		if err != nil {
+			return nil, err
+		}
+		alg := "ES256"
+		if k.Crv == "P-384" {
+			alg = "ES384"
+		}
+		return &verificationKey{alg: defaultString(k.Alg, alg), key: pub}, nil
+	case "OKP":
+		pub, err := ed25519PublicKeyFromJWK(k.Crv, k.X)
+		if err != nil {
+			return nil, err
+		}
+		return &verificationKey{alg: defaultString(k.Alg, "EdDSA"), key: pub}, nil
+	}
+	return nil, nil
+}
+
+func defaultString(v, def string) string {
+	if v == "" {
+		return def
+	}
+	return v
+}
+
 // refresh は JWKS を HTTP で取り直し、キャッシュを置き換える（失敗時は旧キャッシュのままにしない）。
 func (c *jwksCache) refresh(ctx context.Context) error {
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.uri, nil)
@@ -86,25 +177,22 @@ func (c *jwksCache) refresh(ctx context.Context) error {
 	if err := json.Unmarshal(body, &doc); err != nil {
 		return fmt.Errorf("JWKS JSON: %w", err)
 	}
-	next := make(map[string]*rsa.PublicKey)
+	next := make(map[string]verificationKey)
 	for _, k := range doc.Keys {
-		if k.Kty != "RSA" {
-			continue
-		}
 		// Use が空なら署名鍵として扱う。enc など別用途の鍵は除外
 		if k.Use != "" && k.Use != "sig" {
 			continue
 		}
-		pub, err := rsaPublicKeyFromJWK(k.N, k.E)
+		vk, err := verificationKeyFromJWK(k)
 		if err != nil {
 			return fmt.Errorf("kid %q: %w", k.Kid, err)
 		}
-		if k.Kid != "" {
-			next[k.Kid] = pub
+		if vk != nil && k.Kid != "" {
+			next[k.Kid] = *vk
 		}
 	}
 	if len(next) == 0 {
-		return fmt.Errorf("JWKS に利用可能な RSA 鍵がありません")
+		return fmt.Errorf("JWKS に利用可能な署名鍵がありません")
 	}
 	c.mu.Lock()
 	c.keys = next
@@ -113,10 +201,10 @@ func (c *jwksCache) refresh(ctx context.Context) error {
 	return nil
 }
 
-// getKey は JWT ヘッダの kid に対応する RSA 公開鍵を返す。
+// getKey は JWT ヘッダの kid に対応する公開鍵を返す。alg が JWKS で宣言された鍵のアルゴリズムと異なる場合はエラー。
 // キャッシュが空または TTL 切れなら refresh する。kid が見つからない場合は JWKS を 1 回だけ再取得してから再検索する
-// （認可サーバー側で鍵を差し替えた直後など）。
-func (c *jwksCache) getKey(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+// （認可サーバー側で鍵をローテーションした直後など）。
+func (c *jwksCache) getKey(ctx context.Context, kid, alg string) (crypto.PublicKey, error) {
 	c.mu.Lock()
 	stale := len(c.keys) == 0 || time.Since(c.fetched) > c.ttl
 	c.mu.Unlock()
@@ -126,19 +214,21 @@ func (c *jwksCache) getKey(ctx context.Context, kid string) (*rsa.PublicKey, err
 		}
 	}
 	c.mu.RLock()
-	pub, ok := c.keys[kid]
-	c.mu.RUnlock()
-	if ok {
-		return pub, nil
-	}
-	if err := c.refresh(ctx); err != nil {
-		return nil, err
-	}
-	c.mu.RLock()
-	pub, ok = c.keys[kid]
+	vk, ok := c.keys[kid]
 	c.mu.RUnlock()
 	if !ok {
-		return nil, fmt.Errorf("kid %q に対応する鍵がありません", kid)
+		if err := c.refresh(ctx); err != nil {
+			return nil, err
+		}
+		c.mu.RLock()
+		vk, ok = c.keys[kid]
+		c.mu.RUnlock()
+		if !ok {
+			return nil, fmt.Errorf("kid %q に対応する鍵がありません", kid)
+		}
 	}
-	return pub, nil
+	if vk.alg != alg {
+		return nil, fmt.Errorf("kid %q の鍵は %s 用です（JWT の alg は %s）", kid, vk.alg, alg)
+	}
+	return vk.key, nil
 }
@@ -6,8 +6,10 @@
 // 環境変数（省略時は括弧内が既定）:
 //   RESOURCE_JWKS_URI          … JWKS の URL（http://localhost:8080/jwks）
 //   RESOURCE_LISTEN_ADDR       … 待ち受けアドレス（:9090）
-//   RESOURCE_EXPECTED_ISS      … JWT の iss と一致させる値（oauth2-server）
+//   RESOURCE_EXPECTED_ISS      … JWT の iss と一致させる値（http://localhost:8080）
 //   RESOURCE_ALLOWED_AUDIENCES … 空なら aud 検証なし。指定時はカンマ区切りでいずれかと一致必須
+//   RESOURCE_PUBLIC_URL        … DPoP 証明の htu と比べる外部公開のベース URL（未設定なら DPoP トークンを受け付けない）
+//   RESOURCE_TLS_CERT_FILE / RESOURCE_TLS_KEY_FILE … 指定時は TLS で待ち受け、クライアント証明書を要求する（mTLS の証明書バインド用）
 package main
 
 import (
@@ -45,6 +47,9 @@ func main() {
 	if addr == "" {
 		addr = ":9090"
 	}
+	if resourcePublicURL() == "" {
+		logger.Warn("RESOURCE_PUBLIC_URL が未設定のため、DPoP に結びついたアクセストークンは受け付けません")
+	}
 
 	mux := http.NewServeMux()
 
@@ -53,15 +58,15 @@ func main() {
 		_, _ = w.Write([]byte("ok\n"))
 	})
 
-	// 保護 API の例: Bearer の JWT を JWKS で検証し、クレームをそのまま JSON で返す
+	// 保護 API の例: Bearer / DPoP の JWT を JWKS で検証し、クレームをそのまま JSON で返す
 	mux.HandleFunc("GET /api/me", func(w http.ResponseWriter, r *http.Request) {
 		ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
 		defer cancel()
 
-		raw, ok := bearerToken(r)
+		raw, scheme, ok := accessToken(r)
 		if !ok {
 			writeJSON(w, http.StatusUnauthorized, map[string]string{
-				"error": "Authorization: Bearer が必要です",
+				"error": "Authorization: Bearer または DPoP が必要です",
 			})
 			return
 		}
@@ -74,6 +79,24 @@ func main() {
 			})
 			return
 		}
+		// cnf.x5t#S256 のあるトークンは同じクライアント証明書の接続でしか使えない
+		if err := checkCertificateBinding(r, claims); err != nil {
+			logger.Debug("クライアント証明書の検証失敗", "err", err.Error())
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			writeJSON(w, http.StatusUnauthorized, map[string]string{
+				"error": "クライアント証明書がトークンと一致しません",
+			})
+			return
+		}
+		// cnf.jkt のあるトークンは DPoP 証明の鍵と一致しなければ使えない
+		if err := checkTokenBinding(r, scheme, raw, claims); err != nil {
+			logger.Debug("DPoP 検証失敗", "err", err.Error())
+			w.Header().Set("WWW-Authenticate", dpopChallenge())
+			writeJSON(w, http.StatusUnauthorized, map[string]string{
+				"error": "DPoP 証明が無効です",
+			})
+			return
+		}
 
 		resp := map[string]any{
 			"sub":       claims.Subject,
@@ -86,6 +109,9 @@ func main() {
 		if claims.ExpiresAt != nil {
 			resp["exp"] = claims.ExpiresAt.Unix()
 		}
+		if claims.Confirmation != nil {
+			resp["cnf"] = claims.Confirmation
+		}
 		writeJSON(w, http.StatusOK, resp)
 	})
 
@@ -95,12 +121,23 @@ func main() {
 		ReadHeaderTimeout: 5 * time.Second,
 	}
 
+	certFile, keyFile, useTLS := tlsFiles()
+	if useTLS {
+		srv.TLSConfig = clientCertTLSConfig()
+	}
+
 	ctxSig, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer stop()
 
 	go func() {
-		logger.Info("resource server starting", "addr", addr, "jwks", jwksURI)
-		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		logger.Info("resource server starting", "addr", addr, "jwks", jwksURI, "tls", useTLS)
+		var err error
+		if useTLS {
+			err = srv.ListenAndServeTLS(certFile, keyFile)
+		} else {
+			err = srv.ListenAndServe()
+		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
 			logger.Error("server error", "err", err)
 			os.Exit(1)
 		}
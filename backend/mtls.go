@@ -0,0 +1,44 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+// mTLS（RFC 8705）で証明書に結びついたアクセストークンの検証。
+// トークンの cnf.x5t#S256 と、この接続で提示されたクライアント証明書の SHA-256 サムプリントが一致することを確認する。
+// 証明書チェーンの検証は認可サーバーがトークン発行時に済ませているため、ここではサムプリントだけを比べる（RFC 8705 3）。
+
+// tlsFiles は RESOURCE_TLS_CERT_FILE / RESOURCE_TLS_KEY_FILE。どちらかが空なら平文の HTTP で待ち受ける。
+func tlsFiles() (certFile, keyFile string, ok bool) {
+	certFile, keyFile = os.Getenv("RESOURCE_TLS_CERT_FILE"), os.Getenv("RESOURCE_TLS_KEY_FILE")
+	return certFile, keyFile, certFile != "" && keyFile != ""
+}
+
+// clientCertTLSConfig はクライアント証明書を要求する（検証はしない）TLS 設定。
+func clientCertTLSConfig() *tls.Config {
+	return &tls.Config{
+		ClientAuth: tls.RequestClientCert,
+		MinVersion: tls.VersionTLS12,
+	}
+}
+
+// checkCertificateBinding は cnf.x5t#S256 のあるトークンが同じクライアント証明書の接続で使われているかを確認する。
+func checkCertificateBinding(r *http.Request, claims *accessClaims) error {
+	if claims.Confirmation == nil || claims.Confirmation.X5TS256 == "" {
+		return nil
+	}
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return fmt.Errorf("証明書に結びついたトークンがクライアント証明書なしで使われました")
+	}
+	sum := sha256.Sum256(r.TLS.PeerCertificates[0].Raw)
+	if subtle.ConstantTimeCompare([]byte(base64.RawURLEncoding.EncodeToString(sum[:])), []byte(claims.Confirmation.X5TS256)) != 1 {
+		return fmt.Errorf("クライアント証明書がトークンの cnf.x5t#S256 と一致しません")
+	}
+	return nil
+}
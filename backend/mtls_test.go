@@ -0,0 +1,95 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// newTestClientCert は自己署名のクライアント証明書を作る。サムプリントだけを比べるので CA は要らない。
+func newTestClientCert(t *testing.T) *tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "public_mtls_client"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func certThumbprint(cert *tls.Certificate) string {
+	sum := sha256.Sum256(cert.Certificate[0])
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func TestCheckCertificateBinding(t *testing.T) {
+	cert := newTestClientCert(t)
+	other := newTestClientCert(t)
+	bound := &accessClaims{Confirmation: &confirmation{X5TS256: certThumbprint(cert)}}
+	unbound := &accessClaims{}
+
+	tests := []struct {
+		name    string
+		cert    *tls.Certificate
+		claims  *accessClaims
+		wantErr bool
+	}{
+		{"同じ証明書", cert, bound, false},
+		{"別の証明書", other, bound, true},
+		{"証明書なし", nil, bound, true},
+		{"結びついていないトークンは証明書なしで使える", nil, unbound, false},
+		{"DPoP だけに結びついたトークン", nil, &accessClaims{Confirmation: &confirmation{JKT: "jkt"}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := make(chan error, 1)
+			srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				result <- checkCertificateBinding(r, tt.claims)
+			}))
+			srv.TLS = clientCertTLSConfig()
+			srv.StartTLS()
+			defer srv.Close()
+
+			client := srv.Client()
+			if tt.cert != nil {
+				client.Transport.(*http.Transport).TLSClientConfig.Certificates = []tls.Certificate{*tt.cert}
+			}
+			res, err := client.Get(srv.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+			if err := <-result; (err != nil) != tt.wantErr {
+				t.Errorf("checkCertificateBinding() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	t.Run("平文の HTTP", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/api/me", nil)
+		if err := checkCertificateBinding(r, bound); err == nil {
+			t.Error("TLS ではない接続で証明書に結びついたトークンを受け入れました")
+		}
+	})
+}
@@ -225,7 +225,7 @@ func callbackHandler(w http.ResponseWriter, r *http.Request) {
             
             <h4>SPAクライアント:</h4>
             <p>Client ID: <code>spa_client_example</code><br>
-            Client Secret: <code>spa_secret_abcdef67890</code></p>
+            公開クライアントのため Client Secret はありません（PKCE と DPoP が必須）</p>
         </div>
 
         <hr style="margin: 30px 0;">
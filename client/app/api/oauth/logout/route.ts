@@ -1,6 +1,44 @@
+import { cookies } from "next/headers";
 import { NextResponse } from "next/server";
+import {
+  oauthClientId,
+  oauthClientSecret,
+  oauthIssuer,
+} from "@/lib/oauth-config";
+
+/** 認可サーバーの POST /revoke（RFC 7009）でトークンを失効させる。失敗してもログアウト自体は続行する */
+async function revokeToken(token: string, hint: "access_token" | "refresh_token") {
+  const body = new URLSearchParams({
+    token,
+    token_type_hint: hint,
+    client_id: oauthClientId(),
+    client_secret: oauthClientSecret(),
+  });
+  try {
+    await fetch(`${oauthIssuer()}/revoke`, {
+      method: "POST",
+      headers: { "Content-Type": "application/x-www-form-urlencoded" },
+      body: body.toString(),
+      cache: "no-store",
+    });
+  } catch {
+    // 認可サーバー停止中などはクッキー削除だけ行う
+  }
+}
 
 export async function POST(request: Request) {
+  const jar = await cookies();
+  const refresh = jar.get("demo_refresh_token")?.value;
+  const access = jar.get("demo_access_token")?.value;
+
+  // リフレッシュトークンを失効させると、紐づくアクセストークンもサーバー側で削除される
+  if (refresh) {
+    await revokeToken(refresh, "refresh_token");
+  }
+  if (access) {
+    await revokeToken(access, "access_token");
+  }
+
   const home = new URL("/", request.url);
   const res = NextResponse.redirect(home, 303);
   res.cookies.delete("demo_access_token");
@@ -15,6 +15,19 @@ function redirectWithError(request: Request, message: string) {
   return NextResponse.redirect(base);
 }
 
+function idTokenNonce(idToken: string): string | undefined {
+  const payload = idToken.split(".")[1];
+  if (!payload) return undefined;
+  try {
+    const claims = JSON.parse(Buffer.from(payload, "base64url").toString("utf8")) as {
+      nonce?: string;
+    };
+    return claims.nonce;
+  } catch {
+    return undefined;
+  }
+}
+
 export async function GET(request: Request) {
   const url = new URL(request.url);
   const code = url.searchParams.get("code");
@@ -69,6 +82,15 @@ export async function GET(request: Request) {
 
   const tokens = (await tokenRes.json()) as OAuthTokenJSON;
 
+  // ID Token の nonce が認可リクエスト時の値と一致するか確認（リプレイ対策。署名検証はデモのため省略）
+  const expectedNonce = jar.get("oauth_nonce")?.value;
+  if (tokens.id_token && expectedNonce) {
+    const nonce = idTokenNonce(tokens.id_token);
+    if (nonce !== expectedNonce) {
+      return redirectWithError(request, "ID Token の nonce が一致しません。もう一度お試しください。");
+    }
+  }
+
   const home = new URL("/", request.url);
   const res = NextResponse.redirect(home);
 
@@ -0,0 +1,401 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// JWT によるクライアント認証（RFC 7523 2.2、OIDC Core 9）
+const (
+	clientAssertionTypeJWTBearer = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+
+	// クライアントアサーションの有効期間の上限。jti の保存期間もこれで抑える
+	clientAssertionMaxLifetime = 10 * time.Minute
+	// exp / iat の時計のずれの許容範囲
+	clientAssertionLeeway = 30 * time.Second
+
+	// jwks_uri から取得した JWKS のキャッシュ期間と、未知の kid による再取得の最小間隔
+	clientJWKSCacheTTL       = 10 * time.Minute
+	clientJWKSRefetchMinWait = time.Minute
+	// jwks_uri から取得する JWKS の大きさの上限
+	clientJWKSMaxSize = 64 * 1024
+	// キャッシュする jwks_uri の数の上限。動的登録で誰でも jwks_uri を増やせるため、メモリを使い切らないよう制限する
+	clientJWKSCacheMaxEntries = 1000
+)
+
+// クライアントアサーションの署名アルゴリズム
+var (
+	privateKeyJWTAlgs   = []string{"RS256", "ES256", "ES384", "EdDSA"}
+	clientSecretJWTAlgs = []string{"HS256", "HS384", "HS512"}
+)
+
+// authenticateClientAssertion は client_assertion（JWT）でクライアントを認証する。
+// iss / sub は client_id、aud はこのサーバー（issuer またはエンドポイントの URL）、exp は必須で、jti の再利用は拒否する。
+func authenticateClientAssertion(ctx context.Context, r *http.Request) (*OAuthClient, error) {
+	if t := r.PostFormValue("client_assertion_type"); t != clientAssertionTypeJWTBearer {
+		return nil, fmt.Errorf("未対応の client_assertion_type です: %s", t)
+	}
+	assertion := r.PostFormValue("client_assertion")
+	if assertion == "" {
+		return nil, fmt.Errorf("client_assertion がありません")
+	}
+
+	// 署名検証の前にクライアントを特定する必要があるため、まず未検証のまま sub を読む
+	unverified := &jwt.RegisteredClaims{}
+	if _, _, err := jwt.NewParser().ParseUnverified(assertion, unverified); err != nil {
+		return nil, fmt.Errorf("client_assertion のパースエラー: %v", err)
+	}
+	clientID := unverified.Subject
+	if clientID == "" {
+		return nil, fmt.Errorf("client_assertion に sub がありません")
+	}
+	if formID := r.PostFormValue("client_id"); formID != "" && formID != clientID {
+		return nil, fmt.Errorf("client_id と client_assertion の sub が一致しません")
+	}
+
+	client, err := repository.GetClientByID(ctx, clientID)
+	if err != nil {
+		return nil, err
+	}
+
+	var algs []string
+	var keyFunc jwt.Keyfunc
+	switch client.TokenEndpointAuthMethod {
+	case authMethodPrivateKeyJWT:
+		algs = privateKeyJWTAlgs
+		keyFunc = func(t *jwt.Token) (any, error) {
+			kid, _ := t.Header["kid"].(string)
+			return clientPublicKey(ctx, client, kid)
+		}
+	case authMethodClientSecretJWT:
+		algs = clientSecretJWTAlgs
+		keyFunc = func(t *jwt.Token) (any, error) {
+			previous, err := previousClientSecret(ctx, clientID)
+			if err != nil {
+				return nil, err
+			}
+			return clientSecretJWTKeys(client.ClientSecret, previous), nil
+		}
+	default:
+		return nil, fmt.Errorf("クライアント認証方式が登録内容（%s）と異なります: client_assertion", client.TokenEndpointAuthMethod)
+	}
+
+	claims, err := verifyClientAssertion(r, assertion, clientID, algs, keyFunc)
+	if err != nil {
+		return nil, err
+	}
+	if err := repository.RecordClientAssertionJTI(ctx, clientID, claims.ID, claims.ExpiresAt.Add(clientAssertionLeeway)); err != nil {
+		return nil, err
+	}
+
+	return client, nil
+}
+
+// verifyClientAssertion は client_assertion の署名（algs の方式、keyFunc の鍵）とクレームを検証する。
+// jti の再利用の確認は呼び出し側でリポジトリに記録して行う。
+func verifyClientAssertion(r *http.Request, assertion, clientID string, algs []string, keyFunc jwt.Keyfunc) (*jwt.RegisteredClaims, error) {
+	parser := jwt.NewParser(
+		jwt.WithValidMethods(algs),
+		jwt.WithIssuer(clientID),
+		jwt.WithSubject(clientID),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+		jwt.WithLeeway(clientAssertionLeeway),
+	)
+	claims := &jwt.RegisteredClaims{}
+	if _, err := parser.ParseWithClaims(assertion, claims, keyFunc); err != nil {
+		return nil, fmt.Errorf("client_assertion の検証エラー: %v", err)
+	}
+
+	if !clientAssertionAudienceOK(claims.Audience, r) {
+		return nil, fmt.Errorf("client_assertion の aud がこのサーバーではありません: %v", claims.Audience)
+	}
+	if claims.ExpiresAt.Sub(time.Now()) > clientAssertionMaxLifetime {
+		return nil, fmt.Errorf("client_assertion の有効期間が長すぎます（最大 %s）", clientAssertionMaxLifetime)
+	}
+	if claims.ID == "" {
+		return nil, fmt.Errorf("client_assertion に jti がありません")
+	}
+	return claims, nil
+}
+
+// previousClientSecret はローテーション前のクライアントシークレットを返す（猶予期間外なら空文字列）。
+var previousClientSecret = func(ctx context.Context, clientID string) (string, error) {
+	return repository.PreviousClientSecret(ctx, clientID)
+}
+
+// clientSecretJWTKeys は client_secret_jwt の検証に使う HMAC 鍵を返す。
+// ローテーションの猶予期間中は直前のシークレットも含める。空のシークレットは鍵にしない。
+func clientSecretJWTKeys(current, previous string) jwt.VerificationKeySet {
+	var keys jwt.VerificationKeySet
+	for _, secret := range []string{current, previous} {
+		if secret != "" {
+			keys.Keys = append(keys.Keys, []byte(secret))
+		}
+	}
+	return keys
+}
+
+// clientAssertionAudienceOK は aud にこのサーバーの issuer、トークンエンドポイント、
+// または実際に呼ばれたエンドポイント（/revoke, /introspect 等、mTLS の別名を含む）の URL が含まれるかを確認する。
+func clientAssertionAudienceOK(aud jwt.ClaimStrings, r *http.Request) bool {
+	baseURL := serverBaseURL()
+	accepted := []string{baseURL, baseURL + "/token", baseURL + r.URL.Path, endpointURL(r, r.URL.Path)}
+	for _, a := range aud {
+		for _, want := range accepted {
+			if strings.TrimSuffix(a, "/") == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// clientPublicKey はクライアントに登録された JWKS（インラインの jwks、または jwks_uri）から kid の公開鍵を返す。
+// kid が無い場合は署名用の鍵が 1 つだけ登録されているときに限りそれを使う。
+func clientPublicKey(ctx context.Context, client *OAuthClient, kid string) (crypto.PublicKey, error) {
+	if client.JWKS != nil && *client.JWKS != "" {
+		keys, err := parseClientJWKS([]byte(*client.JWKS))
+		if err != nil {
+			return nil, err
+		}
+		return selectClientKey(keys, kid)
+	}
+	if client.JWKSURI != nil && *client.JWKSURI != "" {
+		return clientJWKSURICache.key(ctx, *client.JWKSURI, kid)
+	}
+	return nil, fmt.Errorf("クライアントに jwks / jwks_uri が登録されていません")
+}
+
+// clientPublicKeys はクライアントに登録された JWKS の署名用の鍵をすべて返す（self_signed_tls_client_auth 用）。
+func clientPublicKeys(ctx context.Context, client *OAuthClient) (map[string]crypto.PublicKey, error) {
+	if client.JWKS != nil && *client.JWKS != "" {
+		return parseClientJWKS([]byte(*client.JWKS))
+	}
+	if client.JWKSURI != nil && *client.JWKSURI != "" {
+		return clientJWKSURICache.keys(ctx, *client.JWKSURI)
+	}
+	return nil, fmt.Errorf("クライアントに jwks / jwks_uri が登録されていません")
+}
+
+func selectClientKey(keys map[string]crypto.PublicKey, kid string) (crypto.PublicKey, error) {
+	if kid != "" {
+		if k, ok := keys[kid]; ok {
+			return k, nil
+		}
+		return nil, errClientKeyNotFound
+	}
+	if len(keys) == 1 {
+		for _, k := range keys {
+			return k, nil
+		}
+	}
+	return nil, fmt.Errorf("client_assertion に kid がなく、鍵を特定できません")
+}
+
+var errClientKeyNotFound = errors.New("client_assertion の kid に対応する鍵がクライアントの JWKS にありません")
+
+// parseClientJWKS は JWKS（{"keys":[...]}）を kid → 公開鍵に変換する。署名用以外（use=enc）の鍵は除く。
+func parseClientJWKS(data []byte) (map[string]crypto.PublicKey, error) {
+	var set JWKSResponse
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("クライアントの JWKS のパースエラー: %v", err)
+	}
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		pub, err := publicKeyFromJWK(k)
+		if err != nil {
+			return nil, fmt.Errorf("クライアントの JWK（kid %q）: %v", k.Kid, err)
+		}
+		keys[k.Kid] = pub
+	}
+	return keys, nil
+}
+
+// publicKeyFromJWK は RSA / EC（P-256, P-384）/ OKP（Ed25519）の JWK から公開鍵を復元する。
+func publicKeyFromJWK(k JWK) (crypto.PublicKey, error) {
+	decode := base64.RawURLEncoding.DecodeString
+	switch k.Kty {
+	case "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("n のデコードエラー: %v", err)
+		}
+		e, err := decode(k.E)
+		if err != nil {
+			return nil, fmt.Errorf("e のデコードエラー: %v", err)
+		}
+		eInt := new(big.Int).SetBytes(e)
+		if !eInt.IsInt64() {
+			return nil, fmt.Errorf("e が大きすぎます")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(eInt.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		default:
+			return nil, fmt.Errorf("未対応の曲線です: %s", k.Crv)
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, fmt.Errorf("x のデコードエラー: %v", err)
+		}
+		y, err := decode(k.Y)
+		if err != nil {
+			return nil, fmt.Errorf("y のデコードエラー: %v", err)
+		}
+		pub := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(pub.X, pub.Y) {
+			return nil, fmt.Errorf("点が曲線 %s 上にありません", k.Crv)
+		}
+		return pub, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("未対応の曲線です: %s", k.Crv)
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, fmt.Errorf("x のデコードエラー: %v", err)
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("Ed25519 公開鍵の長さが不正です")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("未対応の kty です: %s", k.Kty)
+}
+
+// jwksURICache は jwks_uri ごとに取得した JWKS を保持する。
+// 未知の kid が来たら再取得するが、アサーションを大量に送られても取得元へ負荷をかけないよう間隔を空ける。
+// 上限の数を超えたら期限切れのエントリを捨て、それでも足りなければ最も長く使われていないものから捨てる。
+type jwksURICache struct {
+	mu         sync.Mutex
+	entries    map[string]*jwksURIEntry
+	maxEntries int
+	client     *http.Client
+}
+
+type jwksURIEntry struct {
+	keys     map[string]crypto.PublicKey
+	fetched  time.Time
+	lastUsed time.Time
+}
+
+var clientJWKSURICache = &jwksURICache{
+	entries:    make(map[string]*jwksURIEntry),
+	maxEntries: clientJWKSCacheMaxEntries,
+	client:     newOutboundHTTPClient(),
+}
+
+func (c *jwksURICache) key(ctx context.Context, uri, kid string) (crypto.PublicKey, error) {
+	entry, err := c.entry(ctx, uri)
+	if err != nil {
+		return nil, err
+	}
+	key, err := selectClientKey(entry.keys, kid)
+	if errors.Is(err, errClientKeyNotFound) && time.Since(entry.fetched) > clientJWKSRefetchMinWait {
+		// クライアント側で鍵をローテーションした直後
+		if entry, err = c.fetch(ctx, uri); err != nil {
+			return nil, err
+		}
+		key, err = selectClientKey(entry.keys, kid)
+	}
+	return key, err
+}
+
+// keys は jwks_uri の鍵をすべて返す（キャッシュ期間内なら再取得しない）。
+func (c *jwksURICache) keys(ctx context.Context, uri string) (map[string]crypto.PublicKey, error) {
+	entry, err := c.entry(ctx, uri)
+	if err != nil {
+		return nil, err
+	}
+	return entry.keys, nil
+}
+
+func (c *jwksURICache) entry(ctx context.Context, uri string) (*jwksURIEntry, error) {
+	c.mu.Lock()
+	entry := c.entries[uri]
+	if entry != nil {
+		entry.lastUsed = time.Now()
+	}
+	c.mu.Unlock()
+
+	if entry == nil || time.Since(entry.fetched) > clientJWKSCacheTTL {
+		return c.fetch(ctx, uri)
+	}
+	return entry, nil
+}
+
+func (c *jwksURICache) fetch(ctx context.Context, uri string) (*jwksURIEntry, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, uri, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("jwks_uri の取得エラー: %v", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("jwks_uri の取得エラー: HTTP %d", res.StatusCode)
+	}
+	body, err := readOutboundBody(res, clientJWKSMaxSize)
+	if err != nil {
+		return nil, fmt.Errorf("jwks_uri の取得エラー: %v", err)
+	}
+	keys, err := parseClientJWKS(body)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	entry := &jwksURIEntry{keys: keys, fetched: now, lastUsed: now}
+	c.store(uri, entry)
+	return entry, nil
+}
+
+// store はエントリを保存する。上限に達していれば、先に期限切れのエントリと最も長く使われていないエントリを捨てる。
+func (c *jwksURICache) store(uri string, entry *jwksURIEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.entries[uri]; !ok && len(c.entries) >= c.maxEntries {
+		for u, e := range c.entries {
+			if time.Since(e.fetched) > clientJWKSCacheTTL {
+				delete(c.entries, u)
+			}
+		}
+		for len(c.entries) >= c.maxEntries {
+			var oldest string
+			for u, e := range c.entries {
+				if oldest == "" || e.lastUsed.Before(c.entries[oldest].lastUsed) {
+					oldest = u
+				}
+			}
+			delete(c.entries, oldest)
+		}
+	}
+	c.entries[uri] = entry
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// useTestPreviousClientSecret はローテーション前のクライアントシークレット（DB の previous_client_secret の代わり）を設定する。
+func useTestPreviousClientSecret(t *testing.T, secret string) {
+	t.Helper()
+	prev := previousClientSecret
+	previousClientSecret = func(context.Context, string) (string, error) { return secret, nil }
+	t.Cleanup(func() { previousClientSecret = prev })
+}
+
+// testClientJWKS は keys の公開鍵を並べたクライアントの jwks（oauth_clients.jwks の JSON）を返す。
+func testClientJWKS(t *testing.T, keys ...*signingKey) *string {
+	t.Helper()
+	jwks := JWKSResponse{Keys: []JWK{}}
+	for _, k := range keys {
+		jwk, err := publicJWK(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		jwks.Keys = append(jwks.Keys, jwk)
+	}
+	b, err := json.Marshal(jwks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := string(b)
+	return &s
+}
+
+func TestClientSecretJWTKeys(t *testing.T) {
+	sign := func(secret string) string {
+		t.Helper()
+		token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{
+			Issuer:    "jwt_client",
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute)),
+		}).SignedString([]byte(secret))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+
+	tests := []struct {
+		name     string
+		current  string
+		previous string
+		signedBy string
+		wantErr  bool
+	}{
+		{"現在のシークレット", "new-secret", "", "new-secret", false},
+		{"猶予期間中の直前のシークレット", "new-secret", "old-secret", "old-secret", false},
+		{"猶予期間中も現在のシークレットを受け付ける", "new-secret", "old-secret", "new-secret", false},
+		{"猶予期間を過ぎた直前のシークレット", "new-secret", "", "old-secret", true},
+		{"どちらでもないシークレット", "new-secret", "old-secret", "other-secret", true},
+		{"シークレットが無い", "", "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keys := clientSecretJWTKeys(tt.current, tt.previous)
+			_, err := jwt.Parse(sign(tt.signedBy), func(*jwt.Token) (any, error) { return keys, nil },
+				jwt.WithValidMethods(clientSecretJWTAlgs))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("検証結果 error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestVerifyClientAssertion(t *testing.T) {
+	t.Setenv("SERVER_BASE_URL", "https://as.example.com")
+	const clientID = "jwt_client"
+	es256 := newTestSigningKey(t, "ES256")
+	rs256 := newTestSigningKey(t, "RS256")
+	client := &OAuthClient{ClientID: clientID, TokenEndpointAuthMethod: authMethodPrivateKeyJWT, JWKS: testClientJWKS(t, es256, rs256)}
+	privateKeyFunc := func(token *jwt.Token) (any, error) {
+		kid, _ := token.Header["kid"].(string)
+		return clientPublicKey(context.Background(), client, kid)
+	}
+	secretKeyFunc := func(*jwt.Token) (any, error) { return clientSecretJWTKeys("client-secret", ""), nil }
+
+	now := time.Now()
+	valid := func() jwt.RegisteredClaims {
+		return jwt.RegisteredClaims{
+			Issuer:    clientID,
+			Subject:   clientID,
+			Audience:  jwt.ClaimStrings{"https://as.example.com/token"},
+			ExpiresAt: jwt.NewNumericDate(now.Add(time.Minute)),
+			IssuedAt:  jwt.NewNumericDate(now),
+			ID:        "jti-1",
+		}
+	}
+	signWith := func(key *signingKey) func(c jwt.RegisteredClaims) string {
+		return func(c jwt.RegisteredClaims) string {
+			s, err := signJWTWithKey(key, c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return s
+		}
+	}
+	hmac := func(secret string) func(c jwt.RegisteredClaims) string {
+		return func(c jwt.RegisteredClaims) string {
+			s, err := jwt.NewWithClaims(jwt.SigningMethodHS256, c).SignedString([]byte(secret))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return s
+		}
+	}
+	unregistered := newTestSigningKey(t, "ES256") // JWKS の鍵と同じ kid で別の鍵
+
+	tests := []struct {
+		name    string
+		sign    func(c jwt.RegisteredClaims) string
+		claims  func(c *jwt.RegisteredClaims)
+		secret  bool
+		wantErr bool
+	}{
+		{"ES256", signWith(es256), nil, false, false},
+		{"RS256", signWith(rs256), nil, false, false},
+		{"aud が issuer", signWith(es256), func(c *jwt.RegisteredClaims) { c.Audience = jwt.ClaimStrings{"https://as.example.com/"} }, false, false},
+		{"aud に他の値が混ざっていても可", signWith(es256), func(c *jwt.RegisteredClaims) {
+			c.Audience = jwt.ClaimStrings{"https://other.example.com", "https://as.example.com"}
+		}, false, false},
+		{"aud が別のサーバー", signWith(es256), func(c *jwt.RegisteredClaims) { c.Audience = jwt.ClaimStrings{"https://other.example.com/token"} }, false, true},
+		{"aud が無い", signWith(es256), func(c *jwt.RegisteredClaims) { c.Audience = nil }, false, true},
+		{"iss が client_id ではない", signWith(es256), func(c *jwt.RegisteredClaims) { c.Issuer = "other" }, false, true},
+		{"sub が client_id ではない", signWith(es256), func(c *jwt.RegisteredClaims) { c.Subject = "other" }, false, true},
+		{"exp が無い", signWith(es256), func(c *jwt.RegisteredClaims) { c.ExpiresAt = nil }, false, true},
+		{"有効期限切れ", signWith(es256), func(c *jwt.RegisteredClaims) { c.ExpiresAt = jwt.NewNumericDate(now.Add(-time.Minute)) }, false, true},
+		{"有効期間が長すぎる", signWith(es256), func(c *jwt.RegisteredClaims) {
+			c.ExpiresAt = jwt.NewNumericDate(now.Add(clientAssertionMaxLifetime + time.Minute))
+		}, false, true},
+		{"iat が未来", signWith(es256), func(c *jwt.RegisteredClaims) { c.IssuedAt = jwt.NewNumericDate(now.Add(5 * time.Minute)) }, false, true},
+		{"jti が無い", signWith(es256), func(c *jwt.RegisteredClaims) { c.ID = "" }, false, true},
+		{"JWKS に無い鍵で署名", signWith(unregistered), nil, false, true},
+		{"private_key_jwt で HS256", hmac("client-secret"), nil, false, true},
+		{"client_secret_jwt", hmac("client-secret"), nil, true, false},
+		{"client_secret_jwt で別のシークレット", hmac("other-secret"), nil, true, true},
+		{"client_secret_jwt で公開鍵の署名", signWith(es256), nil, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := valid()
+			if tt.claims != nil {
+				tt.claims(&c)
+			}
+			algs, keyFunc := privateKeyJWTAlgs, jwt.Keyfunc(privateKeyFunc)
+			if tt.secret {
+				algs, keyFunc = clientSecretJWTAlgs, secretKeyFunc
+			}
+			r := newFormRequest("/token", nil)
+			_, err := verifyClientAssertion(r, tt.sign(c), clientID, algs, keyFunc)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("verifyClientAssertion() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestAuthenticateClientAssertionRejectsBeforeLookup(t *testing.T) {
+	// クライアントを引く前に判定できる不正なアサーション
+	noSub, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{Issuer: "jwt_client"}).SignedString([]byte("k"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	withSub, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{Subject: "jwt_client"}).SignedString([]byte("k"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		form url.Values
+	}{
+		{"client_assertion_type が違う", url.Values{"client_assertion_type": {"urn:example"}, "client_assertion": {withSub}}},
+		{"client_assertion が無い", url.Values{"client_assertion_type": {clientAssertionTypeJWTBearer}}},
+		{"JWT ではない", url.Values{"client_assertion_type": {clientAssertionTypeJWTBearer}, "client_assertion": {"not-a-jwt"}}},
+		{"sub が無い", url.Values{"client_assertion_type": {clientAssertionTypeJWTBearer}, "client_assertion": {noSub}}},
+		{"client_id と sub が違う", url.Values{
+			"client_assertion_type": {clientAssertionTypeJWTBearer},
+			"client_assertion":      {withSub},
+			"client_id":             {"other"},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newFormRequest("/token", tt.form)
+			if _, err := authenticateClientAssertion(r.Context(), r); err == nil {
+				t.Error("不正なアサーションを受け入れました")
+			}
+		})
+	}
+}
+
+func TestClientAssertionAudienceOK(t *testing.T) {
+	t.Setenv("SERVER_BASE_URL", "https://as.example.com")
+	tests := []struct {
+		aud  []string
+		path string
+		want bool
+	}{
+		{[]string{"https://as.example.com"}, "/token", true},
+		{[]string{"https://as.example.com/"}, "/token", true},
+		{[]string{"https://as.example.com/token"}, "/revoke", true},
+		{[]string{"https://as.example.com/revoke"}, "/revoke", true},
+		{[]string{"https://as.example.com/revoke"}, "/introspect", false},
+		{[]string{"https://as.example.com/token/extra"}, "/token", false},
+		{[]string{"https://evil.example.com"}, "/token", false},
+		{nil, "/token", false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodPost, tt.path, nil)
+		if got := clientAssertionAudienceOK(tt.aud, r); got != tt.want {
+			t.Errorf("clientAssertionAudienceOK(%v, %s) = %v, want %v", tt.aud, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestParseClientJWKS(t *testing.T) {
+	sig := newTestSigningKey(t, "ES256")
+	jwk, err := publicJWK(sig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc := jwk
+	enc.Kid, enc.Use = "enc-key", "enc"
+	bad := jwk
+	bad.Kid, bad.X = "bad", "!!!"
+	marshal := func(keys ...JWK) []byte {
+		b, err := json.Marshal(JWKSResponse{Keys: keys})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+
+	keys, err := parseClientJWKS(marshal(jwk, enc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := keys[sig.ID]; !ok || len(keys) != 1 {
+		t.Errorf("keys = %v, want 署名用の %s だけ", keys, sig.ID)
+	}
+	for name, data := range map[string][]byte{"JSON ではない": []byte("{"), "不正な鍵": marshal(jwk, bad)} {
+		if _, err := parseClientJWKS(data); err == nil {
+			t.Errorf("%s: parseClientJWKS() がエラーになりません", name)
+		}
+	}
+}
+
+func TestPublicKeyFromJWKRejects(t *testing.T) {
+	b64 := base64.RawURLEncoding.EncodeToString
+	ec, err := publicJWK(newTestSigningKey(t, "ES256"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	offCurve := ec
+	offCurve.Y = b64(make([]byte, 32))
+	p521 := ec
+	p521.Crv = "P-521"
+
+	tests := []struct {
+		name string
+		jwk  JWK
+	}{
+		{"曲線上に無い点", offCurve},
+		{"未対応の曲線", p521},
+		{"x が Base64URL ではない", JWK{Kty: "EC", Crv: "P-256", X: "!!!", Y: ec.Y}},
+		{"Ed25519 の長さが違う", JWK{Kty: "OKP", Crv: "Ed25519", X: b64(make([]byte, 31))}},
+		{"X25519", JWK{Kty: "OKP", Crv: "X25519", X: b64(make([]byte, 32))}},
+		{"RSA の e が大きすぎる", JWK{Kty: "RSA", N: b64([]byte{1}), E: b64([]byte{1, 0, 0, 0, 0, 0, 0, 0, 0})}},
+		{"共通鍵", JWK{Kty: "oct"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := publicKeyFromJWK(tt.jwk); err == nil {
+				t.Error("publicKeyFromJWK() がエラーになりません")
+			}
+		})
+	}
+}
+
+func TestSelectClientKey(t *testing.T) {
+	one := map[string]crypto.PublicKey{"a": "key-a"}
+	two := map[string]crypto.PublicKey{"a": "key-a", "b": "key-b"}
+	tests := []struct {
+		name    string
+		keys    map[string]crypto.PublicKey
+		kid     string
+		want    crypto.PublicKey
+		wantErr bool
+	}{
+		{"kid で選ぶ", two, "b", "key-b", false},
+		{"kid が無く鍵が 1 つ", one, "", "key-a", false},
+		{"kid が無く鍵が複数", two, "", nil, true},
+		{"未知の kid", two, "c", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := selectClientKey(tt.keys, tt.kid)
+			if (err != nil) != tt.wantErr || got != tt.want {
+				t.Errorf("selectClientKey() = (%v, %v), want %v", got, err, tt.want)
+			}
+		})
+	}
+	if _, err := selectClientKey(two, "c"); !errors.Is(err, errClientKeyNotFound) {
+		t.Errorf("未知の kid のエラー = %v, want errClientKeyNotFound", err)
+	}
+}
+
+func TestJWKSURICacheStoreEvicts(t *testing.T) {
+	now := time.Now()
+	c := &jwksURICache{entries: make(map[string]*jwksURIEntry), maxEntries: 2}
+
+	// 上限に達したら最も長く使われていないものから捨てる
+	c.store("https://a.example.com/jwks", &jwksURIEntry{fetched: now, lastUsed: now.Add(-time.Minute)})
+	c.store("https://b.example.com/jwks", &jwksURIEntry{fetched: now, lastUsed: now})
+	c.store("https://c.example.com/jwks", &jwksURIEntry{fetched: now, lastUsed: now})
+	if _, ok := c.entries["https://a.example.com/jwks"]; ok || len(c.entries) != 2 {
+		t.Errorf("LRU で捨てられていません: %v", c.entries)
+	}
+
+	// 期限切れのエントリは使われた時刻に関係なく先に捨てる
+	c.entries["https://b.example.com/jwks"].fetched = now.Add(-2 * clientJWKSCacheTTL)
+	c.entries["https://c.example.com/jwks"].lastUsed = now.Add(-time.Hour)
+	c.store("https://d.example.com/jwks", &jwksURIEntry{fetched: now, lastUsed: now})
+	if _, ok := c.entries["https://b.example.com/jwks"]; ok {
+		t.Error("期限切れのエントリが捨てられていません")
+	}
+	if _, ok := c.entries["https://c.example.com/jwks"]; !ok || len(c.entries) != 2 {
+		t.Errorf("期限内のエントリまで捨てられています: %v", c.entries)
+	}
+
+	// 既にある URI の更新では捨てない
+	c.store("https://c.example.com/jwks", &jwksURIEntry{fetched: now, lastUsed: now})
+	if len(c.entries) != 2 {
+		t.Errorf("len(entries) = %d, want 2", len(c.entries))
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// トークンエンドポイントでのクライアント認証方式（oauth_clients.token_endpoint_auth_method、RFC 7591 2）
+const (
+	authMethodClientSecretBasic = "client_secret_basic" // Authorization: Basic（RFC 6749 2.3.1 推奨）
+	authMethodClientSecretPost  = "client_secret_post"  // フォームボディの client_id + client_secret
+	authMethodNone              = "none"                // 公開クライアント（SPA・ネイティブアプリ）。PKCE 必須
+	authMethodPrivateKeyJWT     = "private_key_jwt"     // 登録した JWKS の鍵で署名した client_assertion（RFC 7523）
+	authMethodClientSecretJWT   = "client_secret_jwt"   // client_secret を HMAC 鍵にした client_assertion
+
+	authMethodTLSClientAuth           = "tls_client_auth"             // CA が発行したクライアント証明書（RFC 8705 2.1）
+	authMethodSelfSignedTLSClientAuth = "self_signed_tls_client_auth" // JWKS に登録した鍵の自己署名証明書（RFC 8705 2.2）
+)
+
+// supportedTokenEndpointAuthMethods は Discovery の token_endpoint_auth_methods_supported に載せる方式。
+var supportedTokenEndpointAuthMethods = []string{
+	authMethodClientSecretBasic,
+	authMethodClientSecretPost,
+	authMethodNone,
+	authMethodPrivateKeyJWT,
+	authMethodClientSecretJWT,
+	authMethodTLSClientAuth,
+	authMethodSelfSignedTLSClientAuth,
+}
+
+// authenticateClient はトークンエンドポイント系（/token, /device_authorization 等）で共通のクライアント認証を行う。
+// リクエストで使われた方式がクライアントに登録された token_endpoint_auth_method と一致する場合だけ成功する。
+func authenticateClient(ctx context.Context, r *http.Request) (*OAuthClient, error) {
+	if r.PostFormValue("client_assertion_type") != "" || r.PostFormValue("client_assertion") != "" {
+		// RFC 6749 2.3: 複数の認証方式を同時に使うことは禁止
+		if _, _, ok := r.BasicAuth(); ok || r.PostFormValue("client_secret") != "" {
+			return nil, fmt.Errorf("複数のクライアント認証方式が使われています")
+		}
+		return authenticateClientAssertion(ctx, r)
+	}
+
+	clientID, clientSecret, method, err := clientCredentialsFromRequest(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var client *OAuthClient
+	if method == authMethodNone {
+		client, err = repository.GetClientByID(ctx, clientID)
+		// 証明書で認証するクライアントも、フォームには client_id だけを送る（RFC 8705 2）
+		if err == nil && isTLSClientAuthMethod(client.TokenEndpointAuthMethod) {
+			if err := authenticateTLSClient(ctx, r, client); err != nil {
+				return nil, err
+			}
+			method = client.TokenEndpointAuthMethod
+		}
+	} else {
+		client, err = repository.ValidateClientCredentials(ctx, clientID, clientSecret, method)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if client.TokenEndpointAuthMethod != method {
+		return nil, fmt.Errorf("クライアント認証方式が登録内容（%s）と異なります: %s", client.TokenEndpointAuthMethod, method)
+	}
+	return client, nil
+}
+
+// clientCredentialsFromRequest は Authorization: Basic またはフォームボディからクライアントの認証情報を取り出し、
+// 使われた認証方式を判定する。複数の方式を同時に使うことは禁止されている（RFC 6749 2.3）。
+func clientCredentialsFromRequest(r *http.Request) (clientID, clientSecret, method string, err error) {
+	formID := r.PostFormValue("client_id")
+	formSecret := r.PostFormValue("client_secret")
+
+	if user, pass, ok := r.BasicAuth(); ok {
+		if formSecret != "" {
+			return "", "", "", fmt.Errorf("複数のクライアント認証方式が使われています")
+		}
+		// RFC 6749 2.3.1: client_id / client_secret は application/x-www-form-urlencoded でエンコードしてから Basic に載せる
+		clientID, err = url.QueryUnescape(user)
+		if err != nil {
+			return "", "", "", fmt.Errorf("Basic 認証の client_id が不正です")
+		}
+		clientSecret, err = url.QueryUnescape(pass)
+		if err != nil {
+			return "", "", "", fmt.Errorf("Basic 認証の client_secret が不正です")
+		}
+		if formID != "" && formID != clientID {
+			return "", "", "", fmt.Errorf("Basic 認証とフォームの client_id が一致しません")
+		}
+		if clientID == "" || clientSecret == "" {
+			return "", "", "", fmt.Errorf("クライアント認証情報がありません")
+		}
+		return clientID, clientSecret, authMethodClientSecretBasic, nil
+	}
+
+	if formID == "" {
+		return "", "", "", fmt.Errorf("クライアント認証情報がありません")
+	}
+	if formSecret != "" {
+		return formID, formSecret, authMethodClientSecretPost, nil
+	}
+	return formID, "", authMethodNone, nil
+}
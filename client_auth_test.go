@@ -0,0 +1,163 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestClientCredentialsFromRequest(t *testing.T) {
+	tests := []struct {
+		name       string
+		form       url.Values
+		basicUser  string
+		basicPass  string
+		wantID     string
+		wantSecret string
+		wantMethod string
+		wantErr    bool
+	}{
+		{
+			name:       "Basic 認証",
+			basicUser:  "demo",
+			basicPass:  "secret",
+			wantID:     "demo",
+			wantSecret: "secret",
+			wantMethod: authMethodClientSecretBasic,
+		},
+		{
+			name:       "Basic 認証の値はフォームエンコードを外す",
+			basicUser:  "client%3Aid",
+			basicPass:  "p%40ss+word",
+			wantID:     "client:id",
+			wantSecret: "p@ss word",
+			wantMethod: authMethodClientSecretBasic,
+		},
+		{
+			name:       "Basic 認証とフォームの client_id が同じなら可",
+			form:       url.Values{"client_id": {"demo"}},
+			basicUser:  "demo",
+			basicPass:  "secret",
+			wantID:     "demo",
+			wantSecret: "secret",
+			wantMethod: authMethodClientSecretBasic,
+		},
+		{
+			name:      "Basic 認証とフォームの client_id が異なる",
+			form:      url.Values{"client_id": {"other"}},
+			basicUser: "demo",
+			basicPass: "secret",
+			wantErr:   true,
+		},
+		{
+			name:      "Basic 認証とフォームの client_secret を同時に使う",
+			form:      url.Values{"client_secret": {"secret"}},
+			basicUser: "demo",
+			basicPass: "secret",
+			wantErr:   true,
+		},
+		{
+			name:      "Basic 認証のシークレットが空",
+			basicUser: "demo",
+			wantErr:   true,
+		},
+		{
+			name:      "Basic 認証のエンコードが不正",
+			basicUser: "demo",
+			basicPass: "%zz",
+			wantErr:   true,
+		},
+		{
+			name:       "フォームの client_secret",
+			form:       url.Values{"client_id": {"demo"}, "client_secret": {"secret"}},
+			wantID:     "demo",
+			wantSecret: "secret",
+			wantMethod: authMethodClientSecretPost,
+		},
+		{
+			name:       "client_id だけなら公開クライアント",
+			form:       url.Values{"client_id": {"spa_client_example"}},
+			wantID:     "spa_client_example",
+			wantMethod: authMethodNone,
+		},
+		{
+			name:    "client_id が無い",
+			form:    url.Values{"client_secret": {"secret"}},
+			wantErr: true,
+		},
+		{
+			name:    "何も無い",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newFormRequest("/token", tt.form)
+			if tt.basicUser != "" || tt.basicPass != "" {
+				r.SetBasicAuth(tt.basicUser, tt.basicPass)
+			}
+			id, secret, method, err := clientCredentialsFromRequest(r)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("clientCredentialsFromRequest() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if id != tt.wantID || secret != tt.wantSecret || method != tt.wantMethod {
+				t.Errorf("got (%q, %q, %q), want (%q, %q, %q)", id, secret, method, tt.wantID, tt.wantSecret, tt.wantMethod)
+			}
+		})
+	}
+}
+
+func TestAuthenticateClientRejectsMixedMethods(t *testing.T) {
+	// アサーションとシークレットの併用はリポジトリを引く前に拒否する（RFC 6749 2.3）
+	tests := []struct {
+		name  string
+		form  url.Values
+		basic bool
+	}{
+		{"アサーションとフォームのシークレット", url.Values{
+			"client_assertion_type": {clientAssertionTypeJWTBearer},
+			"client_assertion":      {"x.y.z"},
+			"client_secret":         {"secret"},
+		}, false},
+		{"アサーションと Basic 認証", url.Values{
+			"client_assertion_type": {clientAssertionTypeJWTBearer},
+			"client_assertion":      {"x.y.z"},
+		}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newFormRequest("/token", tt.form)
+			if tt.basic {
+				r.SetBasicAuth("demo", "secret")
+			}
+			if _, err := authenticateClient(r.Context(), r); err == nil {
+				t.Error("複数の認証方式を受け入れました")
+			}
+		})
+	}
+}
+
+func TestOAuthClientIsPublic(t *testing.T) {
+	tests := []struct {
+		method      string
+		requirePKCE bool
+		wantPublic  bool
+		wantPKCE    bool
+	}{
+		{authMethodNone, false, true, true},
+		{authMethodClientSecretBasic, false, false, false},
+		{authMethodClientSecretBasic, true, false, true},
+		{authMethodClientSecretPost, false, false, false},
+		{authMethodPrivateKeyJWT, false, false, false},
+		{authMethodClientSecretJWT, false, false, false},
+		{authMethodTLSClientAuth, false, false, false},
+	}
+	for _, tt := range tests {
+		c := &OAuthClient{TokenEndpointAuthMethod: tt.method, RequirePKCE: tt.requirePKCE}
+		if c.IsPublic() != tt.wantPublic || c.PKCERequired() != tt.wantPKCE {
+			t.Errorf("%s (require_pkce=%v): IsPublic=%v PKCERequired=%v", tt.method, tt.requirePKCE, c.IsPublic(), c.PKCERequired())
+		}
+	}
+}
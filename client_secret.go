@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"time"
+)
+
+// クライアントシークレットの保存形式とローテーション。
+// シークレットは SHA-256 のハッシュだけを client_secrets に保存する。発行するシークレットは 256 ビットの乱数なので、
+// パスワードのような低速ハッシュ（bcrypt）は不要で、トークンエンドポイントのたびにコストを払わずに済む。
+
+// ローテーション後も古いシークレットを受け付ける期間（クライアントの設定を入れ替える猶予）
+const clientSecretRotationGrace = 24 * time.Hour
+
+// hashClientSecret は client_secrets.secret_hash に保存する形式（SHA-256 の 16 進）。
+func hashClientSecret(secret string) string {
+	return hashToken(secret)
+}
+
+// clientSecretMatches は secret が保存済みのハッシュ（ローテーション中は新旧 2 つ）のどれかと一致するかどうか。
+func clientSecretMatches(hashes []string, secret string) bool {
+	given := hashClientSecret(secret)
+	matched := false
+	for _, stored := range hashes {
+		// 一致しても残りと比較を続け、どのシークレットで一致したかが応答時間に出ないようにする
+		if subtle.ConstantTimeCompare([]byte(stored), []byte(given)) == 1 {
+			matched = true
+		}
+	}
+	return matched
+}
+
+// generateClientSecret は新しいクライアントシークレット（32 バイトの乱数、Base64URL）を返す。
+func generateClientSecret() string {
+	return generateRandomString(32)
+}
+
+// rotateClientSecret は clientID に新しいシークレットを発行して返す。平文を返すのはこの 1 回だけ。
+// grace が 0 以下なら clientSecretRotationGrace を使う。
+func rotateClientSecret(ctx context.Context, clientID string, grace time.Duration) (string, time.Time, error) {
+	if grace <= 0 {
+		grace = clientSecretRotationGrace
+	}
+	secret := generateClientSecret()
+	oldExpiresAt := time.Now().Add(grace)
+	if err := repository.RotateClientSecret(ctx, clientID, secret, oldExpiresAt); err != nil {
+		return "", time.Time{}, fmt.Errorf("クライアントシークレットのローテーションに失敗しました: %w", err)
+	}
+	return secret, oldExpiresAt, nil
+}
@@ -0,0 +1,43 @@
+package main
+
+import "testing"
+
+func TestClientSecretMatches(t *testing.T) {
+	current := hashClientSecret("new-secret")
+	previous := hashClientSecret("old-secret")
+	tests := []struct {
+		name   string
+		hashes []string
+		secret string
+		want   bool
+	}{
+		{"現在のシークレット", []string{current}, "new-secret", true},
+		{"ローテーション中の新しいシークレット", []string{previous, current}, "new-secret", true},
+		{"ローテーション中の古いシークレット", []string{previous, current}, "old-secret", true},
+		{"猶予期間を過ぎた古いシークレット", []string{current}, "old-secret", false},
+		{"ハッシュそのものを送る", []string{current}, current, false},
+		{"空のシークレット", []string{current}, "", false},
+		{"ハッシュが無い", nil, "new-secret", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := clientSecretMatches(tt.hashes, tt.secret); got != tt.want {
+				t.Errorf("clientSecretMatches() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGenerateClientSecret(t *testing.T) {
+	a, b := generateClientSecret(), generateClientSecret()
+	if a == b {
+		t.Error("同じシークレットが生成されました")
+	}
+	// 32 バイトの Base64URL（パディングなし）
+	if len(a) != 43 {
+		t.Errorf("len = %d, want 43", len(a))
+	}
+	if len(hashClientSecret(a)) != 64 {
+		t.Errorf("hashClientSecret() の長さ = %d, want 64", len(hashClientSecret(a)))
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// scopeDescriptions は同意画面に表示するスコープの説明。未登録のスコープはスコープ名をそのまま表示する。
+var scopeDescriptions = map[string]string{
+	"openid":             "あなたを識別する ID（ログイン連携）",
+	"profile":            "ユーザー名などのプロフィール情報",
+	"email":              "メールアドレス",
+	"read":               "データの読み取り",
+	"write":              "データの作成・更新",
+	"admin":              "管理者としての操作",
+	"user_management":    "ユーザーの管理",
+	"push_notifications": "プッシュ通知の送信",
+}
+
+// consentCSRFField は同意画面のフォームに埋め込む CSRF トークンのフィールド名
+const consentCSRFField = "csrf_token"
+
+// consentCSRFToken はセッションごとの CSRF トークン。セッション ID（クッキーの値）を鍵にした HMAC なので、
+// DB に保存しなくても再起動・複数台構成で同じ値になり、クッキーを読めない他サイトからは作れない。
+// ID Token の sid（oidcSessionID）とは別の値になるよう、用途のラベルを混ぜている。
+func consentCSRFToken(session *Session) string {
+	mac := hmac.New(sha256.New, []byte(session.ID))
+	mac.Write([]byte("consent-csrf"))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// validConsentCSRFToken は同意画面から送られた CSRF トークンがセッションのものと一致するかどうか
+func validConsentCSRFToken(session *Session, token string) bool {
+	return token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(consentCSRFToken(session))) == 1
+}
+
+// renderConsentPage はクライアント名と要求スコープを表示し、許可・拒否を選ばせる同意画面を返す。
+// 元の認可リクエストのパラメータは hidden フィールドに埋め込み、POST /authorize でそのまま戻す。
+// csrfToken（consentCSRFToken）も hidden フィールドに入れ、POST 側で照合する。
+func renderConsentPage(w http.ResponseWriter, client *OAuthClient, req *authorizeRequest, scopes []string, csrfToken string) {
+	var scopeItems strings.Builder
+	for _, s := range scopes {
+		desc, ok := scopeDescriptions[s]
+		if !ok {
+			desc = s
+		}
+		fmt.Fprintf(&scopeItems, `<li>%s <span class="scope">%s</span></li>`, escapeHTML(desc), escapeHTML(s))
+	}
+	if scopeItems.Len() == 0 {
+		scopeItems.WriteString("<li>アカウントの識別のみ（追加の権限なし）</li>")
+	}
+
+	keys := make([]string, 0, len(req.params))
+	for k := range req.params {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+
+	var hidden strings.Builder
+	for _, k := range keys {
+		for _, v := range req.params[k] {
+			fmt.Fprintf(&hidden, `
+            <input type="hidden" name="%s" value="%s">`, escapeHTML(k), escapeHTML(v))
+		}
+	}
+	fmt.Fprintf(&hidden, `
+            <input type="hidden" name="%s" value="%s">`, consentCSRFField, escapeHTML(csrfToken))
+
+	html := fmt.Sprintf(`
+<!DOCTYPE html>
+<html lang="ja">
+<head>
+    <meta charset="UTF-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <title>アクセスの許可 - OAuth2 Server</title>
+    <style>
+        body {
+            font-family: -apple-system, BlinkMacSystemFont, 'Segoe UI', Roboto, sans-serif;
+            max-width: 480px;
+            margin: 80px auto;
+            padding: 20px;
+            background-color: #f5f5f5;
+        }
+        .container {
+            background: white;
+            padding: 40px;
+            border-radius: 8px;
+            box-shadow: 0 2px 10px rgba(0,0,0,0.1);
+        }
+        h1 { color: #333; margin-top: 0; font-size: 1.4rem; }
+        ul { padding-left: 20px; }
+        li { margin: 8px 0; }
+        .scope { color: #888; font-size: 0.85rem; font-family: monospace; }
+        .actions { display: flex; gap: 12px; margin-top: 24px; }
+        .btn {
+            flex: 1;
+            padding: 12px;
+            border: none;
+            border-radius: 4px;
+            font-size: 16px;
+            cursor: pointer;
+        }
+        .allow { background-color: #007bff; color: white; }
+        .allow:hover { background-color: #0056b3; }
+        .deny { background-color: #f0f0f0; color: #333; border: 1px solid #ddd; }
+        .deny:hover { background-color: #e8e8e8; }
+    </style>
+</head>
+<body>
+    <div class="container">
+        <h1><strong>%s</strong> がアクセスを求めています</h1>
+        <p>許可すると、このアプリケーションは次の情報・操作を利用できます。</p>
+        <ul>%s</ul>
+        <form method="post" action="/authorize">%s
+            <div class="actions">
+                <button type="submit" name="consent_action" value="deny" class="btn deny">拒否</button>
+                <button type="submit" name="consent_action" value="allow" class="btn allow">許可</button>
+            </div>
+        </form>
+    </div>
+</body>
+</html>`,
+		escapeHTML(client.Name),
+		scopeItems.String(),
+		hidden.String(),
+	)
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	// 同意ボタンを他サイトの iframe に重ねるクリックジャッキングを防ぐ
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.Header().Set("Cache-Control", "no-store")
+	fmt.Fprint(w, html)
+}
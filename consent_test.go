@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestConsentCSRFToken(t *testing.T) {
+	session := &Session{ID: "session-a"}
+	token := consentCSRFToken(session)
+
+	tests := []struct {
+		name    string
+		session *Session
+		token   string
+		want    bool
+	}{
+		{"同じセッションのトークン", session, token, true},
+		{"空のトークン", session, "", false},
+		{"別のセッションのトークン", &Session{ID: "session-b"}, token, false},
+		{"ID Token の sid は使えない", session, oidcSessionID(session.ID), false},
+		{"末尾に文字を足したトークン", session, token + "A", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := validConsentCSRFToken(tt.session, tt.token); got != tt.want {
+				t.Errorf("validConsentCSRFToken() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if consentCSRFToken(session) != token {
+		t.Error("同じセッションで CSRF トークンが変わりました")
+	}
+}
+
+func TestRenderConsentPage(t *testing.T) {
+	client := &OAuthClient{ClientID: "demo", Name: `<script>alert(1)</script>`}
+	req := parseAuthorizeRequest(url.Values{
+		"client_id": {"demo"},
+		"state":     {`"><script>`},
+	})
+	w := httptest.NewRecorder()
+	renderConsentPage(w, client, req, []string{"openid", "custom"}, "csrf-value")
+
+	body := w.Body.String()
+	for _, want := range []string{
+		`<input type="hidden" name="csrf_token" value="csrf-value">`,
+		`<input type="hidden" name="client_id" value="demo">`,
+		`&lt;script&gt;alert(1)&lt;/script&gt;`,
+		`<span class="scope">custom</span>`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("同意画面に %q がありません", want)
+		}
+	}
+	if strings.Contains(body, `"><script>`) {
+		t.Error("state がエスケープされていません")
+	}
+	if got := w.Header().Get("X-Frame-Options"); got != "DENY" {
+		t.Errorf("X-Frame-Options = %q", got)
+	}
+}
+
+func TestUserGrantCovers(t *testing.T) {
+	grant := &UserGrant{Scopes: []string{"openid", "read"}}
+	tests := []struct {
+		scopes []string
+		want   bool
+	}{
+		{nil, true},
+		{[]string{"read"}, true},
+		{[]string{"openid", "read"}, true},
+		{[]string{"read", "write"}, false},
+	}
+	for _, tt := range tests {
+		if got := grant.Covers(tt.scopes); got != tt.want {
+			t.Errorf("Covers(%v) = %v, want %v", tt.scopes, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// デバイスコード / ユーザーコードの有効期間（RFC 8628 3.2 expires_in）
+	deviceCodeLifetime = 10 * time.Minute
+	// デバイスがポーリングする最小間隔（秒）。slow_down のたびに 5 秒ずつ延びる
+	deviceCodePollInterval = 5
+	// RFC 8628 3.4 で定義されたデバイスコードグラントの grant_type
+	deviceCodeGrantType = "urn:ietf:params:oauth:grant-type:device_code"
+	// ユーザーコードに使う文字。読み間違えやすい母音・数字を除いた子音のみ（RFC 8628 6.1 の例）
+	userCodeAlphabet = "BCDFGHJKLMNPQRSTVWXZ"
+)
+
+// デバイス認可エンドポイント（POST /device_authorization、RFC 8628 3.1）。
+// ブラウザを開けない CLI やキオスク端末向けに device_code / user_code を発行する。
+func deviceAuthorizationHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	logger := slog.Default()
+
+	if err := r.ParseForm(); err != nil {
+		writeOAuthError(w, errInvalidRequest("invalid form data"))
+		return
+	}
+
+	client, err := authenticateClient(ctx, r)
+	if err != nil {
+		logger.Warn("クライアント認証に失敗しました", "client_id", r.FormValue("client_id"), "error", err.Error())
+		writeOAuthError(w, errInvalidClient("client authentication failed"))
+		return
+	}
+	if !client.AllowsGrantType(deviceCodeGrantType) {
+		writeOAuthError(w, errUnauthorizedClient("the client is not registered for the device_code grant"))
+		return
+	}
+
+	scopes := client.RequestedScopes(r.FormValue("scope"))
+	if s := findUnregisteredScope(client, scopes); s != "" {
+		logger.Warn("登録されていないスコープが要求されました",
+			"client_id", client.ClientID,
+			"scope", s,
+			"allowed_scopes", client.Scopes)
+		writeOAuthError(w, errInvalidScope("the requested scope is not allowed for this client"))
+		return
+	}
+
+	deviceCode := generateRandomString(32)
+	userCode := generateUserCode()
+	expiresAt := time.Now().Add(deviceCodeLifetime)
+
+	if err := repository.CreateDeviceCode(ctx, deviceCode, userCode, client.ClientID, scopes, deviceCodePollInterval, expiresAt); err != nil {
+		logger.Error("デバイスコードの作成に失敗しました", "error", err.Error())
+		writeOAuthError(w, errServerError())
+		return
+	}
+
+	verificationURI := serverBaseURL() + "/device"
+	response := map[string]any{
+		"device_code":               deviceCode,
+		"user_code":                 formatUserCode(userCode),
+		"verification_uri":          verificationURI,
+		"verification_uri_complete": verificationURI + "?user_code=" + url.QueryEscape(formatUserCode(userCode)),
+		"expires_in":                int(deviceCodeLifetime.Seconds()),
+		"interval":                  deviceCodePollInterval,
+	}
+
+	writeTokenJSON(w, logger, response, "デバイスコードを発行しました",
+		"client_id", client.ClientID,
+		"scopes", scopes,
+	)
+}
+
+// デバイス認可の確認ページ（GET /device）。
+// user_code が無ければ入力フォーム、あれば要求元クライアントとスコープを表示して承認・拒否を選ばせる。
+func deviceGetHandler(w http.ResponseWriter, r *http.Request) {
+	session := requireBrowserSession(w, r)
+	if session == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	rawCode := r.URL.Query().Get("user_code")
+	if rawCode == "" {
+		renderDevicePage(w, "デバイスの接続", `
+        <p>デバイスに表示されているコードを入力してください。</p>
+        <form method="get" action="/device">
+            <input type="text" name="user_code" placeholder="XXXX-XXXX" autocomplete="off" autofocus required>
+            <button type="submit" class="btn">次へ</button>
+        </form>`)
+		return
+	}
+
+	userCode := normalizeUserCode(rawCode)
+	dc, err := repository.GetDeviceCodeByUserCode(ctx, userCode)
+	if err != nil {
+		slog.Default().Warn("無効なユーザーコード", "user_code_hash", tokenLogID(userCode), "error", err.Error())
+		renderDevicePage(w, "コードが無効です", `
+        <p class="error">コードが見つからないか、有効期限が切れています。</p>
+        <p><a href="/device">もう一度入力する</a></p>`)
+		return
+	}
+
+	clientName := dc.ClientID
+	if client, err := repository.GetClientByID(ctx, dc.ClientID); err == nil {
+		clientName = client.Name
+	}
+
+	renderDeviceApprovalPage(w, clientName, dc, consentCSRFToken(session))
+}
+
+// renderDeviceApprovalPage は要求元クライアントとスコープを表示し、承認・拒否を選ばせるページを返す。
+// csrfToken（consentCSRFToken）を hidden フィールドに入れ、POST /device で照合する。
+func renderDeviceApprovalPage(w http.ResponseWriter, clientName string, dc *DeviceCode, csrfToken string) {
+	var scopeItems strings.Builder
+	for _, s := range dc.Scopes {
+		if s != "" {
+			fmt.Fprintf(&scopeItems, "<li>%s</li>", escapeHTML(s))
+		}
+	}
+	if scopeItems.Len() == 0 {
+		scopeItems.WriteString("<li>（スコープ指定なし）</li>")
+	}
+
+	renderDevicePage(w, "デバイスの接続を承認", fmt.Sprintf(`
+        <p><strong>%s</strong> があなたのアカウントへのアクセスを要求しています。</p>
+        <p>コード: <code>%s</code></p>
+        <ul>%s</ul>
+        <form method="post" action="/device">
+            <input type="hidden" name="user_code" value="%s">
+            <input type="hidden" name="%s" value="%s">
+            <button type="submit" name="action" value="approve" class="btn">許可</button>
+            <button type="submit" name="action" value="deny" class="btn secondary">拒否</button>
+        </form>`,
+		escapeHTML(clientName),
+		escapeHTML(formatUserCode(dc.UserCode)),
+		scopeItems.String(),
+		escapeHTML(dc.UserCode),
+		consentCSRFField, escapeHTML(csrfToken),
+	))
+}
+
+// デバイス認可の承認・拒否（POST /device）。
+func devicePostHandler(w http.ResponseWriter, r *http.Request) {
+	session := requireBrowserSession(w, r)
+	if session == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	logger := slog.Default()
+
+	// 他サイトから POST させてユーザーに気付かれないまま攻撃者のデバイスを承認させないよう、
+	// 同意画面と同じセッションごとの CSRF トークンを確認する
+	if !validConsentCSRFToken(session, r.PostFormValue(consentCSRFField)) {
+		logger.Warn("デバイス認可の CSRF トークンが無いか一致しません",
+			"user_id", session.UserID,
+			"remoteAddr", r.RemoteAddr)
+		http.Error(w, "Invalid device authorization form", http.StatusForbidden)
+		return
+	}
+
+	userCode := normalizeUserCode(r.PostFormValue("user_code"))
+	approved := r.PostFormValue("action") == "approve"
+
+	if err := repository.DecideDeviceCode(ctx, userCode, session.UserID, approved); err != nil {
+		logger.Warn("デバイス認可の更新に失敗しました", "user_code_hash", tokenLogID(userCode), "error", err.Error())
+		renderDevicePage(w, "コードが無効です", `
+        <p class="error">コードが見つからないか、有効期限が切れています。</p>
+        <p><a href="/device">もう一度入力する</a></p>`)
+		return
+	}
+
+	logger.Info("デバイス認可が決定されました",
+		"user_code_hash", tokenLogID(userCode),
+		"user_id", session.UserID,
+		"approved", approved)
+
+	if approved {
+		renderDevicePage(w, "接続しました", `
+        <p>デバイスへのアクセスを許可しました。デバイスに戻って操作を続けてください。</p>`)
+		return
+	}
+	renderDevicePage(w, "拒否しました", `
+        <p>デバイスへのアクセスを拒否しました。このページは閉じてかまいません。</p>`)
+}
+
+// generateUserCode は userCodeAlphabet から 8 文字のユーザーコードを生成する（ハイフンなし）。
+func generateUserCode() string {
+	alphabetLen := big.NewInt(int64(len(userCodeAlphabet)))
+	b := make([]byte, 8)
+	for i := range b {
+		n, err := rand.Int(rand.Reader, alphabetLen)
+		if err != nil {
+			panic(err)
+		}
+		b[i] = userCodeAlphabet[n.Int64()]
+	}
+	return string(b)
+}
+
+// formatUserCode は表示用に XXXX-XXXX 形式へ整形する。
+func formatUserCode(code string) string {
+	if len(code) != 8 {
+		return code
+	}
+	return code[:4] + "-" + code[4:]
+}
+
+// normalizeUserCode はユーザー入力から区切り文字と空白を除き、大文字に揃える（RFC 8628 6.1）。
+func normalizeUserCode(input string) string {
+	var b strings.Builder
+	for _, c := range strings.ToUpper(input) {
+		if c == '-' || c == ' ' {
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// renderDevicePage はデバイス認可ページ共通のレイアウトで HTML を書き出す。
+func renderDevicePage(w http.ResponseWriter, title, body string) {
+	html := fmt.Sprintf(`
+<!DOCTYPE html>
+<html lang="ja">
+<head>
+    <meta charset="UTF-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <title>%s - OAuth2 Server</title>
+    <style>
+        body {
+            font-family: -apple-system, BlinkMacSystemFont, 'Segoe UI', Roboto, sans-serif;
+            max-width: 480px;
+            margin: 80px auto;
+            padding: 20px;
+            background-color: #f5f5f5;
+        }
+        .container {
+            background: white;
+            padding: 40px;
+            border-radius: 8px;
+            box-shadow: 0 2px 10px rgba(0,0,0,0.1);
+        }
+        h1 { color: #333; margin-top: 0; font-size: 1.5rem; }
+        input[type="text"] {
+            width: 100%%;
+            padding: 12px;
+            border: 1px solid #ddd;
+            border-radius: 4px;
+            font-size: 20px;
+            letter-spacing: 4px;
+            text-align: center;
+            text-transform: uppercase;
+            box-sizing: border-box;
+        }
+        code { font-size: 1.1rem; letter-spacing: 2px; }
+        .btn {
+            padding: 12px 24px;
+            background-color: #007bff;
+            color: white;
+            border: none;
+            border-radius: 4px;
+            font-size: 16px;
+            cursor: pointer;
+            margin-top: 16px;
+        }
+        .btn:hover { background-color: #0056b3; }
+        .btn.secondary { background-color: #f0f0f0; color: #333; border: 1px solid #ddd; }
+        .btn.secondary:hover { background-color: #e8e8e8; }
+        .error { color: #dc3545; }
+    </style>
+</head>
+<body>
+    <div class="container">
+        <h1>%s</h1>%s
+    </div>
+</body>
+</html>`, escapeHTML(title), escapeHTML(title), body)
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	// 同意画面と同じく、承認ボタンを他サイトの iframe に重ねるクリックジャッキングを防ぐ
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.Header().Set("Cache-Control", "no-store")
+	fmt.Fprint(w, html)
+}
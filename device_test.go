@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestGenerateUserCode(t *testing.T) {
+	for range 100 {
+		code := generateUserCode()
+		if len(code) != 8 {
+			t.Fatalf("len(%q) = %d, want 8", code, len(code))
+		}
+		for _, c := range code {
+			if !strings.ContainsRune(userCodeAlphabet, c) {
+				t.Fatalf("%q に userCodeAlphabet 以外の文字があります", code)
+			}
+		}
+		if got := normalizeUserCode(formatUserCode(code)); got != code {
+			t.Fatalf("normalizeUserCode(formatUserCode(%q)) = %q", code, got)
+		}
+	}
+}
+
+func TestFormatUserCode(t *testing.T) {
+	tests := []struct {
+		code string
+		want string
+	}{
+		{"BCDFGHJK", "BCDF-GHJK"},
+		{"BCDFGHJ", "BCDFGHJ"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := formatUserCode(tt.code); got != tt.want {
+			t.Errorf("formatUserCode(%q) = %q, want %q", tt.code, got, tt.want)
+		}
+	}
+}
+
+func TestNormalizeUserCode(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"BCDF-GHJK", "BCDFGHJK"},
+		{"bcdf-ghjk", "BCDFGHJK"},
+		{" bcdf ghjk ", "BCDFGHJK"},
+		{"BC-DF-GH-JK", "BCDFGHJK"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := normalizeUserCode(tt.input); got != tt.want {
+			t.Errorf("normalizeUserCode(%q) = %q, want %q", tt.input, got, tt.want)
+		}
+	}
+}
+
+func TestHandleDeviceCodeGrantRequiresDeviceCode(t *testing.T) {
+	rec := httptest.NewRecorder()
+	r := newFormRequest("/token", url.Values{"grant_type": {deviceCodeGrantType}})
+	handleDeviceCodeGrant(context.Background(), rec, r, slog.Default(), &OAuthClient{ClientID: "tv_client"}, nil)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("status = %d, want 400", rec.Code)
+	}
+	if code := oauthErrorCode(t, rec); code != "invalid_request" {
+		t.Errorf("error = %q, want invalid_request", code)
+	}
+}
+
+func TestErrDeviceGrant(t *testing.T) {
+	// ポーリング結果はいずれも 400 で、error にそのままコードを入れる（RFC 8628 3.5）
+	for _, code := range []string{"authorization_pending", "slow_down", "expired_token", "access_denied"} {
+		rec := httptest.NewRecorder()
+		writeOAuthError(rec, errDeviceGrant(code))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want 400", code, rec.Code)
+		}
+		if got := oauthErrorCode(t, rec); got != code {
+			t.Errorf("error = %q, want %q", got, code)
+		}
+	}
+}
+
+func TestRenderDeviceApprovalPage(t *testing.T) {
+	dc := &DeviceCode{UserCode: "BCDFGHJK", ClientID: "tv_client", Scopes: []string{"openid", "<b>"}}
+	w := httptest.NewRecorder()
+	renderDeviceApprovalPage(w, `<script>alert(1)</script>`, dc, "csrf-value")
+
+	body := w.Body.String()
+	for _, want := range []string{
+		`<input type="hidden" name="csrf_token" value="csrf-value">`,
+		`<input type="hidden" name="user_code" value="BCDFGHJK">`,
+		`<code>BCDF-GHJK</code>`,
+		`&lt;script&gt;alert(1)&lt;/script&gt;`,
+		`<li>&lt;b&gt;</li>`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("承認ページに %q がありません", want)
+		}
+	}
+	if got := w.Header().Get("X-Frame-Options"); got != "DENY" {
+		t.Errorf("X-Frame-Options = %q", got)
+	}
+	if got := w.Header().Get("Cache-Control"); got != "no-store" {
+		t.Errorf("Cache-Control = %q", got)
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Yuki-TU/oauth2/internal/jose"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// DPoP（RFC 9449）: クライアントが持つ鍵でリクエストごとに署名した証明（DPoP ヘッダの JWT）を送らせ、
+// アクセストークンをその鍵に結びつける（cnf.jkt）。トークンが漏れても鍵が無ければ使えない。
+const (
+	// Authorization ヘッダのスキームと、DPoP に結びついたトークンの token_type
+	authSchemeDPoP = "DPoP"
+
+	dpopProofType = "dpop+jwt"
+	// 証明の iat の許容範囲（過去 / 未来方向の時計のずれ）。jti はこの期間だけ保存してリプレイを防ぐ
+	dpopProofMaxAge = time.Minute
+	dpopProofLeeway = 30 * time.Second
+	// サーバーが発行する nonce の有効期間
+	dpopNonceLifetime = 5 * time.Minute
+)
+
+// dpopSigningAlgs は証明に使える署名アルゴリズム（非対称鍵のみ）
+var dpopSigningAlgs = []string{"RS256", "ES256", "ES384", "EdDSA"}
+
+var (
+	// errUseDPoPNonce は nonce が無い・古い証明を表す。呼び出し側は新しい nonce を DPoP-Nonce ヘッダで返す（RFC 9449 8）
+	errUseDPoPNonce = errors.New("DPoP 証明にサーバー発行の nonce が必要です")
+	// errDPoPProofMissing はトークンが鍵に結びついているのに証明が無いことを表す
+	errDPoPProofMissing = errors.New("DPoP 証明がありません")
+)
+
+// dpopProofClaims は DPoP 証明のクレーム（RFC 9449 4.2）
+type dpopProofClaims struct {
+	jwt.RegisteredClaims
+	HTM   string `json:"htm"`
+	HTU   string `json:"htu"`
+	ATH   string `json:"ath,omitempty"`
+	Nonce string `json:"nonce,omitempty"`
+}
+
+// dpopNonceRequired はトークンエンドポイント・UserInfo で nonce 付きの証明を要求するかどうか（DPOP_REQUIRE_NONCE=true）。
+// クライアントの時計に頼らず、証明を事前に作り置きされるのを防ぐ。
+func dpopNonceRequired() bool {
+	return os.Getenv("DPOP_REQUIRE_NONCE") == "true"
+}
+
+// dpopNonceKey は nonce の HMAC 鍵。起動ごとに作り直すため、再起動すると発行済みの nonce は使えなくなる
+// （複数台で動かす場合は同じ nonce を検証できないので、ロードバランサでクライアントを固定すること）。
+var dpopNonceKey = func() []byte {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return b
+}()
+
+// newDPoPNonce は発行時刻と HMAC からなる nonce を返す。状態を持たずに検証できる。
+func newDPoPNonce() string {
+	buf := make([]byte, 8, 8+sha256.Size)
+	binary.BigEndian.PutUint64(buf, uint64(time.Now().Unix()))
+	mac := hmac.New(sha256.New, dpopNonceKey)
+	mac.Write(buf)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(buf))
+}
+
+func validDPoPNonce(nonce string) bool {
+	b, err := base64.RawURLEncoding.DecodeString(nonce)
+	if err != nil || len(b) != 8+sha256.Size {
+		return false
+	}
+	mac := hmac.New(sha256.New, dpopNonceKey)
+	mac.Write(b[:8])
+	if !hmac.Equal(mac.Sum(nil), b[8:]) {
+		return false
+	}
+	issued := time.Unix(int64(binary.BigEndian.Uint64(b[:8])), 0)
+	return time.Since(issued) <= dpopNonceLifetime
+}
+
+// checkDPoPProof は DPoP ヘッダの証明を検証し、公開鍵の JWK サムプリント（jkt）を返す。
+// ヘッダが無ければ空文字を返す。htu は呼ばれたエンドポイントの URL、accessToken はリソースへのアクセス時だけ指定する（ath の検証）。
+func checkDPoPProof(ctx context.Context, r *http.Request, htu, accessToken string) (string, error) {
+	values := r.Header.Values("DPoP")
+	if len(values) == 0 {
+		return "", nil
+	}
+	if len(values) > 1 {
+		return "", fmt.Errorf("DPoP ヘッダが複数あります")
+	}
+
+	var jwk JWK
+	parser := jwt.NewParser(jwt.WithValidMethods(dpopSigningAlgs))
+	claims := &dpopProofClaims{}
+	_, err := parser.ParseWithClaims(values[0], claims, func(t *jwt.Token) (any, error) {
+		if typ, _ := t.Header["typ"].(string); typ != dpopProofType {
+			return nil, fmt.Errorf("typ が %s ではありません", dpopProofType)
+		}
+		raw, ok := t.Header["jwk"].(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("ヘッダに jwk がありません")
+		}
+		if _, ok := raw["d"]; ok {
+			return nil, fmt.Errorf("jwk に秘密鍵が含まれています")
+		}
+		b, _ := json.Marshal(raw)
+		if err := json.Unmarshal(b, &jwk); err != nil {
+			return nil, fmt.Errorf("jwk が不正です: %v", err)
+		}
+		return publicKeyFromJWK(jwk)
+	})
+	if err != nil {
+		return "", fmt.Errorf("DPoP 証明の検証エラー: %v", err)
+	}
+
+	if claims.HTM != r.Method {
+		return "", fmt.Errorf("DPoP 証明の htm がリクエストのメソッドと一致しません: %s", claims.HTM)
+	}
+	if !dpopHTUMatches(claims.HTU, htu) {
+		return "", fmt.Errorf("DPoP 証明の htu がリクエストの URL と一致しません: %s", claims.HTU)
+	}
+	if claims.IssuedAt == nil {
+		return "", fmt.Errorf("DPoP 証明に iat がありません")
+	}
+	if age := time.Since(claims.IssuedAt.Time); age > dpopProofMaxAge || age < -dpopProofLeeway {
+		return "", fmt.Errorf("DPoP 証明の iat が許容範囲外です")
+	}
+	if claims.ID == "" {
+		return "", fmt.Errorf("DPoP 証明に jti がありません")
+	}
+	if accessToken != "" {
+		sum := sha256.Sum256([]byte(accessToken))
+		if subtle.ConstantTimeCompare([]byte(claims.ATH), []byte(base64.RawURLEncoding.EncodeToString(sum[:]))) != 1 {
+			return "", fmt.Errorf("DPoP 証明の ath がアクセストークンと一致しません")
+		}
+	}
+	if dpopNonceRequired() && !validDPoPNonce(claims.Nonce) {
+		return "", errUseDPoPNonce
+	}
+
+	jkt, err := jwkThumbprint(jwk)
+	if err != nil {
+		return "", err
+	}
+	expiresAt := claims.IssuedAt.Add(dpopProofMaxAge + dpopProofLeeway)
+	if err := repository.RecordDPoPProofJTI(ctx, jkt, claims.ID, expiresAt); err != nil {
+		return "", err
+	}
+	return jkt, nil
+}
+
+// dpopHTUMatches は証明の htu が呼ばれたエンドポイントかどうか。クエリとフラグメントは比較しない（RFC 9449 4.3）。
+func dpopHTUMatches(htu, expected string) bool {
+	u, err := url.Parse(htu)
+	if err != nil {
+		return false
+	}
+	e, err := url.Parse(expected)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Scheme, e.Scheme) && strings.EqualFold(u.Host, e.Host) && u.EscapedPath() == e.EscapedPath()
+}
+
+// jwkThumbprint は JWK の SHA-256 サムプリント（RFC 7638）を BASE64URL で返す。
+// リソースサーバー（backend）と同じ値になるよう、計算は internal/jose で共有する。
+func jwkThumbprint(k JWK) (string, error) {
+	return jose.JWKThumbprint(jose.JWKMembers{Kty: k.Kty, Crv: k.Crv, X: k.X, Y: k.Y, N: k.N, E: k.E})
+}
+
+// checkAccessTokenBinding はアクセストークンの使い方が cnf.jkt と合っているかを確認する。
+// 鍵に結びついたトークンは DPoP スキームと一致する証明が必須で、Bearer としては使えない（RFC 9449 7.1, 7.2）。
+func checkAccessTokenBinding(ctx context.Context, r *http.Request, scheme, token string, claims *CustomClaims, htu string) error {
+	bound := claims.Confirmation != nil && claims.Confirmation.JKT != ""
+	if scheme != authSchemeDPoP {
+		if bound {
+			return fmt.Errorf("DPoP に結びついたトークンが Bearer として使われました")
+		}
+		return nil
+	}
+	if !bound {
+		return fmt.Errorf("DPoP に結びついていないトークンが DPoP スキームで使われました")
+	}
+
+	jkt, err := checkDPoPProof(ctx, r, htu, token)
+	if err != nil {
+		return err
+	}
+	if jkt == "" {
+		return errDPoPProofMissing
+	}
+	if jkt != claims.Confirmation.JKT {
+		return fmt.Errorf("DPoP 証明の鍵がトークンの cnf.jkt と一致しません")
+	}
+	return nil
+}
+
+// accessTokenType はトークンレスポンスの token_type（RFC 9449 5）。証明書だけに結びついたトークンは Bearer のまま（RFC 8705 3）
+func accessTokenType(cnf *tokenConfirmation) string {
+	if cnf != nil && cnf.JKT != "" {
+		return authSchemeDPoP
+	}
+	return "Bearer"
+}
+
+// writeDPoPError は DPoP スキームの WWW-Authenticate 付きでエラーを返す（RFC 9449 7.1）。
+// use_dpop_nonce のときは新しい nonce を DPoP-Nonce ヘッダで渡す。
+func writeDPoPError(w http.ResponseWriter, code, description string) {
+	challenge := fmt.Sprintf(`DPoP algs="%s", error="%s"`, strings.Join(dpopSigningAlgs, " "), code)
+	if description != "" {
+		challenge += fmt.Sprintf(`, error_description="%s"`, description)
+	}
+	if code == "use_dpop_nonce" {
+		w.Header().Set("DPoP-Nonce", newDPoPNonce())
+	}
+	w.Header().Set("WWW-Authenticate", challenge)
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusUnauthorized)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// ローカルで DPoP の流れを curl から試すための証明の生成（サブコマンド dpop-proof）。
+// 本来はクライアント（ブラウザの WebCrypto 等）が作るもので、サーバーの処理では使わない。
+
+// dpopClientKeyFile はクライアント役の P-256 鍵の保存先（DPOP_KEY_FILE で変更）。無ければ作る
+func dpopClientKeyFile() string {
+	if f := os.Getenv("DPOP_KEY_FILE"); f != "" {
+		return f
+	}
+	return "dpop_client_key.pem"
+}
+
+// generateDPoPProof は method / htu 宛ての DPoP 証明を作る。accessToken を渡すと ath、nonce を渡すと nonce を付ける。
+func generateDPoPProof(method, htu, accessToken, nonce string) (string, error) {
+	key, err := loadOrCreateDPoPClientKey(dpopClientKeyFile())
+	if err != nil {
+		return "", err
+	}
+
+	claims := dpopProofClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:       generateRandomString(16),
+			IssuedAt: jwt.NewNumericDate(time.Now()),
+		},
+		HTM:   method,
+		HTU:   htu,
+		Nonce: nonce,
+	}
+	if accessToken != "" {
+		sum := sha256.Sum256([]byte(accessToken))
+		claims.ATH = base64.RawURLEncoding.EncodeToString(sum[:])
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
+	token.Header["typ"] = dpopProofType
+	token.Header["jwk"] = map[string]string{
+		"kty": "EC",
+		"crv": "P-256",
+		"x":   base64.RawURLEncoding.EncodeToString(key.PublicKey.X.FillBytes(make([]byte, 32))),
+		"y":   base64.RawURLEncoding.EncodeToString(key.PublicKey.Y.FillBytes(make([]byte, 32))),
+	}
+	return token.SignedString(key)
+}
+
+func loadOrCreateDPoPClientKey(path string) (*ecdsa.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, fmt.Errorf("DPoP 鍵の生成に失敗しました: %v", err)
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+			return nil, fmt.Errorf("DPoP 鍵の保存に失敗しました: %v", err)
+		}
+		return key, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("DPoP 鍵の読み込みに失敗しました: %v", err)
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("DPoP 鍵の PEM が不正です: %s", path)
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("DPoP 鍵のパースエラー: %v", err)
+	}
+	key, ok := parsed.(*ecdsa.PrivateKey)
+	if !ok || key.Curve != elliptic.P256() {
+		return nil, fmt.Errorf("DPoP 鍵は P-256 の EC 鍵である必要があります: %s", path)
+	}
+	return key, nil
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// testDPoPKey はクライアント役の DPoP 鍵と、その JWK（証明のヘッダに載せる形）。
+type testDPoPKey struct {
+	key *ecdsa.PrivateKey
+	jwk map[string]any
+}
+
+func newTestDPoPKey(t *testing.T) *testDPoPKey {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testDPoPKey{key: key, jwk: map[string]any{
+		"kty": "EC",
+		"crv": "P-256",
+		"x":   base64.RawURLEncoding.EncodeToString(key.PublicKey.X.FillBytes(make([]byte, 32))),
+		"y":   base64.RawURLEncoding.EncodeToString(key.PublicKey.Y.FillBytes(make([]byte, 32))),
+	}}
+}
+
+// proof は claims の DPoP 証明を作る。header で typ / jwk を上書きできる（nil の値はヘッダから消す）。
+func (k *testDPoPKey) proof(t *testing.T, claims dpopProofClaims, header map[string]any) string {
+	t.Helper()
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
+	token.Header["typ"] = dpopProofType
+	token.Header["jwk"] = k.jwk
+	for name, v := range header {
+		if v == nil {
+			delete(token.Header, name)
+		} else {
+			token.Header[name] = v
+		}
+	}
+	s, err := token.SignedString(k.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestCheckDPoPProofRejects(t *testing.T) {
+	key := newTestDPoPKey(t)
+	const htu = "https://as.example.com/token"
+	now := time.Now()
+	valid := func() dpopProofClaims {
+		return dpopProofClaims{
+			RegisteredClaims: jwt.RegisteredClaims{ID: "jti-1", IssuedAt: jwt.NewNumericDate(now)},
+			HTM:              http.MethodPost,
+			HTU:              htu,
+		}
+	}
+	sum := sha256.Sum256([]byte("access-token"))
+	ath := base64.RawURLEncoding.EncodeToString(sum[:])
+	withPrivate := map[string]any{}
+	for k, v := range key.jwk {
+		withPrivate[k] = v
+	}
+	withPrivate["d"] = "secret"
+
+	tests := []struct {
+		name        string
+		claims      func(c *dpopProofClaims)
+		header      map[string]any
+		accessToken string
+		wantErr     string
+	}{
+		{"typ が dpop+jwt ではない", nil, map[string]any{"typ": "JWT"}, "", "typ"},
+		{"jwk が無い", nil, map[string]any{"jwk": nil}, "", "jwk"},
+		{"jwk に秘密鍵が含まれる", nil, map[string]any{"jwk": withPrivate}, "", "秘密鍵"},
+		{"htm が違う", func(c *dpopProofClaims) { c.HTM = http.MethodGet }, nil, "", "htm"},
+		{"htu が違う", func(c *dpopProofClaims) { c.HTU = "https://as.example.com/userinfo" }, nil, "", "htu"},
+		{"htu のホストが違う", func(c *dpopProofClaims) { c.HTU = "https://evil.example.com/token" }, nil, "", "htu"},
+		{"iat が無い", func(c *dpopProofClaims) { c.IssuedAt = nil }, nil, "", "iat"},
+		{"iat が古すぎる", func(c *dpopProofClaims) { c.IssuedAt = jwt.NewNumericDate(now.Add(-2 * time.Minute)) }, nil, "", "iat"},
+		{"iat が未来すぎる", func(c *dpopProofClaims) { c.IssuedAt = jwt.NewNumericDate(now.Add(time.Minute)) }, nil, "", "iat"},
+		{"jti が無い", func(c *dpopProofClaims) { c.ID = "" }, nil, "", "jti"},
+		{"ath が無い", nil, nil, "access-token", "ath"},
+		{"ath が別のトークン", func(c *dpopProofClaims) { c.ATH = ath }, nil, "other-token", "ath"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := valid()
+			if tt.claims != nil {
+				tt.claims(&claims)
+			}
+			r := httptest.NewRequest(http.MethodPost, "/token", nil)
+			r.Header.Set("DPoP", key.proof(t, claims, tt.header))
+			_, err := checkDPoPProof(context.Background(), r, htu, tt.accessToken)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("checkDPoPProof() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+
+	t.Run("HS256 の証明", func(t *testing.T) {
+		token := jwt.NewWithClaims(jwt.SigningMethodHS256, valid())
+		token.Header["typ"] = dpopProofType
+		token.Header["jwk"] = key.jwk
+		s, err := token.SignedString([]byte("secret"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := httptest.NewRequest(http.MethodPost, "/token", nil)
+		r.Header.Set("DPoP", s)
+		if _, err := checkDPoPProof(context.Background(), r, htu, ""); err == nil {
+			t.Error("共通鍵で署名した証明を受け入れました")
+		}
+	})
+
+	t.Run("DPoP ヘッダが複数", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodPost, "/token", nil)
+		r.Header.Add("DPoP", key.proof(t, valid(), nil))
+		r.Header.Add("DPoP", key.proof(t, valid(), nil))
+		if _, err := checkDPoPProof(context.Background(), r, htu, ""); err == nil {
+			t.Error("複数の DPoP ヘッダを受け入れました")
+		}
+	})
+
+	t.Run("nonce が必須なのに無い", func(t *testing.T) {
+		t.Setenv("DPOP_REQUIRE_NONCE", "true")
+		r := httptest.NewRequest(http.MethodPost, "/token", nil)
+		r.Header.Set("DPoP", key.proof(t, valid(), nil))
+		if _, err := checkDPoPProof(context.Background(), r, htu, ""); !errors.Is(err, errUseDPoPNonce) {
+			t.Errorf("checkDPoPProof() error = %v, want errUseDPoPNonce", err)
+		}
+	})
+
+	t.Run("DPoP ヘッダが無い", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodPost, "/token", nil)
+		jkt, err := checkDPoPProof(context.Background(), r, htu, "")
+		if jkt != "" || err != nil {
+			t.Errorf("checkDPoPProof() = (%q, %v), want (\"\", nil)", jkt, err)
+		}
+	})
+}
+
+func TestDPoPHTUMatches(t *testing.T) {
+	const expected = "https://as.example.com/token"
+	tests := []struct {
+		htu  string
+		want bool
+	}{
+		{"https://as.example.com/token", true},
+		{"https://as.example.com/token?x=1", true},
+		{"https://as.example.com/token#frag", true},
+		{"HTTPS://AS.EXAMPLE.COM/token", true},
+		{"https://as.example.com/Token", false},
+		{"http://as.example.com/token", false},
+		{"https://as.example.com:8443/token", false},
+		{"https://as.example.com/token/", false},
+		{"%zz", false},
+	}
+	for _, tt := range tests {
+		if got := dpopHTUMatches(tt.htu, expected); got != tt.want {
+			t.Errorf("dpopHTUMatches(%q) = %v, want %v", tt.htu, got, tt.want)
+		}
+	}
+}
+
+func TestValidDPoPNonce(t *testing.T) {
+	nonce := newDPoPNonce()
+	b, _ := base64.RawURLEncoding.DecodeString(nonce)
+	tampered := append([]byte{}, b...)
+	tampered[len(tampered)-1] ^= 1
+
+	tests := []struct {
+		name  string
+		nonce string
+		want  bool
+	}{
+		{"発行した nonce", nonce, true},
+		{"空", "", false},
+		{"Base64URL ではない", "!!!", false},
+		{"長さが違う", base64.RawURLEncoding.EncodeToString(b[:10]), false},
+		{"HMAC を書き換えた", base64.RawURLEncoding.EncodeToString(tampered), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := validDPoPNonce(tt.nonce); got != tt.want {
+				t.Errorf("validDPoPNonce() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestJWKThumbprintMatchesPublicJWK(t *testing.T) {
+	// 署名鍵の JWK（publicJWK）と DPoP ヘッダの JWK のどちらから計算しても同じサムプリントになる
+	for _, alg := range []string{"RS256", "ES256", "ES384", "EdDSA"} {
+		k := newTestSigningKey(t, alg)
+		jwk, err := publicJWK(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		withMeta := jwk
+		withMeta.Kid, withMeta.Alg, withMeta.Use = "other", "", ""
+		a, err := jwkThumbprint(jwk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := jwkThumbprint(withMeta)
+		if a != b {
+			t.Errorf("%s: kid / alg / use でサムプリントが変わりました", alg)
+		}
+	}
+}
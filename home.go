@@ -170,13 +170,18 @@ func homeHandler(w http.ResponseWriter, r *http.Request) {
             <ul class="feature-list">
                 <li><strong>GET /authorize</strong> - OAuth2認可エンドポイント</li>
                 <li><strong>POST /token</strong> - OAuth2トークンエンドポイント（JWT発行）</li>
+                <li><strong>POST /revoke</strong> - トークン失効（RFC 7009）</li>
+                <li><strong>POST /introspect</strong> - トークンイントロスペクション（RFC 7662）</li>
                 <li><strong>GET /callback</strong> - OAuth2コールバック</li>
+                <li><strong>POST /device_authorization</strong> - デバイス認可（RFC 8628）</li>
+                <li><strong>GET|POST /device</strong> - デバイスのユーザーコード承認（要ログイン）</li>
                 <li><strong>GET|POST /login</strong> - ログイン</li>
                 <li><strong>GET|POST /signup</strong> - ユーザー登録</li>
                 <li><strong>GET /account</strong> - マイアカウント（要ログイン）</li>
                 <li><strong>GET /jwks</strong> - JWT署名検証用公開鍵</li>
                 <li><strong>GET /.well-known/jwks.json</strong> - JWKS（標準）</li>
                 <li><strong>GET /.well-known/openid_configuration</strong> - OpenID Connect Discovery</li>
+                <li><strong>GET|POST /userinfo</strong> - OIDC UserInfo（Bearer トークン必須）</li>
                 <li><strong>POST /tokeninfo</strong> - JWT トークン情報取得</li>
             </ul>
         </div>
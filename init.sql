@@ -4,10 +4,42 @@
 CREATE TABLE IF NOT EXISTS oauth_clients (
     id SERIAL PRIMARY KEY,
     client_id VARCHAR(255) UNIQUE NOT NULL,
-    client_secret VARCHAR(255) NOT NULL,
+    client_secret VARCHAR(255),            -- 平文。client_secret_jwt の HMAC 鍵と、ハッシュ化前のシードだけが持つ
+    previous_client_secret VARCHAR(255),   -- client_secret_jwt のローテーション前の平文。previous_client_secret_expires_at まで HMAC 鍵として使える
+    previous_client_secret_expires_at TIMESTAMP,
     name VARCHAR(255) NOT NULL,
     redirect_uris TEXT[],
-    scopes TEXT[],
+    scopes TEXT[],                         -- このクライアントが要求できるスコープ
+    default_scopes TEXT[],                 -- scope 省略時に付与するスコープ（scopes の部分集合）
+    -- トークンエンドポイントの認証方式: client_secret_basic / client_secret_post / none（公開クライアント、PKCE 必須）
+    token_endpoint_auth_method VARCHAR(32) NOT NULL DEFAULT 'client_secret_basic',
+    -- private_key_jwt 用の公開鍵。JWKS の JSON をそのまま保存するか、取得先の URL を登録する
+    jwks TEXT,
+    jwks_uri TEXT,
+    -- 有効期間（秒）。NULL ならサーバーの既定値（アクセス 1 時間、認可コード 10 分、リフレッシュ 30 日、絶対上限 90 日）。
+    -- アクセストークンは署名鍵の猶予期間に収まるよう 23 時間が上限（keyset.go の maxAccessTokenLifetime）
+    access_token_lifetime INTEGER,
+    authorization_code_lifetime INTEGER,
+    refresh_token_lifetime INTEGER,          -- リフレッシュトークン 1 つあたり
+    refresh_token_absolute_lifetime INTEGER, -- 最初の認可からの上限。ローテーションしても延びない
+    refresh_token_idle_timeout INTEGER,      -- 最後のリフレッシュからの無操作タイムアウト。NULL ならなし
+    refresh_token_rotation BOOLEAN NOT NULL DEFAULT TRUE, -- FALSE なら同じリフレッシュトークンを使い続ける
+    require_pkce BOOLEAN NOT NULL DEFAULT FALSE, -- 機密クライアントにも PKCE を必須にする（公開クライアントは常に必須）
+    application_type VARCHAR(10) NOT NULL DEFAULT 'web' CHECK (application_type IN ('web', 'native')), -- native はループバック IP とプライベートスキームを使える（RFC 8252）
+    require_pushed_authorization_requests BOOLEAN NOT NULL DEFAULT FALSE, -- TRUE なら /authorize は PAR の request_uri だけを受け付ける（RFC 9126）
+    -- リクエストオブジェクト（RFC 9101）: 署名アルゴリズムの指定（NULL なら対応する全方式）と、取得を許可する request_uri
+    request_object_signing_alg VARCHAR(10),
+    request_uris TEXT[],
+    dpop_bound_access_tokens BOOLEAN NOT NULL DEFAULT FALSE, -- TRUE ならトークン要求に DPoP 証明を必須にする（RFC 9449）
+    tls_client_certificate_bound_access_tokens BOOLEAN NOT NULL DEFAULT FALSE, -- TRUE ならトークン要求に mTLS のクライアント証明書を必須にする（RFC 8705）
+    -- tls_client_auth で照合する証明書の subject DN（RFC 2253 形式）か SAN。どれか 1 つだけを登録する
+    tls_client_auth_subject_dn TEXT,
+    tls_client_auth_san_dns TEXT,
+    tls_client_auth_san_uri TEXT,
+    tls_client_auth_san_ip TEXT,
+    tls_client_auth_san_email TEXT,
+    grant_types TEXT[],                    -- 使えるグラント。NULL なら制限なし（動的登録したクライアントは必ず持つ）
+    registration_access_token_hash VARCHAR(64), -- 動的登録（RFC 7591 / 7592）の管理用トークンの SHA-256。シードのクライアントは NULL で管理 API を使えない
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
     updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 );
@@ -25,7 +57,7 @@ CREATE TABLE IF NOT EXISTS users (
 -- 認可コードテーブル
 CREATE TABLE IF NOT EXISTS authorization_codes (
     id SERIAL PRIMARY KEY,
-    code VARCHAR(255) UNIQUE NOT NULL,
+    code_hash VARCHAR(64) UNIQUE NOT NULL,    -- 認可コードの SHA-256（16 進）。コードそのものは保存しない
     client_id VARCHAR(255) NOT NULL,
     user_id INTEGER NOT NULL,
     redirect_uri VARCHAR(255) NOT NULL,
@@ -36,6 +68,36 @@ CREATE TABLE IF NOT EXISTS authorization_codes (
     -- OpenID Connect サポート
     nonce VARCHAR(255),                    -- OIDC nonce parameter
     state VARCHAR(255),                    -- OAuth2 state parameter
+    auth_time TIMESTAMP,                   -- ID Token の auth_time（ログインしたセッションの作成時刻）
+    sid VARCHAR(64),                       -- ID Token の sid（セッション ID の SHA-256 ハッシュ）
+    expires_at TIMESTAMP NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (client_id) REFERENCES oauth_clients(client_id) ON DELETE CASCADE,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+-- PAR（RFC 9126 Pushed Authorization Requests）で受け取った認可パラメータ
+CREATE TABLE IF NOT EXISTS pushed_authorization_requests (
+    id SERIAL PRIMARY KEY,
+    request_uri_hash VARCHAR(64) UNIQUE NOT NULL,  -- request_uri の SHA-256（16 進）
+    client_id VARCHAR(255) NOT NULL,
+    parameters TEXT NOT NULL,                      -- 認可パラメータ（application/x-www-form-urlencoded）
+    expires_at TIMESTAMP NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (client_id) REFERENCES oauth_clients(client_id) ON DELETE CASCADE
+);
+
+-- デバイス認可コードテーブル（RFC 8628 Device Authorization Grant）
+CREATE TABLE IF NOT EXISTS device_codes (
+    id SERIAL PRIMARY KEY,
+    device_code_hash VARCHAR(64) UNIQUE NOT NULL,    -- デバイスがポーリングに使う秘密値の SHA-256（16 進）
+    user_code VARCHAR(16) UNIQUE NOT NULL,           -- ユーザーが /device で入力する短いコード（ハイフンなしで保存）
+    client_id VARCHAR(255) NOT NULL,
+    user_id INTEGER,                                 -- 承認したユーザー（承認前は NULL）
+    scopes TEXT[],
+    status VARCHAR(16) NOT NULL DEFAULT 'pending',   -- 'pending' | 'approved' | 'denied'
+    poll_interval INTEGER NOT NULL DEFAULT 5,        -- 秒。slow_down のたびに 5 秒延長
+    last_polled_at TIMESTAMP,
     expires_at TIMESTAMP NOT NULL,
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
     FOREIGN KEY (client_id) REFERENCES oauth_clients(client_id) ON DELETE CASCADE,
@@ -45,7 +107,7 @@ CREATE TABLE IF NOT EXISTS authorization_codes (
 -- アクセストークンテーブル
 CREATE TABLE IF NOT EXISTS access_tokens (
     id SERIAL PRIMARY KEY,
-    token TEXT UNIQUE NOT NULL,
+    jti VARCHAR(64) UNIQUE NOT NULL,       -- JWT の jti。JWT そのものは保存しない
     client_id VARCHAR(255) NOT NULL,
     user_id INTEGER,
     scopes TEXT[],
@@ -55,14 +117,95 @@ CREATE TABLE IF NOT EXISTS access_tokens (
     FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
 );
 
+-- リフレッシュトークンファミリー（1 回の認可から始まるローテーションの系列）。
+-- 使用済みのトークンが再提示されたら revoked_at を立て、ファミリーのトークンをすべて無効にする
+CREATE TABLE IF NOT EXISTS refresh_token_families (
+    id SERIAL PRIMARY KEY,
+    client_id VARCHAR(255) NOT NULL,
+    user_id INTEGER NOT NULL,
+    expires_at TIMESTAMP NOT NULL,         -- 絶対的な有効期限（最初の認可 + refresh_token_absolute_lifetime）。ローテーションしても延びない
+    idle_expires_at TIMESTAMP,             -- アイドルタイムアウト（使うたびに延長）。NULL ならなし
+    revoked_at TIMESTAMP,
+    dpop_jkt VARCHAR(64),                  -- 公開クライアントが DPoP で取得した場合の鍵のサムプリント。リフレッシュにも同じ鍵が必要
+    x5t_s256 VARCHAR(64),                  -- 公開クライアントが mTLS で取得した場合の証明書のサムプリント。リフレッシュにも同じ証明書が必要
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (client_id) REFERENCES oauth_clients(client_id) ON DELETE CASCADE,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
 -- リフレッシュトークンテーブル
 CREATE TABLE IF NOT EXISTS refresh_tokens (
     id SERIAL PRIMARY KEY,
-    token VARCHAR(255) UNIQUE NOT NULL,
-    access_token_id INTEGER NOT NULL,
+    token_hash VARCHAR(64) UNIQUE NOT NULL, -- リフレッシュトークンの SHA-256（16 進）
+    family_id INTEGER NOT NULL,
+    access_token_id INTEGER,               -- 使用済み（ローテーション済み）になると旧アクセストークンの削除で NULL
+    scopes TEXT[],                         -- 元の認可で付与されたスコープ
+    used_at TIMESTAMP,                     -- ローテーションで使用済みになった時刻。再提示されたら盗用とみなす
+    expires_at TIMESTAMP NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (family_id) REFERENCES refresh_token_families(id) ON DELETE CASCADE,
+    FOREIGN KEY (access_token_id) REFERENCES access_tokens(id) ON DELETE SET NULL
+);
+
+-- セキュリティイベント（リフレッシュトークンの再利用検知など）。監査用に削除しない
+CREATE TABLE IF NOT EXISTS security_events (
+    id SERIAL PRIMARY KEY,
+    event_type VARCHAR(64) NOT NULL,
+    client_id VARCHAR(255),
+    user_id INTEGER,
+    detail TEXT,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- ユーザー同意テーブル（クライアントごとに同意済みのスコープ）
+CREATE TABLE IF NOT EXISTS user_grants (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL,
+    client_id VARCHAR(255) NOT NULL,
+    scopes TEXT[],
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (user_id, client_id),
+    FOREIGN KEY (client_id) REFERENCES oauth_clients(client_id) ON DELETE CASCADE,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+-- クライアントシークレット（SHA-256 のハッシュ）。ローテーション中は新旧 2 つが有効で、古い方は expires_at まで使える
+CREATE TABLE IF NOT EXISTS client_secrets (
+    id SERIAL PRIMARY KEY,
+    client_id VARCHAR(255) NOT NULL,
+    secret_hash VARCHAR(64) NOT NULL,
+    expires_at TIMESTAMP,                  -- NULL は無期限（現在のシークレット）
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (client_id) REFERENCES oauth_clients(client_id) ON DELETE CASCADE
+);
+
+-- クライアントアサーション（private_key_jwt / client_secret_jwt）の使用済み jti。有効期限まで保持してリプレイを防ぐ
+CREATE TABLE IF NOT EXISTS client_assertion_jtis (
+    id SERIAL PRIMARY KEY,
+    client_id VARCHAR(255) NOT NULL,
+    jti VARCHAR(255) NOT NULL,
     expires_at TIMESTAMP NOT NULL,
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-    FOREIGN KEY (access_token_id) REFERENCES access_tokens(id) ON DELETE CASCADE
+    UNIQUE (client_id, jti),
+    FOREIGN KEY (client_id) REFERENCES oauth_clients(client_id) ON DELETE CASCADE
+);
+
+-- DPoP 証明（RFC 9449）の使用済み jti。鍵のサムプリントごとに有効期限まで保持してリプレイを防ぐ
+CREATE TABLE IF NOT EXISTS dpop_proof_jtis (
+    jkt VARCHAR(64) NOT NULL,
+    jti VARCHAR(255) NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    PRIMARY KEY (jkt, jti)
+);
+
+-- リクエストオブジェクト（RFC 9101）の使用済み jti。認可コードを発行した時点で記録し、有効期限まで保持してリプレイを防ぐ
+CREATE TABLE IF NOT EXISTS request_object_jtis (
+    client_id VARCHAR(255) NOT NULL,
+    jti VARCHAR(255) NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    PRIMARY KEY (client_id, jti),
+    FOREIGN KEY (client_id) REFERENCES oauth_clients(client_id) ON DELETE CASCADE
 );
 
 -- セッションテーブル
@@ -74,9 +217,115 @@ CREATE TABLE IF NOT EXISTS sessions (
     FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
 );
 
+-- 既存 DB 向けのカラム追加（make db-sync-demo-redirects で再適用しても冪等）
+ALTER TABLE oauth_clients ADD COLUMN IF NOT EXISTS default_scopes TEXT[];
+-- 既存クライアントはこれまでどおりフォームの client_secret で認証できるよう client_secret_post で埋め、既定値だけ basic にする
+ALTER TABLE oauth_clients ADD COLUMN IF NOT EXISTS token_endpoint_auth_method VARCHAR(32) NOT NULL DEFAULT 'client_secret_post';
+ALTER TABLE oauth_clients ALTER COLUMN token_endpoint_auth_method SET DEFAULT 'client_secret_basic';
+ALTER TABLE oauth_clients ADD COLUMN IF NOT EXISTS jwks TEXT;
+ALTER TABLE oauth_clients ADD COLUMN IF NOT EXISTS jwks_uri TEXT;
+ALTER TABLE oauth_clients ADD COLUMN IF NOT EXISTS access_token_lifetime INTEGER;
+ALTER TABLE oauth_clients ADD COLUMN IF NOT EXISTS authorization_code_lifetime INTEGER;
+ALTER TABLE oauth_clients ADD COLUMN IF NOT EXISTS refresh_token_lifetime INTEGER;
+ALTER TABLE oauth_clients ADD COLUMN IF NOT EXISTS refresh_token_absolute_lifetime INTEGER;
+ALTER TABLE oauth_clients ADD COLUMN IF NOT EXISTS refresh_token_idle_timeout INTEGER;
+ALTER TABLE oauth_clients ADD COLUMN IF NOT EXISTS refresh_token_rotation BOOLEAN NOT NULL DEFAULT TRUE;
+ALTER TABLE oauth_clients ADD COLUMN IF NOT EXISTS require_pkce BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE oauth_clients ADD COLUMN IF NOT EXISTS application_type VARCHAR(10) NOT NULL DEFAULT 'web';
+ALTER TABLE oauth_clients ADD COLUMN IF NOT EXISTS require_pushed_authorization_requests BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE oauth_clients ADD COLUMN IF NOT EXISTS request_object_signing_alg VARCHAR(10);
+ALTER TABLE oauth_clients ADD COLUMN IF NOT EXISTS request_uris TEXT[];
+ALTER TABLE oauth_clients ADD COLUMN IF NOT EXISTS dpop_bound_access_tokens BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE oauth_clients ADD COLUMN IF NOT EXISTS tls_client_certificate_bound_access_tokens BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE oauth_clients ADD COLUMN IF NOT EXISTS tls_client_auth_subject_dn TEXT;
+ALTER TABLE oauth_clients ADD COLUMN IF NOT EXISTS tls_client_auth_san_dns TEXT;
+ALTER TABLE oauth_clients ADD COLUMN IF NOT EXISTS tls_client_auth_san_uri TEXT;
+ALTER TABLE oauth_clients ADD COLUMN IF NOT EXISTS tls_client_auth_san_ip TEXT;
+ALTER TABLE oauth_clients ADD COLUMN IF NOT EXISTS tls_client_auth_san_email TEXT;
+ALTER TABLE oauth_clients ADD COLUMN IF NOT EXISTS grant_types TEXT[];
+ALTER TABLE oauth_clients ADD COLUMN IF NOT EXISTS registration_access_token_hash VARCHAR(64);
+-- 平文のシークレットは初回の認証成功時に client_secrets へ移して NULL にする
+ALTER TABLE oauth_clients ALTER COLUMN client_secret DROP NOT NULL;
+ALTER TABLE oauth_clients ADD COLUMN IF NOT EXISTS previous_client_secret VARCHAR(255);
+ALTER TABLE oauth_clients ADD COLUMN IF NOT EXISTS previous_client_secret_expires_at TIMESTAMP;
+ALTER TABLE refresh_tokens ADD COLUMN IF NOT EXISTS scopes TEXT[];
+ALTER TABLE authorization_codes ADD COLUMN IF NOT EXISTS auth_time TIMESTAMP;
+ALTER TABLE authorization_codes ADD COLUMN IF NOT EXISTS sid VARCHAR(64);
+
+-- ベアラー値を平文で保存していた既存の行を、ハッシュ（アクセストークンは jti）に置き換える
+DO $$
+BEGIN
+    IF EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'authorization_codes' AND column_name = 'code') THEN
+        ALTER TABLE authorization_codes RENAME COLUMN code TO code_hash;
+        UPDATE authorization_codes SET code_hash = encode(sha256(convert_to(code_hash, 'UTF8')), 'hex');
+        ALTER TABLE authorization_codes ALTER COLUMN code_hash TYPE VARCHAR(64);
+    END IF;
+
+    IF EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'device_codes' AND column_name = 'device_code') THEN
+        ALTER TABLE device_codes RENAME COLUMN device_code TO device_code_hash;
+        UPDATE device_codes SET device_code_hash = encode(sha256(convert_to(device_code_hash, 'UTF8')), 'hex');
+        ALTER TABLE device_codes ALTER COLUMN device_code_hash TYPE VARCHAR(64);
+    END IF;
+
+    IF EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'refresh_tokens' AND column_name = 'token') THEN
+        ALTER TABLE refresh_tokens RENAME COLUMN token TO token_hash;
+        UPDATE refresh_tokens SET token_hash = encode(sha256(convert_to(token_hash, 'UTF8')), 'hex');
+        ALTER TABLE refresh_tokens ALTER COLUMN token_hash TYPE VARCHAR(64);
+    END IF;
+
+    IF EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'access_tokens' AND column_name = 'token') THEN
+        -- JWT のペイロード（2 番目のセグメント、Base64URL）から jti を取り出す。JWT でない行は検証できないので消す
+        DELETE FROM access_tokens WHERE token NOT LIKE '%.%.%';
+        ALTER TABLE access_tokens RENAME COLUMN token TO jti;
+        UPDATE access_tokens SET jti = convert_from(decode(
+            rpad(translate(split_part(jti, '.', 2), '-_', '+/'), ((length(split_part(jti, '.', 2)) + 3) / 4) * 4, '='),
+            'base64'), 'UTF8')::json->>'jti';
+        ALTER TABLE access_tokens ALTER COLUMN jti TYPE VARCHAR(64);
+    END IF;
+END $$;
+
+-- 絶対的な有効期限・アイドルタイムアウト導入前のファミリーは、作成から既定の 90 日を上限にする
+ALTER TABLE refresh_token_families ADD COLUMN IF NOT EXISTS expires_at TIMESTAMP;
+ALTER TABLE refresh_token_families ADD COLUMN IF NOT EXISTS idle_expires_at TIMESTAMP;
+ALTER TABLE refresh_token_families ADD COLUMN IF NOT EXISTS dpop_jkt VARCHAR(64);
+ALTER TABLE refresh_token_families ADD COLUMN IF NOT EXISTS x5t_s256 VARCHAR(64);
+UPDATE refresh_token_families SET expires_at = created_at + INTERVAL '90 days' WHERE expires_at IS NULL;
+ALTER TABLE refresh_token_families ALTER COLUMN expires_at SET NOT NULL;
+
+-- リフレッシュトークンファミリー導入前の行: 使用済みの行を残せるよう FK を SET NULL に変え、1 行ずつファミリーを作る
+ALTER TABLE refresh_tokens ADD COLUMN IF NOT EXISTS family_id INTEGER REFERENCES refresh_token_families(id) ON DELETE CASCADE;
+ALTER TABLE refresh_tokens ADD COLUMN IF NOT EXISTS used_at TIMESTAMP;
+ALTER TABLE refresh_tokens ALTER COLUMN access_token_id DROP NOT NULL;
+ALTER TABLE refresh_tokens DROP CONSTRAINT IF EXISTS refresh_tokens_access_token_id_fkey;
+ALTER TABLE refresh_tokens ADD CONSTRAINT refresh_tokens_access_token_id_fkey
+    FOREIGN KEY (access_token_id) REFERENCES access_tokens(id) ON DELETE SET NULL;
+UPDATE refresh_tokens rt SET scopes = at.scopes
+FROM access_tokens at WHERE at.id = rt.access_token_id AND rt.scopes IS NULL;
+DO $$
+DECLARE
+    rec RECORD;
+    fid INTEGER;
+BEGIN
+    FOR rec IN
+        SELECT rt.id, at.client_id, at.user_id
+        FROM refresh_tokens rt
+        INNER JOIN access_tokens at ON at.id = rt.access_token_id
+        WHERE rt.family_id IS NULL AND at.user_id IS NOT NULL
+    LOOP
+        INSERT INTO refresh_token_families (client_id, user_id, expires_at)
+        VALUES (rec.client_id, rec.user_id, NOW() + INTERVAL '90 days') RETURNING id INTO fid;
+        UPDATE refresh_tokens SET family_id = fid WHERE id = rec.id;
+    END LOOP;
+END $$;
+DELETE FROM refresh_tokens WHERE family_id IS NULL;
+ALTER TABLE refresh_tokens ALTER COLUMN family_id SET NOT NULL;
+
 -- セッションテーブルのインデックス
 CREATE INDEX IF NOT EXISTS idx_sessions_user_id ON sessions(user_id);
 CREATE INDEX IF NOT EXISTS idx_sessions_expires_at ON sessions(expires_at);
+CREATE INDEX IF NOT EXISTS idx_client_secrets_client_id ON client_secrets(client_id);
+CREATE INDEX IF NOT EXISTS idx_refresh_tokens_family_id ON refresh_tokens(family_id);
+CREATE INDEX IF NOT EXISTS idx_refresh_tokens_access_token_id ON refresh_tokens(access_token_id);
 
 -- サンプルデータの挿入
 
@@ -88,27 +337,88 @@ INSERT INTO users (username, password_hash, email) VALUES
 ON CONFLICT (username) DO NOTHING;
 
 -- テストクライアントの挿入
-INSERT INTO oauth_clients (client_id, client_secret, name, redirect_uris, scopes) VALUES 
--- Webアプリケーション用クライアント
+INSERT INTO oauth_clients (client_id, client_secret, name, redirect_uris, scopes, default_scopes, token_endpoint_auth_method,
+                           access_token_lifetime, refresh_token_lifetime, refresh_token_absolute_lifetime, refresh_token_idle_timeout,
+                           require_pkce, application_type, require_pushed_authorization_requests,
+                           dpop_bound_access_tokens) VALUES 
+-- Webアプリケーション用クライアント（Next デモは PKCE を送るので機密クライアントでも必須にする）
 ('oauth2_demo_client', 'demo_client_secret_12345', 'OAuth2 Demo Application', 
  '{"http://localhost:3000/callback", "http://localhost:3000/auth/callback", "https://oauthdebugger.com/debug", "http://localhost:8080/callback"}',
- '{"read", "write", "openid", "profile", "email"}'),
+ '{"read", "write", "openid", "profile", "email"}',
+ '{"read"}',
+ 'client_secret_post',
+ NULL, NULL, NULL, NULL,
+ TRUE, 'web', FALSE, FALSE),
 
--- SPAアプリケーション用クライアント（PKCE必須）
-('spa_client_example', 'spa_secret_abcdef67890', 'Single Page Application', 
+-- SPAアプリケーション用クライアント（公開クライアント: client_secret なし、PKCE必須）
+-- ブラウザのストレージから漏れたトークンを使い回されないよう、DPoP を必須にする
+('spa_client_example', NULL, 'Single Page Application',
  '{"http://localhost:8080/callback", "http://127.0.0.1:8080/callback"}',
- '{"read", "profile"}'),
+ '{"read", "profile"}',
+ '{"read"}',
+ 'none',
+ NULL, NULL, NULL, NULL,
+ TRUE, 'web', FALSE, TRUE),
 
--- モバイルアプリ用クライアント
-('mobile_app_client', 'mobile_secret_xyz789012', 'Mobile Application', 
- '{"com.example.oauth://callback", "https://app.example.com/auth/callback"}',
- '{"read", "write", "push_notifications"}'),
+-- モバイルアプリ用クライアント（公開クライアント: client_secret なし、PKCE必須）
+-- 端末の紛失に備えて短命: アクセス 15 分、リフレッシュ 7 日（3 日使わなければ失効）、最初のログインから 30 日で再ログイン
+('mobile_app_client', NULL, 'Mobile Application',
+ '{"com.example.oauth:/callback", "https://app.example.com/auth/callback"}',
+ '{"read", "write", "push_notifications"}',
+ '{"read"}',
+ 'none',
+ 900, 604800, 2592000, 259200,
+ TRUE, 'native', FALSE, FALSE),
 
--- 管理者用クライアント
+-- デスクトップ CLI 用クライアント（公開クライアント、ネイティブアプリ）
+-- 起動のたびに空いているポートで待ち受けるため、ループバック IP はポートなしで登録する（任意のポートを許可）
+('desktop_cli_client', NULL, 'Desktop CLI',
+ '{"http://127.0.0.1/callback", "http://[::1]/callback"}',
+ '{"read", "openid", "profile"}',
+ '{"read"}',
+ 'none',
+ NULL, NULL, NULL, NULL,
+ TRUE, 'native', FALSE, FALSE),
+
+-- 管理者用クライアント（機密クライアントだが権限が強いため PKCE も必須。認可パラメータは PAR でだけ受け付ける）
 ('admin_console', 'admin_secret_super_secure_456', 'Admin Console', 
  '{"http://localhost:8081/admin/callback"}',
- '{"read", "write", "admin", "user_management"}')
+ '{"read", "write", "admin", "user_management"}',
+ '{"read"}',
+ 'client_secret_post',
+ NULL, NULL, NULL, NULL,
+ TRUE, 'web', TRUE, FALSE)
+-- token_endpoint_auth_method は再適用しても上書きしない（既存のクライアントの認証方式を勝手に変えると、その方式で送っているクライアントが認証できなくなる）
 ON CONFLICT (client_id) DO UPDATE SET
   redirect_uris = EXCLUDED.redirect_uris,
   scopes = EXCLUDED.scopes,
+  default_scopes = EXCLUDED.default_scopes,
+  access_token_lifetime = EXCLUDED.access_token_lifetime,
+  refresh_token_lifetime = EXCLUDED.refresh_token_lifetime,
+  refresh_token_absolute_lifetime = EXCLUDED.refresh_token_absolute_lifetime,
+  refresh_token_idle_timeout = EXCLUDED.refresh_token_idle_timeout,
+  require_pkce = EXCLUDED.require_pkce,
+  application_type = EXCLUDED.application_type,
+  require_pushed_authorization_requests = EXCLUDED.require_pushed_authorization_requests,
+  dpop_bound_access_tokens = EXCLUDED.dpop_bound_access_tokens,
+  updated_at = CURRENT_TIMESTAMP;
+
+-- サービス間通信用の mTLS クライアント（RFC 8705 tls_client_auth）。シークレットは持たず、
+-- make create-mtls-certs で作るクライアント証明書（CN=mtls_service_client）で認証し、トークンもその証明書に結びつける
+INSERT INTO oauth_clients (client_id, client_secret, name, redirect_uris, scopes, default_scopes, token_endpoint_auth_method,
+                           tls_client_auth_subject_dn, tls_client_certificate_bound_access_tokens) VALUES
+('mtls_service_client', NULL, 'mTLS Service', '{}', '{"read", "write"}', '{"read"}',
+ 'tls_client_auth', 'CN=mtls_service_client', TRUE)
+ON CONFLICT (client_id) DO UPDATE SET
+  scopes = EXCLUDED.scopes,
+  default_scopes = EXCLUDED.default_scopes,
+  tls_client_auth_subject_dn = EXCLUDED.tls_client_auth_subject_dn,
+  tls_client_certificate_bound_access_tokens = EXCLUDED.tls_client_certificate_bound_access_tokens,
   updated_at = CURRENT_TIMESTAMP;
+
+-- 公開クライアント（token_endpoint_auth_method = 'none'）はシークレットを持たない。
+-- 以前のシードで入っていた平文と、ハッシュに移したシークレットを消す（ON CONFLICT では client_secret を更新しないため）
+UPDATE oauth_clients SET client_secret = NULL, updated_at = CURRENT_TIMESTAMP
+WHERE token_endpoint_auth_method = 'none' AND client_secret IS NOT NULL;
+DELETE FROM client_secrets
+WHERE client_id IN (SELECT client_id FROM oauth_clients WHERE token_endpoint_auth_method = 'none');
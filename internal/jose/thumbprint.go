@@ -0,0 +1,37 @@
+// Package jose は認可サーバーとリソースサーバー（backend）で共通の JOSE の処理。
+// DPoP の cnf.jkt は両方で同じ値を計算できなければならないため、ここにまとめる。
+package jose
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+)
+
+// JWKMembers はサムプリントに使う JWK の必須メンバー（RFC 7638 3.2）。値は JWK のまま（Base64URL）渡す。
+type JWKMembers struct {
+	Kty string
+	Crv string // EC / OKP
+	X   string // EC / OKP
+	Y   string // EC
+	N   string // RSA
+	E   string // RSA
+}
+
+// JWKThumbprint は JWK の SHA-256 サムプリント（RFC 7638）を BASE64URL で返す。
+// 必須メンバーだけを辞書順に並べた JSON をハッシュする。
+func JWKThumbprint(k JWKMembers) (string, error) {
+	var members string
+	switch k.Kty {
+	case "RSA":
+		members = fmt.Sprintf(`{"e":%q,"kty":"RSA","n":%q}`, k.E, k.N)
+	case "EC":
+		members = fmt.Sprintf(`{"crv":%q,"kty":"EC","x":%q,"y":%q}`, k.Crv, k.X, k.Y)
+	case "OKP":
+		members = fmt.Sprintf(`{"crv":%q,"kty":"OKP","x":%q}`, k.Crv, k.X)
+	default:
+		return "", fmt.Errorf("未対応の kty です: %s", k.Kty)
+	}
+	sum := sha256.Sum256([]byte(members))
+	return base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
@@ -0,0 +1,55 @@
+package jose
+
+import "testing"
+
+func TestJWKThumbprint(t *testing.T) {
+	tests := []struct {
+		name    string
+		key     JWKMembers
+		want    string
+		wantErr bool
+	}{
+		{
+			// RFC 7638 3.1 の例
+			name: "RSA",
+			key: JWKMembers{
+				Kty: "RSA",
+				N:   "0vx7agoebGcQSuuPiLJXZptN9nndrQmbXEps2aiAFbWhM78LhWx4cbbfAAtVT86zwu1RK7aPFFxuhDR1L6tSoc_BJECPebWKRXjBZCiFV4n3oknjhMstn64tZ_2W-5JsGY4Hc5n9yBXArwl93lqt7_RN5w6Cf0h4QyQ5v-65YGjQR0_FDW2QvzqY368QQMicAtaSqzs8KJZgnYb9c7d0zgdAZHzu6qMQvRL5hajrn1n91CbOpbISD08qNLyrdkt-bFTWhAI4vMQFh6WeZu0fM4lFd2NcRwr3XPksINHaQ-G_xBniIqbw0Ls1jF44-csFCur-kEgU8awapJzKnqDKgw",
+				E:   "AQAB",
+			},
+			want: "NzbLsXh8uDCcd-6MNwXF4W_7noWXFZAfHkxZsRGC9Xs",
+		},
+		{
+			// RFC 8037 A.3 の例
+			name: "OKP",
+			key:  JWKMembers{Kty: "OKP", Crv: "Ed25519", X: "11qYAYKxCrfVS_7TyWQHOg7hcvPapiMlrwIaaPcHURo"},
+			want: "kPrK_qmxVWaYVA9wwBF6Iuo3vVzz7TxHCTwXBygrS4k",
+		},
+		{
+			name:    "未対応の kty",
+			key:     JWKMembers{Kty: "oct"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := JWKThumbprint(tt.key)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("JWKThumbprint() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("JWKThumbprint() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	// サムプリントに使わないメンバーは結果に影響しない（EC の鍵に n / e を入れても同じ）
+	ec := JWKMembers{Kty: "EC", Crv: "P-256", X: "x", Y: "y"}
+	withExtra := ec
+	withExtra.N, withExtra.E = "n", "e"
+	a, _ := JWKThumbprint(ec)
+	b, _ := JWKThumbprint(withExtra)
+	if a != b {
+		t.Error("必須メンバー以外でサムプリントが変わりました")
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// introspectionResponse は RFC 7662 2.2 のイントロスペクションレスポンス。
+// 非アクティブなトークンでは active=false 以外のフィールドを返さない。
+type introspectionResponse struct {
+	Active    bool     `json:"active"`
+	Scope     string   `json:"scope,omitempty"`
+	ClientID  string   `json:"client_id,omitempty"`
+	Username  string   `json:"username,omitempty"`
+	TokenType string   `json:"token_type,omitempty"`
+	Exp       int64    `json:"exp,omitempty"`
+	Iat       int64    `json:"iat,omitempty"`
+	Nbf       int64    `json:"nbf,omitempty"`
+	Sub       string   `json:"sub,omitempty"`
+	Aud       []string `json:"aud,omitempty"`
+	Iss       string   `json:"iss,omitempty"`
+	Jti       string   `json:"jti,omitempty"`
+	// Cnf は送信者制約付きトークンの cnf（DPoP の jkt、RFC 9449 6.2 / mTLS の x5t#S256、RFC 8705 3.2）
+	Cnf *tokenConfirmation `json:"cnf,omitempty"`
+}
+
+// トークンイントロスペクションエンドポイント（POST /introspect、RFC 7662）。
+// JWT 署名だけでなく access_tokens / refresh_tokens の行を確認するため、失効・ローテーション済みのトークンは active=false になる。
+// 認証済みクライアントであれば、他クライアントに発行されたトークンも問い合わせられる（リソースサーバーからの利用を想定）。
+func introspectHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	logger := slog.Default()
+
+	if err := r.ParseForm(); err != nil {
+		writeOAuthError(w, errInvalidRequest("invalid form data"))
+		return
+	}
+
+	client, err := authenticateClient(ctx, r)
+	if err != nil {
+		logger.Warn("クライアント認証に失敗しました", "client_id", r.FormValue("client_id"), "error", err.Error())
+		writeOAuthError(w, errInvalidClient("client authentication failed"))
+		return
+	}
+
+	// 公開クライアントは client_id だけで認証できてしまうため、任意のトークンの中身を問い合わせさせない
+	if client.IsPublic() {
+		writeOAuthError(w, errUnauthorizedClient("public clients cannot use the introspection endpoint"))
+		return
+	}
+
+	token := r.FormValue("token")
+	if token == "" {
+		writeOAuthError(w, errInvalidRequest("token is required"))
+		return
+	}
+
+	// token_type_hint は探索順のヒント。外れたらもう一方も探す（RFC 7662 2.1）
+	lookups := []func(context.Context, string) *introspectionResponse{
+		introspectAccessToken,
+		introspectRefreshToken,
+	}
+	if r.FormValue("token_type_hint") == "refresh_token" {
+		lookups[0], lookups[1] = lookups[1], lookups[0]
+	}
+
+	resp := &introspectionResponse{Active: false}
+	for _, lookup := range lookups {
+		if found := lookup(ctx, token); found != nil {
+			resp = found
+			break
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Pragma", "no-cache")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		logger.Error("イントロスペクションレスポンスのエンコードに失敗しました", "error", err.Error())
+		return
+	}
+
+	logger.Info("トークンイントロスペクションを処理しました",
+		"client_id", client.ClientID,
+		"active", resp.Active,
+		"token_type", resp.TokenType)
+}
+
+// introspectAccessToken は JWT 署名と access_tokens 行の両方が有効なときだけレスポンスを返す。
+func introspectAccessToken(ctx context.Context, token string) *introspectionResponse {
+	claims, err := validateJWTToken(token)
+	if err != nil {
+		return nil
+	}
+	row, err := repository.GetAccessTokenByToken(ctx, token)
+	if err != nil {
+		return nil
+	}
+
+	resp := &introspectionResponse{
+		Active:    true,
+		Scope:     strings.Join(row.Scopes, " "),
+		ClientID:  row.ClientID,
+		Username:  claims.Username,
+		TokenType: accessTokenType(claims.Confirmation),
+		Exp:       row.ExpiresAt.Unix(),
+		Sub:       claims.Subject,
+		Aud:       claims.Audience,
+		Iss:       claims.Issuer,
+		Jti:       claims.ID,
+		Cnf:       claims.Confirmation,
+	}
+	if claims.IssuedAt != nil {
+		resp.Iat = claims.IssuedAt.Unix()
+	}
+	if claims.NotBefore != nil {
+		resp.Nbf = claims.NotBefore.Unix()
+	}
+	return resp
+}
+
+// introspectRefreshToken は使用可能な（未使用・期限内・ファミリーが有効な）refresh_tokens 行があればレスポンスを返す。
+func introspectRefreshToken(ctx context.Context, token string) *introspectionResponse {
+	rt, err := repository.GetRefreshTokenByToken(ctx, token)
+	if err != nil {
+		return nil
+	}
+
+	resp := &introspectionResponse{
+		Active:    true,
+		Scope:     strings.Join(rt.Scopes, " "),
+		ClientID:  rt.ClientID,
+		TokenType: "refresh_token",
+		Exp:       rt.ExpiresAt.Unix(),
+		Iat:       rt.CreatedAt.Unix(),
+		Sub:       strconv.Itoa(rt.UserID),
+		Aud:       []string{rt.ClientID},
+		Iss:       serverBaseURL(),
+	}
+	if user, err := repository.GetUserByID(ctx, rt.UserID); err == nil {
+		resp.Username = user.Username
+	}
+	return resp
+}
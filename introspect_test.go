@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestIntrospectHandlerRequiresClientAuthentication(t *testing.T) {
+	rec := httptest.NewRecorder()
+	introspectHandler(rec, newFormRequest("/introspect", url.Values{"token": {"t"}}))
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("status = %d, want 401", rec.Code)
+	}
+	if code := oauthErrorCode(t, rec); code != "invalid_client" {
+		t.Errorf("error = %q, want invalid_client", code)
+	}
+}
+
+func TestIntrospectAccessTokenRejectsInvalidJWT(t *testing.T) {
+	// 署名・発行者・有効期限のどれかが不正な JWT は、access_tokens を引く前に非アクティブとする
+	t.Setenv("SERVER_BASE_URL", "https://as.example.com")
+	key := useTestSigningKey(t, "ES256")
+	other := newTestSigningKey(t, "ES256")
+
+	claims := func(set func(c *CustomClaims)) CustomClaims {
+		c := CustomClaims{RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    "https://as.example.com",
+			Subject:   "1",
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute)),
+		}}
+		if set != nil {
+			set(&c)
+		}
+		return c
+	}
+	sign := func(k *signingKey, c CustomClaims) string {
+		s, err := signJWTWithKey(k, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{"JWT ではない", "opaque-token"},
+		{"別の鍵で署名", sign(other, claims(nil))},
+		{"発行者が違う", sign(key, claims(func(c *CustomClaims) { c.Issuer = "https://evil.example.com" }))},
+		{"有効期限切れ", sign(key, claims(func(c *CustomClaims) { c.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-time.Minute)) }))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if resp := introspectAccessToken(context.Background(), tt.token); resp != nil {
+				t.Errorf("introspectAccessToken() = %+v, want nil", resp)
+			}
+		})
+	}
+}
+
+func TestInactiveIntrospectionResponse(t *testing.T) {
+	// 非アクティブなトークンについては active 以外を返さない（RFC 7662 2.2）
+	b, err := json.Marshal(&introspectionResponse{Active: false})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != `{"active":false}` {
+		t.Errorf("json = %s", b)
+	}
+}
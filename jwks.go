@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"log/slog"
 	"net/http"
@@ -18,8 +19,8 @@ func jwksHandler(w http.ResponseWriter, r *http.Request) {
 
 	// レスポンスヘッダーを設定
 	w.Header().Set("Content-Type", "application/json")
-	w.Header().Set("Cache-Control", "public, max-age=3600") // 1時間キャッシュ
-	w.Header().Set("Access-Control-Allow-Origin", "*")      // CORS対応
+	w.Header().Set("Cache-Control", jwksCacheControl())
+	w.Header().Set("Access-Control-Allow-Origin", "*") // CORS対応
 
 	// JWKSレスポンスを返す
 	w.WriteHeader(http.StatusOK)
@@ -30,6 +31,11 @@ func jwksHandler(w http.ResponseWriter, r *http.Request) {
 		"userAgent", r.UserAgent())
 }
 
+// jwksCacheControl は JWKS の Cache-Control。署名鍵の猶予期間（maxAccessTokenLifetime）の計算と同じ値を使う
+func jwksCacheControl() string {
+	return fmt.Sprintf("public, max-age=%d", int(jwksCacheMaxAge.Seconds()))
+}
+
 // /.well-known/jwksエンドポイントハンドラー（OpenID Connect Discovery用）
 func wellKnownJwksHandler(w http.ResponseWriter, r *http.Request) {
 	// JWKS JSONを生成
@@ -42,8 +48,8 @@ func wellKnownJwksHandler(w http.ResponseWriter, r *http.Request) {
 
 	// レスポンスヘッダーを設定
 	w.Header().Set("Content-Type", "application/json")
-	w.Header().Set("Cache-Control", "public, max-age=3600") // 1時間キャッシュ
-	w.Header().Set("Access-Control-Allow-Origin", "*")      // CORS対応
+	w.Header().Set("Cache-Control", jwksCacheControl())
+	w.Header().Set("Access-Control-Allow-Origin", "*") // CORS対応
 
 	// JWKSレスポンスを返す
 	w.WriteHeader(http.StatusOK)
@@ -57,15 +63,21 @@ func wellKnownJwksHandler(w http.ResponseWriter, r *http.Request) {
 // OpenID Connect Discovery エンドポイント
 func wellKnownOpenidConfigurationHandler(w http.ResponseWriter, r *http.Request) {
 	// サーバーのベースURL（環境変数またはデフォルト）
-	baseURL := "http://localhost:8080"
+	baseURL := serverBaseURL()
 
 	// OpenID Connect Discovery レスポンス
 	discoveryResponse := fmt.Sprintf(`{
   "issuer": "%s",
   "authorization_endpoint": "%s/authorize",
   "token_endpoint": "%s/token",
+  "revocation_endpoint": "%s/revoke",
+  "introspection_endpoint": "%s/introspect",
   "jwks_uri": "%s/jwks",
   "userinfo_endpoint": "%s/userinfo",
+  "device_authorization_endpoint": "%s/device_authorization",
+  "pushed_authorization_request_endpoint": "%s/par",
+  "registration_endpoint": "%s/register",
+  "require_pushed_authorization_requests": false,
   "response_types_supported": [
     "code",
     "code id_token"
@@ -73,16 +85,8 @@ func wellKnownOpenidConfigurationHandler(w http.ResponseWriter, r *http.Request)
   "subject_types_supported": [
     "public"
   ],
-  "id_token_signing_alg_values_supported": [
-    "RS256"
-  ],
-  "scopes_supported": [
-    "openid",
-    "profile",
-    "email",
-    "read",
-    "write"
-  ],
+  "id_token_signing_alg_values_supported": %s,
+  "scopes_supported": %s,
   "claims_supported": [
     "sub",
     "iss",
@@ -91,17 +95,37 @@ func wellKnownOpenidConfigurationHandler(w http.ResponseWriter, r *http.Request)
     "iat",
     "username",
     "scope",
-    "client_id"
+    "client_id",
+    "nonce",
+    "auth_time",
+    "at_hash",
+    "azp",
+    "sid",
+    "email",
+    "preferred_username",
+    "updated_at"
   ],
+  "token_endpoint_auth_methods_supported": %s,
+  "revocation_endpoint_auth_methods_supported": %s,
+  "introspection_endpoint_auth_methods_supported": %s,
+  "token_endpoint_auth_signing_alg_values_supported": %s,
   "grant_types_supported": [
     "authorization_code",
-    "refresh_token"
+    "refresh_token",
+    "client_credentials",
+    "urn:ietf:params:oauth:grant-type:device_code"
   ],
-  "code_challenge_methods_supported": [
-    "S256",
-    "plain"
-  ]
-}`, baseURL, baseURL, baseURL, baseURL, baseURL)
+  "code_challenge_methods_supported": %s,
+  "request_parameter_supported": true,
+  "request_uri_parameter_supported": true,
+  "require_request_uri_registration": true,
+  "request_object_signing_alg_values_supported": %s,
+  "dpop_signing_alg_values_supported": %s,
+  "tls_client_certificate_bound_access_tokens": %t%s
+}`, baseURL, baseURL, baseURL, baseURL, baseURL, baseURL, baseURL, baseURL, baseURL, baseURL, signingAlgValuesJSON(), scopesSupportedJSON(),
+		tokenEndpointAuthMethodsJSON(), tokenEndpointAuthMethodsJSON(), introspectionAuthMethodsJSON(),
+		clientAssertionAlgsJSON(), pkceMethodsJSON(), requestObjectAlgsJSON(), dpopSigningAlgsJSON(),
+		mtlsEnabled(), mtlsDiscoveryJSON())
 
 	// レスポンスヘッダーを設定
 	w.Header().Set("Content-Type", "application/json")
@@ -116,7 +140,73 @@ func wellKnownOpenidConfigurationHandler(w http.ResponseWriter, r *http.Request)
 		"userAgent", r.UserAgent())
 }
 
-// JWT トークン情報エンドポイント（デバッグ用）
+// signingAlgValuesJSON は id_token_signing_alg_values_supported の値。
+// 猶予期間中の退役済みの鍵も含め、JWKS に載っている鍵のアルゴリズムを返す。
+func signingAlgValuesJSON() string {
+	algs := []string{defaultSigningAlg}
+	if ks := jwtKeys.Load(); ks != nil {
+		algs = ks.algorithms()
+	}
+	b, _ := json.Marshal(algs)
+	return string(b)
+}
+
+// scopesSupportedJSON は scopes_supported の値（動的登録で要求できるスコープと同じ）。
+func scopesSupportedJSON() string {
+	b, _ := json.Marshal(supportedScopes)
+	return string(b)
+}
+
+// tokenEndpointAuthMethodsJSON は /token・/revoke で受け付けるクライアント認証方式（mTLS が無効なら証明書の方式は除く）。
+func tokenEndpointAuthMethodsJSON() string {
+	methods := []string{}
+	for _, m := range supportedTokenEndpointAuthMethods {
+		if mtlsEnabled() || !isTLSClientAuthMethod(m) {
+			methods = append(methods, m)
+		}
+	}
+	b, _ := json.Marshal(methods)
+	return string(b)
+}
+
+// introspectionAuthMethodsJSON は /introspect で受け付ける方式（公開クライアントの none は除く）。
+func introspectionAuthMethodsJSON() string {
+	methods := []string{}
+	for _, m := range supportedTokenEndpointAuthMethods {
+		if m != authMethodNone && (mtlsEnabled() || !isTLSClientAuthMethod(m)) {
+			methods = append(methods, m)
+		}
+	}
+	b, _ := json.Marshal(methods)
+	return string(b)
+}
+
+// clientAssertionAlgsJSON は private_key_jwt / client_secret_jwt で受け付ける署名アルゴリズム。
+func clientAssertionAlgsJSON() string {
+	b, _ := json.Marshal(append(append([]string{}, privateKeyJWTAlgs...), clientSecretJWTAlgs...))
+	return string(b)
+}
+
+// pkceMethodsJSON は code_challenge_methods_supported の値（PKCE_ALLOW_PLAIN=true のときだけ plain を含む）。
+func pkceMethodsJSON() string {
+	b, _ := json.Marshal(supportedPKCEMethods())
+	return string(b)
+}
+
+// requestObjectAlgsJSON はリクエストオブジェクト（RFC 9101）で受け付ける署名アルゴリズム。
+func requestObjectAlgsJSON() string {
+	b, _ := json.Marshal(supportedRequestObjectAlgs())
+	return string(b)
+}
+
+// dpopSigningAlgsJSON は DPoP 証明（RFC 9449）で受け付ける署名アルゴリズム。
+func dpopSigningAlgsJSON() string {
+	b, _ := json.Marshal(dpopSigningAlgs)
+	return string(b)
+}
+
+// JWT トークン情報エンドポイント（デバッグ用）。
+// 署名しか見ないため失効済みトークンも active になる。リソースサーバーからの確認には POST /introspect を使う。
 func tokenInfoHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
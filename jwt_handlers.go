@@ -7,7 +7,7 @@ import (
 )
 
 func testJWTHandler(w http.ResponseWriter, r *http.Request) {
-	token, err := generateJWTAccessToken(1, "testuser", "test-client", "openid profile", time.Hour)
+	token, err := generateJWTAccessToken(1, "testuser", "test-client", "openid profile", time.Hour, nil)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
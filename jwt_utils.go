@@ -1,155 +1,121 @@
 package main
 
 import (
-	"crypto/rand"
+	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
 	"crypto/x509"
 	"encoding/base64"
 	"encoding/json"
-	"encoding/pem"
 	"fmt"
 	"log/slog"
 	"math/big"
-	"os"
-	"path/filepath"
+	"slices"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 )
 
-// JWT関連の設定
-var (
-	privateKey *rsa.PrivateKey
-	publicKey  *rsa.PublicKey
-	keyID      = "oauth2-server-key-1" // JWKSで使用するkey ID
-)
-
 // JWTクレーム構造体
 type CustomClaims struct {
 	jwt.RegisteredClaims
-	Scope    string `json:"scope,omitempty"`
-	ClientID string `json:"client_id,omitempty"`
-	Username string `json:"username,omitempty"`
-}
-
-// JWKSレスポンス用の構造体
-type JWKSResponse struct {
-	Keys []JWK `json:"keys"`
+	Scope        string             `json:"scope,omitempty"`
+	ClientID     string             `json:"client_id,omitempty"`
+	Username     string             `json:"username,omitempty"`
+	Confirmation *tokenConfirmation `json:"cnf,omitempty"`
 }
 
-type JWK struct {
-	Kty string `json:"kty"` // Key Type (RSA)
-	Use string `json:"use"` // Public Key Use (sig)
-	Kid string `json:"kid"` // Key ID
-	Alg string `json:"alg"` // Algorithm (RS256)
-	N   string `json:"n"`   // Modulus
-	E   string `json:"e"`   // Exponent
+// tokenConfirmation はアクセストークンを送信者の鍵に結びつける cnf クレーム（RFC 7800）
+type tokenConfirmation struct {
+	JKT     string `json:"jkt,omitempty"`      // DPoP 公開鍵の JWK SHA-256 サムプリント（RFC 9449 6.1）
+	X5TS256 string `json:"x5t#S256,omitempty"` // mTLS クライアント証明書の SHA-256 サムプリント（RFC 8705 3.1）
 }
 
-// RSA鍵ペアの初期化
-func initJWTKeys() error {
-	privateKeyPath := filepath.Join("certificate", "jwt_private.pem")
-	publicKeyPath := filepath.Join("certificate", "jwt_public.pem")
-
-	// 鍵ファイルが存在するかチェック
-	if _, err := os.Stat(privateKeyPath); os.IsNotExist(err) {
-		slog.Info("RSA鍵ペアが存在しません。新しく生成します...")
-		if err := generateRSAKeys(privateKeyPath, publicKeyPath); err != nil {
-			return fmt.Errorf("RSA鍵ペア生成エラー: %v", err)
-		}
-	}
-
-	// 秘密鍵を読み込み
-	privateKeyData, err := os.ReadFile(privateKeyPath)
-	if err != nil {
-		return fmt.Errorf("秘密鍵ファイル読み込みエラー: %v", err)
-	}
-
-	privateKeyBlock, _ := pem.Decode(privateKeyData)
-	if privateKeyBlock == nil {
-		return fmt.Errorf("無効な秘密鍵形式")
+// newTokenConfirmation は DPoP の鍵・クライアント証明書から cnf クレームを作る（どちらも無ければ nil）。
+func newTokenConfirmation(jkt string, cert *x509.Certificate) *tokenConfirmation {
+	if jkt == "" && cert == nil {
+		return nil
 	}
-
-	privateKey, err = x509.ParsePKCS1PrivateKey(privateKeyBlock.Bytes)
-	if err != nil {
-		return fmt.Errorf("秘密鍵パースエラー: %v", err)
+	cnf := &tokenConfirmation{JKT: jkt}
+	if cert != nil {
+		cnf.X5TS256 = certificateThumbprint(cert)
 	}
+	return cnf
+}
 
-	// 公開鍵を秘密鍵から取得
-	publicKey = &privateKey.PublicKey
-
-	slog.Info("RSA鍵ペアが正常に読み込まれました", "keyID", keyID)
-	return nil
+// OpenID Connect ID Token のクレーム構造体（OIDC Core 2, 5.1）
+type IDTokenClaims struct {
+	jwt.RegisteredClaims
+	Nonce             string           `json:"nonce,omitempty"`
+	AuthTime          *jwt.NumericDate `json:"auth_time,omitempty"`
+	AccessTokenHash   string           `json:"at_hash,omitempty"`
+	AuthorizedParty   string           `json:"azp,omitempty"`
+	SessionID         string           `json:"sid,omitempty"`
+	Email             string           `json:"email,omitempty"`
+	PreferredUsername string           `json:"preferred_username,omitempty"`
 }
 
-// RSA鍵ペアを生成
-func generateRSAKeys(privateKeyPath, publicKeyPath string) error {
-	// certificateディレクトリを作成
-	if err := os.MkdirAll("certificate", 0755); err != nil {
-		return fmt.Errorf("certificateディレクトリ作成エラー: %v", err)
-	}
+// JWKSレスポンス用の構造体
+type JWKSResponse struct {
+	Keys []JWK `json:"keys"`
+}
 
-	// 2048ビットのRSA鍵ペアを生成
-	key, err := rsa.GenerateKey(rand.Reader, 2048)
-	if err != nil {
-		return fmt.Errorf("RSA鍵生成エラー: %v", err)
-	}
+// JWK は RFC 7517 / 8037 の公開鍵。kty によって使うフィールドが異なる
+type JWK struct {
+	Kty string `json:"kty"`           // Key Type (RSA / EC / OKP)
+	Use string `json:"use"`           // Public Key Use (sig)
+	Kid string `json:"kid"`           // Key ID
+	Alg string `json:"alg"`           // Algorithm (RS256 / ES256 / ES384 / EdDSA)
+	N   string `json:"n,omitempty"`   // RSA: Modulus
+	E   string `json:"e,omitempty"`   // RSA: Exponent
+	Crv string `json:"crv,omitempty"` // EC / OKP: Curve (P-256 / P-384 / Ed25519)
+	X   string `json:"x,omitempty"`   // EC: X 座標、OKP: 公開鍵そのもの
+	Y   string `json:"y,omitempty"`   // EC: Y 座標
+}
 
-	// 秘密鍵をPEM形式で保存
-	privateKeyBytes := x509.MarshalPKCS1PrivateKey(key)
-	privateKeyPEM := &pem.Block{
-		Type:  "RSA PRIVATE KEY",
-		Bytes: privateKeyBytes,
+// activeSigningKey は現在の署名鍵を返す。
+func activeSigningKey() (*signingKey, error) {
+	ks := jwtKeys.Load()
+	if ks == nil {
+		return nil, fmt.Errorf("署名鍵が初期化されていません")
 	}
+	return ks.active, nil
+}
 
-	privateKeyFile, err := os.Create(privateKeyPath)
+// signJWT は現在の署名鍵（active）で署名し、ヘッダーに kid を付ける。
+func signJWT(claims jwt.Claims) (string, error) {
+	key, err := activeSigningKey()
 	if err != nil {
-		return fmt.Errorf("秘密鍵ファイル作成エラー: %v", err)
+		return "", err
 	}
-	defer privateKeyFile.Close()
+	return signJWTWithKey(key, claims)
+}
 
-	if err := pem.Encode(privateKeyFile, privateKeyPEM); err != nil {
-		return fmt.Errorf("秘密鍵PEMエンコードエラー: %v", err)
-	}
+// signJWTWithKey は鍵のアルゴリズム（RS256 / ES256 / ES384 / EdDSA）で署名する。
+// 署名そのものは Signer に任せるため、秘密鍵がプロセス外（署名デーモン）にあっても同じ経路で発行できる。
+func signJWTWithKey(key *signingKey, claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(key.Method, claims)
+	token.Header["kid"] = key.ID
 
-	// 公開鍵をPEM形式で保存
-	publicKeyBytes, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	signingInput, err := token.SigningString()
 	if err != nil {
-		return fmt.Errorf("公開鍵マーシャルエラー: %v", err)
+		return "", err
 	}
-
-	publicKeyPEM := &pem.Block{
-		Type:  "PUBLIC KEY",
-		Bytes: publicKeyBytes,
-	}
-
-	publicKeyFile, err := os.Create(publicKeyPath)
+	sig, err := key.Signer.SignJWS(signingInput)
 	if err != nil {
-		return fmt.Errorf("公開鍵ファイル作成エラー: %v", err)
+		return "", err
 	}
-	defer publicKeyFile.Close()
-
-	if err := pem.Encode(publicKeyFile, publicKeyPEM); err != nil {
-		return fmt.Errorf("公開鍵PEMエンコードエラー: %v", err)
-	}
-
-	slog.Info("RSA鍵ペアが生成されました",
-		"privateKey", privateKeyPath,
-		"publicKey", publicKeyPath)
-
-	return nil
+	return signingInput + "." + token.EncodeSegment(sig), nil
 }
 
-// JWTアクセストークンを生成
-func generateJWTAccessToken(userID int, username, clientID, scope string, expiresIn time.Duration) (string, error) {
-	if privateKey == nil {
-		return "", fmt.Errorf("RSA秘密鍵が初期化されていません")
-	}
-
+// JWTアクセストークンを生成。cnf を渡すと送信者制約付き（DPoP 等）のトークンになる
+func generateJWTAccessToken(userID int, username, clientID, scope string, expiresIn time.Duration, cnf *tokenConfirmation) (string, error) {
 	now := time.Now()
 	claims := CustomClaims{
 		RegisteredClaims: jwt.RegisteredClaims{
-			Issuer:    "oauth2-server",
+			Issuer:    serverBaseURL(),
 			Subject:   fmt.Sprintf("%d", userID),
 			Audience:  []string{clientID},
 			ExpiresAt: jwt.NewNumericDate(now.Add(expiresIn)),
@@ -157,15 +123,13 @@ func generateJWTAccessToken(userID int, username, clientID, scope string, expire
 			IssuedAt:  jwt.NewNumericDate(now),
 			ID:        generateRandomString(16), // JTI (JWT ID)
 		},
-		Scope:    scope,
-		ClientID: clientID,
-		Username: username,
+		Scope:        scope,
+		ClientID:     clientID,
+		Username:     username,
+		Confirmation: cnf,
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
-	token.Header["kid"] = keyID
-
-	tokenString, err := token.SignedString(privateKey)
+	tokenString, err := signJWT(claims)
 	if err != nil {
 		return "", fmt.Errorf("JWT署名エラー: %v", err)
 	}
@@ -179,44 +143,80 @@ func generateJWTAccessToken(userID int, username, clientID, scope string, expire
 	return tokenString, nil
 }
 
-// OpenID Connect ID Token を生成
-func generateJWTIDToken(userID int, username, clientID, nonce string, expiresIn time.Duration) (string, error) {
-	if privateKey == nil {
-		return "", fmt.Errorf("RSA秘密鍵が初期化されていません")
-	}
-
+// クライアント自身を主体とするJWTアクセストークンを生成（client_credentials グラント用）。
+// ユーザーは存在しないため sub には client_id を入れ、username は付与しない。
+func generateJWTClientAccessToken(clientID, scope string, expiresIn time.Duration, cnf *tokenConfirmation) (string, error) {
 	now := time.Now()
 	claims := CustomClaims{
 		RegisteredClaims: jwt.RegisteredClaims{
-			Issuer:    "oauth2-server",
-			Subject:   fmt.Sprintf("%d", userID),
+			Issuer:    serverBaseURL(),
+			Subject:   clientID,
 			Audience:  []string{clientID},
 			ExpiresAt: jwt.NewNumericDate(now.Add(expiresIn)),
 			NotBefore: jwt.NewNumericDate(now),
 			IssuedAt:  jwt.NewNumericDate(now),
 			ID:        generateRandomString(16), // JTI (JWT ID)
 		},
-		Username: username,
-		ClientID: clientID,
+		Scope:        scope,
+		ClientID:     clientID,
+		Confirmation: cnf,
 	}
 
-	// OpenID Connect用のクレームを追加
-	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
-	token.Header["kid"] = keyID
+	tokenString, err := signJWT(claims)
+	if err != nil {
+		return "", fmt.Errorf("JWT署名エラー: %v", err)
+	}
+
+	slog.Info("クライアント向けJWTアクセストークンを生成しました",
+		"clientID", clientID,
+		"scope", scope,
+		"expiresIn", expiresIn)
+
+	return tokenString, nil
+}
 
-	// nonceクレームを追加
-	if nonce != "" {
-		// TODO: nonceクレームを適切に追加
-		// 現在は簡略化のため省略
+// OpenID Connect ID Token を生成。
+// email / preferred_username は要求スコープ（email / profile）に含まれる場合だけ付与する。
+// メールアドレスの到達確認は行っていないため、email_verified は付与しない（OIDC Core 5.1 では任意のクレーム）。
+func generateJWTIDToken(user *User, clientID string, scopes []string, nonce string, authTime time.Time, sid, accessToken string, expiresIn time.Duration) (string, error) {
+	now := time.Now()
+	claims := IDTokenClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    serverBaseURL(),
+			Subject:   fmt.Sprintf("%d", user.ID),
+			Audience:  []string{clientID},
+			ExpiresAt: jwt.NewNumericDate(now.Add(expiresIn)),
+			IssuedAt:  jwt.NewNumericDate(now),
+		},
+		Nonce:           nonce,
+		AuthorizedParty: clientID,
+		SessionID:       sid,
+	}
+	if !authTime.IsZero() {
+		claims.AuthTime = jwt.NewNumericDate(authTime)
+	}
+	// at_hash のハッシュ関数は署名アルゴリズムで決まるため、署名に使う鍵をここで確定させる
+	key, err := activeSigningKey()
+	if err != nil {
+		return "", err
+	}
+	if accessToken != "" {
+		claims.AccessTokenHash = accessTokenHash(accessToken, key.Alg)
+	}
+	if slices.Contains(scopes, "email") && user.Email != "" {
+		claims.Email = user.Email
+	}
+	if slices.Contains(scopes, "profile") {
+		claims.PreferredUsername = user.Username
 	}
 
-	tokenString, err := token.SignedString(privateKey)
+	tokenString, err := signJWTWithKey(key, claims)
 	if err != nil {
 		return "", fmt.Errorf("ID Token JWT署名エラー: %v", err)
 	}
 
 	slog.Info("OpenID Connect ID Tokenを生成しました",
-		"userID", userID,
+		"userID", user.ID,
 		"clientID", clientID,
 		"nonce", nonce,
 		"expiresIn", expiresIn)
@@ -224,19 +224,52 @@ func generateJWTIDToken(userID int, username, clientID, nonce string, expiresIn
 	return tokenString, nil
 }
 
-// JWTトークンを検証
+// accessTokenHash は at_hash を計算する（OIDC Core 3.1.3.6）。
+// 署名アルゴリズムに対応するハッシュ（RS256 / ES256 は SHA-256、ES384 は SHA-384、EdDSA は SHA-512）の
+// 左半分を BASE64URL（パディングなし）にする。
+func accessTokenHash(accessToken, alg string) string {
+	var sum []byte
+	switch alg {
+	case "ES384":
+		h := sha512.Sum384([]byte(accessToken))
+		sum = h[:]
+	case "EdDSA":
+		h := sha512.Sum512([]byte(accessToken))
+		sum = h[:]
+	default:
+		h := sha256.Sum256([]byte(accessToken))
+		sum = h[:]
+	}
+	return base64.RawURLEncoding.EncodeToString(sum[:len(sum)/2])
+}
+
+// oidcSessionID はブラウザセッション ID から ID Token の sid を導出する。
+// セッション ID はクッキーの値そのものなので、トークンには SHA-256 ハッシュだけを載せる。
+func oidcSessionID(sessionID string) string {
+	sum := sha256.Sum256([]byte(sessionID))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// JWTトークンを検証。ヘッダーの kid で鍵を選ぶため、ローテーション後も猶予期間内の鍵で署名されたトークンは有効。
+// iss は Discovery の issuer（serverBaseURL）と一致する必要がある
 func validateJWTToken(tokenString string) (*CustomClaims, error) {
-	if publicKey == nil {
-		return nil, fmt.Errorf("RSA公開鍵が初期化されていません")
+	ks := jwtKeys.Load()
+	if ks == nil {
+		return nil, fmt.Errorf("署名鍵が初期化されていません")
 	}
 
 	token, err := jwt.ParseWithClaims(tokenString, &CustomClaims{}, func(token *jwt.Token) (interface{}, error) {
-		// 署名方法がRS256であることを確認
-		if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
+		kid, _ := token.Header["kid"].(string)
+		key, ok := ks.lookup(kid)
+		if !ok {
+			return nil, fmt.Errorf("kid %q に対応する鍵がありません", kid)
+		}
+		// 署名方法が鍵のアルゴリズムと一致することを確認（alg の差し替えによる検証回避を防ぐ）
+		if token.Method.Alg() != key.Alg {
 			return nil, fmt.Errorf("予期しない署名方法: %v", token.Header["alg"])
 		}
-		return publicKey, nil
-	})
+		return key.Public, nil
+	}, jwt.WithIssuer(serverBaseURL()))
 
 	if err != nil {
 		return nil, fmt.Errorf("JWTトークン検証エラー: %v", err)
@@ -249,36 +282,50 @@ func validateJWTToken(tokenString string) (*CustomClaims, error) {
 	return nil, fmt.Errorf("無効なJWTトークン")
 }
 
-// JWKS形式の公開鍵を生成
+// JWKS形式の公開鍵を生成。active な鍵に加え、猶予期間内の退役済みの鍵も載せる
 func generateJWKS() (*JWKSResponse, error) {
-	if publicKey == nil {
-		return nil, fmt.Errorf("RSA公開鍵が初期化されていません")
-	}
-
-	// RSA公開鍵のN（modulus）とE（exponent）を取得
-	nBytes := publicKey.N.Bytes()
-	eBytes := big.NewInt(int64(publicKey.E)).Bytes()
-
-	// Base64URL エンコード
-	n := base64.RawURLEncoding.EncodeToString(nBytes)
-	e := base64.RawURLEncoding.EncodeToString(eBytes)
-
-	jwk := JWK{
-		Kty: "RSA",
-		Use: "sig",
-		Kid: keyID,
-		Alg: "RS256",
-		N:   n,
-		E:   e,
+	ks := jwtKeys.Load()
+	if ks == nil {
+		return nil, fmt.Errorf("署名鍵が初期化されていません")
 	}
 
-	jwks := &JWKSResponse{
-		Keys: []JWK{jwk},
+	jwks := &JWKSResponse{Keys: []JWK{}}
+	for _, k := range ks.published() {
+		jwk, err := publicJWK(k)
+		if err != nil {
+			return nil, err
+		}
+		jwks.Keys = append(jwks.Keys, jwk)
 	}
 
 	return jwks, nil
 }
 
+// publicJWK は公開鍵を JWK に変換する。値はいずれも Base64URL（パディングなし）
+func publicJWK(k *signingKey) (JWK, error) {
+	jwk := JWK{Use: "sig", Kid: k.ID, Alg: k.Alg}
+	switch pub := k.Public.(type) {
+	case *rsa.PublicKey:
+		jwk.Kty = "RSA"
+		jwk.N = base64.RawURLEncoding.EncodeToString(pub.N.Bytes())
+		jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+	case *ecdsa.PublicKey:
+		// RFC 7518 6.2.1.2: x / y は曲線のバイト長に左ゼロ詰めする
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		jwk.Kty = "EC"
+		jwk.Crv = pub.Curve.Params().Name
+		jwk.X = base64.RawURLEncoding.EncodeToString(pub.X.FillBytes(make([]byte, size)))
+		jwk.Y = base64.RawURLEncoding.EncodeToString(pub.Y.FillBytes(make([]byte, size)))
+	case ed25519.PublicKey:
+		jwk.Kty = "OKP"
+		jwk.Crv = "Ed25519"
+		jwk.X = base64.RawURLEncoding.EncodeToString(pub)
+	default:
+		return JWK{}, fmt.Errorf("kid %q: 未対応の公開鍵の種類です", k.ID)
+	}
+	return jwk, nil
+}
+
 // JWKS JSONレスポンスを生成
 func getJWKSJSON() ([]byte, error) {
 	jwks, err := generateJWKS()
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// useTestSigningKey は alg の鍵を生成して jwtKeys に設定し、テスト終了時に元の鍵セットへ戻す。
+func useTestSigningKey(t *testing.T, alg string) *signingKey {
+	t.Helper()
+	k := newTestSigningKey(t, alg)
+	prev := jwtKeys.Load()
+	jwtKeys.Store(&keySet{active: k, keys: map[string]*signingKey{k.ID: k}, order: []string{k.ID}})
+	t.Cleanup(func() { jwtKeys.Store(prev) })
+	return k
+}
+
+// newTestSigningKey は alg の鍵を生成する（クライアントの鍵としても使う）。
+func newTestSigningKey(t *testing.T, alg string) *signingKey {
+	t.Helper()
+	var key crypto.Signer
+	var err error
+	switch alg {
+	case "RS256":
+		key, err = rsa.GenerateKey(rand.Reader, 2048)
+	case "ES256":
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case "ES384":
+		key, err = ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case "EdDSA":
+		_, key, err = ed25519.GenerateKey(rand.Reader)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := newLocalSigner(key, alg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &signingKey{
+		ID:        "test-" + alg,
+		Alg:       alg,
+		Method:    signingMethods[alg],
+		Signer:    signer,
+		Public:    signer.Public(),
+		CreatedAt: time.Now(),
+	}
+}
+
+func TestAccessTokenIssuer(t *testing.T) {
+	t.Setenv("SERVER_BASE_URL", "https://as.example.com/")
+	key := useTestSigningKey(t, "ES256")
+
+	userToken, err := generateJWTAccessToken(1, "testuser", "demo", "read", time.Minute, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientToken, err := generateJWTClientAccessToken("svc", "read", time.Minute, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy, err := signJWTWithKey(key, CustomClaims{RegisteredClaims: jwt.RegisteredClaims{
+		Issuer:    "oauth2-server",
+		Subject:   "1",
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute)),
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		token   string
+		wantErr bool
+	}{
+		{"ユーザーのアクセストークン", userToken, false},
+		{"client_credentials のアクセストークン", clientToken, false},
+		{"issuer が異なるトークン", legacy, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := validateJWTToken(tt.token)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("validateJWTToken() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && claims.Issuer != "https://as.example.com" {
+				t.Errorf("iss = %q", claims.Issuer)
+			}
+		})
+	}
+}
+
+func TestGenerateJWTIDToken(t *testing.T) {
+	t.Setenv("SERVER_BASE_URL", "https://as.example.com")
+	user := &User{ID: 7, Username: "testuser", Email: "test@example.com"}
+	authTime := time.Now().Add(-time.Minute).Truncate(time.Second)
+
+	tests := []struct {
+		name      string
+		scopes    []string
+		wantEmail bool
+		wantName  bool
+	}{
+		{"openid のみ", []string{"openid"}, false, false},
+		{"email スコープ", []string{"openid", "email"}, true, false},
+		{"profile スコープ", []string{"openid", "profile"}, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key := useTestSigningKey(t, "ES384")
+			token, err := generateJWTIDToken(user, "demo", tt.scopes, "n-0S6", authTime, "sid-1", "access-token", time.Minute)
+			if err != nil {
+				t.Fatal(err)
+			}
+			claims := jwt.MapClaims{}
+			if _, err := jwt.ParseWithClaims(token, claims, func(*jwt.Token) (any, error) { return key.Public, nil },
+				jwt.WithIssuer("https://as.example.com"), jwt.WithAudience("demo")); err != nil {
+				t.Fatal(err)
+			}
+
+			want := map[string]any{
+				"sub":       "7",
+				"nonce":     "n-0S6",
+				"azp":       "demo",
+				"sid":       "sid-1",
+				"auth_time": float64(authTime.Unix()),
+				"at_hash":   accessTokenHash("access-token", "ES384"),
+			}
+			for k, v := range want {
+				if claims[k] != v {
+					t.Errorf("%s = %v, want %v", k, claims[k], v)
+				}
+			}
+			if _, ok := claims["email"]; ok != tt.wantEmail {
+				t.Errorf("email の有無 = %v, want %v", ok, tt.wantEmail)
+			}
+			if _, ok := claims["preferred_username"]; ok != tt.wantName {
+				t.Errorf("preferred_username の有無 = %v, want %v", ok, tt.wantName)
+			}
+			if _, ok := claims["email_verified"]; ok {
+				t.Error("到達確認していないメールアドレスに email_verified が付いています")
+			}
+		})
+	}
+}
+
+func TestAccessTokenHash(t *testing.T) {
+	// OIDC Core 3.1.3.6 の手順どおり、ハッシュの左半分を BASE64URL にしたものの長さ
+	tests := []struct {
+		alg     string
+		wantLen int
+	}{
+		{"RS256", 22},
+		{"ES256", 22},
+		{"ES384", 32},
+		{"EdDSA", 43},
+	}
+	for _, tt := range tests {
+		if got := accessTokenHash("token", tt.alg); len(got) != tt.wantLen {
+			t.Errorf("accessTokenHash(%s) の長さ = %d, want %d", tt.alg, len(got), tt.wantLen)
+		}
+	}
+	// OIDC Core A.3 の例（RS256）
+	if got := accessTokenHash("jHkWEdUXMU1BwAsC4vtUsZwnNvTIxEl0z9K3vx5KF0Y", "RS256"); got != "77QmUPtjPfzWtF2AnpK9RQ" {
+		t.Errorf("at_hash = %q", got)
+	}
+}
+
+func TestSigningAlgorithms(t *testing.T) {
+	t.Setenv("SERVER_BASE_URL", "https://as.example.com")
+	tests := []struct {
+		alg     string
+		wantKty string
+		wantCrv string
+	}{
+		{"RS256", "RSA", ""},
+		{"ES256", "EC", "P-256"},
+		{"ES384", "EC", "P-384"},
+		{"EdDSA", "OKP", "Ed25519"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.alg, func(t *testing.T) {
+			key := useTestSigningKey(t, tt.alg)
+			token, err := generateJWTAccessToken(1, "testuser", "demo", "read", time.Minute, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			parsed, _, err := jwt.NewParser().ParseUnverified(token, jwt.MapClaims{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if parsed.Header["alg"] != tt.alg || parsed.Header["kid"] != key.ID {
+				t.Errorf("header = %v", parsed.Header)
+			}
+			if _, err := validateJWTToken(token); err != nil {
+				t.Errorf("validateJWTToken() error = %v", err)
+			}
+
+			// JWKS に載せた JWK から同じ公開鍵を復元できる
+			jwk, err := publicJWK(key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if jwk.Kty != tt.wantKty || jwk.Crv != tt.wantCrv || jwk.Alg != tt.alg || jwk.Use != "sig" {
+				t.Errorf("JWK = %+v", jwk)
+			}
+			pub, err := publicKeyFromJWK(jwk)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !pub.(interface{ Equal(crypto.PublicKey) bool }).Equal(key.Public) {
+				t.Error("JWK から復元した公開鍵が一致しません")
+			}
+		})
+	}
+}
+
+func TestValidateJWTTokenRejectsAlgorithmMismatch(t *testing.T) {
+	// kid が同じでも、鍵のアルゴリズムと異なる alg で署名したトークンは受け付けない
+	t.Setenv("SERVER_BASE_URL", "https://as.example.com")
+	key := useTestSigningKey(t, "ES256")
+	claims := CustomClaims{RegisteredClaims: jwt.RegisteredClaims{
+		Issuer:    "https://as.example.com",
+		Subject:   "1",
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute)),
+	}}
+
+	forged := newTestSigningKey(t, "EdDSA")
+	forged.ID = key.ID
+	eddsa, err := signJWTWithKey(forged, claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	none := jwt.NewWithClaims(jwt.SigningMethodNone, claims)
+	none.Header["kid"] = key.ID
+	unsigned, err := none.SignedString(jwt.UnsafeAllowNoneSignatureType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unknownKid := newTestSigningKey(t, "ES256")
+	unknownKid.ID = "unknown"
+	otherKid, err := signJWTWithKey(unknownKid, claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, token := range map[string]string{"EdDSA": eddsa, "none": unsigned, "未知の kid": otherKid} {
+		if _, err := validateJWTToken(token); err == nil {
+			t.Errorf("%s のトークンを受け入れました", name)
+		}
+	}
+}
@@ -0,0 +1,438 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	// 署名鍵を置くディレクトリ
+	keyDir = "certificate"
+	// 鍵の一覧（どの kid がどのファイルか、いつ退役したか）を記録するマニフェスト
+	keyManifestFile = "keys.json"
+	// 旧バージョンが生成していた単一鍵のファイル名と kid。マニフェストが無ければこの鍵を引き継ぐ
+	legacyKeyFile = "jwt_private.pem"
+	legacyKeyID   = "oauth2-server-key-1"
+
+	// 退役した鍵を JWKS に載せ続ける期間。過ぎた鍵は次回のローテーションで削除する。
+	// 退役直前に署名したトークンが切れるまで検証できるよう、アクセストークンの有効期間は
+	// クライアントごとの設定にかかわらず maxAccessTokenLifetime（猶予期間 − JWKS のキャッシュ期間）で打ち切る
+	signingKeyGracePeriod = 24 * time.Hour
+	// JWKS レスポンスの Cache-Control max-age（jwks.go）。リソースサーバーはこの間、取得済みの JWKS を使い続けうる
+	jwksCacheMaxAge = time.Hour
+	// アクセストークン・ID トークンの有効期間の上限（OAuthClient.AccessTokenTTL）
+	maxAccessTokenLifetime = signingKeyGracePeriod - jwksCacheMaxAge
+	// 稼働中のサーバーがマニフェストを読み直す間隔。rotate-keys で追加された鍵はこの間隔で反映される
+	keyReloadInterval = 5 * time.Minute
+	// 署名アルゴリズムの既定値。JWT_SIGNING_ALG または rotate-keys の引数で変更する
+	defaultSigningAlg = "RS256"
+)
+
+// signingMethods は対応している署名アルゴリズム（JWS alg）。鍵ごとにどれか 1 つを使う
+var signingMethods = map[string]jwt.SigningMethod{
+	"RS256": jwt.SigningMethodRS256,
+	"ES256": jwt.SigningMethodES256,
+	"ES384": jwt.SigningMethodES384,
+	"EdDSA": jwt.SigningMethodEdDSA,
+}
+
+// configuredSigningAlg は新しく生成する鍵のアルゴリズム（環境変数 JWT_SIGNING_ALG、既定は RS256）。
+func configuredSigningAlg() string {
+	if v := os.Getenv("JWT_SIGNING_ALG"); v != "" {
+		return v
+	}
+	return defaultSigningAlg
+}
+
+// signingKey は kid 付きの署名鍵。RetiredAt が nil のものが現在の署名鍵。
+// 署名は Signer に任せ、Public の型は Alg による（*rsa.PublicKey、*ecdsa.PublicKey、ed25519.PublicKey）。
+type signingKey struct {
+	ID        string
+	Alg       string
+	Method    jwt.SigningMethod
+	Signer    Signer
+	Public    crypto.PublicKey
+	CreatedAt time.Time
+	RetiredAt *time.Time
+}
+
+// keySet は署名に使う鍵（active）と、検証用に残している退役済みの鍵をまとめたもの。
+// 読み込み後は変更しないため、差し替えは jwtKeys をまるごと入れ替えて行う。
+type keySet struct {
+	active *signingKey
+	keys   map[string]*signingKey
+	// JWKS に載せる順序（active が先頭、以降は新しい順）
+	order []string
+}
+
+// 現在の鍵セット。initJWTKeys / reloadJWTKeys が設定する
+var jwtKeys atomic.Pointer[keySet]
+
+// lookup は kid に対応する鍵を返す（JWT 検証用）。
+func (ks *keySet) lookup(kid string) (*signingKey, bool) {
+	k, ok := ks.keys[kid]
+	return k, ok
+}
+
+// algorithms は公開中の鍵が使うアルゴリズムの一覧（active の鍵が先頭、重複なし）。
+func (ks *keySet) algorithms() []string {
+	var algs []string
+	for _, k := range ks.published() {
+		if !slices.Contains(algs, k.Alg) {
+			algs = append(algs, k.Alg)
+		}
+	}
+	return algs
+}
+
+// published は JWKS に公開する鍵を返す。
+func (ks *keySet) published() []*signingKey {
+	keys := make([]*signingKey, 0, len(ks.order))
+	for _, kid := range ks.order {
+		keys = append(keys, ks.keys[kid])
+	}
+	return keys
+}
+
+// keyManifest は certificate/keys.json の内容。
+type keyManifest struct {
+	Keys []keyManifestEntry `json:"keys"`
+}
+
+type keyManifestEntry struct {
+	Kid       string     `json:"kid"`
+	File      string     `json:"file,omitempty"`       // keyDir からの相対パス（signer が file のとき）
+	Alg       string     `json:"alg,omitempty"`        // 省略時は RS256（旧形式のマニフェスト）
+	Signer    string     `json:"signer,omitempty"`     // file（既定）または remote
+	Socket    string     `json:"socket,omitempty"`     // 署名デーモンの Unix ソケット（signer が remote のとき）
+	PublicKey string     `json:"public_key,omitempty"` // 署名デーモンの鍵の公開鍵（PKIX DER の Base64、signer が remote のとき）
+	CreatedAt time.Time  `json:"created_at"`
+	RetiredAt *time.Time `json:"retired_at,omitempty"`
+}
+
+// expired は猶予期間を過ぎ、JWKS から外してよい退役済みの鍵かどうか。
+func (e keyManifestEntry) expired(now time.Time) bool {
+	return e.RetiredAt != nil && now.After(e.RetiredAt.Add(signingKeyGracePeriod))
+}
+
+// 鍵セットの初期化。鍵が無ければ新しく生成する
+func initJWTKeys() error {
+	if _, err := ensureKeyManifest(); err != nil {
+		return err
+	}
+	return reloadJWTKeys()
+}
+
+// reloadJWTKeys はマニフェストを読み直して鍵セットを差し替える。
+func reloadJWTKeys() error {
+	manifest, err := readKeyManifest()
+	if err != nil {
+		return err
+	}
+	ks, err := loadKeySet(manifest, jwtKeys.Load(), time.Now())
+	if err != nil {
+		return err
+	}
+
+	prev := jwtKeys.Swap(ks)
+	if prev == nil || prev.active.ID != ks.active.ID || len(prev.keys) != len(ks.keys) {
+		slog.Info("JWT署名鍵を読み込みました",
+			"activeKeyID", ks.active.ID,
+			"publishedKeyIDs", ks.order)
+	}
+	return nil
+}
+
+// rotateJWTKeys は alg の新しい署名鍵を生成して active にし、それまでの鍵を退役させる。
+func rotateJWTKeys(alg string) (string, error) {
+	manifest, err := ensureKeyManifest()
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now().UTC()
+	entry, err := newKeyEntry(alg, now)
+	if err != nil {
+		return "", err
+	}
+	return activateKeyEntry(manifest, entry, now)
+}
+
+// rotateToRemoteSigner は署名デーモンが現在使っている鍵を active にし、それまでの鍵を退役させる。
+// 鍵の生成・保管はデーモン側で行い、マニフェストには kid / alg / ソケットと公開鍵だけを記録する。
+// 公開鍵を記録しておくことで、デーモンが次の鍵に切り替えた後も退役した鍵を JWKS に載せ続けられる。
+func rotateToRemoteSigner(socket string) (string, error) {
+	manifest, err := ensureKeyManifest()
+	if err != nil {
+		return "", err
+	}
+
+	info, _, err := fetchRemotePublicKey(socket)
+	if err != nil {
+		return "", err
+	}
+	if info.Kid == "" {
+		return "", fmt.Errorf("署名デーモンが kid を返しませんでした")
+	}
+	if _, ok := signingMethods[info.Alg]; !ok {
+		return "", fmt.Errorf("未対応の署名アルゴリズムです: %s", info.Alg)
+	}
+	for _, e := range manifest.Keys {
+		if e.Kid == info.Kid {
+			return "", fmt.Errorf("kid %q は既にマニフェストにあります", info.Kid)
+		}
+	}
+
+	now := time.Now().UTC()
+	entry := keyManifestEntry{Kid: info.Kid, Alg: info.Alg, Signer: "remote", Socket: socket, PublicKey: info.PublicKey, CreatedAt: now}
+	return activateKeyEntry(manifest, entry, now)
+}
+
+// activateKeyEntry は entry を active としてマニフェストに追加し、それまでの鍵を退役させる。
+// 退役した鍵は signingKeyGracePeriod の間は JWKS に残り、猶予を過ぎた鍵はファイルごと削除する。
+func activateKeyEntry(manifest *keyManifest, entry keyManifestEntry, now time.Time) (string, error) {
+	var kept []keyManifestEntry
+	for _, e := range manifest.Keys {
+		if e.RetiredAt == nil {
+			e.RetiredAt = &now
+		}
+		if e.expired(now) {
+			if e.File != "" {
+				if err := os.Remove(filepath.Join(keyDir, e.File)); err != nil && !errors.Is(err, os.ErrNotExist) {
+					return "", fmt.Errorf("退役済み鍵ファイル削除エラー: %v", err)
+				}
+			}
+			slog.Info("猶予期間を過ぎた署名鍵を削除しました", "kid", e.Kid)
+			continue
+		}
+		kept = append(kept, e)
+	}
+	manifest.Keys = append([]keyManifestEntry{entry}, kept...)
+
+	if err := writeKeyManifest(manifest); err != nil {
+		return "", err
+	}
+
+	slog.Info("JWT署名鍵をローテーションしました",
+		"activeKeyID", entry.Kid,
+		"alg", entry.Alg,
+		"gracePeriod", signingKeyGracePeriod)
+	return entry.Kid, nil
+}
+
+// newKeyEntry は alg の鍵を生成して保存し、マニフェストのエントリを返す。
+func newKeyEntry(alg string, now time.Time) (keyManifestEntry, error) {
+	if _, ok := signingMethods[alg]; !ok {
+		return keyManifestEntry{}, fmt.Errorf("未対応の署名アルゴリズムです: %s", alg)
+	}
+	// 同じ秒に続けて生成しても kid とファイル名が衝突しないよう乱数を付ける
+	nonce := make([]byte, 4)
+	if _, err := rand.Read(nonce); err != nil {
+		return keyManifestEntry{}, fmt.Errorf("kid 生成エラー: %v", err)
+	}
+	suffix := fmt.Sprintf("%s-%x", now.Format("20060102T150405Z"), nonce)
+	entry := keyManifestEntry{
+		Kid:       fmt.Sprintf("oauth2-server-key-%s", suffix),
+		File:      fmt.Sprintf("jwt_private_%s.pem", suffix),
+		Alg:       alg,
+		CreatedAt: now,
+	}
+	if err := generateSigningKey(filepath.Join(keyDir, entry.File), alg); err != nil {
+		return keyManifestEntry{}, err
+	}
+	return entry, nil
+}
+
+// ensureKeyManifest はマニフェストを読み込む。無い場合は旧形式の鍵を引き継ぐか、新しい鍵を生成して作成する。
+func ensureKeyManifest() (*keyManifest, error) {
+	manifest, err := readKeyManifest()
+	if err == nil {
+		return manifest, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	// 旧バージョンの単一鍵があれば、既に発行済みのトークンを検証できるよう同じ kid で引き継ぐ
+	now := time.Now().UTC()
+	var entry keyManifestEntry
+	if _, err := os.Stat(filepath.Join(keyDir, legacyKeyFile)); err == nil {
+		entry = keyManifestEntry{Kid: legacyKeyID, File: legacyKeyFile, Alg: "RS256", CreatedAt: now}
+	} else {
+		slog.Info("署名鍵が存在しません。新しく生成します...", "alg", configuredSigningAlg())
+		entry, err = newKeyEntry(configuredSigningAlg(), now)
+		if err != nil {
+			return nil, fmt.Errorf("署名鍵生成エラー: %v", err)
+		}
+	}
+	manifest = &keyManifest{Keys: []keyManifestEntry{entry}}
+	if err := writeKeyManifest(manifest); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+func readKeyManifest() (*keyManifest, error) {
+	data, err := os.ReadFile(filepath.Join(keyDir, keyManifestFile))
+	if err != nil {
+		return nil, err
+	}
+	var manifest keyManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("鍵マニフェストのパースエラー: %v", err)
+	}
+	return &manifest, nil
+}
+
+// writeKeyManifest は一時ファイルに書いてから rename し、稼働中のサーバーが書きかけを読まないようにする。
+func writeKeyManifest(manifest *keyManifest) error {
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("鍵マニフェストのエンコードエラー: %v", err)
+	}
+	path := filepath.Join(keyDir, keyManifestFile)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("鍵マニフェスト書き込みエラー: %v", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("鍵マニフェスト書き込みエラー: %v", err)
+	}
+	return nil
+}
+
+// loadKeySet はマニフェストの各鍵の Signer を用意する。猶予期間を過ぎた鍵は読み込まない。
+// prev に同じ kid の鍵があればそれを再利用する（暗号化鍵の復号や署名デーモンへの問い合わせを再読み込みのたびに行わない）。
+func loadKeySet(manifest *keyManifest, prev *keySet, now time.Time) (*keySet, error) {
+	ks := &keySet{keys: make(map[string]*signingKey)}
+	for _, e := range manifest.Keys {
+		if e.expired(now) {
+			continue
+		}
+		alg := e.Alg
+		if alg == "" {
+			alg = "RS256"
+		}
+		method, ok := signingMethods[alg]
+		if !ok {
+			return nil, fmt.Errorf("kid %q: 未対応の署名アルゴリズムです: %s", e.Kid, alg)
+		}
+		var signer Signer
+		if prev != nil {
+			if k, ok := prev.lookup(e.Kid); ok && k.Alg == alg {
+				signer = k.Signer
+			}
+		}
+		if signer == nil {
+			var err error
+			signer, err = openSigner(e, alg)
+			if err != nil && e.RetiredAt != nil {
+				// 退役済みの鍵は検証用に残しているだけなので、読み込めなくても起動は止めない
+				slog.Warn("退役済みの署名鍵を読み込めないため JWKS から外します", "kid", e.Kid, "error", err)
+				continue
+			}
+			if err != nil {
+				return nil, fmt.Errorf("kid %q: %v", e.Kid, err)
+			}
+		}
+		k := &signingKey{
+			ID:        e.Kid,
+			Alg:       alg,
+			Method:    method,
+			Signer:    signer,
+			Public:    signer.Public(),
+			CreatedAt: e.CreatedAt,
+			RetiredAt: e.RetiredAt,
+		}
+		// 退役していない鍵が複数ある場合（手作業での編集など）は新しいものを使う
+		if k.RetiredAt == nil && (ks.active == nil || k.CreatedAt.After(ks.active.CreatedAt)) {
+			ks.active = k
+		}
+		ks.keys[k.ID] = k
+	}
+	if ks.active == nil {
+		return nil, fmt.Errorf("有効な署名鍵がありません（%s を確認してください）", filepath.Join(keyDir, keyManifestFile))
+	}
+
+	ks.order = append(ks.order, ks.active.ID)
+	for _, e := range manifest.Keys {
+		if _, ok := ks.keys[e.Kid]; ok && e.Kid != ks.active.ID {
+			ks.order = append(ks.order, e.Kid)
+		}
+	}
+	return ks, nil
+}
+
+// generateSigningKey は alg 用の秘密鍵を生成して PEM で保存する。
+// RSA は 2048 ビット、ES256 / ES384 は P-256 / P-384、EdDSA は Ed25519。
+// パスフレーズが設定されていれば暗号化 PKCS#8（ENCRYPTED PRIVATE KEY）、無ければ RSA は PKCS#1・それ以外は PKCS#8 で保存する。
+func generateSigningKey(path, alg string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("certificateディレクトリ作成エラー: %v", err)
+	}
+
+	var key any
+	var err error
+	switch alg {
+	case "RS256":
+		key, err = rsa.GenerateKey(rand.Reader, 2048)
+	case "ES256":
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case "ES384":
+		key, err = ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case "EdDSA":
+		_, key, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		return fmt.Errorf("未対応の署名アルゴリズムです: %s", alg)
+	}
+	if err != nil {
+		return fmt.Errorf("%s鍵生成エラー: %v", alg, err)
+	}
+
+	passphrase, err := keyPassphrase()
+	if err != nil {
+		return err
+	}
+
+	var block *pem.Block
+	if rsaKey, ok := key.(*rsa.PrivateKey); ok && passphrase == "" {
+		block = &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)}
+	} else {
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return fmt.Errorf("秘密鍵マーシャルエラー: %v", err)
+		}
+		block = &pem.Block{Type: "PRIVATE KEY", Bytes: der}
+		if passphrase != "" {
+			encrypted, err := encryptPKCS8(der, passphrase)
+			if err != nil {
+				return fmt.Errorf("秘密鍵の暗号化エラー: %v", err)
+			}
+			block = &pem.Block{Type: "ENCRYPTED PRIVATE KEY", Bytes: encrypted}
+		}
+	}
+
+	if err := os.WriteFile(path, pem.EncodeToMemory(block), 0600); err != nil {
+		return fmt.Errorf("秘密鍵ファイル作成エラー: %v", err)
+	}
+
+	slog.Info("署名鍵が生成されました", "privateKey", path, "alg", alg)
+	return nil
+}
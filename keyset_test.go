@@ -0,0 +1,182 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// useTestKeyDir はテスト用の作業ディレクトリで鍵を生成できるようにし、終了時に jwtKeys を元に戻す。
+func useTestKeyDir(t *testing.T) {
+	t.Helper()
+	t.Chdir(t.TempDir())
+	t.Setenv("JWT_KEY_PASSPHRASE_FILE", "")
+	t.Setenv("JWT_KEY_PASSPHRASE", "")
+	prev := jwtKeys.Load()
+	t.Cleanup(func() { jwtKeys.Store(prev) })
+}
+
+func TestRotateJWTKeys(t *testing.T) {
+	useTestKeyDir(t)
+	t.Setenv("JWT_SIGNING_ALG", "ES256")
+	if err := initJWTKeys(); err != nil {
+		t.Fatal(err)
+	}
+	first := jwtKeys.Load().active
+	oldToken, err := generateJWTClientAccessToken("svc", "read", time.Minute, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kid, err := rotateJWTKeys("EdDSA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := reloadJWTKeys(); err != nil {
+		t.Fatal(err)
+	}
+	ks := jwtKeys.Load()
+	if ks.active.ID != kid || ks.active.Alg != "EdDSA" {
+		t.Fatalf("active = %s (%s), want %s (EdDSA)", ks.active.ID, ks.active.Alg, kid)
+	}
+	// JWKS は新しい鍵が先頭で、退役した鍵も猶予期間中は残す
+	if !slices.Equal(ks.order, []string{kid, first.ID}) {
+		t.Errorf("order = %v, want [%s %s]", ks.order, kid, first.ID)
+	}
+	if !slices.Equal(ks.algorithms(), []string{"EdDSA", "ES256"}) {
+		t.Errorf("algorithms = %v", ks.algorithms())
+	}
+	if retired, _ := ks.lookup(first.ID); retired.RetiredAt == nil {
+		t.Error("ローテーション前の鍵が退役していません")
+	}
+
+	// 退役した鍵で署名したトークンも検証でき、新しいトークンは新しい鍵で署名する
+	if _, err := validateJWTToken(oldToken); err != nil {
+		t.Errorf("退役した鍵のトークンを検証できません: %v", err)
+	}
+	newToken, err := generateJWTClientAccessToken("svc", "read", time.Minute, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := validateJWTToken(newToken); err != nil {
+		t.Errorf("新しい鍵のトークンを検証できません: %v", err)
+	}
+
+	if _, err := rotateJWTKeys("HS256"); err == nil {
+		t.Error("未対応のアルゴリズムでローテーションできました")
+	}
+}
+
+func TestRotateJWTKeysRemovesExpiredKeys(t *testing.T) {
+	useTestKeyDir(t)
+	now := time.Now().UTC()
+	expiredAt := now.Add(-signingKeyGracePeriod - time.Minute)
+	graceAt := now.Add(-time.Hour)
+	entry := func(created time.Time, retiredAt *time.Time) keyManifestEntry {
+		e, err := newKeyEntry("ES256", created)
+		if err != nil {
+			t.Fatal(err)
+		}
+		e.RetiredAt = retiredAt
+		return e
+	}
+	expired := entry(now.Add(-72*time.Hour), &expiredAt)
+	inGrace := entry(now.Add(-48*time.Hour), &graceAt)
+	active := entry(now.Add(-24*time.Hour), nil)
+	if err := writeKeyManifest(&keyManifest{Keys: []keyManifestEntry{active, inGrace, expired}}); err != nil {
+		t.Fatal(err)
+	}
+
+	kid, err := rotateJWTKeys("ES256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := readKeyManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var kids []string
+	for _, e := range manifest.Keys {
+		kids = append(kids, e.Kid)
+	}
+	if !slices.Equal(kids, []string{kid, active.Kid, inGrace.Kid}) {
+		t.Errorf("マニフェストの kid = %v", kids)
+	}
+	if manifest.Keys[1].RetiredAt == nil {
+		t.Error("それまでの active が退役していません")
+	}
+	if _, err := os.Stat(filepath.Join(keyDir, expired.File)); !os.IsNotExist(err) {
+		t.Errorf("猶予期間を過ぎた鍵ファイルが残っています: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(keyDir, inGrace.File)); err != nil {
+		t.Errorf("猶予期間中の鍵ファイルを削除しました: %v", err)
+	}
+}
+
+func TestKeyManifestEntryExpired(t *testing.T) {
+	now := time.Now()
+	at := func(d time.Duration) *time.Time {
+		t := now.Add(d)
+		return &t
+	}
+	tests := []struct {
+		name      string
+		retiredAt *time.Time
+		want      bool
+	}{
+		{"active", nil, false},
+		{"退役直後", at(-time.Minute), false},
+		{"猶予期間ちょうど", at(-signingKeyGracePeriod), false},
+		{"猶予期間を過ぎた", at(-signingKeyGracePeriod - time.Second), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := (keyManifestEntry{RetiredAt: tt.retiredAt}).expired(now); got != tt.want {
+				t.Errorf("expired() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadKeySetRejects(t *testing.T) {
+	useTestKeyDir(t)
+	now := time.Now().UTC()
+	retiredAt := now.Add(-time.Hour)
+	retired, err := newKeyEntry("ES256", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	retired.RetiredAt = &retiredAt
+	unknown := retired
+	unknown.Kid, unknown.Alg, unknown.RetiredAt = "hs", "HS256", nil
+	missing := keyManifestEntry{Kid: "missing", File: "missing.pem", Alg: "ES256", CreatedAt: now}
+
+	tests := []struct {
+		name string
+		keys []keyManifestEntry
+	}{
+		{"退役済みの鍵しか無い", []keyManifestEntry{retired}},
+		{"未対応のアルゴリズム", []keyManifestEntry{unknown}},
+		{"鍵ファイルが無い", []keyManifestEntry{missing}},
+		{"鍵が無い", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := loadKeySet(&keyManifest{Keys: tt.keys}, nil, now); err == nil {
+				t.Error("loadKeySet() がエラーになりません")
+			}
+		})
+	}
+}
+
+func TestMaxAccessTokenLifetimeFitsGracePeriod(t *testing.T) {
+	// 退役直前に署名したトークンが切れ、リソースサーバーの JWKS キャッシュが更新されるまで鍵を JWKS に残す
+	if maxAccessTokenLifetime+jwksCacheMaxAge > signingKeyGracePeriod {
+		t.Errorf("maxAccessTokenLifetime(%v) + jwksCacheMaxAge(%v) > signingKeyGracePeriod(%v)", maxAccessTokenLifetime, jwksCacheMaxAge, signingKeyGracePeriod)
+	}
+	if maxAccessTokenLifetime < defaultAccessTokenLifetime {
+		t.Errorf("maxAccessTokenLifetime(%v) が既定のアクセストークンの有効期間より短い", maxAccessTokenLifetime)
+	}
+}
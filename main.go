@@ -4,6 +4,7 @@ package main
 import (
 	"context"
 	"errors"
+	"fmt"
 	"log/slog"
 	"net/http"
 	"os"
@@ -23,6 +24,52 @@ var (
 func main() {
 	logger := slog.Default()
 
+	// サブコマンド: 署名鍵のローテーション（DB 接続は不要）。
+	// 稼働中のサーバーは keyReloadInterval ごとにマニフェストを読み直して新しい鍵に切り替える
+	// 引数でアルゴリズム（RS256 / ES256 / ES384 / EdDSA）を指定でき、省略時は JWT_SIGNING_ALG に従う。
+	// rotate-keys remote <socket> は署名デーモンの鍵に切り替える
+	if len(os.Args) > 1 && os.Args[1] == "rotate-keys" {
+		var kid string
+		var err error
+		switch {
+		case len(os.Args) > 3 && os.Args[2] == "remote":
+			kid, err = rotateToRemoteSigner(os.Args[3])
+		case len(os.Args) > 2:
+			kid, err = rotateJWTKeys(os.Args[2])
+		default:
+			kid, err = rotateJWTKeys(configuredSigningAlg())
+		}
+		if err != nil {
+			logger.Error("署名鍵のローテーションに失敗しました", "error", err)
+			os.Exit(1)
+		}
+		logger.Info("新しい署名鍵を作成しました", "kid", kid)
+		return
+	}
+
+	// サブコマンド: ローカル検証用の DPoP 証明を標準出力に出す（DB 接続は不要）。
+	// dpop-proof <METHOD> <URL> [アクセストークン] [nonce]
+	if len(os.Args) > 1 && os.Args[1] == "dpop-proof" {
+		if len(os.Args) < 4 {
+			logger.Error("使い方: dpop-proof <METHOD> <URL> [access_token] [nonce]")
+			os.Exit(2)
+		}
+		var accessToken, nonce string
+		if len(os.Args) > 4 {
+			accessToken = os.Args[4]
+		}
+		if len(os.Args) > 5 {
+			nonce = os.Args[5]
+		}
+		proof, err := generateDPoPProof(os.Args[2], os.Args[3], accessToken, nonce)
+		if err != nil {
+			logger.Error("DPoP 証明の生成に失敗しました", "error", err)
+			os.Exit(1)
+		}
+		fmt.Println(proof)
+		return
+	}
+
 	// データベース接続を初期化
 	var err error
 	db, err = NewDatabase()
@@ -35,12 +82,48 @@ func main() {
 	// リポジトリを初期化
 	repository = NewRepository(db)
 
+	// サブコマンド: クライアントシークレットのローテーション。
+	// rotate-client-secret <client_id> [猶予期間（例: 48h）]。新しいシークレットは標準出力に 1 度だけ表示する
+	if len(os.Args) > 1 && os.Args[1] == "rotate-client-secret" {
+		if len(os.Args) < 3 {
+			logger.Error("使い方: rotate-client-secret <client_id> [猶予期間]")
+			os.Exit(2)
+		}
+		var grace time.Duration
+		if len(os.Args) > 3 {
+			if grace, err = time.ParseDuration(os.Args[3]); err != nil {
+				logger.Error("猶予期間の形式が不正です", "error", err)
+				os.Exit(2)
+			}
+		}
+		secret, oldExpiresAt, err := rotateClientSecret(context.Background(), os.Args[2], grace)
+		if err != nil {
+			logger.Error("クライアントシークレットのローテーションに失敗しました", "error", err)
+			os.Exit(1)
+		}
+		logger.Info("新しいクライアントシークレットを発行しました。以前のシークレットは期限まで有効です",
+			"client_id", os.Args[2], "old_secret_expires_at", oldExpiresAt.Format(time.RFC3339))
+		fmt.Println(secret)
+		return
+	}
+
 	// JWT鍵を初期化
 	if err := initJWTKeys(); err != nil {
 		logger.Error("JWT鍵の初期化に失敗しました", "error", err)
 		os.Exit(1)
 	}
 
+	// rotate-keys で追加・退役した鍵を定期的に取り込む
+	go func() {
+		ticker := time.NewTicker(keyReloadInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := reloadJWTKeys(); err != nil {
+				logger.Error("JWT鍵の再読み込みに失敗しました", "error", err)
+			}
+		}
+	}()
+
 	// クリーンアップタスクを定期実行
 	go func() {
 		ticker := time.NewTicker(1 * time.Hour)
@@ -77,13 +160,30 @@ func main() {
 
 	// OAuth2エンドポイント
 	mux.HandleFunc("GET /authorize", authorizeHandler)
+	mux.HandleFunc("POST /authorize", authorizeConsentHandler)
 	mux.HandleFunc("POST /token", tokenHandler)
+	mux.HandleFunc("POST /revoke", revokeHandler)
+	mux.HandleFunc("POST /introspect", introspectHandler)
+	mux.HandleFunc("POST /par", pushedAuthorizationRequestHandler)
+
+	// 動的クライアント登録（RFC 7591）と登録内容の管理（RFC 7592）
+	mux.HandleFunc("POST /register", registerClientHandler)
+	mux.HandleFunc("GET /register/{client_id}", getRegisteredClientHandler)
+	mux.HandleFunc("PUT /register/{client_id}", updateRegisteredClientHandler)
+	mux.HandleFunc("DELETE /register/{client_id}", deleteRegisteredClientHandler)
 	mux.HandleFunc("GET /callback", callbackHandler)
 
+	// デバイス認可グラント（RFC 8628）
+	mux.HandleFunc("POST /device_authorization", deviceAuthorizationHandler)
+	mux.HandleFunc("GET /device", deviceGetHandler)
+	mux.HandleFunc("POST /device", devicePostHandler)
+
 	// JWKS・OpenID Connect エンドポイント
 	mux.HandleFunc("GET /jwks", jwksHandler)
 	mux.HandleFunc("GET /.well-known/jwks.json", wellKnownJwksHandler)
 	mux.HandleFunc("GET /.well-known/openid_configuration", wellKnownOpenidConfigurationHandler)
+	mux.HandleFunc("GET /userinfo", userinfoHandler)
+	mux.HandleFunc("POST /userinfo", userinfoHandler)
 	mux.HandleFunc("POST /tokeninfo", tokenInfoHandler)
 
 	// JWT動作テスト用エンドポイント
@@ -97,6 +197,15 @@ func main() {
 		IdleTimeout:       60 * time.Second,
 	}
 
+	// mTLS（RFC 8705）のリスナー。MTLS_LISTEN_ADDR を設定したときだけ、同じハンドラをクライアント証明書を要求する TLS で公開する
+	var mtlsSrv *http.Server
+	if mtlsEnabled() {
+		if mtlsSrv, err = newMTLSServer(mux); err != nil {
+			logger.Error("mTLS リスナーの初期化に失敗しました", "error", err)
+			os.Exit(1)
+		}
+	}
+
 	// graceful shutdown
 	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer stop()
@@ -108,11 +217,26 @@ func main() {
 		}
 	}()
 
+	if mtlsSrv != nil {
+		go func() {
+			logger.Info("mtls server starting", "addr", mtlsSrv.Addr, "base_url", mtlsBaseURL())
+			// 証明書は TLSConfig に読み込み済み
+			if err := mtlsSrv.ListenAndServeTLS("", ""); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				logger.Error("mtls server error", "err", err)
+			}
+		}()
+	}
+
 	<-ctx.Done()
 	logger.Info("shutdown signal received")
 
 	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
+	if mtlsSrv != nil {
+		if err := mtlsSrv.Shutdown(shutdownCtx); err != nil {
+			logger.Error("mtls graceful shutdown failed", "err", err)
+		}
+	}
 	if err := srv.Shutdown(shutdownCtx); err != nil {
 		logger.Error("graceful shutdown failed", "err", err)
 		return
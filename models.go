@@ -1,6 +1,8 @@
 package main
 
 import (
+	"slices"
+	"strings"
 	"time"
 
 	"github.com/lib/pq"
@@ -16,22 +18,112 @@ type User struct {
 	UpdatedAt    time.Time `json:"updated_at"`
 }
 
-// OAuthClient はOAuth2クライアント情報を表す構造体
+// OAuthClient はOAuth2クライアント情報を表す構造体。
+// *Lifetime / RefreshTokenIdleTimeout は秒で、NULL なら既定値（token.go の default*Lifetime）を使う。
+// ApplicationType は web か native で、使える redirect_uri の形式が変わる（redirect_uri.go）。
+// TLSClientAuth* は tls_client_auth で照合する証明書の subject DN / SAN で、どれか 1 つだけを登録する（mtls.go）。
+// GrantTypes が空なら全グラントを許可する。RegistrationAccessTokenHash は動的登録（registration.go）したクライアントだけが持つ。
 type OAuthClient struct {
-	ID           int            `json:"id"`
-	ClientID     string         `json:"client_id"`
-	ClientSecret string         `json:"client_secret"`
-	Name         string         `json:"name"`
-	RedirectURIs pq.StringArray `json:"redirect_uris"`
-	Scopes       pq.StringArray `json:"scopes"`
-	CreatedAt    time.Time      `json:"created_at"`
-	UpdatedAt    time.Time      `json:"updated_at"`
+	ID                           int            `json:"id"`
+	ClientID                     string         `json:"client_id"`
+	ClientSecret                 string         `json:"client_secret"`
+	Name                         string         `json:"name"`
+	RedirectURIs                 pq.StringArray `json:"redirect_uris"`
+	Scopes                       pq.StringArray `json:"scopes"`
+	DefaultScopes                pq.StringArray `json:"default_scopes"`
+	TokenEndpointAuthMethod      string         `json:"token_endpoint_auth_method"`
+	JWKS                         *string        `json:"jwks,omitempty"`
+	JWKSURI                      *string        `json:"jwks_uri,omitempty"`
+	AccessTokenLifetime          *int           `json:"access_token_lifetime,omitempty"`
+	AuthorizationCodeLifetime    *int           `json:"authorization_code_lifetime,omitempty"`
+	RefreshTokenLifetime         *int           `json:"refresh_token_lifetime,omitempty"`
+	RefreshTokenAbsoluteLifetime *int           `json:"refresh_token_absolute_lifetime,omitempty"`
+	RefreshTokenIdleTimeout      *int           `json:"refresh_token_idle_timeout,omitempty"`
+	RefreshTokenRotation         bool           `json:"refresh_token_rotation"`
+	RequirePKCE                  bool           `json:"require_pkce"`
+	ApplicationType              string         `json:"application_type"`
+	RequestObjectSigningAlg      *string        `json:"request_object_signing_alg,omitempty"`
+	RequestURIs                  pq.StringArray `json:"request_uris,omitempty"`
+	DPoPBoundAccessTokens        bool           `json:"dpop_bound_access_tokens"`
+	CertBoundAccessTokens        bool           `json:"tls_client_certificate_bound_access_tokens"`
+	TLSClientAuthSubjectDN       *string        `json:"tls_client_auth_subject_dn,omitempty"`
+	TLSClientAuthSANDNS          *string        `json:"tls_client_auth_san_dns,omitempty"`
+	TLSClientAuthSANURI          *string        `json:"tls_client_auth_san_uri,omitempty"`
+	TLSClientAuthSANIP           *string        `json:"tls_client_auth_san_ip,omitempty"`
+	TLSClientAuthSANEmail        *string        `json:"tls_client_auth_san_email,omitempty"`
+	GrantTypes                   pq.StringArray `json:"grant_types,omitempty"`
+	RegistrationAccessTokenHash  *string        `json:"-"`
+	RequirePAR                   bool           `json:"require_pushed_authorization_requests"`
+	CreatedAt                    time.Time      `json:"created_at"`
+	UpdatedAt                    time.Time      `json:"updated_at"`
+}
+
+// IsPublic は client_secret を持たない公開クライアント（token_endpoint_auth_method=none）かどうか
+func (c *OAuthClient) IsPublic() bool {
+	return c.TokenEndpointAuthMethod == authMethodNone
+}
+
+// PKCERequired は認可リクエストに PKCE（code_challenge）を必須とするかどうか。
+// 公開クライアントはトークン交換時に秘密を示せないため、require_pkce に関係なく必須
+func (c *OAuthClient) PKCERequired() bool {
+	return c.RequirePKCE || c.IsPublic()
+}
+
+// AllowsGrantType は grant_types に grantType が登録されているかどうか（未登録のクライアントはすべて許可）
+func (c *OAuthClient) AllowsGrantType(grantType string) bool {
+	return len(c.GrantTypes) == 0 || slices.Contains(c.GrantTypes, grantType)
+}
+
+// AccessTokenTTL はアクセストークンの有効期間。署名鍵の猶予期間内に切れるよう maxAccessTokenLifetime を超えない
+func (c *OAuthClient) AccessTokenTTL() time.Duration {
+	return min(lifetimeOrDefault(c.AccessTokenLifetime, defaultAccessTokenLifetime), maxAccessTokenLifetime)
+}
+
+// AuthorizationCodeTTL は認可コードの有効期間
+func (c *OAuthClient) AuthorizationCodeTTL() time.Duration {
+	return lifetimeOrDefault(c.AuthorizationCodeLifetime, defaultAuthorizationCodeLifetime)
+}
+
+// RefreshTokenTTL はリフレッシュトークン 1 つあたりの有効期間
+func (c *OAuthClient) RefreshTokenTTL() time.Duration {
+	return lifetimeOrDefault(c.RefreshTokenLifetime, defaultRefreshTokenLifetime)
+}
+
+// RefreshTokenAbsoluteTTL は最初の認可からリフレッシュを続けられる上限
+func (c *OAuthClient) RefreshTokenAbsoluteTTL() time.Duration {
+	return lifetimeOrDefault(c.RefreshTokenAbsoluteLifetime, defaultRefreshTokenAbsoluteLifetime)
+}
+
+// RefreshTokenIdleTTL は最後のリフレッシュからの無操作タイムアウト（0 ならなし）
+func (c *OAuthClient) RefreshTokenIdleTTL() time.Duration {
+	return lifetimeOrDefault(c.RefreshTokenIdleTimeout, 0)
+}
+
+func lifetimeOrDefault(seconds *int, def time.Duration) time.Duration {
+	if seconds == nil || *seconds <= 0 {
+		return def
+	}
+	return time.Duration(*seconds) * time.Second
+}
+
+// RequestedScopes は scope パラメータを分割して返す。省略時はクライアントの既定スコープを返す
+func (c *OAuthClient) RequestedScopes(scope string) []string {
+	if scope != "" {
+		return strings.Fields(scope)
+	}
+	scopes := []string{}
+	for _, s := range c.DefaultScopes {
+		if s != "" {
+			scopes = append(scopes, s)
+		}
+	}
+	return scopes
 }
 
 // AuthorizationCode は認可コード情報を表す構造体
 type AuthorizationCode struct {
 	ID                  int            `json:"id"`
-	Code                string         `json:"code"`
+	CodeHash            string         `json:"code_hash"`
 	ClientID            string         `json:"client_id"`
 	UserID              int            `json:"user_id"`
 	RedirectURI         string         `json:"redirect_uri"`
@@ -40,14 +132,42 @@ type AuthorizationCode struct {
 	CodeChallengeMethod *string        `json:"code_challenge_method"`
 	Nonce               *string        `json:"nonce"`
 	State               *string        `json:"state"`
+	AuthTime            *time.Time     `json:"auth_time"`
+	SessionID           *string        `json:"sid"`
 	ExpiresAt           time.Time      `json:"expires_at"`
 	CreatedAt           time.Time      `json:"created_at"`
 }
 
+// DeviceCode はデバイス認可リクエスト（RFC 8628）を表す構造体
+type DeviceCode struct {
+	ID             int            `json:"id"`
+	DeviceCodeHash string         `json:"device_code_hash"`
+	UserCode       string         `json:"user_code"`
+	ClientID       string         `json:"client_id"`
+	UserID         *int           `json:"user_id"`
+	Scopes         pq.StringArray `json:"scopes"`
+	Status         string         `json:"status"`
+	PollInterval   int            `json:"poll_interval"`
+	LastPolledAt   *time.Time     `json:"last_polled_at"`
+	ExpiresAt      time.Time      `json:"expires_at"`
+	CreatedAt      time.Time      `json:"created_at"`
+}
+
+// PushedAuthorizationRequest は PAR（RFC 9126）で受け取った認可パラメータを表す構造体。
+// Parameters は application/x-www-form-urlencoded の形で保存する
+type PushedAuthorizationRequest struct {
+	ID             int       `json:"id"`
+	RequestURIHash string    `json:"request_uri_hash"`
+	ClientID       string    `json:"client_id"`
+	Parameters     string    `json:"parameters"`
+	ExpiresAt      time.Time `json:"expires_at"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
 // AccessToken はアクセストークン情報を表す構造体
 type AccessToken struct {
 	ID        int            `json:"id"`
-	Token     string         `json:"token"`
+	JTI       string         `json:"jti"`
 	ClientID  string         `json:"client_id"`
 	UserID    *int           `json:"user_id"`
 	Scopes    pq.StringArray `json:"scopes"`
@@ -55,19 +175,54 @@ type AccessToken struct {
 	CreatedAt time.Time      `json:"created_at"`
 }
 
-// RefreshToken はリフレッシュトークン情報を表す構造体
+// RefreshToken はリフレッシュトークン情報を表す構造体。
+// ClientID 以降は所属するファミリー（refresh_token_families）の値。
 type RefreshToken struct {
-	ID            int       `json:"id"`
-	Token         string    `json:"token"`
-	AccessTokenID int       `json:"access_token_id"`
-	ExpiresAt     time.Time `json:"expires_at"`
-	CreatedAt     time.Time `json:"created_at"`
+	ID                  int            `json:"id"`
+	TokenHash           string         `json:"token_hash"`
+	FamilyID            int            `json:"family_id"`
+	AccessTokenID       *int           `json:"access_token_id"` // 使用済み（ローテーション済み）なら NULL
+	Scopes              pq.StringArray `json:"scopes"`
+	UsedAt              *time.Time     `json:"used_at"`
+	ExpiresAt           time.Time      `json:"expires_at"`
+	CreatedAt           time.Time      `json:"created_at"`
+	ClientID            string         `json:"client_id"`
+	UserID              int            `json:"user_id"`
+	FamilyExpiresAt     time.Time      `json:"family_expires_at"`      // 絶対的な有効期限（ローテーションしても延びない）
+	FamilyIdleExpiresAt *time.Time     `json:"family_idle_expires_at"` // アイドルタイムアウト（使うたびに延長、NULL ならなし）
+	FamilyRevokedAt     *time.Time     `json:"family_revoked_at"`
+	FamilyDPoPJKT       *string        `json:"family_dpop_jkt"` // 公開クライアントが DPoP で取得したときの鍵のサムプリント
+	FamilyX5TS256       *string        `json:"family_x5t_s256"` // 公開クライアントが mTLS で取得したときの証明書のサムプリント
 }
 
 // RefreshTokenBundle は grant_type=refresh_token 時に JWT クレームを組み立てるための中間データ。
+// Scopes は元の認可で付与されたスコープ（scope パラメータによる縮小の上限）。
+// DPoPJKT / CertThumbprint が空でなければ、リフレッシュにも同じ鍵の DPoP 証明・同じクライアント証明書が必要。
 type RefreshTokenBundle struct {
-	UserID int      `json:"user_id"`
-	Scopes []string `json:"scopes"`
+	UserID         int      `json:"user_id"`
+	Scopes         []string `json:"scopes"`
+	DPoPJKT        string   `json:"dpop_jkt,omitempty"`
+	CertThumbprint string   `json:"x5t#S256,omitempty"`
+}
+
+// UserGrant はユーザーがクライアントに同意したスコープを表す構造体
+type UserGrant struct {
+	ID        int            `json:"id"`
+	UserID    int            `json:"user_id"`
+	ClientID  string         `json:"client_id"`
+	Scopes    pq.StringArray `json:"scopes"`
+	CreatedAt time.Time      `json:"created_at"`
+	UpdatedAt time.Time      `json:"updated_at"`
+}
+
+// Covers は scopes がすべて同意済みかどうかを返す（同意画面を省略できるか）
+func (g *UserGrant) Covers(scopes []string) bool {
+	for _, s := range scopes {
+		if !slices.Contains(g.Scopes, s) {
+			return false
+		}
+	}
+	return true
 }
 
 // Session はセッション情報を表す構造体
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestRequestedScopes(t *testing.T) {
+	client := &OAuthClient{DefaultScopes: []string{"openid", "", "read"}}
+	tests := []struct {
+		name  string
+		scope string
+		want  []string
+	}{
+		{"指定したスコープ", "openid profile", []string{"openid", "profile"}},
+		{"連続した空白", "  read   write ", []string{"read", "write"}},
+		{"省略時は既定スコープ（空要素は除く）", "", []string{"openid", "read"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := client.RequestedScopes(tt.scope); !slices.Equal(got, tt.want) {
+				t.Errorf("RequestedScopes(%q) = %v, want %v", tt.scope, got, tt.want)
+			}
+		})
+	}
+
+	if got := (&OAuthClient{}).RequestedScopes(""); got == nil || len(got) != 0 {
+		t.Errorf("既定スコープが無いクライアント: %#v, want 空のスライス", got)
+	}
+}
+
+func TestClientTokenLifetimes(t *testing.T) {
+	seconds := func(n int) *int { return &n }
+	tests := []struct {
+		name   string
+		client *OAuthClient
+		got    func(c *OAuthClient) time.Duration
+		want   time.Duration
+	}{
+		{"アクセストークンの既定値", &OAuthClient{}, (*OAuthClient).AccessTokenTTL, defaultAccessTokenLifetime},
+		{"アクセストークン", &OAuthClient{AccessTokenLifetime: seconds(300)}, (*OAuthClient).AccessTokenTTL, 5 * time.Minute},
+		{"0 以下は既定値", &OAuthClient{AccessTokenLifetime: seconds(0)}, (*OAuthClient).AccessTokenTTL, defaultAccessTokenLifetime},
+		{"負の値は既定値", &OAuthClient{AccessTokenLifetime: seconds(-1)}, (*OAuthClient).AccessTokenTTL, defaultAccessTokenLifetime},
+		{"署名鍵の猶予期間を超えるアクセストークン", &OAuthClient{AccessTokenLifetime: seconds(7 * 86400)}, (*OAuthClient).AccessTokenTTL, maxAccessTokenLifetime},
+		{"認可コードの既定値", &OAuthClient{}, (*OAuthClient).AuthorizationCodeTTL, defaultAuthorizationCodeLifetime},
+		{"認可コード", &OAuthClient{AuthorizationCodeLifetime: seconds(60)}, (*OAuthClient).AuthorizationCodeTTL, time.Minute},
+		{"リフレッシュトークンの既定値", &OAuthClient{}, (*OAuthClient).RefreshTokenTTL, defaultRefreshTokenLifetime},
+		{"リフレッシュトークン", &OAuthClient{RefreshTokenLifetime: seconds(3600)}, (*OAuthClient).RefreshTokenTTL, time.Hour},
+		{"絶対的な上限の既定値", &OAuthClient{}, (*OAuthClient).RefreshTokenAbsoluteTTL, defaultRefreshTokenAbsoluteLifetime},
+		{"絶対的な上限", &OAuthClient{RefreshTokenAbsoluteLifetime: seconds(86400)}, (*OAuthClient).RefreshTokenAbsoluteTTL, 24 * time.Hour},
+		{"アイドルタイムアウトは既定でなし", &OAuthClient{}, (*OAuthClient).RefreshTokenIdleTTL, 0},
+		{"アイドルタイムアウト", &OAuthClient{RefreshTokenIdleTimeout: seconds(1800)}, (*OAuthClient).RefreshTokenIdleTTL, 30 * time.Minute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.got(tt.client); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// mTLS（RFC 8705）: クライアント証明書によるクライアント認証と、アクセストークンの証明書への結びつけ（cnf.x5t#S256）。
+// 既存の HTTP リスナーとは別に、MTLS_LISTEN_ADDR を設定したときだけクライアント証明書を要求する TLS リスナーを開く。
+// 証明書チェーンの検証は方式ごとに異なるため、ハンドシェイクでは証明書を受け取るだけにして（tls.RequestClientCert）、
+// 検証は authenticateTLSClient で行う。
+
+// mtlsEnabled は mTLS のリスナーを開くかどうか（MTLS_LISTEN_ADDR が設定されている）。
+func mtlsEnabled() bool {
+	return os.Getenv("MTLS_LISTEN_ADDR") != ""
+}
+
+// mtlsBaseURL は mTLS リスナーの外部公開 URL。Discovery の mtls_endpoint_aliases と DPoP 証明の htu に使う。
+func mtlsBaseURL() string {
+	if u := os.Getenv("MTLS_BASE_URL"); u != "" {
+		return strings.TrimRight(u, "/")
+	}
+	addr := os.Getenv("MTLS_LISTEN_ADDR")
+	if strings.HasPrefix(addr, ":") {
+		addr = "localhost" + addr
+	}
+	return "https://" + addr
+}
+
+// endpointURL はリクエストを受けたリスナーから見たエンドポイントの URL（mTLS で受けたときは別名の URL）。
+func endpointURL(r *http.Request, path string) string {
+	if r.TLS != nil && mtlsEnabled() {
+		return mtlsBaseURL() + path
+	}
+	return serverBaseURL() + path
+}
+
+// newMTLSServer は mTLS 用の http.Server を作る。サーバー証明書は MTLS_CERT_FILE / MTLS_KEY_FILE。
+func newMTLSServer(handler http.Handler) (*http.Server, error) {
+	certFile, keyFile := os.Getenv("MTLS_CERT_FILE"), os.Getenv("MTLS_KEY_FILE")
+	if certFile == "" || keyFile == "" {
+		return nil, fmt.Errorf("MTLS_CERT_FILE と MTLS_KEY_FILE が必要です")
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("mTLS のサーバー証明書の読み込みエラー: %w", err)
+	}
+	if _, err := mtlsClientCAs(); err != nil {
+		return nil, err
+	}
+	return &http.Server{
+		Addr:    os.Getenv("MTLS_LISTEN_ADDR"),
+		Handler: handler,
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			ClientAuth:   tls.RequestClientCert,
+			MinVersion:   tls.VersionTLS12,
+		},
+		ReadHeaderTimeout: 3 * time.Second,
+		IdleTimeout:       60 * time.Second,
+	}, nil
+}
+
+// mtlsClientCAs は tls_client_auth の証明書チェーンを検証する信頼済み CA（MTLS_CLIENT_CA_FILE の PEM）。
+// 未設定なら nil で、tls_client_auth のクライアントは認証できない。
+var mtlsClientCAs = sync.OnceValues(func() (*x509.CertPool, error) {
+	path := os.Getenv("MTLS_CLIENT_CA_FILE")
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("MTLS_CLIENT_CA_FILE の読み込みエラー: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("MTLS_CLIENT_CA_FILE に証明書がありません")
+	}
+	return pool, nil
+})
+
+// clientCertificate は TLS ハンドシェイクで提示されたクライアント証明書（無ければ nil）。
+func clientCertificate(r *http.Request) *x509.Certificate {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return nil
+	}
+	return r.TLS.PeerCertificates[0]
+}
+
+// certificateThumbprint は証明書（DER）の SHA-256 を BASE64URL にしたもの（cnf の x5t#S256、RFC 8705 3.1）。
+func certificateThumbprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// isTLSClientAuthMethod は証明書で認証する方式かどうか
+func isTLSClientAuthMethod(method string) bool {
+	return method == authMethodTLSClientAuth || method == authMethodSelfSignedTLSClientAuth
+}
+
+// authenticateTLSClient は提示されたクライアント証明書がクライアントの登録内容と一致するかを確認する。
+//   - tls_client_auth（RFC 8705 2.1）: MTLS_CLIENT_CA_FILE の CA でチェーンを検証し、登録した subject DN か SAN と照合する
+//   - self_signed_tls_client_auth（RFC 8705 2.2）: 証明書の公開鍵がクライアントの jwks / jwks_uri の鍵と一致すること
+func authenticateTLSClient(ctx context.Context, r *http.Request, client *OAuthClient) error {
+	cert := clientCertificate(r)
+	if cert == nil {
+		return fmt.Errorf("クライアント証明書が提示されていません")
+	}
+	now := time.Now()
+	if now.Before(cert.NotBefore) || now.After(cert.NotAfter) {
+		return fmt.Errorf("クライアント証明書の有効期間外です")
+	}
+
+	switch client.TokenEndpointAuthMethod {
+	case authMethodTLSClientAuth:
+		roots, err := mtlsClientCAs()
+		if err != nil {
+			return err
+		}
+		if roots == nil {
+			return fmt.Errorf("MTLS_CLIENT_CA_FILE が設定されていないため tls_client_auth を使えません")
+		}
+		intermediates := x509.NewCertPool()
+		for _, c := range r.TLS.PeerCertificates[1:] {
+			intermediates.AddCert(c)
+		}
+		_, err = cert.Verify(x509.VerifyOptions{
+			Roots:         roots,
+			Intermediates: intermediates,
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		})
+		if err != nil {
+			return fmt.Errorf("クライアント証明書のチェーン検証エラー: %w", err)
+		}
+		return matchTLSClientAuthSubject(client, cert)
+	case authMethodSelfSignedTLSClientAuth:
+		keys, err := clientPublicKeys(ctx, client)
+		if err != nil {
+			return err
+		}
+		for _, k := range keys {
+			if pub, ok := k.(interface{ Equal(crypto.PublicKey) bool }); ok && pub.Equal(cert.PublicKey) {
+				return nil
+			}
+		}
+		return fmt.Errorf("クライアント証明書の公開鍵がクライアントの JWKS にありません")
+	}
+	return fmt.Errorf("証明書で認証するクライアントではありません: %s", client.TokenEndpointAuthMethod)
+}
+
+// matchTLSClientAuthSubject は登録された tls_client_auth_* のいずれか 1 つと証明書を照合する（RFC 8705 2.1.2）。
+// subject DN は Go の RFC 2253 形式（例: CN=mtls_service_client,O=Example）で比較する。
+func matchTLSClientAuthSubject(client *OAuthClient, cert *x509.Certificate) error {
+	switch {
+	case client.TLSClientAuthSubjectDN != nil:
+		if cert.Subject.String() == *client.TLSClientAuthSubjectDN {
+			return nil
+		}
+	case client.TLSClientAuthSANDNS != nil:
+		if slices.Contains(cert.DNSNames, *client.TLSClientAuthSANDNS) {
+			return nil
+		}
+	case client.TLSClientAuthSANURI != nil:
+		for _, u := range cert.URIs {
+			if u.String() == *client.TLSClientAuthSANURI {
+				return nil
+			}
+		}
+	case client.TLSClientAuthSANIP != nil:
+		want := net.ParseIP(*client.TLSClientAuthSANIP)
+		for _, ip := range cert.IPAddresses {
+			if ip.Equal(want) {
+				return nil
+			}
+		}
+	case client.TLSClientAuthSANEmail != nil:
+		if slices.Contains(cert.EmailAddresses, *client.TLSClientAuthSANEmail) {
+			return nil
+		}
+	default:
+		return fmt.Errorf("tls_client_auth の subject DN / SAN が登録されていません")
+	}
+	return fmt.Errorf("クライアント証明書の subject が登録内容と一致しません: %s", cert.Subject.String())
+}
+
+// checkCertificateBinding は cnf.x5t#S256 のあるアクセストークンが、同じ証明書の mTLS 接続で使われているかを確認する（RFC 8705 3）。
+func checkCertificateBinding(r *http.Request, cnf *tokenConfirmation) error {
+	if cnf == nil || cnf.X5TS256 == "" {
+		return nil
+	}
+	cert := clientCertificate(r)
+	if cert == nil {
+		return fmt.Errorf("証明書に結びついたトークンがクライアント証明書なしで使われました")
+	}
+	if subtle.ConstantTimeCompare([]byte(certificateThumbprint(cert)), []byte(cnf.X5TS256)) != 1 {
+		return fmt.Errorf("クライアント証明書がトークンの cnf.x5t#S256 と一致しません")
+	}
+	return nil
+}
+
+// mtlsDiscoveryJSON は Discovery に追加する mtls_endpoint_aliases（RFC 8705 5）。mTLS が無効なら空文字列。
+func mtlsDiscoveryJSON() string {
+	if !mtlsEnabled() {
+		return ""
+	}
+	base := mtlsBaseURL()
+	b, _ := json.MarshalIndent(map[string]string{
+		"token_endpoint":                        base + "/token",
+		"revocation_endpoint":                   base + "/revoke",
+		"introspection_endpoint":                base + "/introspect",
+		"userinfo_endpoint":                     base + "/userinfo",
+		"device_authorization_endpoint":         base + "/device_authorization",
+		"pushed_authorization_request_endpoint": base + "/par",
+	}, "  ", "  ")
+	return fmt.Sprintf(",\n  \"mtls_endpoint_aliases\": %s", b)
+}
@@ -0,0 +1,401 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// テスト用の CA と証明書。鍵はいずれも P-256。
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T, cn string) *testCA {
+	t.Helper()
+	key := newTestECKey(t)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key}
+}
+
+// intermediate は ca が署名した中間 CA を作る。
+func (ca *testCA) intermediate(t *testing.T, cn string) *testCA {
+	t.Helper()
+	key := newTestECKey(t)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(2),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key}
+}
+
+// issue は tmpl の内容でクライアント証明書を発行する。chain は証明書の後ろに付けて送る中間 CA。
+func (ca *testCA) issue(t *testing.T, tmpl *x509.Certificate, chain ...*testCA) *tls.Certificate {
+	t.Helper()
+	key := newTestECKey(t)
+	der, err := x509.CreateCertificate(rand.Reader, clientCertTemplate(tmpl), ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	for _, c := range chain {
+		cert.Certificate = append(cert.Certificate, c.cert.Raw)
+	}
+	return cert
+}
+
+// newSelfSignedCert は key の自己署名のクライアント証明書を作る（self_signed_tls_client_auth 用）。
+func newSelfSignedCert(t *testing.T, key *ecdsa.PrivateKey) *tls.Certificate {
+	t.Helper()
+	tmpl := clientCertTemplate(&x509.Certificate{Subject: pkix.Name{CommonName: "self-signed"}})
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// clientCertTemplate は tmpl に有効期間・用途の既定値を埋める。
+func clientCertTemplate(tmpl *x509.Certificate) *x509.Certificate {
+	c := *tmpl
+	if c.SerialNumber == nil {
+		c.SerialNumber = big.NewInt(time.Now().UnixNano())
+	}
+	if c.NotBefore.IsZero() {
+		c.NotBefore = time.Now().Add(-time.Hour)
+	}
+	if c.NotAfter.IsZero() {
+		c.NotAfter = time.Now().Add(time.Hour)
+	}
+	if c.ExtKeyUsage == nil {
+		c.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	}
+	c.KeyUsage = x509.KeyUsageDigitalSignature
+	return &c
+}
+
+func newTestECKey(t *testing.T) *ecdsa.PrivateKey {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// serveTLS はクライアント証明書を要求する httptest の TLS サーバーへ clientCert（nil なら提示しない）で接続し、
+// サーバー側で受けたリクエストに f を適用した結果を返す。
+func serveTLS(t *testing.T, clientCert *tls.Certificate, f func(r *http.Request) error) error {
+	t.Helper()
+	result := make(chan error, 1)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		result <- f(r)
+	}))
+	srv.TLS = &tls.Config{ClientAuth: tls.RequestClientCert, MinVersion: tls.VersionTLS12}
+	srv.StartTLS()
+	defer srv.Close()
+
+	client := srv.Client()
+	if clientCert != nil {
+		client.Transport.(*http.Transport).TLSClientConfig.Certificates = []tls.Certificate{*clientCert}
+	}
+	res, err := client.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	return <-result
+}
+
+// useTestClientCAs は tls_client_auth の信頼済み CA（MTLS_CLIENT_CA_FILE の代わり）を設定する。
+func useTestClientCAs(t *testing.T, cas ...*testCA) {
+	t.Helper()
+	pool := x509.NewCertPool()
+	for _, ca := range cas {
+		pool.AddCert(ca.cert)
+	}
+	prev := mtlsClientCAs
+	mtlsClientCAs = func() (*x509.CertPool, error) { return pool, nil }
+	t.Cleanup(func() { mtlsClientCAs = prev })
+}
+
+func TestAuthenticateTLSClientAuth(t *testing.T) {
+	ca := newTestCA(t, "Test Client CA")
+	useTestClientCAs(t, ca)
+	inter := ca.intermediate(t, "Test Intermediate CA")
+	untrusted := newTestCA(t, "Untrusted CA")
+
+	uri, _ := url.Parse("spiffe://example.com/mtls_service_client")
+	leaf := ca.issue(t, &x509.Certificate{
+		Subject:        pkix.Name{CommonName: "mtls_service_client", Organization: []string{"Example"}},
+		DNSNames:       []string{"client.example.com"},
+		URIs:           []*url.URL{uri},
+		IPAddresses:    []net.IP{net.ParseIP("192.0.2.10")},
+		EmailAddresses: []string{"ops@example.com"},
+	})
+	str := func(s string) *string { return &s }
+	client := func(set func(c *OAuthClient)) *OAuthClient {
+		c := &OAuthClient{ClientID: "mtls_service_client", TokenEndpointAuthMethod: authMethodTLSClientAuth}
+		if set != nil {
+			set(c)
+		}
+		return c
+	}
+	byDN := client(func(c *OAuthClient) { c.TLSClientAuthSubjectDN = str("CN=mtls_service_client,O=Example") })
+
+	tests := []struct {
+		name    string
+		cert    *tls.Certificate
+		client  *OAuthClient
+		wantErr bool
+	}{
+		{"subject DN が一致", leaf, byDN, false},
+		{"subject DN が一致しない", leaf, client(func(c *OAuthClient) { c.TLSClientAuthSubjectDN = str("CN=other,O=Example") }), true},
+		{"SAN の DNS が一致", leaf, client(func(c *OAuthClient) { c.TLSClientAuthSANDNS = str("client.example.com") }), false},
+		{"SAN の DNS が一致しない", leaf, client(func(c *OAuthClient) { c.TLSClientAuthSANDNS = str("other.example.com") }), true},
+		{"SAN の URI が一致", leaf, client(func(c *OAuthClient) { c.TLSClientAuthSANURI = str("spiffe://example.com/mtls_service_client") }), false},
+		{"SAN の IP が一致（表記が違っても同じアドレス）", leaf, client(func(c *OAuthClient) { c.TLSClientAuthSANIP = str("::ffff:192.0.2.10") }), false},
+		{"SAN の IP が一致しない", leaf, client(func(c *OAuthClient) { c.TLSClientAuthSANIP = str("192.0.2.11") }), true},
+		{"SAN のメールアドレスが一致", leaf, client(func(c *OAuthClient) { c.TLSClientAuthSANEmail = str("ops@example.com") }), false},
+		{"subject DN / SAN が登録されていない", leaf, client(nil), true},
+		{"中間 CA を送ればチェーンを検証できる", inter.issue(t, &x509.Certificate{
+			Subject: pkix.Name{CommonName: "mtls_service_client", Organization: []string{"Example"}},
+		}, inter), byDN, false},
+		{"中間 CA を送らないとチェーンを検証できない", inter.issue(t, &x509.Certificate{
+			Subject: pkix.Name{CommonName: "mtls_service_client", Organization: []string{"Example"}},
+		}), byDN, true},
+		{"信頼していない CA の証明書", untrusted.issue(t, &x509.Certificate{
+			Subject: pkix.Name{CommonName: "mtls_service_client", Organization: []string{"Example"}},
+		}), byDN, true},
+		{"同じ subject の自己署名証明書", newSelfSignedCert(t, newTestECKey(t)), byDN, true},
+		{"クライアント認証用ではない証明書", ca.issue(t, &x509.Certificate{
+			Subject:     pkix.Name{CommonName: "mtls_service_client", Organization: []string{"Example"}},
+			ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		}), byDN, true},
+		{"有効期限切れ", ca.issue(t, &x509.Certificate{
+			Subject:   pkix.Name{CommonName: "mtls_service_client", Organization: []string{"Example"}},
+			NotBefore: time.Now().Add(-2 * time.Hour),
+			NotAfter:  time.Now().Add(-time.Hour),
+		}), byDN, true},
+		{"証明書を提示しない", nil, byDN, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := serveTLS(t, tt.cert, func(r *http.Request) error {
+				return authenticateTLSClient(context.Background(), r, tt.client)
+			})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("authenticateTLSClient() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestAuthenticateTLSClientAuthWithoutCA(t *testing.T) {
+	prev := mtlsClientCAs
+	mtlsClientCAs = func() (*x509.CertPool, error) { return nil, nil }
+	t.Cleanup(func() { mtlsClientCAs = prev })
+
+	ca := newTestCA(t, "Test Client CA")
+	dn := "CN=mtls_service_client"
+	client := &OAuthClient{ClientID: "mtls_service_client", TokenEndpointAuthMethod: authMethodTLSClientAuth, TLSClientAuthSubjectDN: &dn}
+	err := serveTLS(t, ca.issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: "mtls_service_client"}}), func(r *http.Request) error {
+		return authenticateTLSClient(context.Background(), r, client)
+	})
+	if err == nil {
+		t.Error("MTLS_CLIENT_CA_FILE が無いのに tls_client_auth で認証できました")
+	}
+}
+
+func TestAuthenticateSelfSignedTLSClient(t *testing.T) {
+	key := newTestECKey(t)
+	registered := newTestSigningKey(t, "ES256")
+	signer, err := newLocalSigner(key, "ES256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	certKey := &signingKey{ID: "cert-key", Alg: "ES256", Public: signer.Public()}
+	ca := newTestCA(t, "Test Client CA")
+
+	tests := []struct {
+		name    string
+		cert    *tls.Certificate
+		jwks    *string
+		wantErr bool
+	}{
+		{"JWKS に登録した鍵の自己署名証明書", newSelfSignedCert(t, key), testClientJWKS(t, registered, certKey), false},
+		{"JWKS に無い鍵の自己署名証明書", newSelfSignedCert(t, key), testClientJWKS(t, registered), true},
+		{"CA が発行しても鍵が JWKS に無ければ不可", ca.issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: "self_signed_client"}}), testClientJWKS(t, certKey), true},
+		{"証明書を提示しない", nil, testClientJWKS(t, certKey), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &OAuthClient{ClientID: "self_signed_client", TokenEndpointAuthMethod: authMethodSelfSignedTLSClientAuth, JWKS: tt.jwks}
+			err := serveTLS(t, tt.cert, func(r *http.Request) error {
+				return authenticateTLSClient(context.Background(), r, client)
+			})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("authenticateTLSClient() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCertificateBoundTokens(t *testing.T) {
+	t.Setenv("SERVER_BASE_URL", "https://as.example.com")
+	useTestSigningKey(t, "ES256")
+	ca := newTestCA(t, "Test Client CA")
+	cert := ca.issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: "public_mtls_client"}})
+	otherCert := ca.issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: "public_mtls_client"}})
+
+	// トークンエンドポイント: 接続のクライアント証明書から cnf.x5t#S256 を作ってアクセストークンに入れる
+	var cnf *tokenConfirmation
+	if err := serveTLS(t, cert, func(r *http.Request) error {
+		cnf = newTokenConfirmation("", clientCertificate(r))
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if cnf == nil || cnf.X5TS256 == "" {
+		t.Fatal("cnf.x5t#S256 が作られていません")
+	}
+	token, err := generateJWTAccessToken(1, "testuser", "public_mtls_client", "read", time.Minute, cnf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := validateJWTToken(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Confirmation == nil || claims.Confirmation.X5TS256 != cnf.X5TS256 {
+		t.Fatalf("アクセストークンの cnf = %+v", claims.Confirmation)
+	}
+
+	t.Run("アクセストークン", func(t *testing.T) {
+		tests := []struct {
+			name    string
+			cert    *tls.Certificate
+			wantErr bool
+		}{
+			{"同じ証明書", cert, false},
+			{"別の証明書", otherCert, true},
+			{"証明書なし", nil, true},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				err := serveTLS(t, tt.cert, func(r *http.Request) error {
+					return checkCertificateBinding(r, claims.Confirmation)
+				})
+				if (err != nil) != tt.wantErr {
+					t.Errorf("checkCertificateBinding() error = %v, wantErr %v", err, tt.wantErr)
+				}
+			})
+		}
+	})
+
+	t.Run("リフレッシュトークン", func(t *testing.T) {
+		// 公開クライアントのリフレッシュトークンは証明書に結びつき、機密クライアントは結びつけない
+		public := &OAuthClient{TokenEndpointAuthMethod: authMethodNone}
+		confidential := &OAuthClient{TokenEndpointAuthMethod: authMethodTLSClientAuth}
+		binding := refreshTokenBinding(public, cnf)
+		if binding == nil || binding.X5TS256 != cnf.X5TS256 {
+			t.Fatalf("公開クライアントのリフレッシュトークンが証明書に結びついていません: %+v", binding)
+		}
+		if refreshTokenBinding(confidential, cnf) != nil {
+			t.Error("機密クライアントのリフレッシュトークンが証明書に結びついています")
+		}
+		bundle := &RefreshTokenBundle{UserID: 1, CertThumbprint: binding.X5TS256}
+
+		tests := []struct {
+			name    string
+			cert    *tls.Certificate
+			wantErr bool
+		}{
+			{"同じ証明書でリフレッシュ", cert, false},
+			{"別の証明書でリフレッシュ", otherCert, true},
+			{"証明書なしでリフレッシュ", nil, true},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				var e *oauthError
+				if err := serveTLS(t, tt.cert, func(r *http.Request) error {
+					e = checkRefreshTokenBinding(bundle, newTokenConfirmation("", clientCertificate(r)))
+					return nil
+				}); err != nil {
+					t.Fatal(err)
+				}
+				if (e != nil) != tt.wantErr {
+					t.Errorf("checkRefreshTokenBinding() = %+v, wantErr %v", e, tt.wantErr)
+				}
+				if e != nil && e.Code != "invalid_grant" {
+					t.Errorf("error = %s, want invalid_grant", e.Code)
+				}
+			})
+		}
+	})
+}
+
+func TestCheckRefreshTokenBindingDPoP(t *testing.T) {
+	tests := []struct {
+		name    string
+		bundle  *RefreshTokenBundle
+		cnf     *tokenConfirmation
+		wantErr bool
+	}{
+		{"結びついていない", &RefreshTokenBundle{}, nil, false},
+		{"結びついていないトークンを DPoP で使う", &RefreshTokenBundle{}, &tokenConfirmation{JKT: "jkt-a"}, false},
+		{"同じ鍵", &RefreshTokenBundle{DPoPJKT: "jkt-a"}, &tokenConfirmation{JKT: "jkt-a"}, false},
+		{"別の鍵", &RefreshTokenBundle{DPoPJKT: "jkt-a"}, &tokenConfirmation{JKT: "jkt-b"}, true},
+		{"証明なし", &RefreshTokenBundle{DPoPJKT: "jkt-a"}, nil, true},
+		{"証明書だけ提示", &RefreshTokenBundle{DPoPJKT: "jkt-a"}, &tokenConfirmation{X5TS256: "x5t"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if e := checkRefreshTokenBinding(tt.bundle, tt.cnf); (e != nil) != tt.wantErr {
+				t.Errorf("checkRefreshTokenBinding() = %+v, wantErr %v", e, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// oauthError は RFC 6749 のエラーレスポンス（トークンエンドポイントの JSON 5.2、認可エンドポイントのリダイレクト 4.1.2.1）を表す。
+// Description / URI はクライアント開発者向けの英語の説明で、ユーザーには表示しない想定。
+type oauthError struct {
+	Status      int
+	Code        string
+	Description string
+	URI         string
+}
+
+func (e *oauthError) Error() string {
+	if e.Description == "" {
+		return e.Code
+	}
+	return e.Code + ": " + e.Description
+}
+
+// RFC のエラーコード定義箇所。error_uri としてクライアントに返す
+const (
+	rfc6749TokenErrorURI     = "https://datatracker.ietf.org/doc/html/rfc6749#section-5.2"
+	rfc6749AuthorizeErrorURI = "https://datatracker.ietf.org/doc/html/rfc6749#section-4.1.2.1"
+	rfc8628ErrorURI          = "https://datatracker.ietf.org/doc/html/rfc8628#section-3.5"
+	rfc7591ErrorURI          = "https://datatracker.ietf.org/doc/html/rfc7591#section-3.2.2"
+)
+
+func newOAuthError(status int, code, description, uri string) *oauthError {
+	return &oauthError{Status: status, Code: code, Description: description, URI: uri}
+}
+
+// トークンエンドポイント系（/token, /revoke, /introspect, /device_authorization）のエラー
+
+func errInvalidRequest(description string) *oauthError {
+	return newOAuthError(http.StatusBadRequest, "invalid_request", description, rfc6749TokenErrorURI)
+}
+
+func errInvalidClient(description string) *oauthError {
+	return newOAuthError(http.StatusUnauthorized, "invalid_client", description, rfc6749TokenErrorURI)
+}
+
+func errInvalidGrant(description string) *oauthError {
+	return newOAuthError(http.StatusBadRequest, "invalid_grant", description, rfc6749TokenErrorURI)
+}
+
+func errUnauthorizedClient(description string) *oauthError {
+	return newOAuthError(http.StatusBadRequest, "unauthorized_client", description, rfc6749TokenErrorURI)
+}
+
+func errUnsupportedGrantType(description string) *oauthError {
+	return newOAuthError(http.StatusBadRequest, "unsupported_grant_type", description, rfc6749TokenErrorURI)
+}
+
+func errInvalidScope(description string) *oauthError {
+	return newOAuthError(http.StatusBadRequest, "invalid_scope", description, rfc6749TokenErrorURI)
+}
+
+func errServerError() *oauthError {
+	return newOAuthError(http.StatusInternalServerError, "server_error", "internal server error", "")
+}
+
+// デバイスコードグラントのポーリング結果（RFC 8628 3.5）
+func errDeviceGrant(code string) *oauthError {
+	return newOAuthError(http.StatusBadRequest, code, "", rfc8628ErrorURI)
+}
+
+// 動的クライアント登録（/register）のエラー（RFC 7591 3.2.2）
+
+func errInvalidClientMetadata(description string) *oauthError {
+	return newOAuthError(http.StatusBadRequest, "invalid_client_metadata", description, rfc7591ErrorURI)
+}
+
+func errInvalidRedirectURI(description string) *oauthError {
+	return newOAuthError(http.StatusBadRequest, "invalid_redirect_uri", description, rfc7591ErrorURI)
+}
+
+// writeOAuthError は RFC 6749 5.2 形式の JSON エラーを書き出す。
+// invalid_client は 401 とし、WWW-Authenticate でクライアント認証方式を示す。
+func writeOAuthError(w http.ResponseWriter, e *oauthError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Pragma", "no-cache")
+	if e.Code == "invalid_client" {
+		w.Header().Set("WWW-Authenticate", `Basic realm="oauth2-server"`)
+	}
+	w.WriteHeader(e.Status)
+
+	body := map[string]string{"error": e.Code}
+	if e.Description != "" {
+		body["error_description"] = e.Description
+	}
+	if e.URI != "" {
+		body["error_uri"] = e.URI
+	}
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+// 認可エンドポイントのリダイレクトで返すエラー（RFC 6749 4.1.2.1）
+
+func errAuthorize(code, description string) *oauthError {
+	return newOAuthError(http.StatusFound, code, description, rfc6749AuthorizeErrorURI)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWriteOAuthError(t *testing.T) {
+	tests := []struct {
+		name           string
+		err            *oauthError
+		wantStatus     int
+		wantBody       map[string]string
+		wantChallenged bool
+	}{
+		{"invalid_client は 401 と WWW-Authenticate", errInvalidClient("client authentication failed"), http.StatusUnauthorized, map[string]string{
+			"error":             "invalid_client",
+			"error_description": "client authentication failed",
+			"error_uri":         rfc6749TokenErrorURI,
+		}, true},
+		{"invalid_grant は 400", errInvalidGrant("the authorization code is invalid"), http.StatusBadRequest, map[string]string{
+			"error":             "invalid_grant",
+			"error_description": "the authorization code is invalid",
+			"error_uri":         rfc6749TokenErrorURI,
+		}, false},
+		{"server_error は error_uri を付けない", errServerError(), http.StatusInternalServerError, map[string]string{
+			"error":             "server_error",
+			"error_description": "internal server error",
+		}, false},
+		{"説明の無いエラー", errDeviceGrant("slow_down"), http.StatusBadRequest, map[string]string{
+			"error":     "slow_down",
+			"error_uri": rfc8628ErrorURI,
+		}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			writeOAuthError(rec, tt.err)
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if got := rec.Header().Get("WWW-Authenticate") != ""; got != tt.wantChallenged {
+				t.Errorf("WWW-Authenticate = %q", rec.Header().Get("WWW-Authenticate"))
+			}
+			if rec.Header().Get("Content-Type") != "application/json" || rec.Header().Get("Cache-Control") != "no-store" {
+				t.Errorf("Content-Type = %q, Cache-Control = %q", rec.Header().Get("Content-Type"), rec.Header().Get("Cache-Control"))
+			}
+			var body map[string]string
+			if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+				t.Fatal(err)
+			}
+			if len(body) != len(tt.wantBody) {
+				t.Errorf("body = %v, want %v", body, tt.wantBody)
+			}
+			for k, v := range tt.wantBody {
+				if body[k] != v {
+					t.Errorf("%s = %q, want %q", k, body[k], v)
+				}
+			}
+		})
+	}
+}
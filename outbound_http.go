@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"syscall"
+	"time"
+)
+
+// クライアントが登録した URL（jwks_uri / request_uris）をサーバーから取得するための HTTP クライアント。
+// 登録時に https を確認するだけでは、名前解決の結果がループバックや内部ネットワークを指す URL で
+// サーバー内部へリクエストさせられる（SSRF）。そのため接続する直前に、名前解決後の IP アドレスで判定する。
+
+const (
+	outboundTimeout      = 5 * time.Second
+	outboundMaxRedirects = 3
+)
+
+// errOutboundAddressBlocked は接続先が外部に公開されたアドレスではない場合のエラー。
+var errOutboundAddressBlocked = errors.New("内部ネットワークのアドレスへは接続できません")
+
+// outboundBlockedPrefixes は netip.Addr の判定メソッドで拾えない、外部から到達できないアドレス範囲。
+var outboundBlockedPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),     // this network（Linux ではローカルホストに届く）
+	netip.MustParsePrefix("100.64.0.0/10"), // CGNAT の共有アドレス（RFC 6598）
+	netip.MustParsePrefix("192.0.0.0/24"),  // IETF プロトコル割り当て
+	netip.MustParsePrefix("198.18.0.0/15"), // ベンチマーク用
+	netip.MustParsePrefix("240.0.0.0/4"),   // 予約済み・ブロードキャスト
+}
+
+// isPublicAddr は addr がループバック・プライベート・リンクローカルなどではない、外部のアドレスかを返す。
+// IPv4 射影 IPv6（::ffff:127.0.0.1 など）は IPv4 として判定する。
+func isPublicAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if !addr.IsValid() || addr.IsUnspecified() || addr.IsLoopback() || addr.IsPrivate() ||
+		addr.IsLinkLocalUnicast() || addr.IsLinkLocalMulticast() || addr.IsInterfaceLocalMulticast() || addr.IsMulticast() {
+		return false
+	}
+	for _, p := range outboundBlockedPrefixes {
+		if p.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+// outboundDialControl は名前解決後、接続する直前のアドレスを確認する。
+// DNS の応答が取得のたびに変わっても（DNS リバインディング）、実際に接続するアドレスで判定できる。
+func outboundDialControl(_, address string, _ syscall.RawConn) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return err
+	}
+	if !isPublicAddr(addrPort.Addr()) {
+		return fmt.Errorf("%w: %s", errOutboundAddressBlocked, addrPort.Addr())
+	}
+	return nil
+}
+
+var outboundDialer = &net.Dialer{Timeout: outboundTimeout, Control: outboundDialControl}
+
+// outboundDialContext は http.Transport の DialContext。すべての接続（リダイレクト先を含む）を outboundDialControl で確認する。
+func outboundDialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return outboundDialer.DialContext(ctx, network, address)
+}
+
+// newOutboundHTTPClient は内部ネットワークへ接続しない HTTP クライアントを作る。
+// プロキシを経由すると接続先のアドレスを確認できないため、環境変数のプロキシ設定は使わない。
+func newOutboundHTTPClient() *http.Client {
+	return &http.Client{
+		Timeout: outboundTimeout,
+		Transport: &http.Transport{
+			Proxy:               nil,
+			DialContext:         outboundDialContext,
+			TLSHandshakeTimeout: outboundTimeout,
+			ForceAttemptHTTP2:   true,
+			MaxIdleConns:        10,
+			IdleConnTimeout:     90 * time.Second,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= outboundMaxRedirects {
+				return fmt.Errorf("リダイレクトが多すぎます")
+			}
+			if req.URL.Scheme != "https" {
+				return fmt.Errorf("https 以外へリダイレクトされました")
+			}
+			return nil
+		},
+	}
+}
+
+// readOutboundBody はレスポンスボディを最大 limit バイト読む。上限を超える場合は途中で切らずにエラーにする。
+func readOutboundBody(res *http.Response, limit int64) ([]byte, error) {
+	if res.ContentLength > limit {
+		return nil, fmt.Errorf("レスポンスが大きすぎます（%d バイト）", res.ContentLength)
+	}
+	body, err := io.ReadAll(io.LimitReader(res.Body, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) > limit {
+		return nil, fmt.Errorf("レスポンスが大きすぎます（上限 %d バイト）", limit)
+	}
+	return body, nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestIsPublicAddr(t *testing.T) {
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:2800:220:1:248:1893:25c8:1946", true},
+		{"127.0.0.1", false},
+		{"127.1.2.3", false},
+		{"::1", false},
+		{"::ffff:127.0.0.1", false},
+		{"10.0.0.1", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"fd00::1", false},
+		{"169.254.169.254", false}, // クラウドのメタデータサービス
+		{"fe80::1", false},
+		{"0.0.0.0", false},
+		{"0.1.2.3", false},
+		{"::", false},
+		{"100.64.0.1", false},
+		{"224.0.0.1", false},
+		{"ff02::1", false},
+		{"255.255.255.255", false},
+	}
+	for _, tt := range tests {
+		if got := isPublicAddr(netip.MustParseAddr(tt.addr)); got != tt.want {
+			t.Errorf("isPublicAddr(%s) = %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+}
+
+// newCountingServer は受けたリクエストの数を数える httptest サーバー（127.0.0.1 で待ち受ける）。
+func newCountingServer(t *testing.T, body string) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var hits atomic.Int32
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		io.WriteString(w, body)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &hits
+}
+
+func TestOutboundHTTPClientRejectsLoopback(t *testing.T) {
+	srv, hits := newCountingServer(t, `{"keys":[]}`)
+
+	t.Run("HTTP クライアント", func(t *testing.T) {
+		res, err := newOutboundHTTPClient().Get(srv.URL)
+		if err == nil {
+			res.Body.Close()
+		}
+		if !errors.Is(err, errOutboundAddressBlocked) {
+			t.Errorf("Get() error = %v, want errOutboundAddressBlocked", err)
+		}
+	})
+
+	t.Run("localhost の名前解決後に拒否する", func(t *testing.T) {
+		url := strings.Replace(srv.URL, "127.0.0.1", "localhost", 1)
+		res, err := newOutboundHTTPClient().Get(url)
+		if err == nil {
+			res.Body.Close()
+		}
+		if !errors.Is(err, errOutboundAddressBlocked) {
+			t.Errorf("Get() error = %v, want errOutboundAddressBlocked", err)
+		}
+	})
+
+	t.Run("request_uri", func(t *testing.T) {
+		client := &OAuthClient{ClientID: "jar_client", RequestURIs: []string{srv.URL + "/request.jwt"}}
+		if _, err := fetchRequestObject(context.Background(), client, srv.URL+"/request.jwt"); err == nil {
+			t.Error("ループバックの request_uri を取得しました")
+		}
+	})
+
+	t.Run("jwks_uri", func(t *testing.T) {
+		if _, err := clientJWKSURICache.keys(context.Background(), srv.URL+"/jwks.json"); err == nil {
+			t.Error("ループバックの jwks_uri を取得しました")
+		}
+	})
+
+	if n := hits.Load(); n != 0 {
+		t.Errorf("サーバーに %d 回接続しました", n)
+	}
+}
+
+func TestReadOutboundBody(t *testing.T) {
+	tests := []struct {
+		name          string
+		body          string
+		contentLength int64
+		wantErr       bool
+	}{
+		{"上限ちょうど", strings.Repeat("a", 16), -1, false},
+		{"上限を超える", strings.Repeat("a", 17), -1, true},
+		{"Content-Length が上限を超える", "a", 1 << 20, true},
+		{"空", "", 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := &http.Response{Body: io.NopCloser(strings.NewReader(tt.body)), ContentLength: tt.contentLength}
+			body, err := readOutboundBody(res, 16)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("readOutboundBody() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && string(body) != tt.body {
+				t.Errorf("readOutboundBody() = %q, want %q", body, tt.body)
+			}
+		})
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	// PAR で発行する request_uri の接頭辞（RFC 9126 2.2）
+	parRequestURIPrefix = "urn:ietf:params:oauth:request_uri:"
+	// request_uri の有効期間。/authorize の後にログイン・同意画面を挟むため、コードの交換ほど短くはしない
+	parRequestLifetime = 5 * time.Minute
+)
+
+// parClientAuthParams はクライアント認証のためのパラメータ。認可パラメータとしては保存しない
+var parClientAuthParams = map[string]bool{
+	"client_secret":         true,
+	"client_assertion":      true,
+	"client_assertion_type": true,
+}
+
+// Pushed Authorization Request エンドポイント（POST /par、RFC 9126）。
+// 認可パラメータをブラウザを経由せずに直接受け取り、/authorize で使う短命の request_uri を返す。
+// パラメータがブラウザの履歴やアクセスログに残らず、改ざんもされない。
+func pushedAuthorizationRequestHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	logger := slog.Default()
+
+	if err := r.ParseForm(); err != nil {
+		writeOAuthError(w, errInvalidRequest("invalid form data"))
+		return
+	}
+
+	client, err := authenticateClient(ctx, r)
+	if err != nil {
+		logger.Warn("クライアント認証に失敗しました", "client_id", r.FormValue("client_id"), "error", err.Error())
+		writeOAuthError(w, errInvalidClient("client authentication failed"))
+		return
+	}
+
+	params, e := pushedAuthorizeParams(r.PostForm, client)
+	if e != nil {
+		writeOAuthError(w, e)
+		return
+	}
+
+	// RFC 9126 3: request（リクエストオブジェクト）も送れる。検証して中のパラメータだけを保存し、jti はここで使用済みにする
+	if request := params.Get("request"); request != "" {
+		var claims jwt.MapClaims
+		params, claims, err = mergeRequestObject(ctx, client, request)
+		if err == nil {
+			err = recordRequestObjectJTI(ctx, client.ClientID, claims)
+		}
+		if err != nil {
+			logger.Warn("リクエストオブジェクトが無効です", "client_id", client.ClientID, "error", err.Error())
+			writeOAuthError(w, newOAuthError(http.StatusBadRequest, "invalid_request_object", "the request object is invalid", ""))
+			return
+		}
+	}
+
+	req, e := checkPushedAuthorizeRequest(logger, client, params)
+	if e != nil {
+		writeOAuthError(w, e)
+		return
+	}
+
+	requestURI := parRequestURIPrefix + generateRandomString(32)
+	expiresAt := time.Now().Add(parRequestLifetime)
+	if err := repository.CreatePushedAuthorizationRequest(ctx, requestURI, client.ClientID, params.Encode(), expiresAt); err != nil {
+		logger.Error("PAR の保存に失敗しました", "error", err.Error())
+		writeOAuthError(w, errServerError())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Pragma", "no-cache")
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(map[string]any{
+		"request_uri": requestURI,
+		"expires_in":  int(parRequestLifetime.Seconds()),
+	}); err != nil {
+		logger.Error("PAR レスポンスのエンコードに失敗しました", "error", err.Error())
+		return
+	}
+
+	logger.Info("PAR を受け付けました",
+		"client_id", client.ClientID,
+		"scopes", req.Scopes)
+}
+
+// pushedAuthorizeParams は PAR のフォームから保存する認可パラメータを取り出す。
+// クライアント認証のパラメータは除き、client_id は認証済みのクライアントで埋める。
+func pushedAuthorizeParams(form url.Values, client *OAuthClient) (url.Values, *oauthError) {
+	// RFC 9126 2.1: PAR の中で request_uri を使うことはできない
+	if form.Has("request_uri") {
+		return nil, errInvalidRequest("request_uri must not be sent to the pushed authorization request endpoint")
+	}
+
+	params := url.Values{}
+	for k, v := range form {
+		if !parClientAuthParams[k] {
+			params[k] = v
+		}
+	}
+	// Basic 認証では client_id がボディに無いことがあるため、認証済みのクライアントで埋める
+	params.Set("client_id", client.ClientID)
+	return params, nil
+}
+
+// checkPushedAuthorizeRequest は /authorize と同じ検証を行う。ここではリダイレクトできないので JSON で返す（RFC 9126 2.3）
+func checkPushedAuthorizeRequest(logger *slog.Logger, client *OAuthClient, params url.Values) (*authorizeRequest, *oauthError) {
+	req := parseAuthorizeRequest(params)
+	if req.RedirectURI == "" {
+		return nil, errInvalidRequest("redirect_uri is required")
+	}
+	if err := client.checkRedirectURI(req.RedirectURI); err != nil {
+		logger.Warn("無効なリダイレクトURI",
+			"client_id", client.ClientID,
+			"redirect_uri", req.RedirectURI,
+			"error", err.Error())
+		return nil, errInvalidRequest(err.Error())
+	}
+	if e := checkAuthorizeParameters(logger, client, req); e != nil {
+		return nil, newOAuthError(http.StatusBadRequest, e.Code, e.Description, "")
+	}
+	return req, nil
+}
+
+// loadAuthorizeRequest は /authorize のパラメータから authorizeRequest を組み立てる。
+// request_uri が PAR で発行したものなら、保存済みのパラメータだけを使う（クエリの他のパラメータは無視する）。
+// request、または PAR 以外の request_uri はリクエストオブジェクト（RFC 9101）として扱う。
+func loadAuthorizeRequest(ctx context.Context, params url.Values) (*authorizeRequest, error) {
+	requestURI := params.Get("request_uri")
+	if !strings.HasPrefix(requestURI, parRequestURIPrefix) {
+		if requestURI != "" || params.Has("request") {
+			return loadRequestObject(ctx, params)
+		}
+		return parseAuthorizeRequest(params), nil
+	}
+
+	par, err := repository.GetPushedAuthorizationRequest(ctx, requestURI)
+	if err != nil {
+		return nil, err
+	}
+	// RFC 9126 4: request_uri を登録したクライアント以外には使わせない
+	if params.Get("client_id") != par.ClientID {
+		return nil, fmt.Errorf("request_uri を登録したクライアントと client_id が一致しません")
+	}
+	stored, err := url.ParseQuery(par.Parameters)
+	if err != nil {
+		return nil, fmt.Errorf("保存済みの認可パラメータが不正です: %w", err)
+	}
+
+	req := parseAuthorizeRequest(stored)
+	req.RequestURI = requestURI
+	req.params = url.Values{"client_id": {par.ClientID}, "request_uri": {requestURI}}
+	return req, nil
+}
+
+// consumePushedAuthorizationRequest は認可コードを発行する直前に request_uri を使用済みにする（RFC 9126 4）。
+// 既に使われたか期限切れで削除できなかった場合はエラーを返し、認可コードは発行しない。
+func consumePushedAuthorizationRequest(ctx context.Context, req *authorizeRequest) error {
+	if req.RequestURI == "" {
+		return nil
+	}
+	return repository.ConsumePushedAuthorizationRequest(ctx, req.RequestURI, req.ClientID)
+}
+
+// discardPushedAuthorizationRequest は認可が拒否された request_uri を削除し、再利用できなくする。
+func discardPushedAuthorizationRequest(ctx context.Context, logger *slog.Logger, req *authorizeRequest) {
+	if req.RequestURI == "" {
+		return
+	}
+	if err := repository.DeletePushedAuthorizationRequest(ctx, req.RequestURI); err != nil {
+		// 有効期限で無効になるため、拒否の通知自体は止めない
+		logger.Warn("PAR の削除に失敗しました", "client_id", req.ClientID, "error", err.Error())
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"testing"
+)
+
+func TestPushedAuthorizationRequestHandlerRequiresClientAuthentication(t *testing.T) {
+	rec := httptest.NewRecorder()
+	form := url.Values{"response_type": {"code"}, "redirect_uri": {"https://app.example.com/callback"}}
+	pushedAuthorizationRequestHandler(rec, newFormRequest("/par", form))
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("status = %d, want 401", rec.Code)
+	}
+	if code := oauthErrorCode(t, rec); code != "invalid_client" {
+		t.Errorf("error = %q, want invalid_client", code)
+	}
+}
+
+func TestPushedAuthorizeParams(t *testing.T) {
+	client := &OAuthClient{ClientID: "demo"}
+	tests := []struct {
+		name     string
+		form     url.Values
+		want     url.Values
+		wantCode string
+	}{
+		{
+			name: "クライアント認証のパラメータは保存しない",
+			form: url.Values{
+				"client_id":             {"demo"},
+				"client_secret":         {"secret"},
+				"client_assertion":      {"jwt"},
+				"client_assertion_type": {clientAssertionTypeJWTBearer},
+				"response_type":         {"code"},
+				"scope":                 {"openid read"},
+			},
+			want: url.Values{"client_id": {"demo"}, "response_type": {"code"}, "scope": {"openid read"}},
+		},
+		{
+			name: "Basic 認証で client_id がボディに無い",
+			form: url.Values{"response_type": {"code"}},
+			want: url.Values{"client_id": {"demo"}, "response_type": {"code"}},
+		},
+		{
+			name: "ボディの client_id は認証済みのクライアントで上書きする",
+			form: url.Values{"client_id": {"other"}},
+			want: url.Values{"client_id": {"demo"}},
+		},
+		{
+			name:     "PAR の中の request_uri",
+			form:     url.Values{"request_uri": {parRequestURIPrefix + "abc"}},
+			wantCode: "invalid_request",
+		},
+		{
+			name:     "空の request_uri",
+			form:     url.Values{"request_uri": {""}},
+			wantCode: "invalid_request",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, e := pushedAuthorizeParams(tt.form, client)
+			if tt.wantCode != "" {
+				if e == nil || e.Code != tt.wantCode {
+					t.Fatalf("pushedAuthorizeParams() error = %+v, want %s", e, tt.wantCode)
+				}
+				return
+			}
+			if e != nil {
+				t.Fatalf("pushedAuthorizeParams() error = %+v", e)
+			}
+			if got.Encode() != tt.want.Encode() {
+				t.Errorf("pushedAuthorizeParams() = %s, want %s", got.Encode(), tt.want.Encode())
+			}
+		})
+	}
+}
+
+func TestCheckPushedAuthorizeRequest(t *testing.T) {
+	t.Setenv("PKCE_ALLOW_PLAIN", "")
+	client := &OAuthClient{
+		ClientID:                "demo",
+		TokenEndpointAuthMethod: authMethodClientSecretBasic,
+		RedirectURIs:            []string{"https://app.example.com/callback"},
+		Scopes:                  []string{"openid", "read"},
+		DefaultScopes:           []string{"openid"},
+	}
+	valid := func(set func(v url.Values)) url.Values {
+		v := url.Values{
+			"client_id":     {"demo"},
+			"response_type": {"code"},
+			"redirect_uri":  {"https://app.example.com/callback"},
+		}
+		if set != nil {
+			set(v)
+		}
+		return v
+	}
+	tests := []struct {
+		name       string
+		params     url.Values
+		wantCode   string
+		wantScopes []string
+	}{
+		{"有効な要求", valid(nil), "", []string{"openid"}},
+		{"スコープの指定", valid(func(v url.Values) { v.Set("scope", "read") }), "", []string{"read"}},
+		{"redirect_uri なし", valid(func(v url.Values) { v.Del("redirect_uri") }), "invalid_request", nil},
+		{"未登録の redirect_uri", valid(func(v url.Values) { v.Set("redirect_uri", "https://evil.example.com/callback") }), "invalid_request", nil},
+		{"未対応の response_type", valid(func(v url.Values) { v.Set("response_type", "token") }), "unsupported_response_type", nil},
+		{"登録されていないスコープ", valid(func(v url.Values) { v.Set("scope", "admin") }), "invalid_scope", nil},
+		{"plain の PKCE", valid(func(v url.Values) {
+			v.Set("code_challenge", rfc7636Verifier)
+			v.Set("code_challenge_method", "plain")
+		}), "invalid_request", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, e := checkPushedAuthorizeRequest(slog.Default(), client, tt.params)
+			if tt.wantCode != "" {
+				if e == nil || e.Code != tt.wantCode {
+					t.Fatalf("checkPushedAuthorizeRequest() error = %+v, want %s", e, tt.wantCode)
+				}
+				// PAR ではリダイレクトせず、400 の JSON で返す
+				if e.Status != http.StatusBadRequest {
+					t.Errorf("status = %d, want 400", e.Status)
+				}
+				return
+			}
+			if e != nil {
+				t.Fatalf("checkPushedAuthorizeRequest() error = %+v", e)
+			}
+			if !slices.Equal(req.Scopes, tt.wantScopes) {
+				t.Errorf("scopes = %v, want %v", req.Scopes, tt.wantScopes)
+			}
+		})
+	}
+}
+
+func TestLoadAuthorizeRequestWithoutRequestURI(t *testing.T) {
+	// PAR でもリクエストオブジェクトでもなければ、クエリのパラメータをそのまま使う
+	params := url.Values{"client_id": {"demo"}, "redirect_uri": {"https://app.example.com/callback"}, "state": {"xyz"}}
+	req, err := loadAuthorizeRequest(context.Background(), params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.ClientID != "demo" || req.State != "xyz" || req.RequestURI != "" {
+		t.Errorf("loadAuthorizeRequest() = %+v", req)
+	}
+}
+
+func TestConsumePushedAuthorizationRequestWithoutRequestURI(t *testing.T) {
+	// PAR を使っていない認可リクエストでは何もしない（DB にも触れない）
+	req := &authorizeRequest{ClientID: "demo"}
+	if err := consumePushedAuthorizationRequest(context.Background(), req); err != nil {
+		t.Errorf("consumePushedAuthorizationRequest() error = %v", err)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// PKCE（RFC 7636）の code_challenge_method
+const (
+	pkceMethodS256  = "S256"
+	pkceMethodPlain = "plain"
+)
+
+// pkcePlainAllowed は code_challenge_method=plain を受け付けるかどうか。
+// plain は code_challenge がそのまま verifier なので認可リクエストの漏えいに弱く（OAuth 2.0 Security BCP 2.1.1）、
+// 既定では拒否する。S256 を実装できない古いクライアントのためだけに PKCE_ALLOW_PLAIN=true で許可できる。
+func pkcePlainAllowed() bool {
+	return os.Getenv("PKCE_ALLOW_PLAIN") == "true"
+}
+
+// supportedPKCEMethods は Discovery の code_challenge_methods_supported に載せる方式。
+func supportedPKCEMethods() []string {
+	if pkcePlainAllowed() {
+		return []string{pkceMethodS256, pkceMethodPlain}
+	}
+	return []string{pkceMethodS256}
+}
+
+// normalizeCodeChallenge は /authorize の code_challenge / code_challenge_method を検証し、保存する方式を返す。
+// 方式の省略は plain とみなす（RFC 7636 4.3）。
+// S256 の challenge は SHA-256 の BASE64URL（パディングなし）なので 43 文字、plain は verifier と同じ 43〜128 文字（4.1）。
+func normalizeCodeChallenge(challenge, method string) (string, error) {
+	if method == "" {
+		method = pkceMethodPlain
+	}
+	switch method {
+	case pkceMethodS256:
+		if len(challenge) != 43 || !isPKCEString(challenge, false) {
+			return "", fmt.Errorf("code_challenge must be a 43-character base64url-encoded SHA-256 hash")
+		}
+	case pkceMethodPlain:
+		if !pkcePlainAllowed() {
+			return "", fmt.Errorf("code_challenge_method plain is not allowed; use S256")
+		}
+		if len(challenge) < 43 || len(challenge) > 128 || !isPKCEString(challenge, true) {
+			return "", fmt.Errorf("code_challenge must be 43 to 128 unreserved characters")
+		}
+	default:
+		return "", fmt.Errorf("unsupported code_challenge_method: %s", method)
+	}
+	return method, nil
+}
+
+// verifyCodeVerifier は code_verifier が保存済みの code_challenge と一致するかを確認する（RFC 7636 4.6）。
+func verifyCodeVerifier(verifier, challenge, method string) error {
+	if len(verifier) < 43 || len(verifier) > 128 || !isPKCEString(verifier, true) {
+		return fmt.Errorf("code_verifier must be 43 to 128 unreserved characters")
+	}
+
+	var computed string
+	switch method {
+	case pkceMethodS256:
+		// S256: SHA256(code_verifier) を BASE64URL（パディングなし）
+		hash := sha256.Sum256([]byte(verifier))
+		computed = base64.RawURLEncoding.EncodeToString(hash[:])
+	case pkceMethodPlain:
+		// 発行後に PKCE_ALLOW_PLAIN を外した場合も、そのコードは受け付けない
+		if !pkcePlainAllowed() {
+			return fmt.Errorf("code_challenge_method plain is not allowed")
+		}
+		computed = verifier
+	default:
+		return fmt.Errorf("unsupported code_challenge_method: %s", method)
+	}
+
+	if subtle.ConstantTimeCompare([]byte(computed), []byte(challenge)) != 1 {
+		return fmt.Errorf("code_verifier does not match the code_challenge")
+	}
+	return nil
+}
+
+// isPKCEString は RFC 7636 の unreserved 文字（ALPHA / DIGIT / "-" / "." / "_" / "~"）だけかどうか。
+// allowDotTilde=false なら BASE64URL の文字集合（"." と "~" を含まない）に限る。
+func isPKCEString(s string, allowDotTilde bool) bool {
+	for _, c := range s {
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_':
+		case allowDotTilde && strings.ContainsRune(".~", c):
+		default:
+			return false
+		}
+	}
+	return true
+}
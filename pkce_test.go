@@ -0,0 +1,124 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+// RFC 7636 付録 B の例
+const (
+	rfc7636Verifier  = "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	rfc7636Challenge = "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"
+)
+
+func TestNormalizeCodeChallenge(t *testing.T) {
+	plain := strings.Repeat("a.~-_", 10)
+	tests := []struct {
+		name       string
+		challenge  string
+		method     string
+		allowPlain bool
+		want       string
+		wantErr    bool
+	}{
+		{"S256", rfc7636Challenge, "S256", false, "S256", false},
+		{"S256 が 42 文字", rfc7636Challenge[:42], "S256", false, "", true},
+		{"S256 が 44 文字", rfc7636Challenge + "A", "S256", false, "", true},
+		{"S256 にパディング", rfc7636Challenge[:42] + "=", "S256", false, "", true},
+		{"S256 に . を含む", rfc7636Challenge[:42] + ".", "S256", false, "", true},
+		{"s256（小文字）", rfc7636Challenge, "s256", false, "", true},
+		{"plain は既定で拒否", plain, "plain", false, "", true},
+		{"方式の省略は plain とみなして拒否", plain, "", false, "", true},
+		{"PKCE_ALLOW_PLAIN なら plain を許可", plain, "plain", true, "plain", false},
+		{"PKCE_ALLOW_PLAIN なら方式の省略は plain", plain, "", true, "plain", false},
+		{"plain が 42 文字", plain[:42], "plain", true, "", true},
+		{"plain が 129 文字", strings.Repeat("a", 129), "plain", true, "", true},
+		{"plain に予約文字", strings.Repeat("a", 42) + "+", "plain", true, "", true},
+		{"未知の方式", rfc7636Challenge, "S512", false, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.allowPlain {
+				t.Setenv("PKCE_ALLOW_PLAIN", "true")
+			} else {
+				t.Setenv("PKCE_ALLOW_PLAIN", "")
+			}
+			got, err := normalizeCodeChallenge(tt.challenge, tt.method)
+			if (err != nil) != tt.wantErr || got != tt.want {
+				t.Errorf("normalizeCodeChallenge() = (%q, %v), want %q (wantErr %v)", got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestVerifyCodeVerifier(t *testing.T) {
+	plain := strings.Repeat("a.~-_", 10)
+	tests := []struct {
+		name       string
+		verifier   string
+		challenge  string
+		method     string
+		allowPlain bool
+		wantErr    bool
+	}{
+		{"S256（RFC 7636 付録 B）", rfc7636Verifier, rfc7636Challenge, "S256", false, false},
+		{"S256 で verifier が違う", rfc7636Verifier[:42] + "A", rfc7636Challenge, "S256", false, true},
+		{"S256 で challenge をそのまま送る", rfc7636Challenge, rfc7636Challenge, "S256", false, true},
+		{"verifier が 42 文字", rfc7636Verifier[:42], rfc7636Challenge, "S256", false, true},
+		{"verifier が 129 文字", strings.Repeat("a", 129), rfc7636Challenge, "S256", false, true},
+		{"verifier に予約文字", rfc7636Verifier[:42] + "/", rfc7636Challenge, "S256", false, true},
+		{"plain", plain, plain, "plain", true, false},
+		{"plain で不一致", plain, plain[:49] + "x", "plain", true, true},
+		{"発行後に plain を禁止したコード", plain, plain, "plain", false, true},
+		{"未知の方式", rfc7636Verifier, rfc7636Challenge, "S512", false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.allowPlain {
+				t.Setenv("PKCE_ALLOW_PLAIN", "true")
+			} else {
+				t.Setenv("PKCE_ALLOW_PLAIN", "")
+			}
+			err := verifyCodeVerifier(tt.verifier, tt.challenge, tt.method)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("verifyCodeVerifier() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestIsPKCEString(t *testing.T) {
+	tests := []struct {
+		s             string
+		allowDotTilde bool
+		want          bool
+	}{
+		{"AZaz09-_", false, true},
+		{"a.b", false, false},
+		{"a~b", false, false},
+		{"a.b~c", true, true},
+		{"a+b", true, false},
+		{"a/b", true, false},
+		{"a=b", true, false},
+		{"a b", true, false},
+		{"あ", true, false},
+		{"", true, true},
+	}
+	for _, tt := range tests {
+		if got := isPKCEString(tt.s, tt.allowDotTilde); got != tt.want {
+			t.Errorf("isPKCEString(%q, %v) = %v, want %v", tt.s, tt.allowDotTilde, got, tt.want)
+		}
+	}
+}
+
+func TestSupportedPKCEMethods(t *testing.T) {
+	t.Setenv("PKCE_ALLOW_PLAIN", "")
+	if got := supportedPKCEMethods(); !slices.Equal(got, []string{"S256"}) {
+		t.Errorf("supportedPKCEMethods() = %v", got)
+	}
+	t.Setenv("PKCE_ALLOW_PLAIN", "true")
+	if got := supportedPKCEMethods(); !slices.Equal(got, []string{"S256", "plain"}) {
+		t.Errorf("PKCE_ALLOW_PLAIN=true: supportedPKCEMethods() = %v", got)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// クライアントの種別（OpenID Connect Dynamic Client Registration の application_type）
+const (
+	applicationTypeWeb    = "web"
+	applicationTypeNative = "native"
+)
+
+// matchRedirectURI は要求された redirect_uri が登録済みのいずれかと一致するかどうか。
+// 基本は完全一致だが、ネイティブアプリのループバック IP（127.0.0.1 / [::1]）の http リダイレクトは
+// 起動時に空いているポートを使うため、ポートだけは任意とする（RFC 8252 7.3）。
+// web クライアントは同じホストの別ポートで動く別のアプリに code を渡さないよう、ループバックでも完全一致に限る。
+func (c *OAuthClient) matchRedirectURI(requested string) bool {
+	native := c.ApplicationType == applicationTypeNative
+	for _, registered := range c.RedirectURIs {
+		if registered == requested || (native && loopbackRedirectURIMatches(registered, requested)) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkRedirectURI は redirect_uri が登録済みで、かつクライアントの種別に対して使える形式かを確認する。
+func (c *OAuthClient) checkRedirectURI(uri string) error {
+	if !c.matchRedirectURI(uri) {
+		return fmt.Errorf("redirect_uri is not registered for this client")
+	}
+	return validateRedirectURI(uri, c.ApplicationType)
+}
+
+// loopbackRedirectURIMatches はポート以外（スキーム・IP・パス・クエリ）が一致するループバックのリダイレクトかどうか。
+func loopbackRedirectURIMatches(registered, requested string) bool {
+	reg, err := url.Parse(registered)
+	if err != nil || reg.Scheme != "http" || reg.User != nil || !isLoopbackIP(reg.Hostname()) {
+		return false
+	}
+	req, err := url.Parse(requested)
+	if err != nil || req.Scheme != "http" || req.User != nil || req.Fragment != "" {
+		return false
+	}
+	// 127.0.0.1 と [::1] は別物として扱う（両方使うなら両方登録する）
+	if !net.ParseIP(reg.Hostname()).Equal(net.ParseIP(req.Hostname())) {
+		return false
+	}
+	return reg.EscapedPath() == req.EscapedPath() && reg.RawQuery == req.RawQuery
+}
+
+// validateRedirectURI は redirect_uri がクライアントの種別に対して使ってよい形式かを確認する。
+//   - フラグメントは不可（RFC 6749 3.1.2）
+//   - web: https。http は開発用の localhost とループバック IP だけ（盗聴や改ざんで認可コードを奪われないよう）
+//   - native: https（Claimed URL）、ループバック IP の http（RFC 8252 7.3）、
+//     逆ドメイン名のプライベートスキーム（com.example.app:/callback、RFC 8252 7.1）
+//
+// ネイティブアプリの localhost はファイアウォールや hosts の設定で別のインターフェースに解決されうるため拒否し、
+// IP リテラルを使わせる（RFC 8252 8.3）。
+func validateRedirectURI(uri, applicationType string) error {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return fmt.Errorf("redirect_uri is not a valid URI")
+	}
+	if u.Scheme == "" {
+		return fmt.Errorf("redirect_uri must be an absolute URI")
+	}
+	if u.Fragment != "" || strings.Contains(uri, "#") {
+		return fmt.Errorf("redirect_uri must not contain a fragment")
+	}
+
+	native := applicationType == applicationTypeNative
+	switch u.Scheme {
+	case "https":
+		if u.Host == "" {
+			return fmt.Errorf("redirect_uri must have a host")
+		}
+	case "http":
+		if u.Host == "" {
+			return fmt.Errorf("redirect_uri must have a host")
+		}
+		if !native {
+			if !strings.EqualFold(u.Hostname(), "localhost") && !isLoopbackIP(u.Hostname()) {
+				return fmt.Errorf("web clients may only use http with localhost or a loopback IP address")
+			}
+			return nil
+		}
+		if strings.EqualFold(u.Hostname(), "localhost") {
+			return fmt.Errorf("native clients must use a loopback IP literal (127.0.0.1 or [::1]) instead of localhost")
+		}
+		if !isLoopbackIP(u.Hostname()) {
+			return fmt.Errorf("native clients may only use http with a loopback IP literal")
+		}
+	default:
+		if !native {
+			return fmt.Errorf("private-use URI schemes are only allowed for native clients")
+		}
+		// 他のアプリに横取りされにくいよう、自分が管理するドメインを逆にしたスキームに限る
+		if !strings.Contains(u.Scheme, ".") {
+			return fmt.Errorf("private-use URI schemes must be based on a reverse domain name (e.g. com.example.app)")
+		}
+		if u.Host != "" || u.Opaque != "" {
+			return fmt.Errorf("private-use URI scheme redirects must have the form %s:/path", u.Scheme)
+		}
+	}
+	return nil
+}
+
+// isLoopbackIP はホスト名がループバックの IP リテラルかどうか（localhost のような名前は含めない）。
+func isLoopbackIP(host string) bool {
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
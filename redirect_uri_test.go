@@ -0,0 +1,135 @@
+package main
+
+import "testing"
+
+func TestMatchRedirectURI(t *testing.T) {
+	registered := []string{
+		"https://app.example.com/callback",
+		"http://127.0.0.1/callback",
+		"http://[::1]:8080/callback?x=1",
+		"com.example.app:/callback",
+	}
+	native := &OAuthClient{ApplicationType: applicationTypeNative, RedirectURIs: registered}
+	web := &OAuthClient{ApplicationType: applicationTypeWeb, RedirectURIs: registered}
+	tests := []struct {
+		name       string
+		requested  string
+		wantNative bool
+		wantWeb    bool
+	}{
+		{"完全一致", "https://app.example.com/callback", true, true},
+		{"https はポートも含めて完全一致", "https://app.example.com:8443/callback", false, false},
+		{"末尾のスラッシュ", "https://app.example.com/callback/", false, false},
+		{"大文字小文字", "https://APP.example.com/callback", false, false},
+		{"クエリの追加", "https://app.example.com/callback?x=1", false, false},
+		{"ループバック IPv4 は native だけ任意のポート", "http://127.0.0.1:51004/callback", true, false},
+		{"ループバック IPv4 のポートなし", "http://127.0.0.1/callback", true, true},
+		{"ループバック IPv6 は native だけ任意のポート", "http://[::1]:3000/callback?x=1", true, false},
+		{"ループバック IPv6 の登録したポート", "http://[::1]:8080/callback?x=1", true, true},
+		{"ループバックでもパスは一致が必要", "http://127.0.0.1:51004/other", false, false},
+		{"ループバックでもクエリは一致が必要", "http://[::1]:3000/callback", false, false},
+		{"IPv4 の登録に IPv6 で来る", "http://[::1]:51004/callback", false, false},
+		{"別のループバックアドレス", "http://127.0.0.2:51004/callback", false, false},
+		{"localhost はポートを緩めない", "http://localhost:51004/callback", false, false},
+		{"ループバックでも https は緩めない", "https://127.0.0.1:51004/callback", false, false},
+		{"ループバックにフラグメント", "http://127.0.0.1:51004/callback#x", false, false},
+		{"ループバックにユーザー情報", "http://user@127.0.0.1:51004/callback", false, false},
+		{"プライベートスキーム", "com.example.app:/callback", true, true},
+		{"未登録", "https://evil.example.com/callback", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := native.matchRedirectURI(tt.requested); got != tt.wantNative {
+				t.Errorf("native: matchRedirectURI(%q) = %v, want %v", tt.requested, got, tt.wantNative)
+			}
+			if got := web.matchRedirectURI(tt.requested); got != tt.wantWeb {
+				t.Errorf("web: matchRedirectURI(%q) = %v, want %v", tt.requested, got, tt.wantWeb)
+			}
+		})
+	}
+}
+
+func TestValidateRedirectURI(t *testing.T) {
+	tests := []struct {
+		name            string
+		uri             string
+		applicationType string
+		wantErr         bool
+	}{
+		{"web の https", "https://app.example.com/callback", applicationTypeWeb, false},
+		{"web のループバック以外の http", "http://app.example.com/callback", applicationTypeWeb, true},
+		{"web のプライベート IP の http", "http://192.168.0.1/callback", applicationTypeWeb, true},
+		{"web の localhost", "http://localhost:3000/callback", applicationTypeWeb, false},
+		{"web のループバック IPv4", "http://127.0.0.1:8080/callback", applicationTypeWeb, false},
+		{"web のループバック IPv6", "http://[::1]:8080/callback", applicationTypeWeb, false},
+		{"種別の省略は web", "http://localhost:3000/callback", "", false},
+		{"web のプライベートスキーム", "com.example.app:/callback", applicationTypeWeb, true},
+		{"相対 URI", "/callback", applicationTypeWeb, true},
+		{"フラグメント", "https://app.example.com/callback#x", applicationTypeWeb, true},
+		{"空のフラグメント", "https://app.example.com/callback#", applicationTypeWeb, true},
+		{"ホストの無い https", "https:/callback", applicationTypeWeb, true},
+		{"ホストの無い http", "http:/callback", applicationTypeWeb, true},
+		{"native の https", "https://app.example.com/callback", applicationTypeNative, false},
+		{"native のループバック IPv4", "http://127.0.0.1:51004/callback", applicationTypeNative, false},
+		{"native のループバック IPv6", "http://[::1]/callback", applicationTypeNative, false},
+		{"native の localhost", "http://localhost:51004/callback", applicationTypeNative, true},
+		{"native の LOCALHOST", "http://LOCALHOST/callback", applicationTypeNative, true},
+		{"native のループバック以外の http", "http://192.168.0.1/callback", applicationTypeNative, true},
+		{"native のプライベートスキーム", "com.example.app:/callback", applicationTypeNative, false},
+		{"逆ドメイン名でないスキーム", "myapp:/callback", applicationTypeNative, true},
+		{"プライベートスキームにホスト", "com.example.app://callback", applicationTypeNative, true},
+		{"プライベートスキームの opaque", "com.example.app:callback", applicationTypeNative, true},
+		{"不正な URI", "https://app.example.com/%zz", applicationTypeWeb, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateRedirectURI(tt.uri, tt.applicationType)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validateRedirectURI(%q, %q) error = %v, wantErr %v", tt.uri, tt.applicationType, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCheckRedirectURI(t *testing.T) {
+	// 登録済みでも、クライアントの種別に合わない形式は使わせない
+	tests := []struct {
+		name    string
+		client  *OAuthClient
+		uri     string
+		wantErr bool
+	}{
+		{"native のループバック", &OAuthClient{ApplicationType: applicationTypeNative, RedirectURIs: []string{"http://127.0.0.1/cb"}}, "http://127.0.0.1:49152/cb", false},
+		{"native に登録された localhost", &OAuthClient{ApplicationType: applicationTypeNative, RedirectURIs: []string{"http://localhost/cb"}}, "http://localhost/cb", true},
+		{"web のループバックは別のポートを使えない", &OAuthClient{ApplicationType: applicationTypeWeb, RedirectURIs: []string{"http://127.0.0.1:8080/callback"}}, "http://127.0.0.1:9090/callback", true},
+		{"web に登録されたプライベートスキーム", &OAuthClient{ApplicationType: applicationTypeWeb, RedirectURIs: []string{"com.example.app:/cb"}}, "com.example.app:/cb", true},
+		{"未登録", &OAuthClient{ApplicationType: applicationTypeWeb, RedirectURIs: []string{"https://app.example.com/cb"}}, "https://app.example.com/other", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.client.checkRedirectURI(tt.uri)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("checkRedirectURI(%q) error = %v, wantErr %v", tt.uri, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestIsLoopbackIP(t *testing.T) {
+	tests := []struct {
+		host string
+		want bool
+	}{
+		{"127.0.0.1", true},
+		{"127.1.2.3", true},
+		{"::1", true},
+		{"localhost", false},
+		{"192.168.0.1", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := isLoopbackIP(tt.host); got != tt.want {
+			t.Errorf("isLoopbackIP(%q) = %v, want %v", tt.host, got, tt.want)
+		}
+	}
+}
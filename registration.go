@@ -0,0 +1,495 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// 動的クライアント登録（RFC 7591）と登録内容の管理（RFC 7592）。
+// POST /register でクライアントを作り、そのときだけ返す registration_access_token（DB には SHA-256 だけを保存）で
+// GET / PUT / DELETE /register/{client_id} を呼べる。REGISTRATION_INITIAL_ACCESS_TOKEN を設定すると、
+// POST /register にもその値の Bearer トークンを要求する（本番で誰でも登録できる状態を閉じる）。
+
+// registrationMaxBody は登録リクエストの JSON の上限（インラインの jwks を含む）
+const registrationMaxBody = 64 * 1024
+
+// supportedScopes は Discovery の scopes_supported で、動的登録したクライアントが要求できるスコープ。
+// admin / user_management 等のシードにしか無いスコープは、動的登録では付与しない。
+var supportedScopes = []string{"openid", "profile", "email", "read", "write"}
+
+// defaultRegistrationScopes は scope を省略して登録したときのスコープ
+var defaultRegistrationScopes = []string{"read"}
+
+// registrableGrantTypes は grant_types に登録できるグラント
+var registrableGrantTypes = []string{"authorization_code", "refresh_token", "client_credentials", deviceCodeGrantType}
+
+// clientMetadata は RFC 7591 2 のクライアントメタデータ（このサーバーが扱うもの）。未知のメタデータは無視する。
+type clientMetadata struct {
+	ClientID                string          `json:"client_id,omitempty"`
+	ClientSecret            string          `json:"client_secret,omitempty"`
+	ClientName              string          `json:"client_name,omitempty"`
+	RedirectURIs            []string        `json:"redirect_uris,omitempty"`
+	GrantTypes              []string        `json:"grant_types,omitempty"`
+	ResponseTypes           []string        `json:"response_types,omitempty"`
+	TokenEndpointAuthMethod string          `json:"token_endpoint_auth_method,omitempty"`
+	Scope                   string          `json:"scope,omitempty"`
+	ApplicationType         string          `json:"application_type,omitempty"`
+	JWKS                    json.RawMessage `json:"jwks,omitempty"`
+	JWKSURI                 string          `json:"jwks_uri,omitempty"`
+	RequestURIs             []string        `json:"request_uris,omitempty"`
+	RequestObjectSigningAlg string          `json:"request_object_signing_alg,omitempty"`
+	RequirePAR              bool            `json:"require_pushed_authorization_requests,omitempty"`
+	DPoPBoundAccessTokens   bool            `json:"dpop_bound_access_tokens,omitempty"`
+	CertBoundAccessTokens   bool            `json:"tls_client_certificate_bound_access_tokens,omitempty"`
+	TLSClientAuthSubjectDN  string          `json:"tls_client_auth_subject_dn,omitempty"`
+	TLSClientAuthSANDNS     string          `json:"tls_client_auth_san_dns,omitempty"`
+	TLSClientAuthSANURI     string          `json:"tls_client_auth_san_uri,omitempty"`
+	TLSClientAuthSANIP      string          `json:"tls_client_auth_san_ip,omitempty"`
+	TLSClientAuthSANEmail   string          `json:"tls_client_auth_san_email,omitempty"`
+}
+
+// clientInformationResponse は登録・参照・更新の応答（RFC 7591 3.2.1、RFC 7592 3）
+type clientInformationResponse struct {
+	clientMetadata
+	ClientIDIssuedAt        int64  `json:"client_id_issued_at"`
+	ClientSecretExpiresAt   *int64 `json:"client_secret_expires_at,omitempty"` // シークレットを使う方式では 0（無期限）
+	RegistrationAccessToken string `json:"registration_access_token"`
+	RegistrationClientURI   string `json:"registration_client_uri"`
+}
+
+// クライアント登録エンドポイント（POST /register、RFC 7591 3）
+func registerClientHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	logger := slog.Default()
+
+	if want := os.Getenv("REGISTRATION_INITIAL_ACCESS_TOKEN"); want != "" {
+		if subtle.ConstantTimeCompare([]byte(registrationBearerToken(r)), []byte(want)) != 1 {
+			logger.Warn("初期アクセストークンが無いか一致しない登録リクエストです", "remoteAddr", r.RemoteAddr)
+			writeBearerError(w, http.StatusUnauthorized, "invalid_token", "a valid initial access token is required", "")
+			return
+		}
+	}
+
+	m, e := decodeClientMetadata(w, r)
+	if e != nil {
+		writeOAuthError(w, e)
+		return
+	}
+
+	client, e := m.toClient(generateRandomString(16))
+	if e != nil {
+		logger.Warn("クライアントメタデータが無効です", "error", e.Error(), "remoteAddr", r.RemoteAddr)
+		writeOAuthError(w, e)
+		return
+	}
+
+	registrationToken := generateRandomString(32)
+	tokenHash := hashToken(registrationToken)
+	client.RegistrationAccessTokenHash = &tokenHash
+
+	var secret string
+	if authMethodUsesSecret(client.TokenEndpointAuthMethod) {
+		secret = generateClientSecret()
+	}
+	if err := repository.CreateClient(ctx, client, secret); err != nil {
+		logger.Error("クライアントの登録に失敗しました", "error", err.Error())
+		writeOAuthError(w, errServerError())
+		return
+	}
+
+	resp := newClientInformationResponse(client, registrationToken)
+	resp.ClientSecret = secret
+	writeRegistrationJSON(w, logger, http.StatusCreated, resp)
+
+	logger.Info("クライアントを動的登録しました",
+		"client_id", client.ClientID,
+		"token_endpoint_auth_method", client.TokenEndpointAuthMethod,
+		"grant_types", client.GrantTypes,
+		"remoteAddr", r.RemoteAddr)
+}
+
+// 登録内容の参照（GET /register/{client_id}、RFC 7592 2.1）。
+// ハッシュしか保存していないため client_secret は返さない（紛失時は make rotate-client-secret で再発行する）。
+func getRegisteredClientHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	logger := slog.Default()
+
+	client, token := registeredClient(ctx, w, r, logger)
+	if client == nil {
+		return
+	}
+	writeRegistrationJSON(w, logger, http.StatusOK, newClientInformationResponse(client, token))
+}
+
+// 登録内容の更新（PUT /register/{client_id}、RFC 7592 2.2）。
+// 送られたメタデータで全体を置き換える（省略した値は既定値に戻る）。client_id・シークレット・認証方式は変えられない。
+func updateRegisteredClientHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	logger := slog.Default()
+
+	current, token := registeredClient(ctx, w, r, logger)
+	if current == nil {
+		return
+	}
+
+	m, e := decodeClientMetadata(w, r)
+	if e != nil {
+		writeOAuthError(w, e)
+		return
+	}
+	if m.ClientID != current.ClientID {
+		writeOAuthError(w, errInvalidRequest("client_id must match the client being updated"))
+		return
+	}
+	if m.ClientSecret != "" {
+		// RFC 7592 2.2: 含める場合は現在の値と一致しなければならない（この値で更新はしない）
+		if !authMethodUsesSecret(current.TokenEndpointAuthMethod) {
+			writeOAuthError(w, errInvalidRequest("the client does not use a client_secret"))
+			return
+		}
+		if _, err := repository.ValidateClientCredentials(ctx, current.ClientID, m.ClientSecret, current.TokenEndpointAuthMethod); err != nil {
+			writeOAuthError(w, errInvalidRequest("client_secret does not match the current secret"))
+			return
+		}
+	}
+	if m.TokenEndpointAuthMethod == "" {
+		m.TokenEndpointAuthMethod = current.TokenEndpointAuthMethod
+	}
+	if m.TokenEndpointAuthMethod != current.TokenEndpointAuthMethod {
+		writeOAuthError(w, errInvalidClientMetadata("token_endpoint_auth_method cannot be changed; register a new client instead"))
+		return
+	}
+
+	client, e := m.toClient(current.ClientID)
+	if e != nil {
+		logger.Warn("クライアントメタデータが無効です", "client_id", current.ClientID, "error", e.Error())
+		writeOAuthError(w, e)
+		return
+	}
+	client.RegistrationAccessTokenHash = current.RegistrationAccessTokenHash
+	client.CreatedAt = current.CreatedAt
+	if err := repository.UpdateClientMetadata(ctx, client); err != nil {
+		logger.Error("クライアントの更新に失敗しました", "client_id", current.ClientID, "error", err.Error())
+		writeOAuthError(w, errServerError())
+		return
+	}
+
+	writeRegistrationJSON(w, logger, http.StatusOK, newClientInformationResponse(client, token))
+	logger.Info("動的登録したクライアントを更新しました", "client_id", client.ClientID, "grant_types", client.GrantTypes)
+}
+
+// 登録の削除（DELETE /register/{client_id}、RFC 7592 2.3）。発行済みのトークンもまとめて無効になる。
+func deleteRegisteredClientHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	logger := slog.Default()
+
+	client, _ := registeredClient(ctx, w, r, logger)
+	if client == nil {
+		return
+	}
+	if err := repository.DeleteClient(ctx, client.ClientID); err != nil {
+		logger.Error("クライアントの削除に失敗しました", "client_id", client.ClientID, "error", err.Error())
+		writeOAuthError(w, errServerError())
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	logger.Info("動的登録したクライアントを削除しました", "client_id", client.ClientID)
+}
+
+// registeredClient は registration_access_token を確認して {client_id} のクライアントとトークンを返す。
+// 失敗時は 401 を書き込んで nil を返す。存在しない・動的登録でないクライアントも同じ 401 にし、有無を漏らさない（RFC 7592 2.1）。
+func registeredClient(ctx context.Context, w http.ResponseWriter, r *http.Request, logger *slog.Logger) (*OAuthClient, string) {
+	token := registrationBearerToken(r)
+	if token == "" {
+		writeBearerError(w, http.StatusUnauthorized, "", "", "")
+		return nil, ""
+	}
+	clientID := r.PathValue("client_id")
+	client, err := repository.GetClientByID(ctx, clientID)
+	if err == nil && client.RegistrationAccessTokenHash != nil &&
+		subtle.ConstantTimeCompare([]byte(*client.RegistrationAccessTokenHash), []byte(hashToken(token))) == 1 {
+		return client, token
+	}
+	logger.Warn("registration_access_token が無効です", "client_id", clientID, "remoteAddr", r.RemoteAddr)
+	writeBearerError(w, http.StatusUnauthorized, "invalid_token", "the registration access token is invalid", "")
+	return nil, ""
+}
+
+// registrationBearerToken は Authorization: Bearer のトークン（無ければ空文字列）
+func registrationBearerToken(r *http.Request) string {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
+
+// decodeClientMetadata は JSON のリクエストボディを読む
+func decodeClientMetadata(w http.ResponseWriter, r *http.Request) (*clientMetadata, *oauthError) {
+	if ct := r.Header.Get("Content-Type"); !strings.HasPrefix(ct, "application/json") {
+		return nil, errInvalidRequest("Content-Type must be application/json")
+	}
+	var m clientMetadata
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, registrationMaxBody)).Decode(&m); err != nil {
+		return nil, errInvalidClientMetadata("the request body is not valid client metadata JSON")
+	}
+	return &m, nil
+}
+
+// authMethodUsesSecret は client_secret を発行する認証方式かどうか
+func authMethodUsesSecret(method string) bool {
+	switch method {
+	case authMethodClientSecretBasic, authMethodClientSecretPost, authMethodClientSecretJWT:
+		return true
+	}
+	return false
+}
+
+// toClient はメタデータを検証し、既定値を補って OAuthClient にする（RFC 7591 2）。
+// 動的登録したクライアントは機密クライアントでも PKCE を必須にする。
+func (m *clientMetadata) toClient(clientID string) (*OAuthClient, *oauthError) {
+	method := m.TokenEndpointAuthMethod
+	if method == "" {
+		method = authMethodClientSecretBasic
+	}
+	if !slices.Contains(supportedTokenEndpointAuthMethods, method) || (isTLSClientAuthMethod(method) && !mtlsEnabled()) {
+		return nil, errInvalidClientMetadata("unsupported token_endpoint_auth_method: " + method)
+	}
+
+	grantTypes := []string{}
+	for _, gt := range m.GrantTypes {
+		if !slices.Contains(registrableGrantTypes, gt) {
+			return nil, errInvalidClientMetadata("unsupported grant_type: " + gt)
+		}
+		if !slices.Contains(grantTypes, gt) {
+			grantTypes = append(grantTypes, gt)
+		}
+	}
+	if len(grantTypes) == 0 {
+		grantTypes = []string{"authorization_code"}
+	}
+	usesCode := slices.Contains(grantTypes, "authorization_code")
+
+	// response_types は code だけ。grant_types の authorization_code と対になっていなければならない（RFC 7591 2.1）
+	responseTypes := m.ResponseTypes
+	if len(responseTypes) == 0 && usesCode {
+		responseTypes = []string{"code"}
+	}
+	for _, rt := range responseTypes {
+		if rt != "code" {
+			return nil, errInvalidClientMetadata("unsupported response_type: " + rt)
+		}
+	}
+	if usesCode != (len(responseTypes) > 0) {
+		return nil, errInvalidClientMetadata("response_types code and grant_types authorization_code must be registered together")
+	}
+	if method == authMethodNone && slices.Contains(grantTypes, "client_credentials") {
+		return nil, errInvalidClientMetadata("public clients cannot use the client_credentials grant")
+	}
+
+	appType := m.ApplicationType
+	if appType == "" {
+		appType = applicationTypeWeb
+	}
+	if appType != applicationTypeWeb && appType != applicationTypeNative {
+		return nil, errInvalidClientMetadata("application_type must be web or native")
+	}
+
+	if usesCode && len(m.RedirectURIs) == 0 {
+		return nil, errInvalidRedirectURI("redirect_uris is required for the authorization_code grant")
+	}
+	for _, uri := range m.RedirectURIs {
+		if err := validateRedirectURI(uri, appType); err != nil {
+			return nil, errInvalidRedirectURI(err.Error())
+		}
+	}
+
+	scopes := strings.Fields(m.Scope)
+	if len(scopes) == 0 {
+		scopes = defaultRegistrationScopes
+	}
+	for _, s := range scopes {
+		if !slices.Contains(supportedScopes, s) {
+			return nil, errInvalidClientMetadata("unsupported scope: " + s)
+		}
+	}
+
+	client := &OAuthClient{
+		ClientID:                clientID,
+		Name:                    m.ClientName,
+		RedirectURIs:            m.RedirectURIs,
+		Scopes:                  scopes,
+		DefaultScopes:           scopes,
+		TokenEndpointAuthMethod: method,
+		GrantTypes:              grantTypes,
+		RequirePKCE:             true,
+		ApplicationType:         appType,
+		RequirePAR:              m.RequirePAR,
+		DPoPBoundAccessTokens:   m.DPoPBoundAccessTokens,
+		CertBoundAccessTokens:   m.CertBoundAccessTokens,
+	}
+	if client.Name == "" {
+		client.Name = clientID
+	}
+
+	// 公開鍵: private_key_jwt と self_signed_tls_client_auth は jwks か jwks_uri のどちらか一方が必須
+	if len(m.JWKS) > 0 && m.JWKSURI != "" {
+		return nil, errInvalidClientMetadata("jwks and jwks_uri must not both be present")
+	}
+	if len(m.JWKS) > 0 {
+		if _, err := parseClientJWKS(m.JWKS); err != nil {
+			return nil, errInvalidClientMetadata("jwks is invalid")
+		}
+		jwks := string(m.JWKS)
+		client.JWKS = &jwks
+	}
+	if m.JWKSURI != "" {
+		if err := checkHTTPSURL(m.JWKSURI); err != nil {
+			return nil, errInvalidClientMetadata("jwks_uri " + err.Error())
+		}
+		client.JWKSURI = &m.JWKSURI
+	}
+	if (method == authMethodPrivateKeyJWT || method == authMethodSelfSignedTLSClientAuth) && client.JWKS == nil && client.JWKSURI == nil {
+		return nil, errInvalidClientMetadata("jwks or jwks_uri is required for " + method)
+	}
+
+	// リクエストオブジェクト（RFC 9101）: 取得先はサーバーから取りに行くため https に限る
+	for _, uri := range m.RequestURIs {
+		if err := checkHTTPSURL(uri); err != nil {
+			return nil, errInvalidClientMetadata("request_uris " + err.Error())
+		}
+	}
+	client.RequestURIs = m.RequestURIs
+	if alg := m.RequestObjectSigningAlg; alg != "" {
+		if !slices.Contains(supportedRequestObjectAlgs(), alg) ||
+			(slices.Contains(clientSecretJWTAlgs, alg) && method != authMethodClientSecretJWT) {
+			return nil, errInvalidClientMetadata("unsupported request_object_signing_alg: " + alg)
+		}
+		client.RequestObjectSigningAlg = &alg
+	}
+
+	// tls_client_auth は照合する subject DN / SAN をちょうど 1 つ登録する（RFC 8705 2.1.2）
+	if method == authMethodTLSClientAuth {
+		client.TLSClientAuthSubjectDN = optionalString(m.TLSClientAuthSubjectDN)
+		client.TLSClientAuthSANDNS = optionalString(m.TLSClientAuthSANDNS)
+		client.TLSClientAuthSANURI = optionalString(m.TLSClientAuthSANURI)
+		client.TLSClientAuthSANIP = optionalString(m.TLSClientAuthSANIP)
+		client.TLSClientAuthSANEmail = optionalString(m.TLSClientAuthSANEmail)
+		registered := 0
+		for _, v := range []*string{client.TLSClientAuthSubjectDN, client.TLSClientAuthSANDNS, client.TLSClientAuthSANURI, client.TLSClientAuthSANIP, client.TLSClientAuthSANEmail} {
+			if v != nil {
+				registered++
+			}
+		}
+		if registered != 1 {
+			return nil, errInvalidClientMetadata("exactly one of tls_client_auth_subject_dn / tls_client_auth_san_* is required")
+		}
+	}
+
+	return client, nil
+}
+
+// checkHTTPSURL はサーバーから取得する URL（jwks_uri / request_uris）が https の絶対 URL かを確認する。
+// ホストが内部ネットワークの IP リテラルや localhost なら登録時点で拒否する（名前解決後の判定は取得時に行う）。
+func checkHTTPSURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || u.Scheme != "https" || u.Host == "" {
+		return fmt.Errorf("must be an absolute https URL")
+	}
+	host := strings.ToLower(strings.TrimSuffix(u.Hostname(), "."))
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return fmt.Errorf("must not point to a loopback or private address")
+	}
+	if addr, err := netip.ParseAddr(host); err == nil && !isPublicAddr(addr) {
+		return fmt.Errorf("must not point to a loopback or private address")
+	}
+	return nil
+}
+
+// optionalString は空文字列を NULL（nil）にする
+func optionalString(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
+
+// stringOrEmpty は NULL（nil）を空文字列にする
+func stringOrEmpty(p *string) string {
+	if p == nil {
+		return ""
+	}
+	return *p
+}
+
+// newClientInformationResponse は保存済みのクライアントから応答を組み立てる（client_secret は含めない）。
+func newClientInformationResponse(client *OAuthClient, registrationToken string) *clientInformationResponse {
+	m := clientMetadata{
+		ClientID:                client.ClientID,
+		ClientName:              client.Name,
+		RedirectURIs:            client.RedirectURIs,
+		GrantTypes:              client.GrantTypes,
+		TokenEndpointAuthMethod: client.TokenEndpointAuthMethod,
+		Scope:                   strings.Join(client.Scopes, " "),
+		ApplicationType:         client.ApplicationType,
+		RequestURIs:             client.RequestURIs,
+		RequirePAR:              client.RequirePAR,
+		DPoPBoundAccessTokens:   client.DPoPBoundAccessTokens,
+		CertBoundAccessTokens:   client.CertBoundAccessTokens,
+	}
+	if client.AllowsGrantType("authorization_code") {
+		m.ResponseTypes = []string{"code"}
+	}
+	if client.JWKS != nil {
+		m.JWKS = json.RawMessage(*client.JWKS)
+	}
+	m.JWKSURI = stringOrEmpty(client.JWKSURI)
+	m.RequestObjectSigningAlg = stringOrEmpty(client.RequestObjectSigningAlg)
+	m.TLSClientAuthSubjectDN = stringOrEmpty(client.TLSClientAuthSubjectDN)
+	m.TLSClientAuthSANDNS = stringOrEmpty(client.TLSClientAuthSANDNS)
+	m.TLSClientAuthSANURI = stringOrEmpty(client.TLSClientAuthSANURI)
+	m.TLSClientAuthSANIP = stringOrEmpty(client.TLSClientAuthSANIP)
+	m.TLSClientAuthSANEmail = stringOrEmpty(client.TLSClientAuthSANEmail)
+
+	resp := &clientInformationResponse{
+		clientMetadata:          m,
+		ClientIDIssuedAt:        client.CreatedAt.Unix(),
+		RegistrationAccessToken: registrationToken,
+		RegistrationClientURI:   serverBaseURL() + "/register/" + url.PathEscape(client.ClientID),
+	}
+	if authMethodUsesSecret(client.TokenEndpointAuthMethod) {
+		var never int64
+		resp.ClientSecretExpiresAt = &never
+	}
+	return resp
+}
+
+// writeRegistrationJSON は登録系のレスポンスを書き出す（トークンを含むのでキャッシュさせない）。
+func writeRegistrationJSON(w http.ResponseWriter, logger *slog.Logger, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Pragma", "no-cache")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		logger.Error("登録レスポンスのエンコードに失敗しました", "error", err.Error())
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestCheckHTTPSURL(t *testing.T) {
+	tests := []struct {
+		url     string
+		wantErr bool
+	}{
+		{"https://client.example.com/jwks.json", false},
+		{"https://93.184.216.34/request.jwt", false},
+		{"http://client.example.com/jwks.json", true},
+		{"/jwks.json", true},
+		{"https://", true},
+		{"https://localhost/jwks.json", true},
+		{"https://LOCALHOST./jwks.json", true},
+		{"https://app.localhost/jwks.json", true},
+		{"https://127.0.0.1:8443/jwks.json", true},
+		{"https://[::1]/jwks.json", true},
+		{"https://10.0.0.5/request.jwt", true},
+		{"https://169.254.169.254/latest/meta-data/", true},
+		{"https://[fe80::1%25eth0]/jwks.json", true},
+	}
+	for _, tt := range tests {
+		if err := checkHTTPSURL(tt.url); (err != nil) != tt.wantErr {
+			t.Errorf("checkHTTPSURL(%q) error = %v, wantErr %v", tt.url, err, tt.wantErr)
+		}
+	}
+}
+
+func TestClientMetadataToClient(t *testing.T) {
+	t.Setenv("MTLS_LISTEN_ADDR", "")
+	jwks := *testClientJWKS(t, newTestSigningKey(t, "ES256"))
+	tests := []struct {
+		name     string
+		metadata string
+		wantCode string
+		check    func(t *testing.T, c *OAuthClient)
+	}{
+		{
+			name:     "既定値",
+			metadata: `{"redirect_uris":["https://app.example.com/cb"]}`,
+			check: func(t *testing.T, c *OAuthClient) {
+				if c.TokenEndpointAuthMethod != authMethodClientSecretBasic || c.ApplicationType != applicationTypeWeb {
+					t.Errorf("auth method = %q, application_type = %q", c.TokenEndpointAuthMethod, c.ApplicationType)
+				}
+				if !slices.Equal(c.GrantTypes, []string{"authorization_code"}) || !slices.Equal(c.Scopes, defaultRegistrationScopes) {
+					t.Errorf("grant_types = %v, scopes = %v", c.GrantTypes, c.Scopes)
+				}
+				// 動的登録したクライアントは機密クライアントでも PKCE 必須
+				if !c.RequirePKCE || c.Name != "client-1" {
+					t.Errorf("require_pkce = %v, name = %q", c.RequirePKCE, c.Name)
+				}
+			},
+		},
+		{
+			name:     "native の公開クライアント",
+			metadata: `{"token_endpoint_auth_method":"none","application_type":"native","redirect_uris":["http://127.0.0.1/cb","com.example.app:/cb"],"scope":"openid profile"}`,
+			check: func(t *testing.T, c *OAuthClient) {
+				if !c.IsPublic() || !slices.Equal(c.Scopes, []string{"openid", "profile"}) {
+					t.Errorf("public = %v, scopes = %v", c.IsPublic(), c.Scopes)
+				}
+			},
+		},
+		{
+			name:     "client_credentials だけなら redirect_uris は不要",
+			metadata: `{"grant_types":["client_credentials","client_credentials"]}`,
+			check: func(t *testing.T, c *OAuthClient) {
+				if !slices.Equal(c.GrantTypes, []string{"client_credentials"}) {
+					t.Errorf("grant_types = %v", c.GrantTypes)
+				}
+			},
+		},
+		{
+			name:     "private_key_jwt と jwks",
+			metadata: `{"token_endpoint_auth_method":"private_key_jwt","grant_types":["client_credentials"],"jwks":` + jwks + `}`,
+			check: func(t *testing.T, c *OAuthClient) {
+				if c.JWKS == nil || c.JWKSURI != nil {
+					t.Errorf("jwks = %v, jwks_uri = %v", c.JWKS, c.JWKSURI)
+				}
+			},
+		},
+		{
+			name:     "mTLS が無効なら tls_client_auth は使えない",
+			metadata: `{"token_endpoint_auth_method":"tls_client_auth","grant_types":["client_credentials"],"tls_client_auth_san_dns":"client.example.com"}`,
+			wantCode: "invalid_client_metadata",
+		},
+		{"未対応の認証方式", `{"token_endpoint_auth_method":"client_secret_jwt2","redirect_uris":["https://app.example.com/cb"]}`, "invalid_client_metadata", nil},
+		{"未対応のグラント", `{"grant_types":["password"]}`, "invalid_client_metadata", nil},
+		{"implicit の response_type", `{"response_types":["token"],"redirect_uris":["https://app.example.com/cb"]}`, "invalid_client_metadata", nil},
+		{"response_types だけで authorization_code が無い", `{"grant_types":["client_credentials"],"response_types":["code"]}`, "invalid_client_metadata", nil},
+		{"公開クライアントの client_credentials", `{"token_endpoint_auth_method":"none","grant_types":["client_credentials"]}`, "invalid_client_metadata", nil},
+		{"未知の application_type", `{"application_type":"desktop","redirect_uris":["https://app.example.com/cb"]}`, "invalid_client_metadata", nil},
+		{"redirect_uris なし", `{}`, "invalid_redirect_uri", nil},
+		{"web のプライベートスキーム", `{"redirect_uris":["com.example.app:/cb"]}`, "invalid_redirect_uri", nil},
+		{"web のループバック以外の http", `{"redirect_uris":["http://app.example.com/cb"]}`, "invalid_redirect_uri", nil},
+		{"native の localhost", `{"application_type":"native","redirect_uris":["http://localhost/cb"]}`, "invalid_redirect_uri", nil},
+		{"フラグメント", `{"redirect_uris":["https://app.example.com/cb#x"]}`, "invalid_redirect_uri", nil},
+		{"シードにしか無いスコープ", `{"redirect_uris":["https://app.example.com/cb"],"scope":"read admin"}`, "invalid_client_metadata", nil},
+		{"jwks と jwks_uri の両方", `{"grant_types":["client_credentials"],"jwks":` + jwks + `,"jwks_uri":"https://app.example.com/jwks"}`, "invalid_client_metadata", nil},
+		{"不正な jwks", `{"grant_types":["client_credentials"],"jwks":{"keys":[{"kty":"oct"}]}}`, "invalid_client_metadata", nil},
+		{"内部ネットワークの jwks_uri", `{"grant_types":["client_credentials"],"jwks_uri":"https://169.254.169.254/jwks"}`, "invalid_client_metadata", nil},
+		{"private_key_jwt に公開鍵が無い", `{"token_endpoint_auth_method":"private_key_jwt","grant_types":["client_credentials"]}`, "invalid_client_metadata", nil},
+		{"http の request_uris", `{"redirect_uris":["https://app.example.com/cb"],"request_uris":["http://app.example.com/req.jwt"]}`, "invalid_client_metadata", nil},
+		{"未対応の request_object_signing_alg", `{"redirect_uris":["https://app.example.com/cb"],"request_object_signing_alg":"none"}`, "invalid_client_metadata", nil},
+		{"client_secret_jwt 以外の HS256", `{"redirect_uris":["https://app.example.com/cb"],"request_object_signing_alg":"HS256"}`, "invalid_client_metadata", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var m clientMetadata
+			if err := json.Unmarshal([]byte(tt.metadata), &m); err != nil {
+				t.Fatal(err)
+			}
+			client, e := m.toClient("client-1")
+			if tt.wantCode != "" {
+				if e == nil || e.Code != tt.wantCode {
+					t.Fatalf("toClient() error = %+v, want %s", e, tt.wantCode)
+				}
+				return
+			}
+			if e != nil {
+				t.Fatalf("toClient() error = %+v", e)
+			}
+			tt.check(t, client)
+		})
+	}
+}
+
+func TestClientMetadataToClientTLSClientAuth(t *testing.T) {
+	t.Setenv("MTLS_LISTEN_ADDR", ":8443")
+	tests := []struct {
+		name     string
+		metadata string
+		wantErr  bool
+	}{
+		{"SAN DNS をひとつ", `{"tls_client_auth_san_dns":"client.example.com"}`, false},
+		{"subject DN をひとつ", `{"tls_client_auth_subject_dn":"CN=client"}`, false},
+		{"照合値が無い", `{}`, true},
+		{"照合値がふたつ", `{"tls_client_auth_subject_dn":"CN=client","tls_client_auth_san_dns":"client.example.com"}`, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := clientMetadata{TokenEndpointAuthMethod: authMethodTLSClientAuth, GrantTypes: []string{"client_credentials"}}
+			if err := json.Unmarshal([]byte(tt.metadata), &m); err != nil {
+				t.Fatal(err)
+			}
+			if _, e := m.toClient("client-1"); (e != nil) != tt.wantErr {
+				t.Errorf("toClient() error = %+v, wantErr %v", e, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRegisterClientHandlerRejects(t *testing.T) {
+	// クライアントを保存する前に返すエラーだけを確認する
+	t.Setenv("REGISTRATION_INITIAL_ACCESS_TOKEN", "initial")
+	tests := []struct {
+		name        string
+		auth        string
+		contentType string
+		body        string
+		wantStatus  int
+		wantCode    string
+	}{
+		{"初期アクセストークンなし", "", "application/json", `{}`, http.StatusUnauthorized, ""},
+		{"初期アクセストークンが違う", "Bearer other", "application/json", `{}`, http.StatusUnauthorized, ""},
+		{"JSON 以外", "Bearer initial", "application/x-www-form-urlencoded", `{}`, http.StatusBadRequest, "invalid_request"},
+		{"壊れた JSON", "Bearer initial", "application/json", `{"redirect_uris":`, http.StatusBadRequest, "invalid_client_metadata"},
+		{"上限を超えるボディ", "Bearer initial", "application/json", `{"client_name":"` + strings.Repeat("a", registrationMaxBody) + `"}`, http.StatusBadRequest, "invalid_client_metadata"},
+		{"無効なメタデータ", "Bearer initial", "application/json", `{"redirect_uris":["ftp://app.example.com/cb"]}`, http.StatusBadRequest, "invalid_redirect_uri"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/register", strings.NewReader(tt.body))
+			r.Header.Set("Content-Type", tt.contentType)
+			if tt.auth != "" {
+				r.Header.Set("Authorization", tt.auth)
+			}
+			rec := httptest.NewRecorder()
+			registerClientHandler(rec, r)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if tt.wantCode == "" {
+				if got := rec.Header().Get("WWW-Authenticate"); !strings.Contains(got, `error="invalid_token"`) {
+					t.Errorf("WWW-Authenticate = %q", got)
+				}
+				return
+			}
+			if code := oauthErrorCode(t, rec); code != tt.wantCode {
+				t.Errorf("error = %q, want %q", code, tt.wantCode)
+			}
+		})
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bufio"
+	"crypto"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// 署名デーモンとの通信タイムアウト（接続から応答受信まで）
+const remoteSignerTimeout = 5 * time.Second
+
+// remoteSigner は秘密鍵を持たず、Unix ソケットで待ち受けるローカルの署名デーモンに署名を依頼する Signer。
+// 鍵素材を認可サーバーのプロセスから切り離したい場合に使う。
+//
+// プロトコルは 1 接続 1 リクエストの改行区切り JSON:
+//
+//	→ {"op":"public_key"}
+//	← {"kid":"...","alg":"ES256","public_key":"<PKIX DER の Base64>"}
+//	→ {"op":"sign","kid":"...","alg":"ES256","signing_input":"<JWS Signing Input>"}
+//	← {"signature":"<JWS 形式の署名の Base64URL>"}
+//
+// 失敗時は {"error":"..."} を返す。
+type remoteSigner struct {
+	socket string
+	kid    string
+	alg    string
+	method jwt.SigningMethod
+	public crypto.PublicKey
+}
+
+type remoteSignerRequest struct {
+	Op           string `json:"op"`
+	Kid          string `json:"kid,omitempty"`
+	Alg          string `json:"alg,omitempty"`
+	SigningInput string `json:"signing_input,omitempty"`
+}
+
+type remoteSignerResponse struct {
+	Kid       string `json:"kid,omitempty"`
+	Alg       string `json:"alg,omitempty"`
+	PublicKey string `json:"public_key,omitempty"`
+	Signature string `json:"signature,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// newRemoteSigner は署名デーモンの鍵 kid の Signer を作る。
+// publicKey（マニフェストに記録した公開鍵）があればそれを使い、デーモンには問い合わせない。
+// デーモンが次の鍵に切り替えた後も、退役した鍵を検証用に読み込めるようにするため。
+// 記録の無い旧形式のマニフェストでは、デーモンの現在の鍵を取得して kid と alg が一致するかを確認する。
+func newRemoteSigner(socket, kid, alg, publicKey string) (Signer, error) {
+	method, ok := signingMethods[alg]
+	if !ok {
+		return nil, fmt.Errorf("未対応の署名アルゴリズムです: %s", alg)
+	}
+	if publicKey != "" {
+		pub, err := parseRemotePublicKey(publicKey)
+		if err != nil {
+			return nil, err
+		}
+		return &remoteSigner{socket: socket, kid: kid, alg: alg, method: method, public: pub}, nil
+	}
+	info, pub, err := fetchRemotePublicKey(socket)
+	if err != nil {
+		return nil, err
+	}
+	if info.Kid != kid || info.Alg != alg {
+		return nil, fmt.Errorf("署名デーモンの鍵（kid=%s, alg=%s）がマニフェストと一致しません", info.Kid, info.Alg)
+	}
+	return &remoteSigner{socket: socket, kid: kid, alg: alg, method: method, public: pub}, nil
+}
+
+// fetchRemotePublicKey は署名デーモンが現在使っている鍵の kid / alg / 公開鍵を取得する。
+func fetchRemotePublicKey(socket string) (*remoteSignerResponse, crypto.PublicKey, error) {
+	res, err := callRemoteSigner(socket, remoteSignerRequest{Op: "public_key"})
+	if err != nil {
+		return nil, nil, err
+	}
+	pub, err := parseRemotePublicKey(res.PublicKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	return res, pub, nil
+}
+
+// parseRemotePublicKey はプロトコルの public_key（PKIX DER の Base64）をパースする。
+func parseRemotePublicKey(b64 string) (crypto.PublicKey, error) {
+	der, err := base64.StdEncoding.DecodeString(b64)
+	if err != nil {
+		return nil, fmt.Errorf("署名デーモンの公開鍵のデコードエラー: %v", err)
+	}
+	pub, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("署名デーモンの公開鍵のパースエラー: %v", err)
+	}
+	return pub, nil
+}
+
+func (s *remoteSigner) Algorithm() string        { return s.alg }
+func (s *remoteSigner) Public() crypto.PublicKey { return s.public }
+
+func (s *remoteSigner) SignJWS(signingInput string) ([]byte, error) {
+	res, err := callRemoteSigner(s.socket, remoteSignerRequest{
+		Op:           "sign",
+		Kid:          s.kid,
+		Alg:          s.alg,
+		SigningInput: signingInput,
+	})
+	if err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(res.Signature)
+	if err != nil {
+		return nil, fmt.Errorf("署名デーモンの署名のデコードエラー: %v", err)
+	}
+	// デーモンの取り違え（別の鍵・形式の誤り）で検証できないトークンを発行しないよう、公開鍵で確かめてから返す
+	if err := s.method.Verify(signingInput, sig, s.public); err != nil {
+		return nil, fmt.Errorf("署名デーモンの署名を検証できません: %v", err)
+	}
+	return sig, nil
+}
+
+func callRemoteSigner(socket string, req remoteSignerRequest) (*remoteSignerResponse, error) {
+	conn, err := net.DialTimeout("unix", socket, remoteSignerTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("署名デーモンへの接続エラー: %v", err)
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(remoteSignerTimeout)); err != nil {
+		return nil, err
+	}
+
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(append(body, '\n')); err != nil {
+		return nil, fmt.Errorf("署名デーモンへの送信エラー: %v", err)
+	}
+
+	line, err := bufio.NewReader(conn).ReadBytes('\n')
+	if err != nil && len(line) == 0 {
+		return nil, fmt.Errorf("署名デーモンからの受信エラー: %v", err)
+	}
+	var res remoteSignerResponse
+	if err := json.Unmarshal(line, &res); err != nil {
+		return nil, fmt.Errorf("署名デーモンの応答のパースエラー: %v", err)
+	}
+	if res.Error != "" {
+		return nil, fmt.Errorf("署名デーモンのエラー: %s", res.Error)
+	}
+	return &res, nil
+}
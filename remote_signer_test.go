@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeSignerDaemon は remote_signer.go のプロトコルを話すテスト用の署名デーモン。
+// rotate で現在の鍵を切り替え、forget で古い鍵を捨てる（実際のデーモンが鍵を破棄した状態）。
+type fakeSignerDaemon struct {
+	socket string
+
+	mu      sync.Mutex
+	current string
+	keys    map[string]*ecdsa.PrivateKey
+}
+
+func newFakeSignerDaemon(t *testing.T) *fakeSignerDaemon {
+	t.Helper()
+	d := &fakeSignerDaemon{socket: filepath.Join(t.TempDir(), "signer.sock"), keys: map[string]*ecdsa.PrivateKey{}}
+	ln, err := net.Listen("unix", d.socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go d.serve(conn)
+		}
+	}()
+	d.rotate(t, "daemon-key-1")
+	return d
+}
+
+func (d *fakeSignerDaemon) rotate(t *testing.T, kid string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.keys[kid] = key
+	d.current = kid
+}
+
+func (d *fakeSignerDaemon) forget(kid string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.keys, kid)
+}
+
+func (d *fakeSignerDaemon) serve(conn net.Conn) {
+	defer conn.Close()
+	line, err := bufio.NewReader(conn).ReadBytes('\n')
+	if err != nil {
+		return
+	}
+	var req remoteSignerRequest
+	res := remoteSignerResponse{}
+	if err := json.Unmarshal(line, &req); err != nil {
+		res.Error = err.Error()
+	} else if err := d.handle(req, &res); err != nil {
+		res.Error = err.Error()
+	}
+	body, _ := json.Marshal(res)
+	conn.Write(append(body, '\n'))
+}
+
+func (d *fakeSignerDaemon) handle(req remoteSignerRequest, res *remoteSignerResponse) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	switch req.Op {
+	case "public_key":
+		der, err := x509.MarshalPKIXPublicKey(d.keys[d.current].Public())
+		if err != nil {
+			return err
+		}
+		res.Kid, res.Alg, res.PublicKey = d.current, "ES256", base64.StdEncoding.EncodeToString(der)
+		return nil
+	case "sign":
+		key, ok := d.keys[req.Kid]
+		if !ok {
+			return errors.New("unknown kid")
+		}
+		sig, err := signingMethods["ES256"].Sign(req.SigningInput, key)
+		if err != nil {
+			return err
+		}
+		res.Signature = base64.RawURLEncoding.EncodeToString(sig)
+		return nil
+	}
+	return errors.New("unknown op")
+}
+
+func TestRemoteSignerSurvivesDaemonRotation(t *testing.T) {
+	t.Chdir(t.TempDir())
+	daemon := newFakeSignerDaemon(t)
+
+	if _, err := rotateToRemoteSigner(daemon.socket); err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := readKeyManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest.Keys[0].PublicKey == "" {
+		t.Fatal("マニフェストに署名デーモンの公開鍵が記録されていません")
+	}
+
+	// デーモンが次の鍵に切り替え、古い鍵を破棄した後も、マニフェストの退役済みの鍵で起動できる
+	daemon.rotate(t, "daemon-key-2")
+	daemon.forget("daemon-key-1")
+	if _, err := rotateToRemoteSigner(daemon.socket); err != nil {
+		t.Fatal(err)
+	}
+	manifest, err = readKeyManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ks, err := loadKeySet(manifest, nil, time.Now())
+	if err != nil {
+		t.Fatalf("デーモンのローテーション後に鍵セットを読み込めません: %v", err)
+	}
+	if ks.active.ID != "daemon-key-2" {
+		t.Errorf("active = %s", ks.active.ID)
+	}
+	if _, ok := ks.lookup("daemon-key-1"); !ok {
+		t.Error("退役した鍵が検証用に残っていません")
+	}
+
+	// active の鍵で署名でき、validateJWTToken で検証できる
+	prev := jwtKeys.Load()
+	jwtKeys.Store(ks)
+	t.Cleanup(func() { jwtKeys.Store(prev) })
+	token, err := generateJWTClientAccessToken("svc", "read", time.Minute, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := validateJWTToken(token); err != nil {
+		t.Errorf("デーモンが署名したトークンを検証できません: %v", err)
+	}
+}
+
+func TestNewRemoteSigner(t *testing.T) {
+	daemon := newFakeSignerDaemon(t)
+	info, _, err := fetchRemotePublicKey(daemon.socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		kid       string
+		alg       string
+		publicKey string
+		wantErr   bool
+	}{
+		{"記録した公開鍵を使う", "daemon-key-1", "ES256", info.PublicKey, false},
+		{"記録が無ければデーモンの現在の鍵と照合する", "daemon-key-1", "ES256", "", false},
+		{"記録が無く kid が一致しない", "other-key", "ES256", "", true},
+		{"記録が無く alg が一致しない", "daemon-key-1", "ES384", "", true},
+		{"記録した公開鍵が壊れている", "daemon-key-1", "ES256", "not base64!", true},
+		{"未対応のアルゴリズム", "daemon-key-1", "HS256", info.PublicKey, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newRemoteSigner(daemon.socket, tt.kid, tt.alg, tt.publicKey)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("newRemoteSigner() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRemoteSignerRejectsWrongSignature(t *testing.T) {
+	daemon := newFakeSignerDaemon(t)
+	info, _, err := fetchRemotePublicKey(daemon.socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := newRemoteSigner(daemon.socket, "daemon-key-1", "ES256", info.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := signer.SignJWS("header.payload"); err != nil {
+		t.Fatalf("SignJWS() error = %v", err)
+	}
+
+	// デーモン側で同じ kid の鍵が差し替わった場合は、検証できない署名を返さない
+	daemon.rotate(t, "daemon-key-1")
+	if _, err := signer.SignJWS("header.payload"); err == nil {
+		t.Error("公開鍵と一致しない署名を受け入れました")
+	}
+}
+
+func TestLoadKeySetSkipsUnreadableRetiredKey(t *testing.T) {
+	t.Chdir(t.TempDir())
+	now := time.Now().UTC()
+	active, err := newKeyEntry("ES256", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	retiredAt := now.Add(-time.Hour)
+	missing := keyManifestEntry{Kid: "missing", File: "missing.pem", Alg: "ES256", CreatedAt: now.Add(-48 * time.Hour), RetiredAt: &retiredAt}
+
+	ks, err := loadKeySet(&keyManifest{Keys: []keyManifestEntry{active, missing}}, nil, now)
+	if err != nil {
+		t.Fatalf("読み込めない退役済みの鍵で起動が止まりました: %v", err)
+	}
+	if _, ok := ks.lookup("missing"); ok {
+		t.Error("読み込めない鍵が鍵セットに入っています")
+	}
+
+	// active の鍵が読み込めない場合は従来どおりエラー
+	active.File = "missing.pem"
+	if _, err := loadKeySet(&keyManifest{Keys: []keyManifestEntry{active}}, nil, now); err == nil {
+		t.Error("active の鍵が読み込めないのにエラーになりません")
+	}
+}
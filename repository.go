@@ -2,8 +2,11 @@ package main
 
 import (
 	"context"
+	"crypto/subtle"
 	"database/sql"
+	"errors"
 	"fmt"
+	"slices"
 	"time"
 
 	"github.com/lib/pq"
@@ -108,14 +111,26 @@ func (r *Repository) ValidateUserPassword(ctx context.Context, username, passwor
 // GetClientByID はクライアントIDでOAuth2クライアントを取得します
 func (r *Repository) GetClientByID(ctx context.Context, clientID string) (*OAuthClient, error) {
 	query := `
-		SELECT id, client_id, client_secret, name, redirect_uris, scopes, created_at, updated_at
+		SELECT id, client_id, COALESCE(client_secret, ''), name, redirect_uris, scopes, default_scopes, token_endpoint_auth_method, jwks, jwks_uri,
+		       access_token_lifetime, authorization_code_lifetime, refresh_token_lifetime,
+		       refresh_token_absolute_lifetime, refresh_token_idle_timeout, refresh_token_rotation, require_pkce,
+		       application_type, require_pushed_authorization_requests, request_object_signing_alg, request_uris,
+		       dpop_bound_access_tokens, tls_client_certificate_bound_access_tokens, tls_client_auth_subject_dn,
+		       tls_client_auth_san_dns, tls_client_auth_san_uri, tls_client_auth_san_ip, tls_client_auth_san_email,
+		       grant_types, registration_access_token_hash, created_at, updated_at
 		FROM oauth_clients
 		WHERE client_id = $1`
 
 	var client OAuthClient
 	err := r.db.db.QueryRowContext(ctx, query, clientID).Scan(
 		&client.ID, &client.ClientID, &client.ClientSecret, &client.Name,
-		&client.RedirectURIs, &client.Scopes, &client.CreatedAt, &client.UpdatedAt,
+		&client.RedirectURIs, &client.Scopes, &client.DefaultScopes, &client.TokenEndpointAuthMethod, &client.JWKS, &client.JWKSURI,
+		&client.AccessTokenLifetime, &client.AuthorizationCodeLifetime, &client.RefreshTokenLifetime,
+		&client.RefreshTokenAbsoluteLifetime, &client.RefreshTokenIdleTimeout, &client.RefreshTokenRotation, &client.RequirePKCE,
+		&client.ApplicationType, &client.RequirePAR, &client.RequestObjectSigningAlg, &client.RequestURIs,
+		&client.DPoPBoundAccessTokens, &client.CertBoundAccessTokens, &client.TLSClientAuthSubjectDN,
+		&client.TLSClientAuthSANDNS, &client.TLSClientAuthSANURI, &client.TLSClientAuthSANIP, &client.TLSClientAuthSANEmail,
+		&client.GrantTypes, &client.RegistrationAccessTokenHash, &client.CreatedAt, &client.UpdatedAt,
 	)
 	if err != nil {
 		if err == sql.ErrNoRows {
@@ -127,29 +142,354 @@ func (r *Repository) GetClientByID(ctx context.Context, clientID string) (*OAuth
 	return &client, nil
 }
 
-// ValidateClientCredentials はクライアントの認証情報を検証します
-func (r *Repository) ValidateClientCredentials(ctx context.Context, clientID, clientSecret string) (*OAuthClient, error) {
+// ValidateClientCredentials はクライアントの認証情報を検証します。
+// method はリクエストで使われた認証方式で、登録内容と異なる場合はシークレットを照合しない。
+// client_secrets の有効なハッシュ（ローテーション中は新旧 2 つ）と照合し、
+// 平文の oauth_clients.client_secret しか無い既存クライアントは照合に成功した時点でハッシュへ移行する。
+func (r *Repository) ValidateClientCredentials(ctx context.Context, clientID, clientSecret, method string) (*OAuthClient, error) {
 	client, err := r.GetClientByID(ctx, clientID)
 	if err != nil {
 		return nil, err
 	}
+	// 方式が違うリクエスト（公開クライアントに送られた client_secret 等）で平文の移行を起こさない
+	if client.TokenEndpointAuthMethod != method {
+		return nil, fmt.Errorf("クライアント認証方式が登録内容（%s）と異なります: %s", client.TokenEndpointAuthMethod, method)
+	}
+
+	rows, err := r.db.db.QueryContext(ctx, `
+		SELECT secret_hash FROM client_secrets
+		WHERE client_id = $1 AND (expires_at IS NULL OR expires_at > $2)`, clientID, time.Now())
+	if err != nil {
+		return nil, fmt.Errorf("クライアントシークレットの取得に失敗しました: %w", err)
+	}
+	defer rows.Close()
+
+	var hashes []string
+	for rows.Next() {
+		var stored string
+		if err := rows.Scan(&stored); err != nil {
+			return nil, fmt.Errorf("クライアントシークレットの取得に失敗しました: %w", err)
+		}
+		hashes = append(hashes, stored)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("クライアントシークレットの取得に失敗しました: %w", err)
+	}
+	if clientSecretMatches(hashes, clientSecret) {
+		return client, nil
+	}
+
+	// ハッシュ化前のシード（init.sql）。client_secret_jwt は HMAC 鍵として平文が必要なので移行しない
+	if client.ClientSecret != "" && subtle.ConstantTimeCompare([]byte(client.ClientSecret), []byte(clientSecret)) == 1 {
+		if client.TokenEndpointAuthMethod != authMethodClientSecretJWT {
+			if err := r.migratePlaintextClientSecret(ctx, clientID, clientSecret); err != nil {
+				return nil, err
+			}
+		}
+		return client, nil
+	}
+
+	return nil, fmt.Errorf("クライアントシークレットが正しくありません")
+}
+
+// migratePlaintextClientSecret は平文のクライアントシークレットをハッシュとして client_secrets に移し、平文を消す。
+func (r *Repository) migratePlaintextClientSecret(ctx context.Context, clientID, clientSecret string) error {
+	tx, err := r.db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("トランザクションの開始に失敗しました: %w", err)
+	}
+	defer tx.Rollback()
+
+	// 同時に移行した別のリクエストが先に消していれば何もしない
+	res, err := tx.ExecContext(ctx,
+		"UPDATE oauth_clients SET client_secret = NULL, updated_at = CURRENT_TIMESTAMP WHERE client_id = $1 AND client_secret = $2",
+		clientID, clientSecret)
+	if err != nil {
+		return fmt.Errorf("クライアントシークレットの移行に失敗しました: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return nil
+	}
+	_, err = tx.ExecContext(ctx,
+		"INSERT INTO client_secrets (client_id, secret_hash) VALUES ($1, $2)",
+		clientID, hashClientSecret(clientSecret))
+	if err != nil {
+		return fmt.Errorf("クライアントシークレットの移行に失敗しました: %w", err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("トランザクションのコミットに失敗しました: %w", err)
+	}
+	return nil
+}
+
+// PreviousClientSecret は client_secret_jwt のクライアントがローテーション前に使っていた平文のシークレットを返す。
+// ローテーションしていない、または猶予期間を過ぎている場合は空文字列を返す。
+func (r *Repository) PreviousClientSecret(ctx context.Context, clientID string) (string, error) {
+	var secret sql.NullString
+	err := r.db.db.QueryRowContext(ctx, `
+		SELECT previous_client_secret FROM oauth_clients
+		WHERE client_id = $1 AND previous_client_secret_expires_at > $2`, clientID, time.Now()).Scan(&secret)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return "", nil
+		}
+		return "", fmt.Errorf("クライアントシークレットの取得に失敗しました: %w", err)
+	}
+	return secret.String, nil
+}
+
+// RotateClientSecret は新しいクライアントシークレットを登録する。
+// 直前まで使われていたシークレット（平文のシードを含む）は oldExpiresAt まで有効のまま残し、それより古いものは即時に失効させる。
+// client_secret_jwt のクライアントは HMAC 鍵として平文が必要なため、oauth_clients.client_secret を置き換え、
+// 直前のシークレットを previous_client_secret に oldExpiresAt まで残す。
+func (r *Repository) RotateClientSecret(ctx context.Context, clientID, newSecret string, oldExpiresAt time.Time) error {
+	client, err := r.GetClientByID(ctx, clientID)
+	if err != nil {
+		return err
+	}
+	switch client.TokenEndpointAuthMethod {
+	case authMethodNone, authMethodPrivateKeyJWT, authMethodTLSClientAuth, authMethodSelfSignedTLSClientAuth:
+		return fmt.Errorf("%s のクライアントはクライアントシークレットを使いません", client.TokenEndpointAuthMethod)
+	case authMethodClientSecretJWT:
+		// SET の右辺は更新前の値を参照するので、直前のシークレットがそのまま previous_client_secret に入る
+		_, err := r.db.db.ExecContext(ctx, `
+			UPDATE oauth_clients
+			SET previous_client_secret = client_secret, previous_client_secret_expires_at = $3,
+			    client_secret = $2, updated_at = CURRENT_TIMESTAMP
+			WHERE client_id = $1`,
+			clientID, newSecret, oldExpiresAt)
+		if err != nil {
+			return fmt.Errorf("クライアントシークレットの更新に失敗しました: %w", err)
+		}
+		return nil
+	}
+
+	tx, err := r.db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("トランザクションの開始に失敗しました: %w", err)
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	var plaintext sql.NullString
+	err = tx.QueryRowContext(ctx, "SELECT client_secret FROM oauth_clients WHERE client_id = $1 FOR UPDATE", clientID).Scan(&plaintext)
+	if err != nil {
+		return fmt.Errorf("クライアントの取得に失敗しました: %w", err)
+	}
+
+	// 有効なシークレットのうち最新の 1 つだけを猶予期間付きで残す
+	_, err = tx.ExecContext(ctx, `
+		UPDATE client_secrets SET expires_at = $2
+		WHERE client_id = $1 AND (expires_at IS NULL OR expires_at > $2)
+		  AND id <> (SELECT id FROM client_secrets WHERE client_id = $1 AND (expires_at IS NULL OR expires_at > $2) ORDER BY created_at DESC, id DESC LIMIT 1)`,
+		clientID, now)
+	if err != nil {
+		return fmt.Errorf("古いクライアントシークレットの失効に失敗しました: %w", err)
+	}
+	_, err = tx.ExecContext(ctx, `
+		UPDATE client_secrets SET expires_at = $3
+		WHERE client_id = $1 AND (expires_at IS NULL OR expires_at > $2)`,
+		clientID, now, oldExpiresAt)
+	if err != nil {
+		return fmt.Errorf("古いクライアントシークレットの失効に失敗しました: %w", err)
+	}
+
+	if plaintext.Valid && plaintext.String != "" {
+		// 未移行の平文シードは、直前のシークレットとして猶予期間だけ残す
+		_, err = tx.ExecContext(ctx, `
+			UPDATE client_secrets SET expires_at = $2 WHERE client_id = $1 AND (expires_at IS NULL OR expires_at > $2)`,
+			clientID, now)
+		if err != nil {
+			return fmt.Errorf("古いクライアントシークレットの失効に失敗しました: %w", err)
+		}
+		_, err = tx.ExecContext(ctx,
+			"INSERT INTO client_secrets (client_id, secret_hash, expires_at) VALUES ($1, $2, $3)",
+			clientID, hashClientSecret(plaintext.String), oldExpiresAt)
+		if err != nil {
+			return fmt.Errorf("クライアントシークレットの移行に失敗しました: %w", err)
+		}
+	}
+
+	_, err = tx.ExecContext(ctx,
+		"INSERT INTO client_secrets (client_id, secret_hash) VALUES ($1, $2)",
+		clientID, hashClientSecret(newSecret))
+	if err != nil {
+		return fmt.Errorf("クライアントシークレットの登録に失敗しました: %w", err)
+	}
+	_, err = tx.ExecContext(ctx,
+		"UPDATE oauth_clients SET client_secret = NULL, updated_at = CURRENT_TIMESTAMP WHERE client_id = $1", clientID)
+	if err != nil {
+		return fmt.Errorf("クライアントシークレットの更新に失敗しました: %w", err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("トランザクションのコミットに失敗しました: %w", err)
+	}
+	return nil
+}
+
+// CreateClient は動的登録（RFC 7591）したクライアントを保存する。
+// secret は client_secret_jwt なら HMAC 鍵として平文のまま oauth_clients.client_secret に、
+// client_secret_basic / client_secret_post ならハッシュだけを client_secrets に保存する（空ならシークレットなし）。
+func (r *Repository) CreateClient(ctx context.Context, client *OAuthClient, secret string) error {
+	tx, err := r.db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("トランザクションの開始に失敗しました: %w", err)
+	}
+	defer tx.Rollback()
+
+	var plaintext *string
+	if secret != "" && client.TokenEndpointAuthMethod == authMethodClientSecretJWT {
+		plaintext = &secret
+	}
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO oauth_clients (client_id, client_secret, name, redirect_uris, scopes, default_scopes, token_endpoint_auth_method,
+		                           grant_types, jwks, jwks_uri, require_pkce, application_type, require_pushed_authorization_requests,
+		                           request_object_signing_alg, request_uris, dpop_bound_access_tokens,
+		                           tls_client_certificate_bound_access_tokens, tls_client_auth_subject_dn, tls_client_auth_san_dns,
+		                           tls_client_auth_san_uri, tls_client_auth_san_ip, tls_client_auth_san_email, registration_access_token_hash)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21, $22, $23)
+		RETURNING id, created_at, updated_at`,
+		client.ClientID, plaintext, client.Name, client.RedirectURIs, client.Scopes, client.DefaultScopes, client.TokenEndpointAuthMethod,
+		client.GrantTypes, client.JWKS, client.JWKSURI, client.RequirePKCE, client.ApplicationType, client.RequirePAR,
+		client.RequestObjectSigningAlg, client.RequestURIs, client.DPoPBoundAccessTokens,
+		client.CertBoundAccessTokens, client.TLSClientAuthSubjectDN, client.TLSClientAuthSANDNS,
+		client.TLSClientAuthSANURI, client.TLSClientAuthSANIP, client.TLSClientAuthSANEmail, client.RegistrationAccessTokenHash,
+	).Scan(&client.ID, &client.CreatedAt, &client.UpdatedAt)
+	if err != nil {
+		return fmt.Errorf("クライアントの登録に失敗しました: %w", err)
+	}
 
-	if client.ClientSecret != clientSecret {
-		return nil, fmt.Errorf("クライアントシークレットが正しくありません")
+	if secret != "" && plaintext == nil {
+		_, err = tx.ExecContext(ctx,
+			"INSERT INTO client_secrets (client_id, secret_hash) VALUES ($1, $2)",
+			client.ClientID, hashClientSecret(secret))
+		if err != nil {
+			return fmt.Errorf("クライアントシークレットの登録に失敗しました: %w", err)
+		}
 	}
 
-	return client, nil
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("トランザクションのコミットに失敗しました: %w", err)
+	}
+	return nil
+}
+
+// UpdateClientMetadata は RFC 7592 の PUT で受け取ったメタデータでクライアントを更新する。
+// client_id・シークレット・token_endpoint_auth_method・registration_access_token は変えない。
+func (r *Repository) UpdateClientMetadata(ctx context.Context, client *OAuthClient) error {
+	res, err := r.db.db.ExecContext(ctx, `
+		UPDATE oauth_clients SET
+		    name = $2, redirect_uris = $3, scopes = $4, default_scopes = $5, grant_types = $6, jwks = $7, jwks_uri = $8,
+		    require_pkce = $9, application_type = $10, require_pushed_authorization_requests = $11,
+		    request_object_signing_alg = $12, request_uris = $13, dpop_bound_access_tokens = $14,
+		    tls_client_certificate_bound_access_tokens = $15, tls_client_auth_subject_dn = $16, tls_client_auth_san_dns = $17,
+		    tls_client_auth_san_uri = $18, tls_client_auth_san_ip = $19, tls_client_auth_san_email = $20,
+		    updated_at = CURRENT_TIMESTAMP
+		WHERE client_id = $1`,
+		client.ClientID, client.Name, client.RedirectURIs, client.Scopes, client.DefaultScopes, client.GrantTypes, client.JWKS, client.JWKSURI,
+		client.RequirePKCE, client.ApplicationType, client.RequirePAR,
+		client.RequestObjectSigningAlg, client.RequestURIs, client.DPoPBoundAccessTokens,
+		client.CertBoundAccessTokens, client.TLSClientAuthSubjectDN, client.TLSClientAuthSANDNS,
+		client.TLSClientAuthSANURI, client.TLSClientAuthSANIP, client.TLSClientAuthSANEmail,
+	)
+	if err != nil {
+		return fmt.Errorf("クライアントの更新に失敗しました: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("クライアントが見つかりません: %s", client.ClientID)
+	}
+	return nil
+}
+
+// DeleteClient はクライアントを削除する。シークレット・認可コード・トークン・同意は外部キーの ON DELETE CASCADE で消える。
+func (r *Repository) DeleteClient(ctx context.Context, clientID string) error {
+	res, err := r.db.db.ExecContext(ctx, "DELETE FROM oauth_clients WHERE client_id = $1", clientID)
+	if err != nil {
+		return fmt.Errorf("クライアントの削除に失敗しました: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("クライアントが見つかりません: %s", clientID)
+	}
+	return nil
+}
+
+// RecordClientAssertionJTI はクライアントアサーションの jti を記録する。
+// 同じクライアントの同じ jti が有効期限内に既に使われていればリプレイとしてエラーを返す（RFC 7523 3）。
+func (r *Repository) RecordClientAssertionJTI(ctx context.Context, clientID, jti string, expiresAt time.Time) error {
+	query := `
+		INSERT INTO client_assertion_jtis (client_id, jti, expires_at)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (client_id, jti) DO NOTHING`
+
+	result, err := r.db.db.ExecContext(ctx, query, clientID, jti, expiresAt)
+	if err != nil {
+		return fmt.Errorf("client_assertion の jti の記録に失敗しました: %w", err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("client_assertion の jti の記録に失敗しました: %w", err)
+	}
+	if n == 0 {
+		return fmt.Errorf("client_assertion の jti が再利用されました: %s", jti)
+	}
+	return nil
+}
+
+// RecordRequestObjectJTI はリクエストオブジェクトの jti を記録する。
+// 同じクライアントの同じ jti が有効期限内に既に使われていればリプレイとしてエラーを返す（RFC 9101 10.8）。
+func (r *Repository) RecordRequestObjectJTI(ctx context.Context, clientID, jti string, expiresAt time.Time) error {
+	query := `
+		INSERT INTO request_object_jtis (client_id, jti, expires_at)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (client_id, jti) DO NOTHING`
+
+	result, err := r.db.db.ExecContext(ctx, query, clientID, jti, expiresAt)
+	if err != nil {
+		return fmt.Errorf("リクエストオブジェクトの jti の記録に失敗しました: %w", err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("リクエストオブジェクトの jti の記録に失敗しました: %w", err)
+	}
+	if n == 0 {
+		return fmt.Errorf("リクエストオブジェクトの jti が再利用されました: %s", jti)
+	}
+	return nil
+}
+
+// RecordDPoPProofJTI は DPoP 証明の jti を記録する。同じ鍵の同じ jti が有効期限内に既に使われていればリプレイとしてエラーを返す（RFC 9449 11.1）。
+func (r *Repository) RecordDPoPProofJTI(ctx context.Context, jkt, jti string, expiresAt time.Time) error {
+	query := `
+		INSERT INTO dpop_proof_jtis (jkt, jti, expires_at)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (jkt, jti) DO NOTHING`
+
+	result, err := r.db.db.ExecContext(ctx, query, jkt, jti, expiresAt)
+	if err != nil {
+		return fmt.Errorf("DPoP 証明の jti の記録に失敗しました: %w", err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("DPoP 証明の jti の記録に失敗しました: %w", err)
+	}
+	if n == 0 {
+		return fmt.Errorf("DPoP 証明の jti が再利用されました: %s", jti)
+	}
+	return nil
 }
 
 // 認可コード関連のメソッド
 
-// CreateAuthorizationCode は新しい認可コードを作成します
-func (r *Repository) CreateAuthorizationCode(ctx context.Context, code string, clientID string, userID int, redirectURI string, scopes []string, codeChallenge, codeChallengeMethod, nonce, state *string, expiresAt time.Time) error {
+// CreateAuthorizationCode は新しい認可コードを作成します（DB にはコードのハッシュだけを保存する）
+// authTime / sid は ID Token の auth_time / sid クレームに使う（ログインしたセッションの作成時刻とセッション ID のハッシュ）。
+func (r *Repository) CreateAuthorizationCode(ctx context.Context, code string, clientID string, userID int, redirectURI string, scopes []string, codeChallenge, codeChallengeMethod, nonce, state *string, authTime time.Time, sid string, expiresAt time.Time) error {
 	query := `
-		INSERT INTO authorization_codes (code, client_id, user_id, redirect_uri, scopes, code_challenge, code_challenge_method, nonce, state, expires_at)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`
+		INSERT INTO authorization_codes (code_hash, client_id, user_id, redirect_uri, scopes, code_challenge, code_challenge_method, nonce, state, auth_time, sid, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)`
 
-	_, err := r.db.db.ExecContext(ctx, query, code, clientID, userID, redirectURI, pq.Array(scopes), codeChallenge, codeChallengeMethod, nonce, state, expiresAt)
+	_, err := r.db.db.ExecContext(ctx, query, hashToken(code), clientID, userID, redirectURI, pq.Array(scopes), codeChallenge, codeChallengeMethod, nonce, state, authTime, sid, expiresAt)
 	if err != nil {
 		return fmt.Errorf("認可コードの作成に失敗しました: %w", err)
 	}
@@ -167,15 +507,17 @@ func (r *Repository) GetAuthorizationCode(ctx context.Context, code string) (*Au
 
 	// 認可コードを取得
 	query := `
-		SELECT id, code, client_id, user_id, redirect_uri, scopes, code_challenge, code_challenge_method, nonce, state, expires_at, created_at
+		SELECT id, code_hash, client_id, user_id, redirect_uri, scopes, code_challenge, code_challenge_method, nonce, state, auth_time, sid, expires_at, created_at
 		FROM authorization_codes
-		WHERE code = $1`
+		WHERE code_hash = $1
+		FOR UPDATE`
 
+	codeHash := hashToken(code)
 	var authCode AuthorizationCode
-	err = tx.QueryRowContext(ctx, query, code).Scan(
-		&authCode.ID, &authCode.Code, &authCode.ClientID, &authCode.UserID, &authCode.RedirectURI,
+	err = tx.QueryRowContext(ctx, query, codeHash).Scan(
+		&authCode.ID, &authCode.CodeHash, &authCode.ClientID, &authCode.UserID, &authCode.RedirectURI,
 		&authCode.Scopes, &authCode.CodeChallenge, &authCode.CodeChallengeMethod,
-		&authCode.Nonce, &authCode.State, &authCode.ExpiresAt, &authCode.CreatedAt,
+		&authCode.Nonce, &authCode.State, &authCode.AuthTime, &authCode.SessionID, &authCode.ExpiresAt, &authCode.CreatedAt,
 	)
 	if err != nil {
 		if err == sql.ErrNoRows {
@@ -187,7 +529,7 @@ func (r *Repository) GetAuthorizationCode(ctx context.Context, code string) (*Au
 	// 期限切れチェック
 	if time.Now().After(authCode.ExpiresAt) {
 		// 期限切れの場合は削除
-		_, err = tx.ExecContext(ctx, "DELETE FROM authorization_codes WHERE code = $1", code)
+		_, err = tx.ExecContext(ctx, "DELETE FROM authorization_codes WHERE id = $1", authCode.ID)
 		if err != nil {
 			return nil, fmt.Errorf("期限切れ認可コードの削除に失敗しました: %w", err)
 		}
@@ -195,7 +537,7 @@ func (r *Repository) GetAuthorizationCode(ctx context.Context, code string) (*Au
 	}
 
 	// 認可コードを削除（使用済みとして）
-	_, err = tx.ExecContext(ctx, "DELETE FROM authorization_codes WHERE code = $1", code)
+	_, err = tx.ExecContext(ctx, "DELETE FROM authorization_codes WHERE id = $1", authCode.ID)
 	if err != nil {
 		return nil, fmt.Errorf("認可コードの削除に失敗しました: %w", err)
 	}
@@ -207,18 +549,235 @@ func (r *Repository) GetAuthorizationCode(ctx context.Context, code string) (*Au
 	return &authCode, nil
 }
 
+// デバイス認可（RFC 8628）関連のメソッド
+
+// PollDeviceCode がポーリング結果として返すエラー。tokenHandler で RFC 8628 3.5 のエラーコードに対応づける。
+var (
+	errDeviceAuthorizationPending = errors.New("ユーザーの承認待ちです")
+	errDeviceSlowDown             = errors.New("ポーリング間隔が短すぎます")
+	errDeviceCodeExpired          = errors.New("デバイスコードが期限切れです")
+	errDeviceAccessDenied         = errors.New("ユーザーがデバイス認可を拒否しました")
+)
+
+// CreateDeviceCode は新しいデバイスコードを承認待ち状態で作成します
+func (r *Repository) CreateDeviceCode(ctx context.Context, deviceCode, userCode, clientID string, scopes []string, pollInterval int, expiresAt time.Time) error {
+	query := `
+		INSERT INTO device_codes (device_code_hash, user_code, client_id, scopes, poll_interval, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6)`
+
+	_, err := r.db.db.ExecContext(ctx, query, hashToken(deviceCode), userCode, clientID, pq.Array(scopes), pollInterval, expiresAt)
+	if err != nil {
+		return fmt.Errorf("デバイスコードの作成に失敗しました: %w", err)
+	}
+
+	return nil
+}
+
+// GetDeviceCodeByUserCode はユーザーコードで承認待ちのデバイスコードを取得します
+func (r *Repository) GetDeviceCodeByUserCode(ctx context.Context, userCode string) (*DeviceCode, error) {
+	query := `
+		SELECT id, device_code_hash, user_code, client_id, user_id, scopes, status, poll_interval, last_polled_at, expires_at, created_at
+		FROM device_codes
+		WHERE user_code = $1 AND status = 'pending'`
+
+	var dc DeviceCode
+	err := r.db.db.QueryRowContext(ctx, query, userCode).Scan(
+		&dc.ID, &dc.DeviceCodeHash, &dc.UserCode, &dc.ClientID, &dc.UserID, &dc.Scopes,
+		&dc.Status, &dc.PollInterval, &dc.LastPolledAt, &dc.ExpiresAt, &dc.CreatedAt,
+	)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("ユーザーコードが見つかりません")
+		}
+		return nil, fmt.Errorf("デバイスコードの取得に失敗しました: %w", err)
+	}
+
+	if time.Now().After(dc.ExpiresAt) {
+		return nil, fmt.Errorf("ユーザーコードが期限切れです")
+	}
+
+	return &dc, nil
+}
+
+// DecideDeviceCode は承認待ちのデバイスコードをユーザーの判断（approved / denied）で更新します
+func (r *Repository) DecideDeviceCode(ctx context.Context, userCode string, userID int, approved bool) error {
+	status := "denied"
+	if approved {
+		status = "approved"
+	}
+
+	res, err := r.db.db.ExecContext(ctx, `
+		UPDATE device_codes SET status = $1, user_id = $2
+		WHERE user_code = $3 AND status = 'pending' AND expires_at > $4
+	`, status, userID, userCode, time.Now())
+	if err != nil {
+		return fmt.Errorf("デバイスコードの更新に失敗しました: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("承認待ちのユーザーコードが見つかりません")
+	}
+
+	return nil
+}
+
+// PollDeviceCode はデバイスからのポーリングを1トランザクションで処理します。
+// 前回ポーリングから poll_interval 秒経っていなければ間隔を 5 秒延ばして errDeviceSlowDown を返す（RFC 8628 3.5）。
+// 承認済み・拒否・期限切れの行は削除し、承認済みのときだけ行を返す（デバイスコードはワンタイム）。
+func (r *Repository) PollDeviceCode(ctx context.Context, deviceCode, clientID string) (*DeviceCode, error) {
+	tx, err := r.db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("トランザクションの開始に失敗しました: %w", err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	var dc DeviceCode
+	err = tx.QueryRowContext(ctx, `
+		SELECT id, device_code_hash, user_code, client_id, user_id, scopes, status, poll_interval, last_polled_at, expires_at, created_at
+		FROM device_codes
+		WHERE device_code_hash = $1 AND client_id = $2
+		FOR UPDATE
+	`, hashToken(deviceCode), clientID).Scan(
+		&dc.ID, &dc.DeviceCodeHash, &dc.UserCode, &dc.ClientID, &dc.UserID, &dc.Scopes,
+		&dc.Status, &dc.PollInterval, &dc.LastPolledAt, &dc.ExpiresAt, &dc.CreatedAt,
+	)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("デバイスコードが見つかりません")
+		}
+		return nil, fmt.Errorf("デバイスコードの取得に失敗しました: %w", err)
+	}
+
+	now := time.Now()
+
+	// 終了状態（期限切れ・拒否・承認済み）は行を消してから結果を返す
+	var result error
+	switch {
+	case now.After(dc.ExpiresAt):
+		result = errDeviceCodeExpired
+	case dc.Status == "denied":
+		result = errDeviceAccessDenied
+	case dc.Status == "approved":
+		// 承認済みはトークン発行に進む
+	default:
+		if dc.LastPolledAt != nil && now.Sub(*dc.LastPolledAt) < time.Duration(dc.PollInterval)*time.Second {
+			_, err = tx.ExecContext(ctx, `
+				UPDATE device_codes SET poll_interval = poll_interval + 5, last_polled_at = $1 WHERE id = $2
+			`, now, dc.ID)
+			if err != nil {
+				return nil, fmt.Errorf("ポーリング間隔の更新に失敗しました: %w", err)
+			}
+			if err := tx.Commit(); err != nil {
+				return nil, fmt.Errorf("トランザクションのコミットに失敗しました: %w", err)
+			}
+			return nil, errDeviceSlowDown
+		}
+
+		_, err = tx.ExecContext(ctx, `UPDATE device_codes SET last_polled_at = $1 WHERE id = $2`, now, dc.ID)
+		if err != nil {
+			return nil, fmt.Errorf("ポーリング時刻の更新に失敗しました: %w", err)
+		}
+		if err := tx.Commit(); err != nil {
+			return nil, fmt.Errorf("トランザクションのコミットに失敗しました: %w", err)
+		}
+		return nil, errDeviceAuthorizationPending
+	}
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM device_codes WHERE id = $1`, dc.ID)
+	if err != nil {
+		return nil, fmt.Errorf("デバイスコードの削除に失敗しました: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("トランザクションのコミットに失敗しました: %w", err)
+	}
+	if result != nil {
+		return nil, result
+	}
+
+	return &dc, nil
+}
+
+// PAR（Pushed Authorization Request）関連のメソッド
+
+// CreatePushedAuthorizationRequest は PAR で受け取った認可パラメータを保存します（DB には request_uri のハッシュだけを保存する）
+func (r *Repository) CreatePushedAuthorizationRequest(ctx context.Context, requestURI, clientID, parameters string, expiresAt time.Time) error {
+	query := `
+		INSERT INTO pushed_authorization_requests (request_uri_hash, client_id, parameters, expires_at)
+		VALUES ($1, $2, $3, $4)`
+
+	_, err := r.db.db.ExecContext(ctx, query, hashToken(requestURI), clientID, parameters, expiresAt)
+	if err != nil {
+		return fmt.Errorf("PAR の作成に失敗しました: %w", err)
+	}
+
+	return nil
+}
+
+// GetPushedAuthorizationRequest は有効期限内の PAR を request_uri で取得します
+func (r *Repository) GetPushedAuthorizationRequest(ctx context.Context, requestURI string) (*PushedAuthorizationRequest, error) {
+	query := `
+		SELECT id, request_uri_hash, client_id, parameters, expires_at, created_at
+		FROM pushed_authorization_requests
+		WHERE request_uri_hash = $1 AND expires_at > $2`
+
+	var par PushedAuthorizationRequest
+	err := r.db.db.QueryRowContext(ctx, query, hashToken(requestURI), time.Now()).Scan(
+		&par.ID, &par.RequestURIHash, &par.ClientID, &par.Parameters, &par.ExpiresAt, &par.CreatedAt,
+	)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("request_uri が見つからないか有効期限切れです")
+		}
+		return nil, fmt.Errorf("PAR の取得に失敗しました: %w", err)
+	}
+
+	return &par, nil
+}
+
+// ConsumePushedAuthorizationRequest は有効期限内の PAR を削除して使用済みにします。
+// 削除と確認を 1 つの文で行うため、同じ request_uri で同時に認可コードを発行しようとしても成功するのは 1 回だけです
+func (r *Repository) ConsumePushedAuthorizationRequest(ctx context.Context, requestURI, clientID string) error {
+	query := `
+		DELETE FROM pushed_authorization_requests
+		WHERE request_uri_hash = $1 AND client_id = $2 AND expires_at > $3
+		RETURNING id`
+
+	var id int
+	err := r.db.db.QueryRowContext(ctx, query, hashToken(requestURI), clientID, time.Now()).Scan(&id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return fmt.Errorf("request_uri が見つからないか、使用済みまたは有効期限切れです")
+		}
+		return fmt.Errorf("PAR の削除に失敗しました: %w", err)
+	}
+	return nil
+}
+
+// DeletePushedAuthorizationRequest は使い終わった PAR を削除します
+func (r *Repository) DeletePushedAuthorizationRequest(ctx context.Context, requestURI string) error {
+	_, err := r.db.db.ExecContext(ctx, "DELETE FROM pushed_authorization_requests WHERE request_uri_hash = $1", hashToken(requestURI))
+	if err != nil {
+		return fmt.Errorf("PAR の削除に失敗しました: %w", err)
+	}
+	return nil
+}
+
 // アクセストークン関連のメソッド
 
-// CreateAccessToken は新しいアクセストークンを作成します
+// CreateAccessToken は新しいアクセストークンを作成します（DB には JWT の jti だけを保存する）
 func (r *Repository) CreateAccessToken(ctx context.Context, token, clientID string, userID *int, scopes []string, expiresAt time.Time) (*AccessToken, error) {
+	jti := accessTokenJTI(token)
+	if jti == "" {
+		return nil, fmt.Errorf("アクセストークンに jti がありません")
+	}
+
 	query := `
-		INSERT INTO access_tokens (token, client_id, user_id, scopes, expires_at)
+		INSERT INTO access_tokens (jti, client_id, user_id, scopes, expires_at)
 		VALUES ($1, $2, $3, $4, $5)
-		RETURNING id, token, client_id, user_id, scopes, expires_at, created_at`
+		RETURNING id, jti, client_id, user_id, scopes, expires_at, created_at`
 
 	var accessToken AccessToken
-	err := r.db.db.QueryRowContext(ctx, query, token, clientID, userID, pq.Array(scopes), expiresAt).Scan(
-		&accessToken.ID, &accessToken.Token, &accessToken.ClientID, &accessToken.UserID,
+	err := r.db.db.QueryRowContext(ctx, query, jti, clientID, userID, pq.Array(scopes), expiresAt).Scan(
+		&accessToken.ID, &accessToken.JTI, &accessToken.ClientID, &accessToken.UserID,
 		&accessToken.Scopes, &accessToken.ExpiresAt, &accessToken.CreatedAt,
 	)
 	if err != nil {
@@ -228,16 +787,16 @@ func (r *Repository) CreateAccessToken(ctx context.Context, token, clientID stri
 	return &accessToken, nil
 }
 
-// GetAccessTokenByToken はトークン文字列でアクセストークンを取得します
+// GetAccessTokenByToken はトークン文字列（JWT）の jti でアクセストークンを取得します
 func (r *Repository) GetAccessTokenByToken(ctx context.Context, token string) (*AccessToken, error) {
 	query := `
-		SELECT id, token, client_id, user_id, scopes, expires_at, created_at
+		SELECT id, jti, client_id, user_id, scopes, expires_at, created_at
 		FROM access_tokens
-		WHERE token = $1`
+		WHERE jti = $1`
 
 	var accessToken AccessToken
-	err := r.db.db.QueryRowContext(ctx, query, token).Scan(
-		&accessToken.ID, &accessToken.Token, &accessToken.ClientID, &accessToken.UserID,
+	err := r.db.db.QueryRowContext(ctx, query, accessTokenJTI(token)).Scan(
+		&accessToken.ID, &accessToken.JTI, &accessToken.ClientID, &accessToken.UserID,
 		&accessToken.Scopes, &accessToken.ExpiresAt, &accessToken.CreatedAt,
 	)
 	if err != nil {
@@ -257,7 +816,7 @@ func (r *Repository) GetAccessTokenByToken(ctx context.Context, token string) (*
 
 // RevokeAccessToken はアクセストークンを無効化します
 func (r *Repository) RevokeAccessToken(ctx context.Context, token string) error {
-	_, err := r.db.db.ExecContext(ctx, "DELETE FROM access_tokens WHERE token = $1", token)
+	_, err := r.db.db.ExecContext(ctx, "DELETE FROM access_tokens WHERE jti = $1", accessTokenJTI(token))
 	if err != nil {
 		return fmt.Errorf("アクセストークンの無効化に失敗しました: %w", err)
 	}
@@ -265,31 +824,212 @@ func (r *Repository) RevokeAccessToken(ctx context.Context, token string) error
 	return nil
 }
 
-// GetRefreshTokenBundle は、リフレッシュグラントで JWT を発行するために必要な user_id / scopes を返す。
-// 行ロックは行わない。競合時は CommitRefreshRotation が失敗し、呼び出し側は invalid_grant 相当で扱う。
-func (r *Repository) GetRefreshTokenBundle(ctx context.Context, refreshPlain, clientID string) (*RefreshTokenBundle, error) {
-	var uid sql.NullInt32
-	var scopes pq.StringArray
-	err := r.db.db.QueryRowContext(ctx, `
-		SELECT at.user_id, at.scopes
-		FROM refresh_tokens rt
-		INNER JOIN access_tokens at ON at.id = rt.access_token_id
-		WHERE rt.token = $1
-		  AND rt.expires_at > NOW()
-		  AND at.client_id = $2
-	`, refreshPlain, clientID).Scan(&uid, &scopes)
+// RevokeAccessTokenForClient は clientID に発行されたアクセストークンを削除します（/revoke 用）。
+// 同じ認可で発行されたリフレッシュトークンもファミリーごと失効させる。該当行が無ければ false を返す。
+func (r *Repository) RevokeAccessTokenForClient(ctx context.Context, token, clientID string) (bool, error) {
+	tx, err := r.db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, fmt.Errorf("トランザクションの開始に失敗しました: %w", err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	var accessID int
+	err = tx.QueryRowContext(ctx, "SELECT id FROM access_tokens WHERE jti = $1 AND client_id = $2 FOR UPDATE",
+		accessTokenJTI(token), clientID).Scan(&accessID)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return nil, fmt.Errorf("無効または期限切れのリフレッシュトークンです")
+			return false, nil
+		}
+		return false, fmt.Errorf("アクセストークンの無効化に失敗しました: %w", err)
+	}
+
+	var familyID int
+	err = tx.QueryRowContext(ctx, "SELECT family_id FROM refresh_tokens WHERE access_token_id = $1", accessID).Scan(&familyID)
+	switch {
+	case err == nil:
+		if err := revokeRefreshTokenFamily(ctx, tx, familyID); err != nil {
+			return false, err
+		}
+	case err != sql.ErrNoRows:
+		return false, fmt.Errorf("アクセストークンの無効化に失敗しました: %w", err)
+	}
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM access_tokens WHERE id = $1", accessID); err != nil {
+		return false, fmt.Errorf("アクセストークンの無効化に失敗しました: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return false, fmt.Errorf("トランザクションのコミットに失敗しました: %w", err)
+	}
+	return true, nil
+}
+
+// リフレッシュトークン関連のメソッド
+//
+// リフレッシュトークンは認可ごとのファミリー（refresh_token_families）に属し、ローテーションしても同じファミリーを引き継ぐ。
+// ローテーション済みの行は used_at を立てて有効期限まで残し、それが再提示されたら盗用とみなして
+// ファミリー全体（と紐づくアクセストークン）を失効させる（OAuth 2.0 Security BCP 4.14.2）。
+
+// errRefreshTokenReused は使用済み（ローテーション済み）のリフレッシュトークンが再提示されたことを表す。
+// 返す時点でファミリーは失効済みで、security_events に記録されている。
+var (
+	errRefreshTokenReused   = errors.New("使用済みのリフレッシュトークンが再利用されました")
+	errRefreshTokenNotFound = errors.New("リフレッシュトークンが見つかりません")
+)
+
+const refreshTokenSelect = `
+	SELECT rt.id, rt.token_hash, rt.family_id, rt.access_token_id, rt.scopes, rt.used_at, rt.expires_at, rt.created_at,
+	       f.client_id, f.user_id, f.expires_at, f.idle_expires_at, f.revoked_at, f.dpop_jkt, f.x5t_s256
+	FROM refresh_tokens rt
+	INNER JOIN refresh_token_families f ON f.id = rt.family_id
+	WHERE rt.token_hash = $1`
+
+func scanRefreshToken(row *sql.Row) (*RefreshToken, error) {
+	var rt RefreshToken
+	err := row.Scan(
+		&rt.ID, &rt.TokenHash, &rt.FamilyID, &rt.AccessTokenID, &rt.Scopes, &rt.UsedAt, &rt.ExpiresAt, &rt.CreatedAt,
+		&rt.ClientID, &rt.UserID, &rt.FamilyExpiresAt, &rt.FamilyIdleExpiresAt, &rt.FamilyRevokedAt, &rt.FamilyDPoPJKT, &rt.FamilyX5TS256,
+	)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, errRefreshTokenNotFound
 		}
 		return nil, fmt.Errorf("リフレッシュトークンの取得に失敗しました: %w", err)
 	}
-	if !uid.Valid {
-		return nil, fmt.Errorf("リフレッシュトークンに紐づくユーザーがありません")
+	return &rt, nil
+}
+
+// checkRefreshToken は clientID が提示したリフレッシュトークンが使えるかを判定する。
+// 使用済みなら errRefreshTokenReused を返す（失効処理は呼び出し側）。
+func checkRefreshToken(rt *RefreshToken, clientID string) error {
+	now := time.Now()
+	switch {
+	case rt.ClientID != clientID:
+		return fmt.Errorf("別のクライアントのリフレッシュトークンです")
+	case rt.FamilyRevokedAt != nil:
+		return fmt.Errorf("失効済みのリフレッシュトークンです")
+	case rt.UsedAt != nil:
+		return errRefreshTokenReused
+	case now.After(rt.ExpiresAt):
+		return fmt.Errorf("リフレッシュトークンが期限切れです")
+	case now.After(rt.FamilyExpiresAt):
+		return fmt.Errorf("リフレッシュトークンの絶対的な有効期限を過ぎています")
+	case rt.FamilyIdleExpiresAt != nil && now.After(*rt.FamilyIdleExpiresAt):
+		return fmt.Errorf("リフレッシュトークンがアイドルタイムアウトしました")
+	}
+	return nil
+}
+
+// revokeRefreshTokenFamily はファミリーを失効させ、ファミリーで発行済みのアクセストークンを削除する。
+// リフレッシュトークンの行は再提示を見分けられるよう有効期限まで残す。
+func revokeRefreshTokenFamily(ctx context.Context, tx *sql.Tx, familyID int) error {
+	_, err := tx.ExecContext(ctx, `
+		DELETE FROM access_tokens
+		WHERE id IN (SELECT access_token_id FROM refresh_tokens WHERE family_id = $1)
+	`, familyID)
+	if err != nil {
+		return fmt.Errorf("ファミリーのアクセストークンの失効に失敗しました: %w", err)
+	}
+	_, err = tx.ExecContext(ctx, `
+		UPDATE refresh_token_families SET revoked_at = NOW() WHERE id = $1 AND revoked_at IS NULL
+	`, familyID)
+	if err != nil {
+		return fmt.Errorf("リフレッシュトークンファミリーの失効に失敗しました: %w", err)
+	}
+	return nil
+}
+
+// revokeReusedRefreshToken は使用済みトークンの再提示を受けてファミリーを失効させ、セキュリティイベントを記録する。
+func revokeReusedRefreshToken(ctx context.Context, tx *sql.Tx, rt *RefreshToken) error {
+	if err := revokeRefreshTokenFamily(ctx, tx, rt.FamilyID); err != nil {
+		return err
+	}
+	return recordSecurityEvent(ctx, tx, securityEventRefreshTokenReuse, rt.ClientID, &rt.UserID,
+		fmt.Sprintf("family_id=%d refresh_token_id=%d used_at=%s", rt.FamilyID, rt.ID, rt.UsedAt.Format(time.RFC3339)))
+}
+
+// セキュリティイベント（security_events）の種類
+const (
+	securityEventRefreshTokenReuse = "refresh_token_reuse" // 使用済みリフレッシュトークンの再提示（ファミリーを失効）
+)
+
+// recordSecurityEvent は security_events に 1 件記録する。失効処理と同じトランザクションで書く。
+func recordSecurityEvent(ctx context.Context, tx *sql.Tx, eventType, clientID string, userID *int, detail string) error {
+	_, err := tx.ExecContext(ctx, `
+		INSERT INTO security_events (event_type, client_id, user_id, detail)
+		VALUES ($1, $2, $3, $4)
+	`, eventType, clientID, userID, detail)
+	if err != nil {
+		return fmt.Errorf("セキュリティイベントの記録に失敗しました: %w", err)
+	}
+	return nil
+}
+
+// RevokeRefreshToken は clientID に発行されたリフレッシュトークンを失効させます（/revoke 用）。
+// ファミリーごと失効させ、紐づくアクセストークンも削除する。該当行が無ければ false を返す。
+func (r *Repository) RevokeRefreshToken(ctx context.Context, refreshPlain, clientID string) (bool, error) {
+	tx, err := r.db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, fmt.Errorf("トランザクションの開始に失敗しました: %w", err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	rt, err := scanRefreshToken(tx.QueryRowContext(ctx, refreshTokenSelect+" FOR UPDATE", hashToken(refreshPlain)))
+	if err != nil {
+		if errors.Is(err, errRefreshTokenNotFound) {
+			return false, nil
+		}
+		return false, err
+	}
+	if rt.ClientID != clientID || rt.FamilyRevokedAt != nil {
+		return false, nil
+	}
+	if err := revokeRefreshTokenFamily(ctx, tx, rt.FamilyID); err != nil {
+		return false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return false, fmt.Errorf("トランザクションのコミットに失敗しました: %w", err)
+	}
+	return true, nil
+}
+
+// GetRefreshTokenByToken は使用可能な（未使用・期限内・ファミリーが有効な）リフレッシュトークンを取得します（/introspect 用）。
+func (r *Repository) GetRefreshTokenByToken(ctx context.Context, refreshPlain string) (*RefreshToken, error) {
+	rt, err := scanRefreshToken(r.db.db.QueryRowContext(ctx, refreshTokenSelect, hashToken(refreshPlain)))
+	if err != nil {
+		return nil, err
+	}
+	if err := checkRefreshToken(rt, rt.ClientID); err != nil {
+		if errors.Is(err, errRefreshTokenReused) {
+			return nil, fmt.Errorf("使用済みのリフレッシュトークンです")
+		}
+		return nil, err
+	}
+	return rt, nil
+}
+
+// GetRefreshTokenBundle は、リフレッシュグラントで JWT を発行するために必要な user_id / scopes を返す。
+// 行ロックは行わない。競合時は CommitRefreshRotation が失敗し、呼び出し側は invalid_grant 相当で扱う。
+// 使用済みのトークンならファミリーを失効させて errRefreshTokenReused を返す。
+func (r *Repository) GetRefreshTokenBundle(ctx context.Context, refreshPlain, clientID string) (*RefreshTokenBundle, error) {
+	rt, err := scanRefreshToken(r.db.db.QueryRowContext(ctx, refreshTokenSelect, hashToken(refreshPlain)))
+	if err != nil {
+		return nil, err
+	}
+	if err := checkRefreshToken(rt, clientID); err != nil {
+		if errors.Is(err, errRefreshTokenReused) {
+			return nil, r.revokeReusedRefreshTokenTx(ctx, refreshPlain, clientID)
+		}
+		return nil, err
 	}
 
-	out := &RefreshTokenBundle{UserID: int(uid.Int32)}
-	for _, s := range scopes {
+	out := &RefreshTokenBundle{UserID: rt.UserID}
+	if rt.FamilyDPoPJKT != nil {
+		out.DPoPJKT = *rt.FamilyDPoPJKT
+	}
+	if rt.FamilyX5TS256 != nil {
+		out.CertThumbprint = *rt.FamilyX5TS256
+	}
+	for _, s := range rt.Scopes {
 		if s != "" {
 			out.Scopes = append(out.Scopes, s)
 		}
@@ -297,88 +1037,181 @@ func (r *Repository) GetRefreshTokenBundle(ctx context.Context, refreshPlain, cl
 	return out, nil
 }
 
-// CreateRefreshToken は認可コード交換直後に、access_tokens.id に紐づく refresh_tokens 行を1件 INSERT する。
-func (r *Repository) CreateRefreshToken(ctx context.Context, token string, accessTokenID int, expiresAt time.Time) (*RefreshToken, error) {
-	query := `
-		INSERT INTO refresh_tokens (token, access_token_id, expires_at)
-		VALUES ($1, $2, $3)
-		RETURNING id, token, access_token_id, expires_at, created_at`
+// revokeReusedRefreshTokenTx は行ロックを取り直して再利用を確認し、ファミリーを失効させる。
+// 失効させたときは errRefreshTokenReused を返す。
+func (r *Repository) revokeReusedRefreshTokenTx(ctx context.Context, refreshPlain, clientID string) error {
+	tx, err := r.db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("トランザクションの開始に失敗しました: %w", err)
+	}
+	defer func() { _ = tx.Rollback() }()
 
-	var rt RefreshToken
-	err := r.db.db.QueryRowContext(ctx, query, token, accessTokenID, expiresAt).Scan(
-		&rt.ID, &rt.Token, &rt.AccessTokenID, &rt.ExpiresAt, &rt.CreatedAt,
+	rt, err := scanRefreshToken(tx.QueryRowContext(ctx, refreshTokenSelect+" FOR UPDATE", hashToken(refreshPlain)))
+	if err != nil {
+		return err
+	}
+	if err := checkRefreshToken(rt, clientID); !errors.Is(err, errRefreshTokenReused) {
+		if err == nil {
+			// 行ロックを取るまでの間に状態が変わることはない（used_at は戻らない）が、念のため
+			return fmt.Errorf("リフレッシュトークンの状態が変わりました")
+		}
+		return err
+	}
+	if err := revokeReusedRefreshToken(ctx, tx, rt); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("トランザクションのコミットに失敗しました: %w", err)
+	}
+	return errRefreshTokenReused
+}
+
+// CreateRefreshToken は認可コード交換直後に、新しいファミリーと access_tokens.id に紐づく refresh_tokens 行を INSERT する。
+// scopes は元の認可で付与されたスコープで、以後のリフレッシュで縮小要求の上限になる。
+// 有効期限はクライアントの設定（RefreshTokenTTL / RefreshTokenAbsoluteTTL / RefreshTokenIdleTTL）から決める。
+// binding を指定するとファミリーをその DPoP 鍵・クライアント証明書に結びつける（公開クライアント向け、RFC 9449 5、RFC 8705 4）。
+func (r *Repository) CreateRefreshToken(ctx context.Context, token string, client *OAuthClient, userID, accessTokenID int, scopes []string, binding *tokenConfirmation) (*RefreshToken, error) {
+	tx, err := r.db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("トランザクションの開始に失敗しました: %w", err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	now := time.Now()
+	rt := RefreshToken{ClientID: client.ClientID, UserID: userID, FamilyExpiresAt: now.Add(client.RefreshTokenAbsoluteTTL())}
+	if idle := client.RefreshTokenIdleTTL(); idle > 0 {
+		idleExpiresAt := now.Add(idle)
+		rt.FamilyIdleExpiresAt = &idleExpiresAt
+	}
+	if binding != nil && binding.JKT != "" {
+		rt.FamilyDPoPJKT = &binding.JKT
+	}
+	if binding != nil && binding.X5TS256 != "" {
+		rt.FamilyX5TS256 = &binding.X5TS256
+	}
+	expiresAt := refreshTokenExpiry(client, rt.FamilyExpiresAt, now)
+
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO refresh_token_families (client_id, user_id, expires_at, idle_expires_at, dpop_jkt, x5t_s256) VALUES ($1, $2, $3, $4, $5, $6) RETURNING id
+	`, client.ClientID, userID, rt.FamilyExpiresAt, rt.FamilyIdleExpiresAt, rt.FamilyDPoPJKT, rt.FamilyX5TS256).Scan(&rt.FamilyID)
+	if err != nil {
+		return nil, fmt.Errorf("リフレッシュトークンファミリーの作成に失敗しました: %w", err)
+	}
+
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO refresh_tokens (token_hash, family_id, access_token_id, scopes, expires_at)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, token_hash, access_token_id, scopes, expires_at, created_at
+	`, hashToken(token), rt.FamilyID, accessTokenID, pq.Array(scopes), expiresAt).Scan(
+		&rt.ID, &rt.TokenHash, &rt.AccessTokenID, &rt.Scopes, &rt.ExpiresAt, &rt.CreatedAt,
 	)
 	if err != nil {
 		return nil, fmt.Errorf("リフレッシュトークンの作成に失敗しました: %w", err)
 	}
 
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("トランザクションのコミットに失敗しました: %w", err)
+	}
 	return &rt, nil
 }
 
+// refreshTokenExpiry は新しく発行するリフレッシュトークンの有効期限。ファミリーの絶対的な有効期限を超えない。
+func refreshTokenExpiry(client *OAuthClient, familyExpiresAt, now time.Time) time.Time {
+	expiresAt := now.Add(client.RefreshTokenTTL())
+	if expiresAt.After(familyExpiresAt) {
+		return familyExpiresAt
+	}
+	return expiresAt
+}
+
 // CommitRefreshRotation はリフレッシュトークンのローテーションを1トランザクションで行う。
-// 手順: (1) 旧 rt+at を FOR UPDATE で取得 (2) 新 at / 新 rt を INSERT (3) 旧 at を DELETE → ON DELETE CASCADE で旧 rt も消える。
-// これにより同じ refresh 値の二重使用や、中間状態の孤立行を防ぐ。
-func (r *Repository) CommitRefreshRotation(ctx context.Context, refreshPlain, clientID, newAccessToken, newRefreshPlain string, accessExpiresAt, refreshExpiresAt time.Time) error {
+// 手順: (1) 旧 rt を FOR UPDATE で取得 (2) 新 at / 新 rt を同じファミリーに INSERT (3) 旧 rt に used_at を立て、旧 at を DELETE。
+// 旧 rt が既に使用済みなら（並行リフレッシュの後着を含む）ファミリーを失効させて errRefreshTokenReused を返す。
+// newRefreshPlain が空ならローテーションせず、旧 rt を新しい at に付け替えて使い続ける（client.RefreshTokenRotation=false）。
+// accessScopes は新しいアクセストークンのスコープ（縮小後）。新しいリフレッシュトークンは元のスコープを引き継ぐ（RFC 6749 6）。
+func (r *Repository) CommitRefreshRotation(ctx context.Context, refreshPlain string, client *OAuthClient, newAccessToken string, accessScopes []string, newRefreshPlain string, accessExpiresAt time.Time) error {
+	clientID := client.ClientID
 	tx, err := r.db.db.BeginTx(ctx, nil)
 	if err != nil {
 		return fmt.Errorf("トランザクション開始に失敗しました: %w", err)
 	}
 	defer func() { _ = tx.Rollback() }()
 
-	var oldAccessID int
-	var uid sql.NullInt32
-	var scopes pq.StringArray
-
-	// 対象行をロックしてから入れ替え（並行リフレッシュの片方はここで待ち、他方は行消失で失敗しうる）
-	err = tx.QueryRowContext(ctx, `
-		SELECT at.id, at.user_id, at.scopes
-		FROM refresh_tokens rt
-		INNER JOIN access_tokens at ON at.id = rt.access_token_id
-		WHERE rt.token = $1
-		  AND rt.expires_at > NOW()
-		  AND at.client_id = $2
-		FOR UPDATE
-	`, refreshPlain, clientID).Scan(&oldAccessID, &uid, &scopes)
+	// 対象行をロックしてから入れ替え（並行リフレッシュの片方はここで待ち、他方は used_at を見て再利用と判定される）
+	old, err := scanRefreshToken(tx.QueryRowContext(ctx, refreshTokenSelect+" FOR UPDATE", hashToken(refreshPlain)))
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return fmt.Errorf("無効または期限切れのリフレッシュトークンです")
-		}
-		return fmt.Errorf("リフレッシュトークンの検証に失敗しました: %w", err)
+		return err
 	}
-	if !uid.Valid {
-		return fmt.Errorf("リフレッシュトークンに紐づくユーザーがありません")
+	if err := checkRefreshToken(old, clientID); err != nil {
+		if errors.Is(err, errRefreshTokenReused) {
+			if err := revokeReusedRefreshToken(ctx, tx, old); err != nil {
+				return err
+			}
+			if err := tx.Commit(); err != nil {
+				return fmt.Errorf("トランザクションのコミットに失敗しました: %w", err)
+			}
+		}
+		return err
 	}
 
-	userID := int(uid.Int32)
-	scopeSlice := make([]string, 0, len(scopes))
-	for _, s := range scopes {
+	scopeSlice := make([]string, 0, len(old.Scopes))
+	for _, s := range old.Scopes {
 		if s != "" {
 			scopeSlice = append(scopeSlice, s)
 		}
 	}
+	for _, s := range accessScopes {
+		if !slices.Contains(scopeSlice, s) {
+			return fmt.Errorf("元の認可に含まれないスコープです: %s", s)
+		}
+	}
 
+	newJTI := accessTokenJTI(newAccessToken)
+	if newJTI == "" {
+		return fmt.Errorf("アクセストークンに jti がありません")
+	}
 	var newAccessID int
 	err = tx.QueryRowContext(ctx, `
-		INSERT INTO access_tokens (token, client_id, user_id, scopes, expires_at)
+		INSERT INTO access_tokens (jti, client_id, user_id, scopes, expires_at)
 		VALUES ($1, $2, $3, $4, $5)
 		RETURNING id
-	`, newAccessToken, clientID, userID, pq.Array(scopeSlice), accessExpiresAt).Scan(&newAccessID)
+	`, newJTI, clientID, old.UserID, pq.Array(accessScopes), accessExpiresAt).Scan(&newAccessID)
 	if err != nil {
 		return fmt.Errorf("アクセストークンの作成に失敗しました: %w", err)
 	}
 
-	_, err = tx.ExecContext(ctx, `
-		INSERT INTO refresh_tokens (token, access_token_id, expires_at)
-		VALUES ($1, $2, $3)
-	`, newRefreshPlain, newAccessID, refreshExpiresAt)
-	if err != nil {
-		return fmt.Errorf("リフレッシュトークンの作成に失敗しました: %w", err)
+	now := time.Now()
+	if newRefreshPlain != "" {
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO refresh_tokens (token_hash, family_id, access_token_id, scopes, expires_at)
+			VALUES ($1, $2, $3, $4, $5)
+		`, hashToken(newRefreshPlain), old.FamilyID, newAccessID, pq.Array(scopeSlice), refreshTokenExpiry(client, old.FamilyExpiresAt, now))
+		if err != nil {
+			return fmt.Errorf("リフレッシュトークンの作成に失敗しました: %w", err)
+		}
+
+		// 旧 rt は削除せず使用済みにする（再提示を検知するため）。旧 at は削除し、旧 rt の access_token_id は FK で NULL になる
+		if _, err := tx.ExecContext(ctx, `UPDATE refresh_tokens SET used_at = NOW() WHERE id = $1`, old.ID); err != nil {
+			return fmt.Errorf("旧リフレッシュトークンの更新に失敗しました: %w", err)
+		}
+	} else {
+		if _, err := tx.ExecContext(ctx, `UPDATE refresh_tokens SET access_token_id = $2 WHERE id = $1`, old.ID, newAccessID); err != nil {
+			return fmt.Errorf("リフレッシュトークンの更新に失敗しました: %w", err)
+		}
 	}
 
-	// 旧 access 削除で、紐づく旧 refresh（同一トランザクション内の対象行）は FK CASCADE でまとめて削除される
-	_, err = tx.ExecContext(ctx, `DELETE FROM access_tokens WHERE id = $1`, oldAccessID)
-	if err != nil {
-		return fmt.Errorf("旧アクセストークンの失効に失敗しました: %w", err)
+	// アイドルタイムアウトは使うたびに延長する（絶対的な有効期限は延ばさない）
+	if idle := client.RefreshTokenIdleTTL(); idle > 0 {
+		_, err := tx.ExecContext(ctx, `UPDATE refresh_token_families SET idle_expires_at = $2 WHERE id = $1`, old.FamilyID, now.Add(idle))
+		if err != nil {
+			return fmt.Errorf("リフレッシュトークンファミリーの更新に失敗しました: %w", err)
+		}
+	}
+
+	if old.AccessTokenID != nil {
+		if _, err := tx.ExecContext(ctx, `DELETE FROM access_tokens WHERE id = $1`, *old.AccessTokenID); err != nil {
+			return fmt.Errorf("旧アクセストークンの失効に失敗しました: %w", err)
+		}
 	}
 
 	if err := tx.Commit(); err != nil {
@@ -388,6 +1221,46 @@ func (r *Repository) CommitRefreshRotation(ctx context.Context, refreshPlain, cl
 	return nil
 }
 
+// 同意（ユーザーグラント）関連のメソッド
+
+// GetUserGrant はユーザーがクライアントに同意済みのスコープを取得します
+func (r *Repository) GetUserGrant(ctx context.Context, userID int, clientID string) (*UserGrant, error) {
+	query := `
+		SELECT id, user_id, client_id, scopes, created_at, updated_at
+		FROM user_grants
+		WHERE user_id = $1 AND client_id = $2`
+
+	var grant UserGrant
+	err := r.db.db.QueryRowContext(ctx, query, userID, clientID).Scan(
+		&grant.ID, &grant.UserID, &grant.ClientID, &grant.Scopes, &grant.CreatedAt, &grant.UpdatedAt,
+	)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("同意情報が見つかりません")
+		}
+		return nil, fmt.Errorf("同意情報の取得に失敗しました: %w", err)
+	}
+
+	return &grant, nil
+}
+
+// SaveUserGrant は同意したスコープを保存します。既存の同意があればスコープを和集合でマージする
+func (r *Repository) SaveUserGrant(ctx context.Context, userID int, clientID string, scopes []string) error {
+	query := `
+		INSERT INTO user_grants (user_id, client_id, scopes)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (user_id, client_id) DO UPDATE SET
+		  scopes = ARRAY(SELECT DISTINCT unnest(user_grants.scopes || EXCLUDED.scopes)),
+		  updated_at = CURRENT_TIMESTAMP`
+
+	_, err := r.db.db.ExecContext(ctx, query, userID, clientID, pq.Array(scopes))
+	if err != nil {
+		return fmt.Errorf("同意情報の保存に失敗しました: %w", err)
+	}
+
+	return nil
+}
+
 // セッション管理メソッド
 
 // CreateSession は新しいセッションを作成します
@@ -501,6 +1374,18 @@ func (r *Repository) CleanupExpiredTokens(ctx context.Context) error {
 		return fmt.Errorf("期限切れ認可コードの削除に失敗しました: %w", err)
 	}
 
+	// 期限切れのデバイスコードを削除
+	_, err = r.db.db.ExecContext(ctx, "DELETE FROM device_codes WHERE expires_at < $1", now)
+	if err != nil {
+		return fmt.Errorf("期限切れデバイスコードの削除に失敗しました: %w", err)
+	}
+
+	// 期限切れの PAR を削除
+	_, err = r.db.db.ExecContext(ctx, "DELETE FROM pushed_authorization_requests WHERE expires_at < $1", now)
+	if err != nil {
+		return fmt.Errorf("期限切れ PAR の削除に失敗しました: %w", err)
+	}
+
 	// 期限切れのアクセストークンを削除
 	_, err = r.db.db.ExecContext(ctx, "DELETE FROM access_tokens WHERE expires_at < $1", now)
 	if err != nil {
@@ -513,6 +1398,38 @@ func (r *Repository) CleanupExpiredTokens(ctx context.Context) error {
 		return fmt.Errorf("期限切れリフレッシュトークンの削除に失敗しました: %w", err)
 	}
 
+	// トークンが 1 つも残っていないファミリーを削除
+	_, err = r.db.db.ExecContext(ctx, `
+		DELETE FROM refresh_token_families f
+		WHERE NOT EXISTS (SELECT 1 FROM refresh_tokens rt WHERE rt.family_id = f.id)`)
+	if err != nil {
+		return fmt.Errorf("リフレッシュトークンファミリーの削除に失敗しました: %w", err)
+	}
+
+	// 猶予期間が過ぎたクライアントシークレットを削除
+	_, err = r.db.db.ExecContext(ctx, "DELETE FROM client_secrets WHERE expires_at < $1", now)
+	if err != nil {
+		return fmt.Errorf("期限切れクライアントシークレットの削除に失敗しました: %w", err)
+	}
+
+	// 期限切れのクライアントアサーション jti を削除（期限切れのアサーションは exp の検証で拒否されるため不要）
+	_, err = r.db.db.ExecContext(ctx, "DELETE FROM client_assertion_jtis WHERE expires_at < $1", now)
+	if err != nil {
+		return fmt.Errorf("期限切れクライアントアサーション jti の削除に失敗しました: %w", err)
+	}
+
+	// 期限切れの DPoP 証明 jti を削除
+	_, err = r.db.db.ExecContext(ctx, "DELETE FROM dpop_proof_jtis WHERE expires_at < $1", now)
+	if err != nil {
+		return fmt.Errorf("期限切れ DPoP 証明 jti の削除に失敗しました: %w", err)
+	}
+
+	// 期限切れのリクエストオブジェクト jti を削除
+	_, err = r.db.db.ExecContext(ctx, "DELETE FROM request_object_jtis WHERE expires_at < $1", now)
+	if err != nil {
+		return fmt.Errorf("期限切れリクエストオブジェクト jti の削除に失敗しました: %w", err)
+	}
+
 	// 期限切れのセッションを削除
 	_, err = r.db.db.ExecContext(ctx, "DELETE FROM sessions WHERE expires_at < $1", now)
 	if err != nil {
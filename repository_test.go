@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCheckRefreshToken(t *testing.T) {
+	now := time.Now()
+	at := func(d time.Duration) *time.Time {
+		t := now.Add(d)
+		return &t
+	}
+	valid := func() *RefreshToken {
+		return &RefreshToken{
+			ClientID:        "demo",
+			ExpiresAt:       now.Add(time.Hour),
+			FamilyExpiresAt: now.Add(24 * time.Hour),
+		}
+	}
+	tests := []struct {
+		name      string
+		set       func(rt *RefreshToken)
+		clientID  string
+		wantErr   bool
+		wantReuse bool
+	}{
+		{"使用可能", nil, "demo", false, false},
+		{"アイドルタイムアウト前", func(rt *RefreshToken) { rt.FamilyIdleExpiresAt = at(time.Minute) }, "demo", false, false},
+		{"使用済み（再提示）", func(rt *RefreshToken) { rt.UsedAt = at(-time.Minute) }, "demo", true, true},
+		{"使用済みなら期限切れでも再提示として扱う", func(rt *RefreshToken) {
+			rt.UsedAt = at(-2 * time.Hour)
+			rt.ExpiresAt = now.Add(-time.Hour)
+		}, "demo", true, true},
+		{"別のクライアントが使用済みのトークンを提示してもファミリーは失効させない", func(rt *RefreshToken) { rt.UsedAt = at(-time.Minute) }, "other", true, false},
+		{"失効済みのファミリー", func(rt *RefreshToken) {
+			rt.FamilyRevokedAt = at(-time.Minute)
+			rt.UsedAt = at(-time.Minute)
+		}, "demo", true, false},
+		{"期限切れ", func(rt *RefreshToken) { rt.ExpiresAt = now.Add(-time.Second) }, "demo", true, false},
+		{"絶対的な有効期限切れ", func(rt *RefreshToken) { rt.FamilyExpiresAt = now.Add(-time.Second) }, "demo", true, false},
+		{"アイドルタイムアウト", func(rt *RefreshToken) { rt.FamilyIdleExpiresAt = at(-time.Second) }, "demo", true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rt := valid()
+			if tt.set != nil {
+				tt.set(rt)
+			}
+			err := checkRefreshToken(rt, tt.clientID)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("checkRefreshToken() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if errors.Is(err, errRefreshTokenReused) != tt.wantReuse {
+				t.Errorf("checkRefreshToken() error = %v, want errRefreshTokenReused: %v", err, tt.wantReuse)
+			}
+		})
+	}
+}
+
+func TestRefreshTokenExpiry(t *testing.T) {
+	now := time.Now()
+	seconds := func(d time.Duration) *int {
+		s := int(d.Seconds())
+		return &s
+	}
+	tests := []struct {
+		name            string
+		client          *OAuthClient
+		familyExpiresAt time.Time
+		want            time.Time
+	}{
+		{"既定の有効期間", &OAuthClient{}, now.Add(defaultRefreshTokenAbsoluteLifetime), now.Add(defaultRefreshTokenLifetime)},
+		{"クライアントごとの有効期間", &OAuthClient{RefreshTokenLifetime: seconds(time.Hour)}, now.Add(24 * time.Hour), now.Add(time.Hour)},
+		{"ファミリーの絶対的な有効期限を超えない", &OAuthClient{}, now.Add(time.Hour), now.Add(time.Hour)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := refreshTokenExpiry(tt.client, tt.familyExpiresAt, now); !got.Equal(tt.want) {
+				t.Errorf("refreshTokenExpiry() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// JWT で署名された認可リクエスト（RFC 9101 JAR）
+const (
+	// request_uri から取得するリクエストオブジェクトの大きさの上限
+	requestObjectMaxSize = 64 * 1024
+	// exp の上限（検証時点から）。同意画面の操作中に切れない長さにとどめる
+	requestObjectMaxLifetime = 60 * time.Minute
+)
+
+var requestObjectHTTPClient = newOutboundHTTPClient()
+
+// requestObjectJWTClaims は JWT としての検証に使うクレーム。認可パラメータには含めない
+var requestObjectJWTClaims = map[string]bool{
+	"iss": true, "aud": true, "exp": true, "iat": true, "nbf": true, "jti": true, "sub": true,
+}
+
+// supportedRequestObjectAlgs は Discovery の request_object_signing_alg_values_supported に載せる方式。
+// クライアントアサーションと同じく、HS* は client_secret_jwt のクライアントだけが使える。
+func supportedRequestObjectAlgs() []string {
+	return append(append([]string{}, privateKeyJWTAlgs...), clientSecretJWTAlgs...)
+}
+
+// loadRequestObject は request（値渡し）または request_uri（参照渡し）のリクエストオブジェクトを検証し、
+// その中の認可パラメータだけで authorizeRequest を組み立てる（RFC 9101 5）。クエリは client_id 以外を無視する。
+// jti は同意画面の POST でも同じオブジェクトを検証し直すためここでは記録せず、認可コードの発行時に記録する。
+func loadRequestObject(ctx context.Context, params url.Values) (*authorizeRequest, error) {
+	request := params.Get("request")
+	requestURI := params.Get("request_uri")
+	if request != "" && requestURI != "" {
+		return nil, fmt.Errorf("request と request_uri は同時に使えません")
+	}
+	clientID := params.Get("client_id")
+	if clientID == "" {
+		return nil, fmt.Errorf("リクエストオブジェクトを使う場合も client_id が必要です")
+	}
+
+	client, err := repository.GetClientByID(ctx, clientID)
+	if err != nil {
+		return nil, err
+	}
+	if requestURI != "" {
+		if request, err = fetchRequestObject(ctx, client, requestURI); err != nil {
+			return nil, err
+		}
+	}
+
+	objectParams, claims, err := mergeRequestObject(ctx, client, request)
+	if err != nil {
+		return nil, err
+	}
+	req := parseAuthorizeRequest(objectParams)
+	req.requestObject = claims
+	// 同意画面からの POST でも同じオブジェクトを検証し直すよう、オブジェクトを指す client_id / request / request_uri だけを持ち回る
+	req.params = url.Values{"client_id": {clientID}}
+	if requestURI != "" {
+		req.params.Set("request_uri", requestURI)
+	} else {
+		req.params.Set("request", request)
+	}
+	return req, nil
+}
+
+// mergeRequestObject はリクエストオブジェクトを検証し、その認可パラメータと検証済みのクレームを返す。
+func mergeRequestObject(ctx context.Context, client *OAuthClient, request string) (url.Values, jwt.MapClaims, error) {
+	claims, err := verifyRequestObject(ctx, client, request)
+	if err != nil {
+		return nil, nil, err
+	}
+	params, err := requestObjectParams(client.ClientID, claims)
+	if err != nil {
+		return nil, nil, err
+	}
+	return params, claims, nil
+}
+
+// requestObjectParams は検証済みのクレームから認可パラメータを組み立てる。
+// RFC 9101 5: リクエストオブジェクトの外（クエリや PAR のフォーム）のパラメータは client_id 以外使わない。
+func requestObjectParams(clientID string, claims jwt.MapClaims) (url.Values, error) {
+	params := url.Values{"client_id": {clientID}}
+	for k, v := range claims {
+		if requestObjectJWTClaims[k] {
+			continue
+		}
+		// RFC 9101 4: オブジェクトの中で request / request_uri を入れ子にしてはならない
+		if k == "request" || k == "request_uri" {
+			return nil, fmt.Errorf("リクエストオブジェクトに %s を含めることはできません", k)
+		}
+		params.Set(k, requestObjectClaimString(v))
+	}
+	return params, nil
+}
+
+// recordRequestObjectJTI はリクエストオブジェクトの jti を exp まで記録し、既に使われていればエラーを返す。
+func recordRequestObjectJTI(ctx context.Context, clientID string, claims jwt.MapClaims) error {
+	jti, _ := claims["jti"].(string)
+	exp, err := claims.GetExpirationTime()
+	if err != nil || exp == nil || jti == "" {
+		return fmt.Errorf("リクエストオブジェクトに jti または exp がありません")
+	}
+	return repository.RecordRequestObjectJTI(ctx, clientID, jti, exp.Add(clientAssertionLeeway))
+}
+
+// verifyRequestObject はクライアントに登録された鍵でリクエストオブジェクトの署名を検証する。
+// iss は client_id、aud はこのサーバーの issuer。exp（requestObjectMaxLifetime 以内）と jti は必須。
+// request_object_signing_alg が登録されていればその方式だけを受け付ける。
+func verifyRequestObject(ctx context.Context, client *OAuthClient, request string) (jwt.MapClaims, error) {
+	algs := privateKeyJWTAlgs
+	if client.TokenEndpointAuthMethod == authMethodClientSecretJWT {
+		algs = supportedRequestObjectAlgs()
+	}
+	if client.RequestObjectSigningAlg != nil && *client.RequestObjectSigningAlg != "" {
+		if !slices.Contains(algs, *client.RequestObjectSigningAlg) {
+			return nil, fmt.Errorf("このクライアントでは request_object_signing_alg %s を使えません", *client.RequestObjectSigningAlg)
+		}
+		algs = []string{*client.RequestObjectSigningAlg}
+	}
+
+	parser := jwt.NewParser(
+		jwt.WithValidMethods(algs),
+		jwt.WithIssuer(client.ClientID),
+		jwt.WithAudience(serverBaseURL()),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+		jwt.WithLeeway(clientAssertionLeeway),
+	)
+	claims := jwt.MapClaims{}
+	_, err := parser.ParseWithClaims(request, claims, func(t *jwt.Token) (any, error) {
+		if strings.HasPrefix(t.Method.Alg(), "HS") {
+			// client_assertion と同じく、ローテーションの猶予期間中は直前のシークレットで署名したものも受け付ける
+			previous, err := previousClientSecret(ctx, client.ClientID)
+			if err != nil {
+				return nil, err
+			}
+			return clientSecretJWTKeys(client.ClientSecret, previous), nil
+		}
+		kid, _ := t.Header["kid"].(string)
+		return clientPublicKey(ctx, client, kid)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("リクエストオブジェクトの検証エラー: %v", err)
+	}
+
+	exp, _ := claims.GetExpirationTime()
+	if exp.Sub(time.Now()) > requestObjectMaxLifetime {
+		return nil, fmt.Errorf("リクエストオブジェクトの有効期間が長すぎます（最大 %s）", requestObjectMaxLifetime)
+	}
+	if jti, _ := claims["jti"].(string); jti == "" {
+		return nil, fmt.Errorf("リクエストオブジェクトに jti がありません")
+	}
+
+	// RFC 9101 5: オブジェクト内の client_id はクエリの client_id と一致しなければならない
+	if id, ok := claims["client_id"]; ok && id != client.ClientID {
+		return nil, fmt.Errorf("リクエストオブジェクトの client_id が一致しません")
+	}
+	return claims, nil
+}
+
+// fetchRequestObject は request_uri からリクエストオブジェクトを取得する。
+// 任意の URL へサーバーからアクセスさせないよう、クライアントに登録された request_uris だけを許可し、
+// 内部ネットワークのアドレスへは接続しない（newOutboundHTTPClient）。
+func fetchRequestObject(ctx context.Context, client *OAuthClient, requestURI string) (string, error) {
+	if !slices.Contains(client.RequestURIs, requestURI) {
+		return "", fmt.Errorf("request_uri がクライアントに登録されていません")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, requestURI, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Accept", "application/oauth-authz-req+jwt")
+	res, err := requestObjectHTTPClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("request_uri の取得エラー: %v", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("request_uri の取得エラー: HTTP %d", res.StatusCode)
+	}
+	body, err := readOutboundBody(res, requestObjectMaxSize)
+	if err != nil {
+		return "", fmt.Errorf("request_uri の取得エラー: %v", err)
+	}
+	return strings.TrimSpace(string(body)), nil
+}
+
+// requestObjectClaimString はクレームの値を認可パラメータの文字列にする。
+// max_age のような数値はそのまま、claims のようなオブジェクトは JSON にする。
+func requestObjectClaimString(v any) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		b, _ := json.Marshal(v)
+		return string(b)
+	}
+}
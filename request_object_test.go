@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestVerifyRequestObject(t *testing.T) {
+	t.Setenv("SERVER_BASE_URL", "https://as.example.com")
+	key := newTestSigningKey(t, "ES256")
+	other := newTestSigningKey(t, "ES256")
+	client := &OAuthClient{ClientID: "jar_client", TokenEndpointAuthMethod: authMethodPrivateKeyJWT, JWKS: testClientJWKS(t, key)}
+	secretClient := &OAuthClient{ClientID: "jar_client", TokenEndpointAuthMethod: authMethodClientSecretJWT, ClientSecret: "hmac-secret"}
+	useTestPreviousClientSecret(t, "old-hmac-secret")
+
+	now := time.Now()
+	valid := func() jwt.MapClaims {
+		return jwt.MapClaims{
+			"iss":           "jar_client",
+			"aud":           "https://as.example.com",
+			"exp":           now.Add(5 * time.Minute).Unix(),
+			"iat":           now.Unix(),
+			"jti":           "jti-1",
+			"response_type": "code",
+			"scope":         "openid",
+		}
+	}
+	with := func(k string, v any) jwt.MapClaims {
+		c := valid()
+		if v == nil {
+			delete(c, k)
+		} else {
+			c[k] = v
+		}
+		return c
+	}
+	hs256With := func(secret string, claims jwt.MapClaims) string {
+		s, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(secret))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	hs256 := func(claims jwt.MapClaims) string { return hs256With("hmac-secret", claims) }
+
+	tests := []struct {
+		name    string
+		client  *OAuthClient
+		key     *signingKey
+		claims  jwt.MapClaims
+		hs256   bool
+		wantErr bool
+	}{
+		{"有効なオブジェクト", client, key, valid(), false, false},
+		{"client_id が一致する", client, key, with("client_id", "jar_client"), false, false},
+		{"exp が無い", client, key, with("exp", nil), false, true},
+		{"exp が長すぎる", client, key, with("exp", now.Add(requestObjectMaxLifetime+time.Minute).Unix()), false, true},
+		{"期限切れ", client, key, with("exp", now.Add(-time.Hour).Unix()), false, true},
+		{"jti が無い", client, key, with("jti", nil), false, true},
+		{"jti が空", client, key, with("jti", ""), false, true},
+		{"iss が client_id ではない", client, key, with("iss", "other"), false, true},
+		{"aud がこのサーバーではない", client, key, with("aud", "https://other.example.com"), false, true},
+		{"client_id が一致しない", client, key, with("client_id", "other"), false, true},
+		{"登録されていない鍵の署名", client, other, valid(), false, true},
+		{"private_key_jwt のクライアントは HS256 を使えない", client, nil, valid(), true, true},
+		{"client_secret_jwt のクライアントは HS256 を使える", secretClient, nil, valid(), true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var request string
+			if tt.hs256 {
+				request = hs256(tt.claims)
+			} else {
+				var err error
+				if request, err = signJWTWithKey(tt.key, tt.claims); err != nil {
+					t.Fatal(err)
+				}
+			}
+			_, err := verifyRequestObject(context.Background(), tt.client, request)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("verifyRequestObject() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	// ローテーションの猶予期間中は直前のシークレットの署名も受け付けるが、それ以外のシークレットは受け付けない
+	if _, err := verifyRequestObject(context.Background(), secretClient, hs256With("old-hmac-secret", valid())); err != nil {
+		t.Errorf("直前のシークレットの署名を拒否しました: %v", err)
+	}
+	if _, err := verifyRequestObject(context.Background(), secretClient, hs256With("unknown-secret", valid())); err == nil {
+		t.Error("登録されていないシークレットの署名を受け入れました")
+	}
+
+	// request_object_signing_alg を登録したクライアントは他の方式を受け付けない
+	alg := "ES384"
+	pinned := &OAuthClient{ClientID: "jar_client", TokenEndpointAuthMethod: authMethodPrivateKeyJWT, JWKS: client.JWKS, RequestObjectSigningAlg: &alg}
+	request, err := signJWTWithKey(key, valid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := verifyRequestObject(context.Background(), pinned, request); err == nil {
+		t.Error("request_object_signing_alg と異なる方式を受け入れました")
+	}
+}
+
+func TestRequestObjectParams(t *testing.T) {
+	tests := []struct {
+		name    string
+		claims  jwt.MapClaims
+		want    url.Values
+		wantErr bool
+	}{
+		{
+			name: "JWT のクレームは認可パラメータに含めない",
+			claims: jwt.MapClaims{
+				"iss": "jar_client", "aud": "https://as.example.com", "exp": float64(1), "jti": "x",
+				"response_type": "code", "redirect_uri": "https://app.example.com/cb",
+			},
+			want: url.Values{
+				"client_id":     {"jar_client"},
+				"response_type": {"code"},
+				"redirect_uri":  {"https://app.example.com/cb"},
+			},
+		},
+		{
+			name:   "数値とオブジェクトは文字列にする",
+			claims: jwt.MapClaims{"max_age": float64(300), "claims": map[string]any{"userinfo": nil}},
+			want: url.Values{
+				"client_id": {"jar_client"},
+				"max_age":   {"300"},
+				"claims":    {`{"userinfo":null}`},
+			},
+		},
+		{
+			name:    "request を入れ子にできない",
+			claims:  jwt.MapClaims{"request": "x.y.z"},
+			wantErr: true,
+		},
+		{
+			name:    "request_uri を入れ子にできない",
+			claims:  jwt.MapClaims{"request_uri": "https://app.example.com/req"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := requestObjectParams("jar_client", tt.claims)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("requestObjectParams() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && got.Encode() != tt.want.Encode() {
+				t.Errorf("requestObjectParams() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMergeRequestObject(t *testing.T) {
+	t.Setenv("SERVER_BASE_URL", "https://as.example.com")
+	key := newTestSigningKey(t, "ES256")
+	client := &OAuthClient{ClientID: "jar_client", TokenEndpointAuthMethod: authMethodPrivateKeyJWT, JWKS: testClientJWKS(t, key)}
+	request, err := signJWTWithKey(key, jwt.MapClaims{
+		"iss":           "jar_client",
+		"aud":           "https://as.example.com",
+		"exp":           time.Now().Add(time.Minute).Unix(),
+		"jti":           "jti-1",
+		"response_type": "code",
+		"redirect_uri":  "https://app.example.com/cb",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	params, claims, err := mergeRequestObject(context.Background(), client, request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := parseAuthorizeRequest(params)
+	// 認可パラメータはオブジェクトの中のものだけ（RFC 9101 5）
+	if req.Scope != "" || req.State != "" || req.RedirectURI != "https://app.example.com/cb" {
+		t.Errorf("認可パラメータ = %+v", req)
+	}
+	if claims["jti"] != "jti-1" {
+		t.Errorf("jti = %v", claims["jti"])
+	}
+}
+
+func TestRecordRequestObjectJTIRequiresClaims(t *testing.T) {
+	// jti / exp の無いクレームはリポジトリを引く前に拒否する
+	for _, claims := range []jwt.MapClaims{
+		{"exp": float64(time.Now().Unix())},
+		{"jti": "jti-1"},
+	} {
+		if err := recordRequestObjectJTI(context.Background(), "jar_client", claims); err == nil {
+			t.Errorf("recordRequestObjectJTI(%v) がエラーになりません", claims)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// トークン失効エンドポイント（POST /revoke、RFC 7009）。
+// クライアント認証は /token と同じ。失効対象が見つからない・他クライアントのトークンでも 200 を返す（RFC 7009 2.2）。
+func revokeHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	logger := slog.Default()
+
+	if err := r.ParseForm(); err != nil {
+		writeOAuthError(w, errInvalidRequest("invalid form data"))
+		return
+	}
+
+	client, err := authenticateClient(ctx, r)
+	if err != nil {
+		logger.Warn("クライアント認証に失敗しました", "client_id", r.FormValue("client_id"), "error", err.Error())
+		writeOAuthError(w, errInvalidClient("client authentication failed"))
+		return
+	}
+
+	token := r.FormValue("token")
+	if token == "" {
+		writeOAuthError(w, errInvalidRequest("token is required"))
+		return
+	}
+
+	// token_type_hint は探索順のヒントにすぎない。外れたらもう一方も探す（RFC 7009 2.1）
+	revokers := []func(context.Context, string, string) (bool, error){
+		repository.RevokeAccessTokenForClient,
+		repository.RevokeRefreshToken,
+	}
+	if r.FormValue("token_type_hint") == "refresh_token" {
+		revokers[0], revokers[1] = revokers[1], revokers[0]
+	}
+
+	revoked := false
+	for _, revoke := range revokers {
+		ok, err := revoke(ctx, token, client.ClientID)
+		if err != nil {
+			logger.Error("トークンの失効に失敗しました", "client_id", client.ClientID, "error", err.Error())
+			// RFC 7009 2.2.1: 一時的に失効できないときは 503 を返す
+			writeOAuthError(w, newOAuthError(http.StatusServiceUnavailable, "temporarily_unavailable", "revocation is temporarily unavailable", ""))
+			return
+		}
+		if ok {
+			revoked = true
+			break
+		}
+	}
+
+	logger.Info("トークン失効リクエストを処理しました",
+		"client_id", client.ClientID,
+		"token_type_hint", r.FormValue("token_type_hint"),
+		"revoked", revoked)
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestRevokeHandlerRequiresClientAuthentication(t *testing.T) {
+	// クライアント認証に失敗したリクエストは、トークンを探す前に 401 invalid_client で拒否する（RFC 7009 2.1）
+	tests := []struct {
+		name  string
+		form  url.Values
+		basic []string
+	}{
+		{"認証情報が無い", url.Values{"token": {"t"}}, nil},
+		{"Basic 認証とフォームの client_id が異なる", url.Values{"token": {"t"}, "client_id": {"other"}}, []string{"demo", "secret"}},
+		{"Basic 認証とフォームのシークレットを併用", url.Values{"token": {"t"}, "client_secret": {"secret"}}, []string{"demo", "secret"}},
+		{"アサーションとシークレットを併用", url.Values{
+			"token":                 {"t"},
+			"client_assertion_type": {clientAssertionTypeJWTBearer},
+			"client_assertion":      {"x.y.z"},
+			"client_secret":         {"secret"},
+		}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newFormRequest("/revoke", tt.form)
+			if tt.basic != nil {
+				r.SetBasicAuth(tt.basic[0], tt.basic[1])
+			}
+			rec := httptest.NewRecorder()
+			revokeHandler(rec, r)
+			if rec.Code != http.StatusUnauthorized {
+				t.Errorf("status = %d, want 401", rec.Code)
+			}
+			if rec.Header().Get("WWW-Authenticate") == "" {
+				t.Error("WWW-Authenticate がありません")
+			}
+			if code := oauthErrorCode(t, rec); code != "invalid_client" {
+				t.Errorf("error = %q, want invalid_client", code)
+			}
+		})
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Signer は JWT の署名を行う抽象。秘密鍵そのものは外に出さず、署名だけを提供する。
+// 実装は PEM ファイル（平文 / パスフレーズで暗号化した PKCS#8）を読み込むものと、
+// Unix ソケットの署名デーモンに署名を依頼するもの（remoteSigner）がある。
+type Signer interface {
+	// Algorithm は JWS の alg（RS256 / ES256 / ES384 / EdDSA）
+	Algorithm() string
+	// Public は検証用の公開鍵（JWKS に載せる）
+	Public() crypto.PublicKey
+	// SignJWS は JWS Signing Input（BASE64URL(header) "." BASE64URL(payload)）に対する
+	// JWS 形式の署名（ES256 / ES384 は r || s の固定長）を返す
+	SignJWS(signingInput string) ([]byte, error)
+}
+
+// localSigner は秘密鍵をプロセス内に持つ Signer。PEM ファイルから読み込む。
+type localSigner struct {
+	alg    string
+	method jwt.SigningMethod
+	key    crypto.Signer
+}
+
+func (s *localSigner) Algorithm() string        { return s.alg }
+func (s *localSigner) Public() crypto.PublicKey { return s.key.Public() }
+
+func (s *localSigner) SignJWS(signingInput string) ([]byte, error) {
+	return s.method.Sign(signingInput, s.key)
+}
+
+// openSigner はマニフェストのエントリに対応する Signer を作る。
+func openSigner(e keyManifestEntry, alg string) (Signer, error) {
+	switch e.Signer {
+	case "", "file":
+		return newFileSigner(filepath.Join(keyDir, e.File), alg)
+	case "remote":
+		return newRemoteSigner(e.Socket, e.Kid, alg, e.PublicKey)
+	default:
+		return nil, fmt.Errorf("未対応の署名方式です: %s", e.Signer)
+	}
+}
+
+// newFileSigner は PEM の秘密鍵から Signer を作る。
+// ENCRYPTED PRIVATE KEY（PKCS#8 PBES2）の場合は keyPassphrase のパスフレーズで復号する。
+func newFileSigner(path, alg string) (Signer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("秘密鍵ファイル読み込みエラー: %v", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("無効な秘密鍵形式")
+	}
+
+	if block.Type == "ENCRYPTED PRIVATE KEY" {
+		passphrase, err := keyPassphrase()
+		if err != nil {
+			return nil, err
+		}
+		if passphrase == "" {
+			return nil, fmt.Errorf("暗号化された秘密鍵ですが JWT_KEY_PASSPHRASE / JWT_KEY_PASSPHRASE_FILE が設定されていません")
+		}
+		return newEncryptedFileSigner(block.Bytes, passphrase, alg)
+	}
+
+	var key any
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("秘密鍵パースエラー: %v", err)
+	}
+	return newLocalSigner(key, alg)
+}
+
+// newEncryptedFileSigner はパスフレーズで暗号化された PKCS#8（DER）を復号して Signer を作る。
+func newEncryptedFileSigner(der []byte, passphrase, alg string) (Signer, error) {
+	plain, err := decryptPKCS8(der, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKCS8PrivateKey(plain)
+	if err != nil {
+		return nil, fmt.Errorf("秘密鍵パースエラー: %v", err)
+	}
+	return newLocalSigner(key, alg)
+}
+
+// newLocalSigner は鍵の種類が alg と一致するかを確認して localSigner を作る。
+func newLocalSigner(key any, alg string) (Signer, error) {
+	method, ok := signingMethods[alg]
+	if !ok {
+		return nil, fmt.Errorf("未対応の署名アルゴリズムです: %s", alg)
+	}
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		if alg == "RS256" {
+			return &localSigner{alg: alg, method: method, key: k}, nil
+		}
+	case *ecdsa.PrivateKey:
+		if (alg == "ES256" && k.Curve == elliptic.P256()) || (alg == "ES384" && k.Curve == elliptic.P384()) {
+			return &localSigner{alg: alg, method: method, key: k}, nil
+		}
+	case ed25519.PrivateKey:
+		if alg == "EdDSA" {
+			return &localSigner{alg: alg, method: method, key: k}, nil
+		}
+	}
+	return nil, fmt.Errorf("秘密鍵の種類が %s と一致しません", alg)
+}
+
+// keyPassphrase は暗号化した秘密鍵のパスフレーズ。
+// JWT_KEY_PASSPHRASE_FILE（Docker / Kubernetes の secret をマウントしたファイル）を優先し、無ければ JWT_KEY_PASSPHRASE を使う。
+func keyPassphrase() (string, error) {
+	if path := os.Getenv("JWT_KEY_PASSPHRASE_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("パスフレーズファイル読み込みエラー: %v", err)
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	}
+	return os.Getenv("JWT_KEY_PASSPHRASE"), nil
+}
@@ -2,24 +2,29 @@ package main
 
 import (
 	"context"
-	"crypto/sha256"
-	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"log/slog"
 	"net/http"
+	"slices"
 	"strings"
 	"time"
 )
 
+// 有効期間の既定値。クライアントごとに oauth_clients の *_lifetime 列で上書きできる（OAuthClient.AccessTokenTTL 等）。
 const (
 	// アクセストークン（JWT）の有効期間。expires_in レスポンスと DB の expires_at に一致させる。
-	accessTokenLifetime = time.Hour
-	// リフレッシュトークン（不透明文字列）の有効期間。refresh_tokens.expires_at に保存する。
-	refreshTokenLifetime = 30 * 24 * time.Hour
+	defaultAccessTokenLifetime = time.Hour
+	// 認可コードの有効期間（RFC 6749 4.1.2 は最大 10 分を推奨）
+	defaultAuthorizationCodeLifetime = 10 * time.Minute
+	// リフレッシュトークン（不透明文字列）1 つあたりの有効期間。refresh_tokens.expires_at に保存する。
+	defaultRefreshTokenLifetime = 30 * 24 * time.Hour
+	// 最初の認可からの絶対的な上限。ローテーションを続けてもこれを超えて延長しない。
+	defaultRefreshTokenAbsoluteLifetime = 90 * 24 * time.Hour
 )
 
 // OAuth2トークンエンドポイント（POST /token）。
-// grant_type ごとに処理を分岐する。クライアント認証（client_id + client_secret）は全グラント共通。
+// grant_type ごとに処理を分岐する。クライアント認証（token_endpoint_auth_method に従う）は全グラント共通。
 func tokenHandler(w http.ResponseWriter, r *http.Request) {
 	ctx, cancel := context.WithTimeout(r.Context(), 15*time.Second)
 	defer cancel()
@@ -27,54 +32,85 @@ func tokenHandler(w http.ResponseWriter, r *http.Request) {
 	logger := slog.Default()
 
 	if err := r.ParseForm(); err != nil {
-		http.Error(w, "Invalid form data", http.StatusBadRequest)
+		writeOAuthError(w, errInvalidRequest("invalid form data"))
 		return
 	}
 
 	grantType := r.FormValue("grant_type")
-	clientID := r.FormValue("client_id")
-	clientSecret := r.FormValue("client_secret")
 
-	if clientID == "" || clientSecret == "" {
-		http.Error(w, "Client credentials required", http.StatusBadRequest)
+	client, err := authenticateClient(ctx, r)
+	if err != nil {
+		logger.Warn("クライアント認証に失敗しました", "client_id", r.FormValue("client_id"), "error", err.Error())
+		writeOAuthError(w, errInvalidClient("client authentication failed"))
+		return
+	}
+	// grant_types を登録したクライアント（動的登録など）は、登録したグラントだけを使える
+	if grantType != "" && !client.AllowsGrantType(grantType) {
+		writeOAuthError(w, errUnauthorizedClient("the client is not registered for grant_type "+grantType))
 		return
 	}
 
-	_, err := repository.ValidateClientCredentials(ctx, clientID, clientSecret)
+	// DPoP（RFC 9449）: 証明があれば、その鍵のサムプリントを発行するアクセストークンの cnf.jkt に入れる
+	jkt, err := checkDPoPProof(ctx, r, endpointURL(r, "/token"), "")
+	if errors.Is(err, errUseDPoPNonce) {
+		w.Header().Set("DPoP-Nonce", newDPoPNonce())
+		writeOAuthError(w, newOAuthError(http.StatusBadRequest, "use_dpop_nonce", "a DPoP nonce is required", ""))
+		return
+	}
 	if err != nil {
-		logger.Warn("クライアント認証に失敗しました", "client_id", clientID, "error", err.Error())
-		http.Error(w, "Invalid client credentials", http.StatusUnauthorized)
+		logger.Warn("DPoP 証明が無効です", "client_id", client.ClientID, "error", err.Error())
+		writeOAuthError(w, newOAuthError(http.StatusBadRequest, "invalid_dpop_proof", "the DPoP proof is invalid", ""))
+		return
+	}
+	if jkt == "" && client.DPoPBoundAccessTokens {
+		writeOAuthError(w, errInvalidRequest("a DPoP proof is required for this client"))
+		return
+	}
+	// mTLS（RFC 8705）: クライアント証明書で接続していれば、アクセストークンをその証明書に結びつける（cnf.x5t#S256）
+	cert := clientCertificate(r)
+	if cert == nil && client.CertBoundAccessTokens {
+		writeOAuthError(w, errInvalidRequest("a mutual-TLS client certificate is required for this client"))
 		return
 	}
+	cnf := newTokenConfirmation(jkt, cert)
 
 	switch grantType {
 	case "authorization_code":
 		// RFC 6749 4.1.3: 認可コードをアクセストークン（＋任意でリフレッシュ）に交換
-		handleAuthorizationCodeGrant(ctx, w, r, logger, clientID)
+		handleAuthorizationCodeGrant(ctx, w, r, logger, client, cnf)
 	case "refresh_token":
 		// RFC 6749 6: リフレッシュトークンでアクセストークンを再発行（本実装ではローテーション）
-		handleRefreshTokenGrant(ctx, w, r, logger, clientID)
+		handleRefreshTokenGrant(ctx, w, r, logger, client, cnf)
+	case "client_credentials":
+		// RFC 6749 4.4: クライアント自身の権限でアクセストークンを発行（サービス間通信用）
+		handleClientCredentialsGrant(ctx, w, r, logger, client, cnf)
+	case deviceCodeGrantType:
+		// RFC 8628 3.4: デバイスがポーリングし、ユーザー承認済みならトークンを発行
+		handleDeviceCodeGrant(ctx, w, r, logger, client, cnf)
+	case "":
+		writeOAuthError(w, errInvalidRequest("grant_type is required"))
 	default:
-		http.Error(w, "Unsupported grant_type", http.StatusBadRequest)
+		writeOAuthError(w, errUnsupportedGrantType("grant_type "+grantType+" is not supported"))
 	}
 }
 
 // handleAuthorizationCodeGrant は認可コードグラントを処理する。
 // 認可コードは GetAuthorizationCode 内で検証後に DB から削除される（ワンタイム）。
-func handleAuthorizationCodeGrant(ctx context.Context, w http.ResponseWriter, r *http.Request, logger *slog.Logger, clientID string) {
+func handleAuthorizationCodeGrant(ctx context.Context, w http.ResponseWriter, r *http.Request, logger *slog.Logger, client *OAuthClient, cnf *tokenConfirmation) {
+	clientID := client.ClientID
 	code := r.FormValue("code")
 	redirectURI := r.FormValue("redirect_uri")
 	codeVerifier := r.FormValue("code_verifier")
 
 	if code == "" {
-		http.Error(w, "Authorization code required", http.StatusBadRequest)
+		writeOAuthError(w, errInvalidRequest("code is required"))
 		return
 	}
 
 	authCode, err := repository.GetAuthorizationCode(ctx, code)
 	if err != nil {
-		logger.Warn("認可コードの検証に失敗しました", "code", code, "error", err.Error())
-		http.Error(w, "Invalid or expired authorization code", http.StatusBadRequest)
+		logger.Warn("認可コードの検証に失敗しました", "code_hash", tokenLogID(code), "error", err.Error())
+		writeOAuthError(w, errInvalidGrant("the authorization code is invalid or expired"))
 		return
 	}
 
@@ -82,7 +118,7 @@ func handleAuthorizationCodeGrant(ctx context.Context, w http.ResponseWriter, r
 		logger.Warn("認可コードのクライアントIDが一致しません",
 			"auth_code_client_id", authCode.ClientID,
 			"request_client_id", clientID)
-		http.Error(w, "Invalid authorization code", http.StatusBadRequest)
+		writeOAuthError(w, errInvalidGrant("the authorization code was issued to another client"))
 		return
 	}
 
@@ -90,36 +126,39 @@ func handleAuthorizationCodeGrant(ctx context.Context, w http.ResponseWriter, r
 		logger.Warn("認可コードのリダイレクトURIが一致しません",
 			"auth_code_redirect_uri", authCode.RedirectURI,
 			"request_redirect_uri", redirectURI)
-		http.Error(w, "Invalid redirect_uri", http.StatusBadRequest)
+		writeOAuthError(w, errInvalidGrant("redirect_uri does not match the authorization request"))
 		return
 	}
 
 	// PKCE: 認可リクエスト時に保存した code_challenge と code_verifier の整合を取る
-	if authCode.CodeChallenge != nil && *authCode.CodeChallenge != "" {
+	hasChallenge := authCode.CodeChallenge != nil && *authCode.CodeChallenge != ""
+	switch {
+	case !hasChallenge && client.PKCERequired():
+		// 公開クライアント・require_pkce のクライアントは PKCE で認可リクエストとの結びつきを必ず確認する
+		writeOAuthError(w, errInvalidGrant("PKCE is required for this client"))
+		return
+	case !hasChallenge && codeVerifier != "":
+		// challenge なしで発行されたコードに verifier が来るのは PKCE のダウングレード攻撃の兆候（Security BCP 4.8.2）
+		logger.Warn("code_challenge のない認可コードに code_verifier が送られました", "client_id", clientID)
+		writeOAuthError(w, errInvalidGrant("code_verifier was sent for an authorization code issued without code_challenge"))
+		return
+	case hasChallenge:
 		if codeVerifier == "" {
-			http.Error(w, "Code verifier required for PKCE", http.StatusBadRequest)
+			// RFC 7636 4.6: 検証できない場合は invalid_grant
+			writeOAuthError(w, errInvalidGrant("code_verifier is required for this authorization code"))
 			return
 		}
-
-		var computedChallenge string
-		if authCode.CodeChallengeMethod != nil && *authCode.CodeChallengeMethod == "S256" {
-			// S256: SHA256(code_verifier) を BASE64URL（パディングなし）
-			hash := sha256.Sum256([]byte(codeVerifier))
-			computedChallenge = base64.RawURLEncoding.EncodeToString(hash[:])
-		} else {
-			// plain: code_challenge と code_verifier が同一（非推奨だが互換のため）
-			computedChallenge = codeVerifier
+		method := pkceMethodPlain
+		if authCode.CodeChallengeMethod != nil && *authCode.CodeChallengeMethod != "" {
+			method = *authCode.CodeChallengeMethod
 		}
-
-		if computedChallenge != *authCode.CodeChallenge {
-			logger.Warn("PKCEコードチャレンジの検証に失敗しました",
-				"expected", *authCode.CodeChallenge,
-				"computed", computedChallenge)
-			http.Error(w, "Invalid code verifier", http.StatusBadRequest)
+		if err := verifyCodeVerifier(codeVerifier, *authCode.CodeChallenge, method); err != nil {
+			logger.Warn("PKCEコードチャレンジの検証に失敗しました", "client_id", clientID, "method", method, "error", err.Error())
+			writeOAuthError(w, errInvalidGrant(err.Error()))
 			return
 		}
 
-		logger.Info("PKCE検証が成功しました", "method", *authCode.CodeChallengeMethod)
+		logger.Info("PKCE検証が成功しました", "method", method)
 	}
 
 	scopes := []string{}
@@ -133,56 +172,67 @@ func handleAuthorizationCodeGrant(ctx context.Context, w http.ResponseWriter, r
 	user, err := repository.GetUserByID(ctx, authCode.UserID)
 	if err != nil {
 		logger.Error("ユーザー情報の取得に失敗しました", "error", err.Error(), "userID", authCode.UserID)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		writeOAuthError(w, errServerError())
 		return
 	}
 
-	accessToken, err := generateJWTAccessToken(authCode.UserID, user.Username, clientID, scopeString, accessTokenLifetime)
+	accessToken, err := generateJWTAccessToken(authCode.UserID, user.Username, clientID, scopeString, client.AccessTokenTTL(), cnf)
 	if err != nil {
 		logger.Error("JWTアクセストークンの生成に失敗しました", "error", err.Error())
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		writeOAuthError(w, errServerError())
 		return
 	}
 
-	// access_tokens にメタデータ保存（token カラムには JWT 文字列そのものを格納）
-	expiresAt := time.Now().Add(accessTokenLifetime)
+	// access_tokens にメタデータ保存（JWT そのものではなく jti を格納）
+	expiresAt := time.Now().Add(client.AccessTokenTTL())
 	createdToken, err := repository.CreateAccessToken(ctx, accessToken, clientID, &authCode.UserID, scopes, expiresAt)
 	if err != nil {
 		logger.Error("アクセストークンの作成に失敗しました", "error", err.Error())
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		writeOAuthError(w, errServerError())
 		return
 	}
 
-	// refresh_tokens は access_tokens.id に外部キーで紐づく（スキーマ上必須）
+	// refresh_tokens は新しいファミリーに属し、access_tokens.id に外部キーで紐づく
 	refreshPlain := generateRandomString(32)
-	refreshExpires := time.Now().Add(refreshTokenLifetime)
-	if _, err := repository.CreateRefreshToken(ctx, refreshPlain, createdToken.ID, refreshExpires); err != nil {
+	if _, err := repository.CreateRefreshToken(ctx, refreshPlain, client, authCode.UserID, createdToken.ID, scopes, refreshTokenBinding(client, cnf)); err != nil {
 		logger.Error("リフレッシュトークンの作成に失敗しました", "error", err.Error())
 		// アクセスだけ先に INSERT 済みのため、孤立行を残さないよう失効させる
 		if revErr := repository.RevokeAccessToken(ctx, accessToken); revErr != nil {
 			logger.Error("ロールバック用アクセストークン失効に失敗", "error", revErr.Error())
 		}
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		writeOAuthError(w, errServerError())
 		return
 	}
 
 	response := map[string]any{
 		"access_token":  accessToken,
-		"token_type":    "Bearer",
-		"expires_in":    int(accessTokenLifetime.Seconds()),
+		"token_type":    accessTokenType(cnf),
+		"expires_in":    int(client.AccessTokenTTL().Seconds()),
 		"refresh_token": refreshPlain,
 	}
 	if len(scopes) > 0 {
 		response["scope"] = strings.Join(scopes, " ")
 	}
-	// OpenID Connect: 認可時に nonce が付いていれば ID Token を同梱
-	if authCode.Nonce != nil && *authCode.Nonce != "" {
-		idToken, err := generateJWTIDToken(authCode.UserID, user.Username, clientID, *authCode.Nonce, accessTokenLifetime)
+	// OpenID Connect: openid スコープで認可されていれば ID Token を同梱（nonce の有無は問わない）
+	if slices.Contains(scopes, "openid") {
+		var nonce, sid string
+		if authCode.Nonce != nil {
+			nonce = *authCode.Nonce
+		}
+		if authCode.SessionID != nil {
+			sid = *authCode.SessionID
+		}
+		var authTime time.Time
+		if authCode.AuthTime != nil {
+			authTime = *authCode.AuthTime
+		}
+		idToken, err := generateJWTIDToken(user, clientID, scopes, nonce, authTime, sid, accessToken, client.AccessTokenTTL())
 		if err != nil {
-			logger.Warn("ID Token生成に失敗しました", "error", err.Error())
-		} else {
-			response["id_token"] = idToken
+			logger.Error("ID Token生成に失敗しました", "error", err.Error())
+			writeOAuthError(w, errServerError())
+			return
 		}
+		response["id_token"] = idToken
 	}
 
 	writeTokenJSON(w, logger, response, "アクセストークンを発行しました",
@@ -196,65 +246,291 @@ func handleAuthorizationCodeGrant(ctx context.Context, w http.ResponseWriter, r
 // handleRefreshTokenGrant はリフレッシュトークングラントを処理する。
 // JWT 署名にユーザー名が必要なため、コミット前に bundle で user_id / scopes を解決する。
 // 真正な排他は CommitRefreshRotation 内の FOR UPDATE + トランザクションで行う（二重使用を防ぐ）。
-func handleRefreshTokenGrant(ctx context.Context, w http.ResponseWriter, r *http.Request, logger *slog.Logger, clientID string) {
+func handleRefreshTokenGrant(ctx context.Context, w http.ResponseWriter, r *http.Request, logger *slog.Logger, client *OAuthClient, cnf *tokenConfirmation) {
+	clientID := client.ClientID
 	refreshPlain := r.FormValue("refresh_token")
 	if refreshPlain == "" {
-		http.Error(w, "refresh_token required", http.StatusBadRequest)
+		writeOAuthError(w, errInvalidRequest("refresh_token is required"))
 		return
 	}
 
 	// ロックなしの読み取り（失効・競合の最終判定は CommitRefreshRotation 側）
 	bundle, err := repository.GetRefreshTokenBundle(ctx, refreshPlain, clientID)
+	if errors.Is(err, errRefreshTokenReused) {
+		logRefreshTokenReuse(logger, clientID)
+		writeOAuthError(w, errInvalidGrant("the refresh token is invalid or expired"))
+		return
+	}
 	if err != nil {
 		logger.Warn("リフレッシュトークンが無効です", "client_id", clientID, "error", err.Error())
-		http.Error(w, "Invalid refresh token", http.StatusBadRequest)
+		writeOAuthError(w, errInvalidGrant("the refresh token is invalid or expired"))
+		return
+	}
+
+	if e := checkRefreshTokenBinding(bundle, cnf); e != nil {
+		logger.Warn("リフレッシュトークンの DPoP 鍵またはクライアント証明書が一致しません", "client_id", clientID, "error", e.Description)
+		writeOAuthError(w, e)
 		return
 	}
 
+	// RFC 6749 6: scope 指定時は元の認可スコープの部分集合だけを許可（縮小）。省略時は元のスコープのまま
+	scopes := bundle.Scopes
+	if requested := r.FormValue("scope"); requested != "" {
+		scopes = strings.Fields(requested)
+		for _, s := range scopes {
+			if !slices.Contains(bundle.Scopes, s) {
+				logger.Warn("元の認可を超えるスコープが要求されました",
+					"client_id", clientID,
+					"scope", s,
+					"granted_scopes", bundle.Scopes)
+				writeOAuthError(w, errInvalidScope("the requested scope exceeds the scope originally granted"))
+				return
+			}
+		}
+	}
+
 	user, err := repository.GetUserByID(ctx, bundle.UserID)
 	if err != nil {
 		logger.Error("ユーザー情報の取得に失敗しました", "error", err.Error(), "userID", bundle.UserID)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		writeOAuthError(w, errServerError())
 		return
 	}
 
-	scopeString := strings.Join(bundle.Scopes, " ")
-	newAccessJWT, err := generateJWTAccessToken(bundle.UserID, user.Username, clientID, scopeString, accessTokenLifetime)
+	scopeString := strings.Join(scopes, " ")
+	newAccessJWT, err := generateJWTAccessToken(bundle.UserID, user.Username, clientID, scopeString, client.AccessTokenTTL(), cnf)
 	if err != nil {
 		logger.Error("JWTアクセストークンの生成に失敗しました", "error", err.Error())
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		writeOAuthError(w, errServerError())
 		return
 	}
 
-	newRefreshPlain := generateRandomString(32)
-	accessExpires := time.Now().Add(accessTokenLifetime)
-	refreshExpires := time.Now().Add(refreshTokenLifetime)
+	// ローテーションが無効なクライアントには新しいリフレッシュトークンを返さず、同じものを使い続けさせる（RFC 6749 6）
+	newRefreshPlain := ""
+	if client.RefreshTokenRotation {
+		newRefreshPlain = generateRandomString(32)
+	}
+	accessExpires := time.Now().Add(client.AccessTokenTTL())
 
-	// 新しい access / refresh を追加したうえで旧 access 行を DELETE（CASCADE で旧 refresh も削除）＝ローテーション
-	if err := repository.CommitRefreshRotation(ctx, refreshPlain, clientID, newAccessJWT, newRefreshPlain, accessExpires, refreshExpires); err != nil {
+	// 新しい access / refresh を同じファミリーに追加し、旧 refresh を使用済みにして旧 access 行を DELETE ＝ローテーション
+	err = repository.CommitRefreshRotation(ctx, refreshPlain, client, newAccessJWT, scopes, newRefreshPlain, accessExpires)
+	if errors.Is(err, errRefreshTokenReused) {
+		logRefreshTokenReuse(logger, clientID)
+		writeOAuthError(w, errInvalidGrant("the refresh token is invalid or expired"))
+		return
+	}
+	if err != nil {
 		logger.Warn("リフレッシュトークンのローテーションに失敗しました", "error", err.Error())
-		http.Error(w, "Invalid refresh token", http.StatusBadRequest)
+		writeOAuthError(w, errInvalidGrant("the refresh token is invalid or expired"))
 		return
 	}
 
 	// リフレッシュ応答では id_token は付与しない（OIDC の推奨挙動は未実装）
 	response := map[string]any{
-		"access_token":  newAccessJWT,
-		"token_type":    "Bearer",
-		"expires_in":    int(accessTokenLifetime.Seconds()),
-		"refresh_token": newRefreshPlain,
+		"access_token": newAccessJWT,
+		"token_type":   accessTokenType(cnf),
+		"expires_in":   int(client.AccessTokenTTL().Seconds()),
+	}
+	if newRefreshPlain != "" {
+		response["refresh_token"] = newRefreshPlain
 	}
-	if len(bundle.Scopes) > 0 {
-		response["scope"] = strings.Join(bundle.Scopes, " ")
+	if len(scopes) > 0 {
+		response["scope"] = scopeString
 	}
 
 	writeTokenJSON(w, logger, response, "リフレッシュによりアクセストークンを再発行しました",
 		"client_id", clientID,
 		"user_id", bundle.UserID,
-		"scopes", bundle.Scopes,
+		"scopes", scopes,
 	)
 }
 
+// refreshTokenBinding はリフレッシュトークンのファミリーを結びつける DPoP 鍵・クライアント証明書。
+// 機密クライアントのリフレッシュトークンはクライアント認証で守られるため、結びつけるのは公開クライアントだけ（RFC 9449 5、RFC 8705 4）。
+func refreshTokenBinding(client *OAuthClient, cnf *tokenConfirmation) *tokenConfirmation {
+	if !client.IsPublic() {
+		return nil
+	}
+	return cnf
+}
+
+// checkRefreshTokenBinding はリフレッシュトークンが結びついた DPoP 鍵・クライアント証明書と、今回のリクエストの cnf を照合する。
+// DPoP に結びついたものは同じ鍵の証明（RFC 9449 5）、証明書に結びついたものは同じクライアント証明書（RFC 8705 4）が必要。
+func checkRefreshTokenBinding(bundle *RefreshTokenBundle, cnf *tokenConfirmation) *oauthError {
+	if bundle.DPoPJKT != "" && (cnf == nil || cnf.JKT != bundle.DPoPJKT) {
+		return errInvalidGrant("the refresh token is bound to a different DPoP key")
+	}
+	if bundle.CertThumbprint != "" && (cnf == nil || cnf.X5TS256 != bundle.CertThumbprint) {
+		return errInvalidGrant("the refresh token is bound to a different client certificate")
+	}
+	return nil
+}
+
+// logRefreshTokenReuse は使用済みリフレッシュトークンの再提示（盗用の疑い）を記録する。
+// ファミリーの失効と security_events への記録はリポジトリ側で済んでいる。
+func logRefreshTokenReuse(logger *slog.Logger, clientID string) {
+	logger.Error("使用済みのリフレッシュトークンが再提示されました。トークンファミリーを失効させました",
+		"client_id", clientID,
+		"event", securityEventRefreshTokenReuse)
+}
+
+// handleClientCredentialsGrant はクライアントクレデンシャルグラントを処理する。
+// ユーザーが介在しないため access_tokens.user_id は NULL で保存し、リフレッシュトークンは発行しない（RFC 6749 4.4.3）。
+func handleClientCredentialsGrant(ctx context.Context, w http.ResponseWriter, r *http.Request, logger *slog.Logger, client *OAuthClient, cnf *tokenConfirmation) {
+	// RFC 6749 4.4: client_credentials は機密クライアント専用
+	if client.IsPublic() {
+		writeOAuthError(w, errUnauthorizedClient("public clients cannot use the client_credentials grant"))
+		return
+	}
+
+	// scope 省略時はクライアントの既定スコープを付与する
+	scopes := client.RequestedScopes(r.FormValue("scope"))
+	if s := findUnregisteredScope(client, scopes); s != "" {
+		logger.Warn("登録されていないスコープが要求されました",
+			"client_id", client.ClientID,
+			"scope", s,
+			"allowed_scopes", client.Scopes)
+		writeOAuthError(w, errInvalidScope("the requested scope is not allowed for this client"))
+		return
+	}
+	scopeString := strings.Join(scopes, " ")
+
+	accessToken, err := generateJWTClientAccessToken(client.ClientID, scopeString, client.AccessTokenTTL(), cnf)
+	if err != nil {
+		logger.Error("JWTアクセストークンの生成に失敗しました", "error", err.Error())
+		writeOAuthError(w, errServerError())
+		return
+	}
+
+	expiresAt := time.Now().Add(client.AccessTokenTTL())
+	createdToken, err := repository.CreateAccessToken(ctx, accessToken, client.ClientID, nil, scopes, expiresAt)
+	if err != nil {
+		logger.Error("アクセストークンの作成に失敗しました", "error", err.Error())
+		writeOAuthError(w, errServerError())
+		return
+	}
+
+	response := map[string]any{
+		"access_token": accessToken,
+		"token_type":   accessTokenType(cnf),
+		"expires_in":   int(client.AccessTokenTTL().Seconds()),
+	}
+	if len(scopes) > 0 {
+		response["scope"] = scopeString
+	}
+
+	writeTokenJSON(w, logger, response, "クライアントクレデンシャルでアクセストークンを発行しました",
+		"token_id", createdToken.ID,
+		"client_id", client.ClientID,
+		"scopes", scopes,
+	)
+}
+
+// handleDeviceCodeGrant はデバイスコードグラントのポーリングを処理する。
+// 承認待ち・間隔違反・期限切れ・拒否は RFC 8628 3.5 のエラーコードを JSON で返し、
+// 承認済みなら device_codes 行を削除（ワンタイム）したうえで認可コードと同様にトークンを発行する。
+func handleDeviceCodeGrant(ctx context.Context, w http.ResponseWriter, r *http.Request, logger *slog.Logger, client *OAuthClient, cnf *tokenConfirmation) {
+	clientID := client.ClientID
+	deviceCode := r.FormValue("device_code")
+	if deviceCode == "" {
+		writeOAuthError(w, errInvalidRequest("device_code is required"))
+		return
+	}
+
+	dc, err := repository.PollDeviceCode(ctx, deviceCode, clientID)
+	switch {
+	case errors.Is(err, errDeviceAuthorizationPending):
+		writeOAuthError(w, errDeviceGrant("authorization_pending"))
+		return
+	case errors.Is(err, errDeviceSlowDown):
+		writeOAuthError(w, errDeviceGrant("slow_down"))
+		return
+	case errors.Is(err, errDeviceCodeExpired):
+		writeOAuthError(w, errDeviceGrant("expired_token"))
+		return
+	case errors.Is(err, errDeviceAccessDenied):
+		writeOAuthError(w, errDeviceGrant("access_denied"))
+		return
+	case err != nil:
+		logger.Warn("デバイスコードの検証に失敗しました", "client_id", clientID, "error", err.Error())
+		writeOAuthError(w, errInvalidGrant("the device code is invalid"))
+		return
+	}
+
+	if dc.UserID == nil {
+		logger.Error("承認済みデバイスコードにユーザーがありません", "device_code_id", dc.ID)
+		writeOAuthError(w, errServerError())
+		return
+	}
+	userID := *dc.UserID
+
+	scopes := []string{}
+	for _, scope := range dc.Scopes {
+		if scope != "" {
+			scopes = append(scopes, scope)
+		}
+	}
+	scopeString := strings.Join(scopes, " ")
+
+	user, err := repository.GetUserByID(ctx, userID)
+	if err != nil {
+		logger.Error("ユーザー情報の取得に失敗しました", "error", err.Error(), "userID", userID)
+		writeOAuthError(w, errServerError())
+		return
+	}
+
+	accessToken, err := generateJWTAccessToken(userID, user.Username, clientID, scopeString, client.AccessTokenTTL(), cnf)
+	if err != nil {
+		logger.Error("JWTアクセストークンの生成に失敗しました", "error", err.Error())
+		writeOAuthError(w, errServerError())
+		return
+	}
+
+	expiresAt := time.Now().Add(client.AccessTokenTTL())
+	createdToken, err := repository.CreateAccessToken(ctx, accessToken, clientID, &userID, scopes, expiresAt)
+	if err != nil {
+		logger.Error("アクセストークンの作成に失敗しました", "error", err.Error())
+		writeOAuthError(w, errServerError())
+		return
+	}
+
+	refreshPlain := generateRandomString(32)
+	if _, err := repository.CreateRefreshToken(ctx, refreshPlain, client, userID, createdToken.ID, scopes, refreshTokenBinding(client, cnf)); err != nil {
+		logger.Error("リフレッシュトークンの作成に失敗しました", "error", err.Error())
+		if revErr := repository.RevokeAccessToken(ctx, accessToken); revErr != nil {
+			logger.Error("ロールバック用アクセストークン失効に失敗", "error", revErr.Error())
+		}
+		writeOAuthError(w, errServerError())
+		return
+	}
+
+	response := map[string]any{
+		"access_token":  accessToken,
+		"token_type":    accessTokenType(cnf),
+		"expires_in":    int(client.AccessTokenTTL().Seconds()),
+		"refresh_token": refreshPlain,
+	}
+	if len(scopes) > 0 {
+		response["scope"] = scopeString
+	}
+
+	writeTokenJSON(w, logger, response, "デバイスコードでアクセストークンを発行しました",
+		"token_id", createdToken.ID,
+		"client_id", clientID,
+		"user_id", userID,
+		"scopes", scopes,
+	)
+}
+
+// findUnregisteredScope は client.Scopes に含まれない最初のスコープを返す（すべて登録済みなら空文字）。
+func findUnregisteredScope(client *OAuthClient, scopes []string) string {
+	for _, s := range scopes {
+		if !slices.Contains(client.Scopes, s) {
+			return s
+		}
+	}
+	return ""
+}
+
 // writeTokenJSON は OAuth 2.0 のトークンレスポンス用ヘッダを付与して JSON を書き出す。
 func writeTokenJSON(w http.ResponseWriter, logger *slog.Logger, response map[string]any, logMsg string, logAttrs ...any) {
 	w.Header().Set("Content-Type", "application/json")
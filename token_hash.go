@@ -0,0 +1,34 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// DB にはベアラー値そのものを保存しない。読み取り権限だけで有効なコードやトークンを再利用されないよう、
+// 認可コード・リフレッシュトークン・デバイスコードは SHA-256 のダイジェスト、JWT のアクセストークンは jti だけを保存して検索する。
+
+// hashToken は認可コード・リフレッシュトークン・デバイスコードの保存形式（SHA-256 の 16 進）。
+// いずれも 128 ビット以上の乱数なので、ソルトや低速ハッシュは不要。
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// tokenLogID はログでコードやトークンを突き合わせるための識別子（SHA-256 の先頭 8 文字）。
+// 値そのものや DB の検索キーになるダイジェスト全体はログに出さない。
+func tokenLogID(token string) string {
+	return hashToken(token)[:8]
+}
+
+// accessTokenJTI は JWT アクセストークンの jti（access_tokens.jti）を返す。JWT でなければ空文字。
+// DB の検索キーを取り出すだけなので署名は検証しない（失効確認の前に呼び出し側で検証済み、または DB に無ければ無効扱い）。
+func accessTokenJTI(token string) string {
+	claims := &jwt.RegisteredClaims{}
+	if _, _, err := jwt.NewParser().ParseUnverified(token, claims); err != nil {
+		return ""
+	}
+	return claims.ID
+}
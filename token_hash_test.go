@@ -0,0 +1,64 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestHashToken(t *testing.T) {
+	// SHA-256("abc") の 16 進（FIPS 180-2 の例）
+	const want = "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"
+	if got := hashToken("abc"); got != want {
+		t.Errorf("hashToken() = %q, want %q", got, want)
+	}
+	if got := tokenLogID("abc"); got != want[:8] {
+		t.Errorf("tokenLogID() = %q, want %q", got, want[:8])
+	}
+	if strings.Contains(tokenLogID("secret-code"), "secret-code") {
+		t.Error("tokenLogID に値そのものが含まれています")
+	}
+}
+
+func TestAccessTokenJTI(t *testing.T) {
+	key := useTestSigningKey(t, "ES256")
+	withJTI, err := signJWTWithKey(key, jwt.RegisteredClaims{
+		ID:        "jti-1",
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	withoutJTI, err := signJWTWithKey(key, jwt.RegisteredClaims{Subject: "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired, err := signJWTWithKey(key, jwt.RegisteredClaims{
+		ID:        "jti-2",
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(-time.Hour)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		want  string
+	}{
+		{"jti のある JWT", withJTI, "jti-1"},
+		{"jti の無い JWT", withoutJTI, ""},
+		{"期限切れでも jti を取り出す", expired, "jti-2"},
+		{"JWT ではない不透明なトークン", "opaque-token", ""},
+		{"空文字", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := accessTokenJTI(tt.token); got != tt.want {
+				t.Errorf("accessTokenJTI() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newFormRequest は application/x-www-form-urlencoded の POST リクエストを作る。
+func newFormRequest(target string, form url.Values) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, target, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return r
+}
+
+// oauthErrorCode は JSON のエラーレスポンスの error を返す。
+func oauthErrorCode(t *testing.T, rec *httptest.ResponseRecorder) string {
+	t.Helper()
+	var body struct {
+		Error string `json:"error"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+		t.Fatalf("エラーレスポンスを読めません: %v", err)
+	}
+	return body.Error
+}
+
+func TestHandleClientCredentialsGrantRejects(t *testing.T) {
+	// リポジトリに触れる前に返すエラーだけを確認する
+	confidential := &OAuthClient{
+		ClientID:                "service_client",
+		TokenEndpointAuthMethod: authMethodClientSecretBasic,
+		Scopes:                  []string{"read", "write"},
+		DefaultScopes:           []string{"read"},
+	}
+	tests := []struct {
+		name     string
+		client   *OAuthClient
+		scope    string
+		wantCode string
+	}{
+		{"公開クライアント", &OAuthClient{ClientID: "spa", TokenEndpointAuthMethod: authMethodNone, Scopes: []string{"read"}}, "read", "unauthorized_client"},
+		{"登録されていないスコープ", confidential, "read admin", "invalid_scope"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			r := newFormRequest("/token", url.Values{"grant_type": {"client_credentials"}, "scope": {tt.scope}})
+			handleClientCredentialsGrant(context.Background(), rec, r, slog.Default(), tt.client, nil)
+			if rec.Code != http.StatusBadRequest {
+				t.Errorf("status = %d, want 400", rec.Code)
+			}
+			if code := oauthErrorCode(t, rec); code != tt.wantCode {
+				t.Errorf("error = %q, want %q", code, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestGenerateJWTClientAccessToken(t *testing.T) {
+	useTestSigningKey(t, "ES256")
+
+	token, err := generateJWTClientAccessToken("service_client", "read write", time.Minute, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := validateJWTToken(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// ユーザーがいないため sub はクライアント自身で、username は付けない
+	if claims.Subject != "service_client" || claims.ClientID != "service_client" {
+		t.Errorf("sub = %q, client_id = %q", claims.Subject, claims.ClientID)
+	}
+	if claims.Username != "" {
+		t.Errorf("username = %q, want 空", claims.Username)
+	}
+	if claims.Scope != "read write" {
+		t.Errorf("scope = %q", claims.Scope)
+	}
+	if claims.Confirmation != nil {
+		t.Errorf("cnf = %+v, want nil", claims.Confirmation)
+	}
+}
+
+func TestFindUnregisteredScope(t *testing.T) {
+	client := &OAuthClient{Scopes: []string{"openid", "profile", "read"}}
+	tests := []struct {
+		scopes []string
+		want   string
+	}{
+		{[]string{"openid", "read"}, ""},
+		{nil, ""},
+		{[]string{"read", "write", "admin"}, "write"},
+		{[]string{"READ"}, "READ"},
+	}
+	for _, tt := range tests {
+		if got := findUnregisteredScope(client, tt.scopes); got != tt.want {
+			t.Errorf("findUnregisteredScope(%v) = %q, want %q", tt.scopes, got, tt.want)
+		}
+	}
+}
+
+func TestHandleRefreshTokenGrantRequiresRefreshToken(t *testing.T) {
+	rec := httptest.NewRecorder()
+	r := newFormRequest("/token", url.Values{"grant_type": {"refresh_token"}})
+	handleRefreshTokenGrant(context.Background(), rec, r, slog.Default(), &OAuthClient{ClientID: "demo"}, nil)
+	if code := oauthErrorCode(t, rec); code != "invalid_request" {
+		t.Errorf("error = %q, want invalid_request", code)
+	}
+}
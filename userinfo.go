@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// OIDC UserInfo エンドポイント（GET / POST /userinfo、OpenID Connect Core 5.3）。
+// アクセストークンは JWT 署名と access_tokens 行（失効していないこと）の両方で確認し、
+// 付与済みスコープに応じて User のクレームを返す。エラーは RFC 6750 3 の WWW-Authenticate で通知する。
+// DPoP に結びついたトークン（cnf.jkt）は Authorization: DPoP と証明が必要（RFC 9449 7）。
+// 証明書に結びついたトークン（cnf.x5t#S256）は mTLS のエンドポイント（mtls_endpoint_aliases）で同じ証明書を提示する。
+func userinfoHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	logger := slog.Default()
+
+	token, scheme, errCode := userinfoAccessToken(r)
+	if errCode != "" {
+		writeBearerError(w, http.StatusBadRequest, errCode, "multiple or malformed access tokens", "")
+		return
+	}
+	if token == "" {
+		// トークン自体が無いときは error 属性を付けない（RFC 6750 3.1）
+		writeBearerError(w, http.StatusUnauthorized, "", "", "")
+		return
+	}
+
+	claims, err := validateJWTToken(token)
+	if err != nil {
+		logger.Warn("UserInfo: JWT の検証に失敗しました", "error", err.Error())
+		writeBearerError(w, http.StatusUnauthorized, "invalid_token", "the access token is invalid", "")
+		return
+	}
+
+	// 証明書に結びついたトークン（cnf.x5t#S256）は同じクライアント証明書の mTLS 接続でしか使えない（RFC 8705 3）
+	if err := checkCertificateBinding(r, claims.Confirmation); err != nil {
+		logger.Warn("UserInfo: クライアント証明書の検証に失敗しました", "jti", claims.ID, "error", err.Error())
+		writeBearerError(w, http.StatusUnauthorized, "invalid_token", "the access token is not bound to the presented client certificate", "")
+		return
+	}
+
+	err = checkAccessTokenBinding(ctx, r, scheme, token, claims, endpointURL(r, "/userinfo"))
+	if errors.Is(err, errUseDPoPNonce) {
+		writeDPoPError(w, "use_dpop_nonce", "a DPoP nonce is required")
+		return
+	}
+	if err != nil {
+		logger.Warn("UserInfo: DPoP の検証に失敗しました", "jti", claims.ID, "error", err.Error())
+		writeDPoPError(w, "invalid_token", "the access token is not bound to the presented DPoP proof")
+		return
+	}
+
+	row, err := repository.GetAccessTokenByToken(ctx, token)
+	if err != nil {
+		logger.Warn("UserInfo: 失効済みまたは未登録のアクセストークンです", "jti", claims.ID, "error", err.Error())
+		writeBearerError(w, http.StatusUnauthorized, "invalid_token", "the access token has been revoked or expired", "")
+		return
+	}
+	if row.UserID == nil {
+		// client_credentials で発行したトークンにはユーザーが存在しない
+		writeBearerError(w, http.StatusUnauthorized, "invalid_token", "the access token is not associated with a user", "")
+		return
+	}
+	if !slices.Contains(row.Scopes, "openid") {
+		writeBearerError(w, http.StatusForbidden, "insufficient_scope", "the openid scope is required", "openid")
+		return
+	}
+
+	user, err := repository.GetUserByID(ctx, *row.UserID)
+	if err != nil {
+		logger.Error("UserInfo: ユーザー情報の取得に失敗しました", "error", err.Error(), "user_id", *row.UserID)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	resp := map[string]any{
+		"sub": strconv.Itoa(user.ID),
+	}
+	if slices.Contains(row.Scopes, "email") {
+		// メールアドレスの到達確認は未実装のため email_verified は返さない
+		resp["email"] = user.Email
+	}
+	if slices.Contains(row.Scopes, "profile") {
+		resp["preferred_username"] = user.Username
+		resp["updated_at"] = user.UpdatedAt.Unix()
+		resp["created_at"] = user.CreatedAt.Unix()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		logger.Error("UserInfo レスポンスのエンコードに失敗しました", "error", err.Error())
+		return
+	}
+
+	logger.Info("UserInfo を返しました",
+		"user_id", user.ID,
+		"client_id", row.ClientID,
+		"scopes", row.Scopes)
+}
+
+// userinfoAccessToken は Authorization ヘッダ（Bearer / DPoP）、または POST のフォーム access_token からトークンを取り出す（RFC 6750 2.1, 2.2）。
+// 両方に指定されている・ヘッダ形式が不正なときは errCode に invalid_request を返す。
+func userinfoAccessToken(r *http.Request) (token, scheme, errCode string) {
+	scheme = "Bearer"
+	if h := r.Header.Get("Authorization"); h != "" {
+		s, t, ok := strings.Cut(h, " ")
+		switch {
+		case !ok || strings.TrimSpace(t) == "":
+			return "", "", "invalid_request"
+		case strings.EqualFold(s, "Bearer"):
+		case strings.EqualFold(s, authSchemeDPoP):
+			scheme = authSchemeDPoP
+		default:
+			return "", "", "invalid_request"
+		}
+		token = strings.TrimSpace(t)
+	}
+
+	if r.Method == http.MethodPost && strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+		if err := r.ParseForm(); err != nil {
+			return "", "", "invalid_request"
+		}
+		if formToken := r.PostForm.Get("access_token"); formToken != "" {
+			if token != "" {
+				return "", "", "invalid_request"
+			}
+			token = formToken
+		}
+	}
+
+	return token, scheme, ""
+}
+
+// writeBearerError は RFC 6750 3 の WWW-Authenticate ヘッダ付きでエラーを返す。
+// code が空のときは realm のみ（認証情報が無いリクエスト向け）。
+func writeBearerError(w http.ResponseWriter, status int, code, description, scope string) {
+	challenge := `Bearer realm="oauth2-server"`
+	if code != "" {
+		challenge += fmt.Sprintf(`, error="%s"`, code)
+	}
+	if description != "" {
+		challenge += fmt.Sprintf(`, error_description="%s"`, description)
+	}
+	if scope != "" {
+		challenge += fmt.Sprintf(`, scope="%s"`, scope)
+	}
+
+	w.Header().Set("WWW-Authenticate", challenge)
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+}
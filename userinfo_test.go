@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUserinfoAccessToken(t *testing.T) {
+	tests := []struct {
+		name       string
+		method     string
+		auth       string
+		form       string
+		wantToken  string
+		wantScheme string
+		wantErr    string
+	}{
+		{name: "Bearer ヘッダ", method: http.MethodGet, auth: "Bearer abc", wantToken: "abc", wantScheme: "Bearer"},
+		{name: "スキームは大文字小文字を区別しない", method: http.MethodGet, auth: "bearer abc", wantToken: "abc", wantScheme: "Bearer"},
+		{name: "DPoP ヘッダ", method: http.MethodGet, auth: "DPoP abc", wantToken: "abc", wantScheme: authSchemeDPoP},
+		{name: "フォームの access_token", method: http.MethodPost, form: "access_token=abc", wantToken: "abc", wantScheme: "Bearer"},
+		{name: "トークンなし", method: http.MethodGet, wantScheme: "Bearer"},
+		{name: "GET のクエリは読まない", method: http.MethodGet, form: "access_token=abc", wantScheme: "Bearer"},
+		{name: "ヘッダとフォームの両方", method: http.MethodPost, auth: "Bearer abc", form: "access_token=abc", wantErr: "invalid_request"},
+		{name: "未知のスキーム", method: http.MethodGet, auth: "Basic abc", wantErr: "invalid_request"},
+		{name: "トークンが空", method: http.MethodGet, auth: "Bearer  ", wantErr: "invalid_request"},
+		{name: "スキームだけ", method: http.MethodGet, auth: "Bearer", wantErr: "invalid_request"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := "/userinfo"
+			var r *http.Request
+			if tt.method == http.MethodPost {
+				r = httptest.NewRequest(tt.method, target, strings.NewReader(tt.form))
+				r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			} else {
+				if tt.form != "" {
+					target += "?" + tt.form
+				}
+				r = httptest.NewRequest(tt.method, target, nil)
+			}
+			if tt.auth != "" {
+				r.Header.Set("Authorization", tt.auth)
+			}
+			token, scheme, errCode := userinfoAccessToken(r)
+			if errCode != tt.wantErr {
+				t.Fatalf("errCode = %q, want %q", errCode, tt.wantErr)
+			}
+			if errCode == "" && (token != tt.wantToken || scheme != tt.wantScheme) {
+				t.Errorf("got (%q, %q), want (%q, %q)", token, scheme, tt.wantToken, tt.wantScheme)
+			}
+		})
+	}
+}
+
+func TestUserinfoHandlerRejects(t *testing.T) {
+	// access_tokens を引く前に返すエラーだけを確認する
+	t.Setenv("SERVER_BASE_URL", "https://as.example.com")
+	useTestSigningKey(t, "ES256")
+	certBound, err := generateJWTAccessToken(1, "testuser", "public_mtls_client", "openid", time.Minute, &tokenConfirmation{X5TS256: "x5t"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		auth       string
+		wantStatus int
+		wantHeader string
+	}{
+		{"トークンなし", "", http.StatusUnauthorized, `Bearer realm="oauth2-server"`},
+		{"ヘッダ形式が不正", "Basic abc", http.StatusBadRequest, `error="invalid_request"`},
+		{"署名が検証できない", "Bearer not-a-jwt", http.StatusUnauthorized, `error="invalid_token"`},
+		{"証明書に結びついたトークンを mTLS なしで使う", "Bearer " + certBound, http.StatusUnauthorized, `error="invalid_token"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/userinfo", nil)
+			if tt.auth != "" {
+				r.Header.Set("Authorization", tt.auth)
+			}
+			rec := httptest.NewRecorder()
+			userinfoHandler(rec, r)
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if got := rec.Header().Get("WWW-Authenticate"); !strings.Contains(got, tt.wantHeader) {
+				t.Errorf("WWW-Authenticate = %q, want %q を含む", got, tt.wantHeader)
+			}
+		})
+	}
+}
+
+func TestWriteBearerError(t *testing.T) {
+	rec := httptest.NewRecorder()
+	writeBearerError(rec, http.StatusForbidden, "insufficient_scope", "the openid scope is required", "openid")
+	want := `Bearer realm="oauth2-server", error="insufficient_scope", error_description="the openid scope is required", scope="openid"`
+	if got := rec.Header().Get("WWW-Authenticate"); got != want {
+		t.Errorf("WWW-Authenticate = %q, want %q", got, want)
+	}
+	if rec.Code != http.StatusForbidden || rec.Header().Get("Cache-Control") != "no-store" {
+		t.Errorf("status = %d, Cache-Control = %q", rec.Code, rec.Header().Get("Cache-Control"))
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"crypto/rand"
 	"encoding/base64"
 	"html"
+	"strings"
 )
 
 // 指定バイト数の暗号論的ランダム文字列を生成（URL安全なbase64エンコード）
@@ -20,3 +21,9 @@ func generateRandomString(byteLen int) string {
 func escapeHTML(s string) string {
 	return html.EscapeString(s)
 }
+
+// serverBaseURL は認可サーバーの外部公開URL（末尾スラッシュなし）を返す。
+// verification_uri や Discovery のエンドポイント URL の組み立てに使う。
+func serverBaseURL() string {
+	return strings.TrimRight(getEnvWithDefault("SERVER_BASE_URL", "http://localhost:8080"), "/")
+}